@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/consumptions"
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+const (
+	defaultAgentInterval = time.Minute
+	agentPushTimeout     = time.Minute
+)
+
+// agentSettings control agent running on nginx host
+type agentSettings struct {
+	// CollectorURL is the HTTPS endpoint pre-aggregated consumptions are pushed to
+	CollectorURL string
+
+	// Token authenticates agent to the collector
+	Token string
+
+	// Server is the name agent reports its consumptions under. Host name is used if it is empty
+	Server string
+
+	// Interval between pushes
+	Interval time.Duration
+
+	// LogFormat describes format of local log lines
+	LogFormat logsreader.LogFormat
+
+	// ReadBufferSize and MaxLineLength control how local log lines are read
+	ReadBufferSize int
+	MaxLineLength  int
+}
+
+// runAgent reads local logs, aggregates them by domain and hour and pushes them to the collector every settings.Agent.Interval
+func runAgent(ctx context.Context, settings applicationSettings) {
+	if !strings.HasPrefix(settings.Agent.CollectorURL, "https://") {
+		log.Println("agent requires HTTPS collector URL")
+		return
+	}
+
+	serverName := settings.Agent.Server
+	if serverName == "" {
+		hostName, err := os.Hostname()
+		if err != nil {
+			log.Println("cannot get host name: " + err.Error())
+			return
+		}
+		serverName = hostName
+	}
+
+	interval := settings.Agent.Interval
+	if interval <= 0 {
+		interval = defaultAgentInterval
+	}
+
+	conn := logsreader.ConnectionInfo{
+		Address:        serverName,
+		TransferMode:   logsreader.TransferLocal,
+		LogFormat:      settings.Agent.LogFormat,
+		ReadBufferSize: settings.Agent.ReadBufferSize,
+		MaxLineLength:  settings.Agent.MaxLineLength,
+	}
+	for {
+		err := pushConsumptions(ctx, settings, conn)
+		if err != nil {
+			log.Println("failed to push consumptions: " + err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
+
+// pushConsumptions sends consumptions of log records added since the last successful push.
+// State is saved only after the collector accepted the payload
+func pushConsumptions(ctx context.Context, settings applicationSettings, conn logsreader.ConnectionInfo) error {
+	state, err := logsreader.GetState(conn)
+	if err != nil && err != logsreader.ErrNoStateFile {
+		return fmt.Errorf("cannot get state: %v", err)
+	}
+
+	usagesSettings := settings.Usages
+	usagesSettings.AggregateByDomain = true
+	usages := consumptions.NewUsagesCollection(nil, usagesSettings)
+	usages.SetClosedBefore(state.FlushedUntil)
+
+	newState, err := logsreader.ReadLogs(ctx, conn, state, usages.AddRecord, logsreader.Checkpoint{})
+	if err != nil {
+		return fmt.Errorf("cannot read logs: %v", err)
+	}
+
+	records := usages.GetDomainConsumption()
+	if len(records) > 0 {
+		payload := agentPayloadJSON{Server: conn.Address, Records: make([]domainConsumptionJSON, len(records)), SaveID: state.ID()}
+		for i, record := range records {
+			payload.Records[i] = toDomainConsumptionJSON(record)
+		}
+
+		err = postPayload(ctx, settings.Agent, payload)
+		if err != nil {
+			return err
+		}
+		log.Printf("pushed %d records to collector\n", len(records))
+	}
+
+	newState.SucceededAt = time.Now().UTC()
+	newState.FlushedUntil = usages.CloseHours()
+	err = logsreader.SaveState(conn, *newState)
+	if err != nil {
+		return fmt.Errorf("cannot save state: %v", err)
+	}
+	if settings.AuditLog != "" {
+		stats := usages.Stats()
+		err = appendAudit(settings.AuditLog, conn.ServerName(), state, *newState, stats.Total, stats.Counted)
+		if err != nil {
+			log.Println("WARNING: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func postPayload(ctx context.Context, settings agentSettings, payload agentPayloadJSON) error {
+	var body bytes.Buffer
+	writer := gzip.NewWriter(&body)
+	err := json.NewEncoder(writer).Encode(payload)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot serialize payload: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", settings.CollectorURL, &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Authorization", "Bearer "+settings.Token)
+
+	client := &http.Client{Timeout: agentPushTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot push payload to collector: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func toDomainConsumptionJSON(record *consumptions.ConsumptionRecord) domainConsumptionJSON {
+	return domainConsumptionJSON{
+		Domain:       record.Domain,
+		Time:         record.Time.Unix(),
+		Files:        record.Files,
+		FilesCount:   record.FilesCount,
+		Dynamic:      record.Dynamic,
+		DynamicCount: record.DynamicCount,
+		Other:        record.Other,
+		OtherCount:   record.OtherCount,
+		Probe:        record.Probe,
+		ProbeCount:   record.ProbeCount,
+		UploadBytes:  record.UploadBytes,
+		SlowCount:    record.SlowCount,
+		RangeCount:   record.RangeRequests,
+		Expensive:    record.ExpensiveCount,
+		ClientClosed: record.ClientClosedCount,
+		Port:         record.Port,
+		Minutes:      record.Minutes,
+		BusyMillis:   record.BusyMillis,
+	}
+}
+
+type agentPayloadJSON struct {
+	Server  string                  `json:"server"`
+	Records []domainConsumptionJSON `json:"records"`
+
+	// SaveID identifies the state records were read from, so that collector replaces rows of a retried push
+	SaveID string `json:"saveId"`
+}
+
+type domainConsumptionJSON struct {
+	Domain       string `json:"d"`
+	Time         int64  `json:"t"`
+	Files        int64  `json:"f"`
+	FilesCount   int    `json:"fc"`
+	Dynamic      int64  `json:"y"`
+	DynamicCount int    `json:"yc"`
+	Other        int64  `json:"o"`
+	OtherCount   int    `json:"oc"`
+	Probe        int64  `json:"p"`
+	ProbeCount   int    `json:"pc"`
+	UploadBytes  int64  `json:"u"`
+	SlowCount    int    `json:"s"`
+	RangeCount   int    `json:"r"`
+	Expensive    int    `json:"x"`
+	ClientClosed int    `json:"cc"`
+	Port         int    `json:"pt,omitempty"`
+	Minutes      []int  `json:"m,omitempty"`
+	BusyMillis   []int  `json:"bm,omitempty"`
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/alexanderromanov/nginx-logparser/consumptions"
+)
+
+// archiveSettings describe blob container aggregated consumptions are archived to
+type archiveSettings struct {
+	// Container of the main storage account consumptions are archived to. Consumptions are not archived if it is empty
+	Container string
+}
+
+// pendingArchive is a gzipped JSON copy of saved consumptions. It has the format of upload queue entries,
+// so that archived consumptions can be replayed by copying them to the queue directory
+type pendingArchive struct {
+	name string
+	data []byte
+}
+
+// newArchive compresses consumptions of the save. Records have to be archived before transforms and billing
+// are applied to them, since replayed entries are transformed again
+func newArchive(serverName, saveID string, websites consumptions.WebsiteConsumptions, accounts consumptions.AccountConsumptions) (*pendingArchive, error) {
+	var data bytes.Buffer
+	writer := gzip.NewWriter(&data)
+	err := json.NewEncoder(writer).Encode(queuedConsumptions{Server: serverName, SaveID: saveID, Websites: websites, Accounts: accounts})
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot compress consumptions of %s: %v", serverName, err)
+	}
+	return &pendingArchive{name: archiveBlobName(serverName, saveID), data: data.Bytes()}, nil
+}
+
+// upload writes the archive to the container. Nothing is uploaded if archive is nil. Blob of repeated save of
+// the same records is overwritten
+func (archive *pendingArchive) upload(ctx context.Context, settings applicationSettings) error {
+	if archive == nil {
+		return nil
+	}
+	ctx, span := tracer.Start(ctx, "archiveConsumptions")
+	defer span.End()
+
+	client, err := settings.AzureStorage.Client()
+	if err != nil {
+		return err
+	}
+	err = client.GetBlobService().PutBlockBlob(ctx, settings.Archive.Container, archive.name, archive.data, "application/gzip")
+	if err != nil {
+		return fmt.Errorf("cannot upload archived consumptions %s: %v", archive.name, err)
+	}
+	return nil
+}
+
+// archiveBlobName returns name of the blob in the folder of the server, e.g. web1/3f2a9c0d1e4b5a6c.json.gz
+func archiveBlobName(serverName, saveID string) string {
+	return serverName + "/" + saveID + ".json.gz"
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+// auditSync serializes appends of servers processed concurrently
+var auditSync sync.Mutex
+
+// appendAudit appends JSON line describing state change of the server to the audit log, so that it can be
+// reconstructed later what was processed. records and counted are numbers of records read and counted
+// between oldState and newState
+func appendAudit(fileName, serverName string, oldState, newState logsreader.State, records, counted int64) error {
+	entry := auditEntryJSON{
+		Time:     time.Now().UTC(),
+		Server:   serverName,
+		OldState: toStateManifestJSON(oldState),
+		NewState: toStateManifestJSON(newState),
+		Records:  records,
+		Counted:  counted,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("cannot serialize audit entry: %v", err)
+	}
+
+	auditSync.Lock()
+	defer auditSync.Unlock()
+
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log %s: %v", fileName, err)
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot append to audit log %s: %v", fileName, err)
+	}
+	return nil
+}
+
+type auditEntryJSON struct {
+	Time     time.Time         `json:"time"`
+	Server   string            `json:"server"`
+	OldState stateManifestJSON `json:"oldState"`
+	NewState stateManifestJSON `json:"newState"`
+	Records  int64             `json:"records"`
+	Counted  int64             `json:"counted"`
+}
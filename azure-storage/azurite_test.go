@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// Integration tests run against Azurite, e.g. started with
+//
+//	docker run -p 10002:10002 mcr.microsoft.com/azure-storage/azurite azurite-table --tableHost 0.0.0.0
+//	AZURITE_TABLE_URL=http://127.0.0.1:10002 go test ./azure-storage
+//
+// They are skipped if AZURITE_TABLE_URL is not set or the emulator is not reachable
+
+const (
+	// azuriteAccount and azuriteKey are the well-known development account of storage emulators
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// azuriteTables returns table client of the emulator and name of a new table deleted when the test ends
+func azuriteTables(t *testing.T) (TableServiceClient, AzureTable) {
+	t.Helper()
+	tableURL := os.Getenv("AZURITE_TABLE_URL")
+	if tableURL == "" {
+		t.Skip("AZURITE_TABLE_URL is not set")
+	}
+	u, err := url.Parse(tableURL)
+	if err != nil {
+		t.Fatalf("invalid AZURITE_TABLE_URL: %v", err)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+	if err != nil {
+		t.Skipf("azurite is not reachable at %s: %v", u.Host, err)
+	}
+	conn.Close()
+
+	client, err := NewEmulatorClient(azuriteAccount, azuriteKey, tableURL, tableURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := client.GetTableService()
+	table := AzureTable(fmt.Sprintf("test%d", time.Now().UnixNano()))
+	if err := tables.CreateTable(context.Background(), table); err != nil {
+		t.Fatalf("cannot create table %s: %v", table, err)
+	}
+	t.Cleanup(func() {
+		if err := tables.DeleteTable(context.Background(), table); err != nil {
+			t.Errorf("cannot delete table %s: %v", table, err)
+		}
+	})
+	return tables, table
+}
+
+func TestAzuriteCreateExistingTable(t *testing.T) {
+	tables, table := azuriteTables(t)
+	if err := tables.CreateTable(context.Background(), table); err != nil {
+		t.Errorf("creating existing table failed: %v", err)
+	}
+}
+
+func TestAzuriteInsertEntity(t *testing.T) {
+	tables, table := azuriteTables(t)
+	ctx := context.Background()
+
+	// values with quotes, backslashes and non-ASCII characters check serialization of entities
+	entity := TableEntity{
+		PartitionKey: "42",
+		RowKey:       "2016073122-server",
+		Fields: map[string]interface{}{
+			"Domain":   "пример.рф \"quoted\" \\",
+			"Files":    12345,
+			"Enabled":  true,
+			"Referrer": "http://example.com/?a=1&b=2",
+		},
+	}
+	if err := tables.InsertEntity(ctx, table, entity); err != nil {
+		t.Fatalf("cannot insert entity: %v", err)
+	}
+	if err := tables.InsertEntity(ctx, table, entity); !IsConflict(err) {
+		t.Errorf("inserting duplicate entity returned %v, expected conflict", err)
+	}
+
+	saved, err := tables.GetEntity(ctx, table, entity.PartitionKey, entity.RowKey)
+	if err != nil {
+		t.Fatalf("cannot get entity: %v", err)
+	}
+	if saved == nil || saved.PartitionKey != entity.PartitionKey || saved.RowKey != entity.RowKey || saved.ETag == "" {
+		t.Fatalf("unexpected entity %+v", saved)
+	}
+	for name, value := range entity.Fields {
+		if fmt.Sprint(saved.Fields[name]) != fmt.Sprint(value) {
+			t.Errorf("field %s is %v, expected %v", name, saved.Fields[name], value)
+		}
+	}
+
+	missing, err := tables.GetEntity(ctx, table, entity.PartitionKey, "missing")
+	if err != nil || missing != nil {
+		t.Errorf("getting missing entity returned %+v, %v", missing, err)
+	}
+}
+
+func TestAzuriteUpdateEntity(t *testing.T) {
+	tables, table := azuriteTables(t)
+	ctx := context.Background()
+
+	entity := TableEntity{PartitionKey: "42", RowKey: "2016073122", Fields: map[string]interface{}{"Files": 1}}
+	if err := tables.InsertEntity(ctx, table, entity); err != nil {
+		t.Fatalf("cannot insert entity: %v", err)
+	}
+	saved, err := tables.GetEntity(ctx, table, entity.PartitionKey, entity.RowKey)
+	if err != nil || saved == nil {
+		t.Fatalf("cannot get entity: %v", err)
+	}
+
+	updated := *saved
+	updated.Fields = map[string]interface{}{"Files": 2}
+	if err := tables.UpdateEntity(ctx, table, updated); err != nil {
+		t.Fatalf("cannot update entity: %v", err)
+	}
+	// ETag of the first read is outdated now
+	if err := tables.UpdateEntity(ctx, table, updated); !IsConflict(err) {
+		t.Errorf("update with outdated etag returned %v, expected conflict", err)
+	}
+
+	saved, err = tables.GetEntity(ctx, table, entity.PartitionKey, entity.RowKey)
+	if err != nil || saved == nil {
+		t.Fatalf("cannot get entity: %v", err)
+	}
+	if fmt.Sprint(saved.Fields["Files"]) != "2" {
+		t.Errorf("Files of updated entity is %v, expected 2", saved.Fields["Files"])
+	}
+}
+
+func TestAzuriteBatchInsertOrReplace(t *testing.T) {
+	tables, table := azuriteTables(t)
+	ctx := context.Background()
+
+	var entities []*TableEntity
+	for i := 0; i < 100; i++ {
+		entities = append(entities, &TableEntity{
+			PartitionKey: "42",
+			RowKey:       fmt.Sprintf("row%03d", i),
+			Fields:       map[string]interface{}{"Index": i, "Domain": "example.com"},
+		})
+	}
+	if err := tables.BatchInsertOrReplace(ctx, table, entities); err != nil {
+		t.Fatalf("cannot insert batch: %v", err)
+	}
+
+	// repeated save of the same rows replaces them instead of failing or adding duplicates
+	replayed := []*TableEntity{
+		{PartitionKey: "42", RowKey: "new", Fields: map[string]interface{}{"Index": -1, "Domain": "example.com"}},
+		{PartitionKey: "42", RowKey: entities[7].RowKey, Fields: map[string]interface{}{"Index": 7, "Domain": "example.org"}},
+	}
+	if err := tables.BatchInsertOrReplace(ctx, table, replayed); err != nil {
+		t.Fatalf("cannot replay batch: %v", err)
+	}
+
+	result, err := tables.QueryEntities(ctx, table, "PartitionKey eq '42'")
+	if err != nil {
+		t.Fatalf("cannot query entities: %v", err)
+	}
+	if len(result) != len(entities)+1 {
+		t.Fatalf("query returned %d entities, expected %d", len(result), len(entities)+1)
+	}
+	for _, entity := range result {
+		expected := "example.com"
+		if entity.RowKey == entities[7].RowKey {
+			expected = "example.org"
+		}
+		if entity.Fields["Domain"] != expected {
+			t.Errorf("entity %s has domain %v, expected %s", entity.RowKey, entity.Fields["Domain"], expected)
+		}
+	}
+
+	filtered, err := tables.QueryEntities(ctx, table, "PartitionKey eq '42' and Index ge 90")
+	if err != nil {
+		t.Fatalf("cannot query entities: %v", err)
+	}
+	if len(filtered) != 10 {
+		t.Errorf("filtered query returned %d entities, expected 10", len(filtered))
+	}
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// BlobStorageClient contains operations for Microsoft Azure Blob Storage
+// Service.
+type BlobStorageClient struct {
+	client Client
+}
+
+// PutBlockBlob uploads data as a block blob with the given name to the container,
+// replacing existing blob if any. Data must not exceed 64MB
+func (b BlobStorageClient) PutBlockBlob(ctx context.Context, container, name string, data []byte, contentType string) error {
+	uri := b.client.getEndpoint(blobServiceName, fmt.Sprintf("%s/%s", container, name), url.Values{})
+
+	headers := map[string]string{
+		"x-ms-version":   b.client.apiVersion,
+		"x-ms-date":      currentTimeRfc1123Formatted(),
+		"x-ms-blob-type": "BlockBlob",
+		"Content-Type":   contentType,
+		"Content-Length": fmt.Sprintf("%d", len(data)),
+	}
+
+	var err error
+	headers["Authorization"], err = b.client.getAuthorizationHeader("PUT", uri, headers)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.client.execInternalJSON(ctx, "PUT", uri, headers, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.body.Close()
+
+	return checkRespCode(resp.statusCode, []int{http.StatusCreated})
+}
+
+// Blob describes blob returned by ListBlobs
+type Blob struct {
+	Name         string
+	LastModified time.Time
+	Etag         string
+	Size         int64
+}
+
+type blobListResponse struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			Etag          string `xml:"Etag"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// ListBlobs returns all blobs of the container with names starting with prefix
+func (b BlobStorageClient) ListBlobs(ctx context.Context, container, prefix string) ([]Blob, error) {
+	var result []Blob
+	marker := ""
+	for {
+		params := url.Values{"restype": {"container"}, "comp": {"list"}}
+		if prefix != "" {
+			params.Set("prefix", prefix)
+		}
+		if marker != "" {
+			params.Set("marker", marker)
+		}
+		uri := b.client.getEndpoint(blobServiceName, container, params)
+
+		resp, err := b.exec(ctx, "GET", uri)
+		if err != nil {
+			return nil, err
+		}
+		var list blobListResponse
+		err = xml.NewDecoder(resp.body).Decode(&list)
+		resp.body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse blobs of %s: %v", container, err)
+		}
+
+		for _, blob := range list.Blobs {
+			modified, err := time.Parse(http.TimeFormat, blob.Properties.LastModified)
+			if err != nil {
+				return nil, fmt.Errorf("invalid modification time of blob %s: %v", blob.Name, err)
+			}
+			result = append(result, Blob{
+				Name:         blob.Name,
+				LastModified: modified,
+				Etag:         blob.Properties.Etag,
+				Size:         blob.Properties.ContentLength,
+			})
+		}
+
+		if list.NextMarker == "" {
+			return result, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+// GetBlob returns reader of blob content. Reader has to be closed by caller
+func (b BlobStorageClient) GetBlob(ctx context.Context, container, name string) (io.ReadCloser, error) {
+	uri := b.client.getEndpoint(blobServiceName, fmt.Sprintf("%s/%s", container, name), url.Values{})
+	resp, err := b.exec(ctx, "GET", uri)
+	if err != nil {
+		return nil, err
+	}
+	return resp.body, nil
+}
+
+// exec runs request without body and returns response if it succeeded
+func (b BlobStorageClient) exec(ctx context.Context, verb, uri string) (*odataResponse, error) {
+	headers := map[string]string{
+		"x-ms-version": b.client.apiVersion,
+		"x-ms-date":    currentTimeRfc1123Formatted(),
+	}
+
+	var err error
+	headers["Authorization"], err = b.client.getAuthorizationHeader(verb, uri, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.client.execInternalJSON(ctx, verb, uri, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = checkRespCode(resp.statusCode, []int{http.StatusOK})
+	if err != nil {
+		resp.body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
@@ -2,6 +2,7 @@
 package storage
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -11,7 +12,9 @@ import (
 	"net/url"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -21,22 +24,44 @@ const (
 
 	// DefaultAPIVersion is the  Azure Storage API version string used when a
 	// basic client is created.
-	DefaultAPIVersion = "2015-02-21"
+	DefaultAPIVersion = "2015-12-11"
+
+	// minAPIVersion is the first version supporting JSON payloads of Table service
+	minAPIVersion = "2013-08-15"
+
+	// emptyContentLengthVersion is the first version signing zero Content-Length as empty string
+	emptyContentLengthVersion = "2015-02-21"
+
+	apiVersionLayout = "2006-01-02"
+
+	// CloudPublic, CloudChina, CloudUSGovernment and CloudGermany name Azure clouds with their own storage endpoints
+	CloudPublic       = "public"
+	CloudChina        = "china"
+	CloudUSGovernment = "usgov"
+	CloudGermany      = "germany"
 
 	tableServiceName = "table"
+	blobServiceName  = "blob"
 )
 
 // Client is the object that needs to be constructed to perform
 // operations on the storage account.
 type Client struct {
 	// HTTPClient is the http.Client used to initiate API
-	// requests.  If it is nil, http.DefaultClient is used.
+	// requests.  If it is nil, client with default Timeouts is used.
 	HTTPClient *http.Client
 
+	// RequestTimeout limits table requests including reading of their responses.
+	// defaultRequestTimeout is used if it is zero. Blob requests are not limited by it
+	RequestTimeout time.Duration
+
 	accountName string
 	accountKey  []byte
 	baseURL     string
 	apiVersion  string
+
+	// endpoints are URLs of services of storage emulator. Account name is the first segment of request paths then
+	endpoints map[string]string
 }
 
 type storageResponse struct {
@@ -79,6 +104,18 @@ type odataErrorMessage struct {
 	Err odataErrorMessageInternal `json:"odata.error"`
 }
 
+// ThrottledError is returned when the service throttles requests with 429 or 503 status code
+type ThrottledError struct {
+	StatusCode int
+
+	// RetryAfter is the delay requested by the service in Retry-After header. Zero if it was not specified
+	RetryAfter time.Duration
+}
+
+func (e ThrottledError) Error() string {
+	return fmt.Sprintf("storage: request is throttled with status code %d, retry after %v", e.StatusCode, e.RetryAfter)
+}
+
 // UnexpectedStatusCodeError is returned when a storage service responds with neither an error
 // nor with an HTTP status code indicating success.
 type UnexpectedStatusCodeError struct {
@@ -89,16 +126,45 @@ func (e UnexpectedStatusCodeError) Error() string {
 	return fmt.Sprintf("storage: status code from service response is %v", e.got)
 }
 
+var cloudBaseURLs = map[string]string{
+	CloudPublic:       DefaultBaseURL,
+	CloudChina:        "core.chinacloudapi.cn",
+	CloudUSGovernment: "core.usgovcloudapi.net",
+	CloudGermany:      "core.cloudapi.de",
+}
+
+// CloudBaseURL returns storage endpoint suffix of the named cloud. DefaultBaseURL is returned for empty name
+func CloudBaseURL(cloud string) (string, error) {
+	if cloud == "" {
+		return DefaultBaseURL, nil
+	}
+	baseURL, ok := cloudBaseURLs[cloud]
+	if !ok {
+		return "", fmt.Errorf("azure: unknown cloud %s", cloud)
+	}
+	return baseURL, nil
+}
+
 // NewBasicClient constructs a Client with given storage service name and
 // key.
 func NewBasicClient(accountName, accountKey string) (Client, error) {
-	return newClient(accountName, accountKey, DefaultBaseURL, DefaultAPIVersion)
+	return NewBasicCloudClient(accountName, accountKey, CloudPublic)
+}
+
+// NewBasicCloudClient constructs a Client of storage account in the named cloud
+func NewBasicCloudClient(accountName, accountKey, cloud string) (Client, error) {
+	baseURL, err := CloudBaseURL(cloud)
+	if err != nil {
+		return Client{}, err
+	}
+	return NewClient(accountName, accountKey, baseURL, DefaultAPIVersion, nil)
 }
 
-// newClient constructs a Client. This should be used if the caller wants
-// to specify whether to use HTTPS, a specific REST API version or a custom
-// storage endpoint than Azure Public Cloud.
-func newClient(accountName, accountKey, blobServiceBaseURL, apiVersion string) (Client, error) {
+// NewClient constructs a Client. This should be used if the caller wants
+// to specify a specific REST API version, a custom storage endpoint than
+// Azure Public Cloud or a custom http.Client, e.g. to use a proxy.
+// Client with default Timeouts is used if httpClient is nil.
+func NewClient(accountName, accountKey, blobServiceBaseURL, apiVersion string, httpClient *http.Client) (Client, error) {
 	var c Client
 	if accountName == "" {
 		return c, fmt.Errorf("azure: account name required")
@@ -106,6 +172,11 @@ func newClient(accountName, accountKey, blobServiceBaseURL, apiVersion string) (
 		return c, fmt.Errorf("azure: account key required")
 	} else if blobServiceBaseURL == "" {
 		return c, fmt.Errorf("azure: base storage service url required")
+	} else if apiVersion == "" {
+		return c, fmt.Errorf("azure: api version required")
+	}
+	if err := ValidateAPIVersion(apiVersion); err != nil {
+		return c, err
 	}
 
 	key, err := base64.StdEncoding.DecodeString(accountKey)
@@ -114,6 +185,7 @@ func newClient(accountName, accountKey, blobServiceBaseURL, apiVersion string) (
 	}
 
 	return Client{
+		HTTPClient:  httpClient,
 		accountName: accountName,
 		accountKey:  key,
 		baseURL:     blobServiceBaseURL,
@@ -121,7 +193,40 @@ func newClient(accountName, accountKey, blobServiceBaseURL, apiVersion string) (
 	}, nil
 }
 
+// NewEmulatorClient constructs a Client of storage emulator like Azurite that serves accounts under path of
+// service endpoints, e.g. http://127.0.0.1:10002/devstoreaccount1 for tableURL http://127.0.0.1:10002
+func NewEmulatorClient(accountName, accountKey, tableURL, blobURL string) (Client, error) {
+	c, err := NewClient(accountName, accountKey, DefaultBaseURL, DefaultAPIVersion, nil)
+	if err != nil {
+		return c, err
+	}
+	c.endpoints = map[string]string{}
+	for service, endpoint := range map[string]string{tableServiceName: tableURL, blobServiceName: blobURL} {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return Client{}, fmt.Errorf("azure: invalid %s service url %s", service, endpoint)
+		}
+		c.endpoints[service] = strings.TrimSuffix(endpoint, "/") + "/" + accountName
+	}
+	return c, nil
+}
+
+// ValidateAPIVersion checks that version is a REST API version supported by the client.
+// Versions are dates, so they are compared as strings
+func ValidateAPIVersion(version string) error {
+	if _, err := time.Parse(apiVersionLayout, version); err != nil {
+		return fmt.Errorf("azure: invalid api version %s, it must look like %s", version, DefaultAPIVersion)
+	}
+	if version < minAPIVersion {
+		return fmt.Errorf("azure: api version %s is not supported, the oldest supported version is %s", version, minAPIVersion)
+	}
+	return nil
+}
+
 func (c Client) getBaseURL(service string) string {
+	if endpoint, ok := c.endpoints[service]; ok {
+		return endpoint
+	}
 	scheme := "https"
 
 	host := fmt.Sprintf("%s.%s.%s", c.accountName, service, c.baseURL)
@@ -144,7 +249,8 @@ func (c Client) getEndpoint(service, path string, params url.Values) string {
 		path = fmt.Sprintf("/%v", path)
 	}
 
-	u.Path = path
+	// emulator endpoints already have account in the path
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
 	u.RawQuery = params.Encode()
 	return u.String()
 }
@@ -155,6 +261,12 @@ func (c Client) GetTableService() TableServiceClient {
 	return TableServiceClient{c}
 }
 
+// GetBlobService returns a BlobStorageClient which can operate on the blob
+// service of the storage account.
+func (c Client) GetBlobService() BlobStorageClient {
+	return BlobStorageClient{c}
+}
+
 func (c Client) createAuthorizationHeader(canonicalizedString string) string {
 	signature := c.computeHmac256(canonicalizedString)
 	return fmt.Sprintf("%s %s:%s", "SharedKey", c.accountName, signature)
@@ -213,8 +325,9 @@ func (c Client) buildCanonicalizedResourceTable(uri string) (string, error) {
 
 	cr := "/" + c.accountName
 
+	// resource is signed as it is sent, i.e. with escaped entity keys
 	if len(u.Path) > 0 {
-		cr += u.Path
+		cr += u.EscapedPath()
 	}
 
 	return cr, nil
@@ -268,7 +381,7 @@ func (c Client) buildCanonicalizedResource(uri string) (string, error) {
 
 func (c Client) buildCanonicalizedString(verb string, headers map[string]string, canonicalizedResource string) string {
 	contentLength := headers["Content-Length"]
-	if contentLength == "0" {
+	if contentLength == "0" && c.apiVersion >= emptyContentLengthVersion {
 		contentLength = ""
 	}
 	canonicalizedString := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s",
@@ -290,15 +403,19 @@ func (c Client) buildCanonicalizedString(verb string, headers map[string]string,
 	return canonicalizedString
 }
 
-func (c Client) execInternalJSON(verb, url string, headers map[string]string, body io.Reader) (*odataResponse, error) {
+func (c Client) execInternalJSON(ctx context.Context, verb, url string, headers map[string]string, body io.Reader) (*odataResponse, error) {
 	req, err := http.NewRequest(verb, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
 	for k, v := range headers {
 		req.Header.Add(k, v)
 	}
 
 	httpClient := c.HTTPClient
 	if httpClient == nil {
-		httpClient = http.DefaultClient
+		httpClient = defaultHTTPClient
 	}
 
 	resp, err := httpClient.Do(req)
@@ -345,14 +462,26 @@ func (c Client) createSharedKeyLite(url string, headers map[string]string) (stri
 	return fmt.Sprintf("SharedKeyLite %s:%s", c.accountName, hmac), nil
 }
 
-func (c Client) execTable(verb, url string, headers map[string]string, body io.Reader) (*odataResponse, error) {
+func (c Client) execTable(ctx context.Context, verb, url string, headers map[string]string, body io.Reader) (*odataResponse, error) {
 	var err error
 	headers["Authorization"], err = c.createSharedKeyLite(url, headers)
 	if err != nil {
 		return nil, err
 	}
 
-	return c.execInternalJSON(verb, url, headers, body)
+	timeout := c.RequestTimeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	// responses of tables are small, so the deadline covers reading of the body and is released on its Close
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	resp, err := c.execInternalJSON(ctx, verb, url, headers, body)
+	if err != nil {
+		cancel()
+		return resp, err
+	}
+	resp.body = cancelOnClose{ReadCloser: resp.body, cancel: cancel}
+	return resp, nil
 }
 
 func readResponseBody(resp *http.Response) ([]byte, error) {
@@ -369,6 +498,25 @@ func (e AzureStorageServiceError) Error() string {
 		e.StatusCode, e.Code, e.Message, e.RequestID, e.QueryParameterName, e.QueryParameterValue)
 }
 
+// checkThrottled returns ThrottledError if the service throttled the request
+func checkThrottled(resp *odataResponse) error {
+	if resp.statusCode != http.StatusTooManyRequests && resp.statusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+
+	result := ThrottledError{StatusCode: resp.statusCode}
+	retryAfter := resp.headers.Get("Retry-After")
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		result.RetryAfter = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(retryAfter); err == nil {
+		result.RetryAfter = time.Until(t)
+	}
+	if result.RetryAfter < 0 {
+		result.RetryAfter = 0
+	}
+	return result
+}
+
 // checkRespCode returns UnexpectedStatusError if the given response code is not
 // one of the allowed status codes; otherwise nil.
 func checkRespCode(respCode int, allowed []int) error {
@@ -0,0 +1,25 @@
+package storage
+
+import "testing"
+
+func TestValidateAPIVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		valid   bool
+	}{
+		{DefaultAPIVersion, true},
+		{"2013-08-15", true},
+		{"2019-02-02", true},
+		{"2012-02-12", false},
+		{"2015-2-21", false},
+		{"latest", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		err := ValidateAPIVersion(test.version)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateAPIVersion(%q) = %v, want valid %v", test.version, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// entityEncoder writes entities as JSON directly into batch content. Encoders and batch buffers
+// are pooled because large runs serialize millions of entities
+type entityEncoder struct {
+	keys    []string
+	scratch []byte
+}
+
+var encoderPool = sync.Pool{New: func() interface{} { return &entityEncoder{} }}
+
+var batchBufferPool = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
+
+func getBatchBuffer() *bytes.Buffer {
+	buffer := batchBufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	return buffer
+}
+
+func putBatchBuffer(buffer *bytes.Buffer) {
+	batchBufferPool.Put(buffer)
+}
+
+// writeEntity writes entity byte for byte as serializeEntity does, but without intermediate map.
+// Keys, including PartitionKey and RowKey, are written in sorted order as encoding/json writes map keys
+func (e *entityEncoder) writeEntity(buffer *bytes.Buffer, entity *TableEntity) error {
+	e.keys = append(e.keys[:0], partitionKeyNode, rowKeyNode)
+	for key := range entity.Fields {
+		if key != partitionKeyNode && key != rowKeyNode {
+			e.keys = append(e.keys, key)
+		}
+	}
+	sort.Strings(e.keys)
+
+	buffer.WriteByte('{')
+	for i, key := range e.keys {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		e.writeString(buffer, key)
+		buffer.WriteByte(':')
+		switch key {
+		case partitionKeyNode:
+			e.writeString(buffer, entity.PartitionKey)
+		case rowKeyNode:
+			e.writeString(buffer, entity.RowKey)
+		default:
+			if err := e.writeValue(buffer, entity.Fields[key]); err != nil {
+				return err
+			}
+		}
+	}
+	buffer.WriteString("}\n")
+	return nil
+}
+
+func (e *entityEncoder) writeValue(buffer *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case int:
+		e.scratch = strconv.AppendInt(e.scratch[:0], int64(v), 10)
+	case int64:
+		e.scratch = strconv.AppendInt(e.scratch[:0], v, 10)
+	case int32:
+		e.scratch = strconv.AppendInt(e.scratch[:0], int64(v), 10)
+	case bool:
+		e.scratch = strconv.AppendBool(e.scratch[:0], v)
+	case string:
+		e.writeString(buffer, v)
+		return nil
+	default:
+		// less common types are rare enough to be encoded by encoding/json
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buffer.Write(encoded)
+		return nil
+	}
+	buffer.Write(e.scratch)
+	return nil
+}
+
+// writeString writes JSON string. Strings with characters encoding/json escapes specially, i.e. control
+// characters, HTML characters, line separators and invalid UTF-8, are rare and are left to encoding/json
+func (e *entityEncoder) writeString(buffer *bytes.Buffer, s string) {
+	if needsJSONEncoder(s) {
+		encoded, _ := json.Marshal(s)
+		buffer.Write(encoded)
+		return
+	}
+
+	buffer.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '"' || c == '\\' {
+			buffer.WriteString(s[start:i])
+			buffer.WriteByte('\\')
+			buffer.WriteByte(c)
+			start = i + 1
+		}
+	}
+	buffer.WriteString(s[start:])
+	buffer.WriteByte('"')
+}
+
+// needsJSONEncoder returns true if the string has characters written by encoding/json as escape sequences
+// other than quote and backslash. Invalid UTF-8 is decoded as RuneError and is left to encoding/json as well
+func needsJSONEncoder(s string) bool {
+	for _, r := range s {
+		if r < 0x20 || r == '<' || r == '>' || r == '&' || r == '\u2028' || r == '\u2029' || r == utf8.RuneError {
+			return true
+		}
+	}
+	return false
+}
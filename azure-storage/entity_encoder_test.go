@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// consumptionEntities returns batch of entities shaped like hourly consumptions
+func consumptionEntities(n int) []*TableEntity {
+	entities := make([]*TableEntity, n)
+	for i := range entities {
+		entities[i] = &TableEntity{
+			PartitionKey: "42",
+			RowKey:       fmt.Sprintf("2016073122-website%d.com-server", i),
+			Fields: map[string]interface{}{
+				"Domain": fmt.Sprintf("website%d.com", i), "WebsiteID": 42, "AccountID": 7,
+				"Files": int64(123456789), "FilesCount": 1234, "Dynamic": int64(98765432), "DynamicCount": 567,
+				"Other": int64(1234), "OtherCount": 12, "Server": "server",
+			},
+		}
+	}
+	return entities
+}
+
+func TestWriteEntityMatchesSerializeEntity(t *testing.T) {
+	tests := []struct {
+		name   string
+		entity TableEntity
+	}{
+		{
+			name:   "consumption entity",
+			entity: *consumptionEntities(1)[0],
+		},
+		{
+			name:   "keys are sorted together with PartitionKey and RowKey",
+			entity: TableEntity{PartitionKey: "p", RowKey: "r", Fields: map[string]interface{}{"A": 1, "Q": 2, "S": 3, "z": 4}},
+		},
+		{
+			name:   "key fields are replaced by entity keys",
+			entity: TableEntity{PartitionKey: "p", RowKey: "r", Fields: map[string]interface{}{"PartitionKey": "x", "RowKey": "y"}},
+		},
+		{
+			name: "strings escaped by encoding/json",
+			entity: TableEntity{PartitionKey: `quote " and \ backslash`, RowKey: "tab\tnew line\n\x00", Fields: map[string]interface{}{
+				"Html":      "<a href='x'>&</a>",
+				"Separator": "line\u2028paragraph\u2029",
+				"Invalid":   "\xff\xfe",
+				"Unicode":   "домен.рф \U0001F600 \uFFFD",
+			}},
+		},
+		{
+			name: "values of other types",
+			entity: TableEntity{PartitionKey: "p", RowKey: "r", Fields: map[string]interface{}{
+				"Int32": int32(-5), "Bool": true, "Float": 0.1, "Nil": nil, "Max": int64(9223372036854775807),
+			}},
+		},
+		{
+			name:   "no fields",
+			entity: TableEntity{PartitionKey: "", RowKey: ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expected, err := serializeEntity(test.entity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actual bytes.Buffer
+			if err := (&entityEncoder{}).writeEntity(&actual, &test.entity); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(actual.Bytes(), expected.Bytes()) {
+				t.Errorf("expected %s, got %s", expected, actual.Bytes())
+			}
+		})
+	}
+}
+
+func BenchmarkBuildBatchContent(b *testing.B) {
+	client, err := NewBasicClient("account", "a2V5")
+	if err != nil {
+		b.Fatal(err)
+	}
+	tables := client.GetTableService()
+	entities := consumptionEntities(99)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		content, err := buildBatchContent(&tables, "batch_boundary", "consumptions", entities)
+		if err != nil {
+			b.Fatal(err)
+		}
+		putBatchBuffer(content)
+	}
+}
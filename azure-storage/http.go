@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultConnectTimeout        = 10 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = time.Minute
+	defaultRequestTimeout        = time.Minute
+)
+
+// defaultHTTPClient is used by clients without their own http.Client, so that hung connection
+// doesn't block requests forever
+var defaultHTTPClient = NewHTTPClient(Timeouts{}, nil)
+
+// Timeouts limit duration of storage requests. Default values are used for zero fields
+type Timeouts struct {
+	// Connect limits establishing of TCP connection
+	Connect time.Duration
+
+	// TLSHandshake limits TLS handshake of new connection
+	TLSHandshake time.Duration
+
+	// ResponseHeader limits waiting for response headers after the request is sent. Bodies of blobs
+	// are streamed without time limit
+	ResponseHeader time.Duration
+
+	// Request limits the whole table request including reading of the response body, see Client.RequestTimeout
+	Request time.Duration
+}
+
+// NewHTTPClient returns http.Client with the timeouts sending requests through proxy if it is not nil.
+// The client has no overall timeout, so that large blobs can be streamed
+func NewHTTPClient(timeouts Timeouts, proxy *url.URL) *http.Client {
+	if timeouts.Connect <= 0 {
+		timeouts.Connect = defaultConnectTimeout
+	}
+	if timeouts.TLSHandshake <= 0 {
+		timeouts.TLSHandshake = defaultTLSHandshakeTimeout
+	}
+	if timeouts.ResponseHeader <= 0 {
+		timeouts.ResponseHeader = defaultResponseHeaderTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeouts.Connect, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeouts.TLSHandshake
+	transport.ResponseHeaderTimeout = timeouts.ResponseHeader
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// cancelOnClose releases the deadline of the request when its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
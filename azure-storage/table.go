@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -31,7 +32,7 @@ func pathForTable(table AzureTable) string { return fmt.Sprintf("%s", table) }
 
 func (c *TableServiceClient) getStandardHeaders() map[string]string {
 	return map[string]string{
-		"x-ms-version":   "2015-02-21",
+		"x-ms-version":   c.client.apiVersion,
 		"x-ms-date":      currentTimeRfc1123Formatted(),
 		"Accept":         "application/json;odata=nometadata",
 		"Accept-Charset": "UTF-8",
@@ -42,7 +43,7 @@ func (c *TableServiceClient) getStandardHeaders() map[string]string {
 // CreateTable creates the table given the specific
 // name. This function fails if the name is not compliant
 // with the specification.
-func (c *TableServiceClient) CreateTable(table AzureTable) error {
+func (c *TableServiceClient) CreateTable(ctx context.Context, table AzureTable) error {
 	uri := c.client.getEndpoint(tableServiceName, tablesURIPath, url.Values{})
 
 	headers := c.getStandardHeaders()
@@ -55,7 +56,7 @@ func (c *TableServiceClient) CreateTable(table AzureTable) error {
 
 	headers["Content-Length"] = fmt.Sprintf("%d", buf.Len())
 
-	resp, err := c.client.execTable("POST", uri, headers, buf)
+	resp, err := c.client.execTable(ctx, "POST", uri, headers, buf)
 	if err != nil {
 		return err
 	}
@@ -72,7 +73,7 @@ func (c *TableServiceClient) CreateTable(table AzureTable) error {
 // name. This function fails if the table is not present.
 // Be advised: DeleteTable deletes all the entries
 // that may be present.
-func (c *TableServiceClient) DeleteTable(table AzureTable) error {
+func (c *TableServiceClient) DeleteTable(ctx context.Context, table AzureTable) error {
 	uri := c.client.getEndpoint(tableServiceName, tablesURIPath, url.Values{})
 	uri += fmt.Sprintf("('%s')", string(table))
 
@@ -80,7 +81,7 @@ func (c *TableServiceClient) DeleteTable(table AzureTable) error {
 
 	headers["Content-Length"] = "0"
 
-	resp, err := c.client.execTable("DELETE", uri, headers, nil)
+	resp, err := c.client.execTable(ctx, "DELETE", uri, headers, nil)
 
 	if err != nil {
 		return err
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// BatchError is returned by BatchInsertOrReplace when some of the entities were rejected.
+// Batch is transactional, so none of its entities are inserted in this case
+type BatchError struct {
+	Table    AzureTable
+	Failures []EntityError
+}
+
+// EntityError describes failure of a single entity of the batch
+type EntityError struct {
+	// Index of the entity in the batch. -1 if the entity cannot be identified
+	Index        int
+	PartitionKey string
+	RowKey       string
+	StatusCode   int
+	Code         string
+	Message      string
+}
+
+func (e BatchError) Error() string {
+	failures := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		failures[i] = fmt.Sprintf("entity %d (%s/%s): %d %s %s", f.Index, f.PartitionKey, f.RowKey, f.StatusCode, f.Code, f.Message)
+	}
+	return fmt.Sprintf("batch insert into %s failed: %s", e.Table, strings.Join(failures, "; "))
+}
+
+// parseBatchResponse checks sub-responses of the batch and returns BatchError if any of them is not successful
+func parseBatchResponse(table AzureTable, contentType string, body io.Reader, entities []*TableEntity) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return fmt.Errorf("unexpected batch response content type %q", contentType)
+	}
+
+	batchError := BatchError{Table: table}
+	parts := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read batch response: %v", err)
+		}
+
+		failures, err := parseChangesetResponse(part, entities)
+		if err != nil {
+			return err
+		}
+		batchError.Failures = append(batchError.Failures, failures...)
+	}
+
+	if len(batchError.Failures) > 0 {
+		return batchError
+	}
+	return nil
+}
+
+func parseChangesetResponse(part *multipart.Part, entities []*TableEntity) ([]EntityError, error) {
+	mediaType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse content type of batch response part: %v", err)
+	}
+
+	// whole batch can be rejected with a single response outside of changeset
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		failure, err := parseSubResponse(part, entities)
+		if err != nil || failure == nil {
+			return nil, err
+		}
+		return []EntityError{*failure}, nil
+	}
+
+	var result []EntityError
+	subResponses := multipart.NewReader(part, params["boundary"])
+	for {
+		subResponse, err := subResponses.NextPart()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read changeset response: %v", err)
+		}
+
+		failure, err := parseSubResponse(subResponse, entities)
+		if err != nil {
+			return nil, err
+		}
+		if failure != nil {
+			result = append(result, *failure)
+		}
+	}
+}
+
+// parseSubResponse returns failure of the entity sub-response is related to or nil if it is successful
+func parseSubResponse(part *multipart.Part, entities []*TableEntity) (*EntityError, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse batch sub-response: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		return nil, nil
+	}
+
+	failure := &EntityError{Index: -1, StatusCode: resp.StatusCode}
+	data, _ := ioutil.ReadAll(resp.Body)
+	var odata odataErrorMessage
+	if json.Unmarshal(data, &odata) == nil {
+		failure.Code = odata.Err.Code
+		failure.Message = odata.Err.Message.Value
+	}
+
+	if id, err := strconv.Atoi(resp.Header.Get("Content-ID")); err == nil {
+		failure.Index = id - 1
+	} else if i := strings.Index(failure.Message, ":"); i > 0 {
+		// without Content-ID the service prefixes message with index of the failed entity
+		if index, err := strconv.Atoi(failure.Message[:i]); err == nil {
+			failure.Index = index
+		}
+	}
+
+	if failure.Index >= 0 && failure.Index < len(entities) {
+		failure.PartitionKey = entities[failure.Index].PartitionKey
+		failure.RowKey = entities[failure.Index].RowKey
+	} else {
+		failure.Index = -1
+	}
+	return failure, nil
+}
@@ -2,37 +2,137 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
 	partitionKeyNode = "PartitionKey"
 	rowKeyNode       = "RowKey"
+	etagHeader       = "ETag"
 )
 
+var tracer = otel.Tracer("github.com/alexanderromanov/nginx-logparser/azure-storage")
+
 // TableEntity struct specifies entity to be saved to Azure Tables
 type TableEntity struct {
 	PartitionKey string
 	RowKey       string
 	Fields       map[string]interface{}
+
+	// ETag is the version of the entity returned by GetEntity. It is used by UpdateEntity for optimistic concurrency
+	ETag string
 }
 
 // InsertEntity inserts an entity in the specified table.
-// The function fails if there is an entity with the same PartitionKey and RowKey in the table.
-func (c *TableServiceClient) InsertEntity(table AzureTable, entity TableEntity) error {
-	statusCode, err := c.execTable(table, entity, "POST")
+// The function fails with AzureStorageServiceError with StatusCode 409 if there is an entity
+// with the same PartitionKey and RowKey in the table.
+func (c *TableServiceClient) InsertEntity(ctx context.Context, table AzureTable, entity TableEntity) error {
+	resp, err := c.execTable(ctx, table, entity, "POST")
+	if resp == nil {
+		return err
+	}
+	defer resp.body.Close()
+
+	return checkEntityResponse(resp, http.StatusCreated)
+}
+
+// GetEntity returns entity with given keys. nil is returned if there is no such entity
+func (c *TableServiceClient) GetEntity(ctx context.Context, table AzureTable, partitionKey, rowKey string) (*TableEntity, error) {
+	uri := c.client.getEndpoint(tableServiceName, entityPath(table, partitionKey, rowKey), url.Values{})
+	headers := c.getStandardHeaders()
+
+	// error responses are reported by status code even if their body cannot be parsed
+	resp, err := c.client.execTable(ctx, "GET", uri, headers, nil)
+	if resp == nil {
+		return nil, err
+	}
+	defer resp.body.Close()
+
+	if resp.statusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := checkEntityResponse(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(resp.body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("cannot parse entity of %s: %v", table, err)
+	}
+
+	entity := deserializeEntity(fields)
+	entity.ETag = resp.headers.Get(etagHeader)
+	return entity, nil
+}
+
+// UpdateEntity replaces entity in the specified table if it wasn't modified since entity.ETag was obtained.
+// The function fails with AzureStorageServiceError with StatusCode 412 if entity was modified
+func (c *TableServiceClient) UpdateEntity(ctx context.Context, table AzureTable, entity TableEntity) error {
+	uri := c.client.getEndpoint(tableServiceName, entityPath(table, entity.PartitionKey, entity.RowKey), url.Values{})
+	headers := c.getStandardHeaders()
+	headers["If-Match"] = entity.ETag
+
+	buf, err := serializeEntity(entity)
 	if err != nil {
-		return checkRespCode(statusCode, []int{http.StatusCreated})
+		return err
+	}
+	headers["Content-Length"] = fmt.Sprintf("%d", buf.Len())
+
+	resp, err := c.client.execTable(ctx, "PUT", uri, headers, buf)
+	if resp == nil {
+		return err
 	}
-	return nil
+	defer resp.body.Close()
+
+	return checkEntityResponse(resp, http.StatusNoContent)
 }
 
-// BatchInsert inserts set of entities in the specified table.
-// Function assumes that batch is formed properly
-func (c *TableServiceClient) BatchInsert(table AzureTable, entities []*TableEntity) error {
+// IsConflict returns true if err indicates that entity was concurrently created or modified
+func IsConflict(err error) bool {
+	serviceErr, ok := err.(AzureStorageServiceError)
+	return ok && (serviceErr.StatusCode == http.StatusConflict || serviceErr.StatusCode == http.StatusPreconditionFailed)
+}
+
+// entityPath returns path of the entity with given keys. Single quotes are doubled as OData requires,
+// the path is escaped when URL is built
+func entityPath(table AzureTable, partitionKey, rowKey string) string {
+	escape := func(key string) string {
+		return strings.Replace(key, "'", "''", -1)
+	}
+	return fmt.Sprintf("%s(PartitionKey='%s',RowKey='%s')", table, escape(partitionKey), escape(rowKey))
+}
+
+func checkEntityResponse(resp *odataResponse, expected int) error {
+	if resp.statusCode == expected {
+		return nil
+	}
+	if err := checkThrottled(resp); err != nil {
+		return err
+	}
+	return AzureStorageServiceError{
+		StatusCode: resp.statusCode,
+		Code:       resp.odata.Err.Code,
+		Message:    resp.odata.Err.Message.Value,
+	}
+}
+
+// BatchInsertOrReplace inserts set of entities in the specified table, entities with the same PartitionKey
+// and RowKey are replaced. Function assumes that batch is formed properly
+func (c *TableServiceClient) BatchInsertOrReplace(ctx context.Context, table AzureTable, entities []*TableEntity) error {
+	ctx, span := tracer.Start(ctx, "BatchInsertOrReplace")
+	defer span.End()
+	span.SetAttributes(attribute.String("table", string(table)), attribute.Int("entities", len(entities)))
+
 	uri := c.client.getEndpoint(tableServiceName, pathForTable("$batch"), url.Values{})
 	uuid, err := pseudoUUID()
 	if err != nil {
@@ -40,7 +140,7 @@ func (c *TableServiceClient) BatchInsert(table AzureTable, entities []*TableEnti
 	}
 	boundary := "batch_" + uuid
 	headers := map[string]string{
-		"x-ms-version":          "2015-12-11",
+		"x-ms-version":          c.client.apiVersion,
 		"x-ms-date":             currentTimeRfc1123Formatted(),
 		"Accept-Charset":        "UTF-8",
 		"Content-Type":          "multipart/mixed; boundary=" + boundary,
@@ -51,15 +151,28 @@ func (c *TableServiceClient) BatchInsert(table AzureTable, entities []*TableEnti
 	if err != nil {
 		return err
 	}
+	// the buffer can be reused only after the request is completely sent
+	defer putBatchBuffer(content)
 	headers["Content-Length"] = fmt.Sprintf("%d", content.Len())
 
-	resp, err := c.client.execTable("POST", uri, headers, content)
-	if err != nil {
+	resp, err := c.client.execTable(ctx, "POST", uri, headers, content)
+	if resp == nil {
 		return err
 	}
 	defer resp.body.Close()
 
-	return nil
+	if err := checkThrottled(resp); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkRespCode(resp.statusCode, []int{http.StatusAccepted}); err != nil {
+		return err
+	}
+
+	// batch is accepted even if its changeset failed, actual result is in sub-responses
+	return parseBatchResponse(table, resp.headers.Get("Content-Type"), resp.body, entities)
 }
 
 func buildBatchContent(c *TableServiceClient, boundary string, table AzureTable, entities []*TableEntity) (*bytes.Buffer, error) {
@@ -69,7 +182,9 @@ func buildBatchContent(c *TableServiceClient, boundary string, table AzureTable,
 	}
 	changeset := "changeset_" + uuid
 
-	var buffer bytes.Buffer
+	buffer := getBatchBuffer()
+	encoder := encoderPool.Get().(*entityEncoder)
+	defer encoderPool.Put(encoder)
 
 	buffer.WriteString("--")
 	buffer.WriteString(boundary)
@@ -77,21 +192,22 @@ func buildBatchContent(c *TableServiceClient, boundary string, table AzureTable,
 	buffer.WriteString(changeset)
 	buffer.WriteString("\n\n")
 
-	uri := c.client.getEndpoint(tableServiceName, pathForTable(table), url.Values{})
-	for _, entity := range entities {
-		serializedEntity, err := serializeEntity(*entity)
-		if err != nil {
-			return nil, err
-		}
-
+	for i, entity := range entities {
+		// PUT without If-Match header inserts entity or replaces existing one
+		uri := c.client.getEndpoint(tableServiceName, entityPath(table, entity.PartitionKey, entity.RowKey), url.Values{})
 		buffer.WriteString("--")
 		buffer.WriteString(changeset)
-		buffer.WriteString("\nContent-Type: application/http\nContent-Transfer-Encoding: binary\n\nPOST ")
+		buffer.WriteString("\nContent-Type: application/http\nContent-Transfer-Encoding: binary\n\nPUT ")
 		buffer.WriteString(uri)
-		buffer.WriteString("() HTTP/1.1\nAccept: application/json;odata=minimalmetadata\nContent-Type: application/json\n")
+		buffer.WriteString(" HTTP/1.1\nAccept: application/json;odata=minimalmetadata\nContent-Type: application/json\n")
+		// Content-ID is returned in sub-response and identifies the entity
+		fmt.Fprintf(buffer, "Content-ID: %d\n", i+1)
 		buffer.WriteString("Prefer: return-no-content\nDataServiceVersion: 3.0;\n\n")
 
-		buffer.Write(serializedEntity.Bytes())
+		if err := encoder.writeEntity(buffer, entity); err != nil {
+			putBatchBuffer(buffer)
+			return nil, err
+		}
 		buffer.WriteString("\n")
 	}
 
@@ -101,26 +217,20 @@ func buildBatchContent(c *TableServiceClient, boundary string, table AzureTable,
 	buffer.WriteString(boundary)
 	buffer.WriteString("--")
 
-	return &buffer, nil
+	return buffer, nil
 }
 
-func (c *TableServiceClient) execTable(table AzureTable, entity TableEntity, method string) (int, error) {
+func (c *TableServiceClient) execTable(ctx context.Context, table AzureTable, entity TableEntity, method string) (*odataResponse, error) {
 	uri := c.client.getEndpoint(tableServiceName, pathForTable(table), url.Values{})
 	headers := c.getStandardHeaders()
 	buf, err := serializeEntity(entity)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	headers["Content-Length"] = fmt.Sprintf("%d", buf.Len())
 
-	resp, err := c.client.execTable(method, uri, headers, buf)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.body.Close()
-
-	return resp.statusCode, nil
+	return c.client.execTable(ctx, method, uri, headers, buf)
 }
 
 func serializeEntity(entity TableEntity) (*bytes.Buffer, error) {
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const (
+	continuationPartitionKeyHeader = "x-ms-continuation-NextPartitionKey"
+	continuationRowKeyHeader       = "x-ms-continuation-NextRowKey"
+)
+
+type queryEntitiesResponse struct {
+	Value []map[string]interface{} `json:"value"`
+}
+
+// QueryEntities returns entities of the table matching OData filter expression,
+// e.g. "PartitionKey eq '42'". All pages of the result are read
+func (c *TableServiceClient) QueryEntities(ctx context.Context, table AzureTable, filter string) ([]*TableEntity, error) {
+	var result []*TableEntity
+	params := url.Values{}
+	if filter != "" {
+		params.Set("$filter", filter)
+	}
+
+	for {
+		uri := c.client.getEndpoint(tableServiceName, pathForTable(table)+"()", params)
+		headers := c.getStandardHeaders()
+
+		resp, err := c.client.execTable(ctx, "GET", uri, headers, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.statusCode != http.StatusOK {
+			resp.body.Close()
+			return nil, AzureStorageServiceError{
+				StatusCode: resp.statusCode,
+				Code:       resp.odata.Err.Code,
+				Message:    resp.odata.Err.Message.Value,
+			}
+		}
+
+		var page queryEntitiesResponse
+		decoder := json.NewDecoder(resp.body)
+		decoder.UseNumber()
+		err = decoder.Decode(&page)
+		resp.body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse entities of %s: %v", table, err)
+		}
+
+		for _, fields := range page.Value {
+			result = append(result, deserializeEntity(fields))
+		}
+
+		nextPartitionKey := resp.headers.Get(continuationPartitionKeyHeader)
+		if nextPartitionKey == "" {
+			return result, nil
+		}
+		params.Set("NextPartitionKey", nextPartitionKey)
+		params.Set("NextRowKey", resp.headers.Get(continuationRowKeyHeader))
+	}
+}
+
+func deserializeEntity(fields map[string]interface{}) *TableEntity {
+	entity := &TableEntity{Fields: map[string]interface{}{}}
+	for k, v := range fields {
+		switch k {
+		case partitionKeyNode:
+			entity.PartitionKey, _ = v.(string)
+		case rowKeyNode:
+			entity.RowKey, _ = v.(string)
+		default:
+			entity.Fields[k] = v
+		}
+	}
+	return entity
+}
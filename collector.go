@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/consumptions"
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+const (
+	maxPayloadSize = 64 << 20
+
+	// maxPayloadFuture limits how far in the future agent clocks may be
+	maxPayloadFuture = time.Hour
+)
+
+// collectorSettings control collector receiving payloads of agents
+type collectorSettings struct {
+	// Listen is the address collector listens on
+	Listen string
+
+	// CertFile and KeyFile enable HTTPS
+	CertFile string
+	KeyFile  string
+
+	// Agents maps tokens to names of agents' servers
+	Agents map[string]string
+
+	// LogFormat describes format of raw lines sent by agents
+	LogFormat logsreader.LogFormat
+}
+
+// collector accepts consumptions pre-aggregated by agents and raw log lines and saves them to storage.
+// Payload is acknowledged only after it is saved, so agents retry failed pushes
+type collector struct {
+	ctx      context.Context
+	settings applicationSettings
+	domains  *domainsCache
+	parse    func(line string) (*logsreader.LogRecord, error)
+}
+
+// runCollector serves collector endpoints until the server fails
+func runCollector(ctx context.Context, settings applicationSettings, domains *domainsCache) {
+	parse, err := logsreader.NewLineParser(settings.Collector.LogFormat)
+	if err != nil {
+		log.Println("invalid collector log format: " + err.Error())
+		return
+	}
+	c := &collector{ctx: ctx, settings: settings, domains: domains, parse: parse}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/consumptions", c.authenticated(c.handleConsumptions))
+	mux.HandleFunc("/lines", c.authenticated(c.handleLines))
+
+	log.Printf("collector listens on %s\n", settings.Collector.Listen)
+	if settings.Collector.CertFile != "" {
+		err = http.ListenAndServeTLS(settings.Collector.Listen, settings.Collector.CertFile, settings.Collector.KeyFile, mux)
+	} else {
+		err = http.ListenAndServe(settings.Collector.Listen, mux)
+	}
+	log.Println("collector failed: " + err.Error())
+}
+
+// authenticated checks agent token and passes name of agent's server to the handler
+func (c *collector) authenticated(handler func(w http.ResponseWriter, r *http.Request, serverName string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		serverName, ok := c.settings.Collector.Agents[token]
+		if token == "" || !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		err := handler(w, r, serverName)
+		if err != nil {
+			log.Printf("%s - payload is rejected: %v\n", serverName, err)
+			status := http.StatusInternalServerError
+			if _, invalid := err.(invalidPayloadError); invalid {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (c *collector) handleConsumptions(w http.ResponseWriter, r *http.Request, serverName string) error {
+	body, err := payloadBody(w, r)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	hash := fnv.New64a()
+	var payload agentPayloadJSON
+	err = json.NewDecoder(io.TeeReader(body, hash)).Decode(&payload)
+	if err != nil {
+		return invalidPayloadError{fmt.Sprintf("cannot parse payload: %v", err)}
+	}
+
+	usages := c.domains.newUsagesCollection(c.settings.Usages)
+	defer c.domains.release(usages)
+	maxTime := time.Now().Add(maxPayloadFuture)
+	for _, record := range payload.Records {
+		consumption, err := record.toConsumptionRecord(maxTime)
+		if err != nil {
+			return err
+		}
+		usages.AddConsumption(consumption)
+	}
+
+	saveID := payload.SaveID
+	if saveID == "" {
+		saveID = strconv.FormatUint(hash.Sum64(), 16)
+	}
+	return c.save(usages, serverName, saveID)
+}
+
+func (c *collector) handleLines(w http.ResponseWriter, r *http.Request, serverName string) error {
+	body, err := payloadBody(w, r)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	usages := c.domains.newUsagesCollection(c.settings.Usages)
+	defer c.domains.release(usages)
+	hash := fnv.New64a()
+	scanner := bufio.NewScanner(io.TeeReader(body, hash))
+	for scanner.Scan() {
+		record, err := c.parse(scanner.Text())
+		if err != nil {
+			return invalidPayloadError{err.Error()}
+		}
+		usages.AddRecord(record)
+	}
+	if err := scanner.Err(); err != nil {
+		return invalidPayloadError{fmt.Sprintf("cannot read lines: %v", err)}
+	}
+
+	// the same lines sent again replace rows of the first attempt
+	return c.save(usages, serverName, strconv.FormatUint(hash.Sum64(), 16))
+}
+
+// save stores consumptions of the payload. saveID identifies the payload, rows of retried payloads are replaced
+func (c *collector) save(usages *consumptions.UsagesCollection, serverName, saveID string) error {
+	for _, domain := range usages.GetUnknownDomains() {
+		log.Printf("%s - Cannot find info for %s requested %d times\n", serverName, domain.Domain, domain.Requested)
+	}
+	archive, err := saveConsumptions(c.ctx, c.settings, usages, serverName, saveID, &serverReport{Server: serverName})
+	if err != nil {
+		return err
+	}
+	// agents keep their own state, the payload is complete once it is stored
+	if err := archive.upload(c.ctx, c.settings); err != nil {
+		log.Printf("%s - WARNING: %v\n", serverName, err)
+	}
+	return nil
+}
+
+// payloadBody returns size limited and, if needed, decompressed request body
+func payloadBody(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	body := http.MaxBytesReader(w, r.Body, maxPayloadSize)
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return body, nil
+	}
+
+	reader, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, invalidPayloadError{fmt.Sprintf("cannot decompress payload: %v", err)}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(reader, maxPayloadSize), body}, nil
+}
+
+func (record domainConsumptionJSON) toConsumptionRecord(maxTime time.Time) (*consumptions.ConsumptionRecord, error) {
+	t := time.Unix(record.Time, 0).UTC()
+	switch {
+	case record.Domain == "":
+		return nil, invalidPayloadError{"record without domain"}
+	case record.Time <= 0 || t.After(maxTime):
+		return nil, invalidPayloadError{fmt.Sprintf("invalid time %d of %s", record.Time, record.Domain)}
+	case record.Files < 0 || record.Dynamic < 0 || record.Other < 0 || record.UploadBytes < 0 || record.Probe < 0 || record.ProbeCount < 0 ||
+		record.FilesCount < 0 || record.DynamicCount < 0 || record.OtherCount < 0 || record.SlowCount < 0 || record.RangeCount < 0 ||
+		record.Expensive < 0 || record.ClientClosed < 0:
+		return nil, invalidPayloadError{fmt.Sprintf("negative counters of %s", record.Domain)}
+	case record.Port < 0 || record.Port > 65535:
+		return nil, invalidPayloadError{fmt.Sprintf("invalid port %d of %s", record.Port, record.Domain)}
+	case len(record.Minutes) != 0 && len(record.Minutes) != consumptions.MinutesInHour:
+		return nil, invalidPayloadError{fmt.Sprintf("%d minute counters of %s", len(record.Minutes), record.Domain)}
+	case len(record.BusyMillis) != 0 && len(record.BusyMillis) != consumptions.MinutesInHour:
+		return nil, invalidPayloadError{fmt.Sprintf("%d minute busy times of %s", len(record.BusyMillis), record.Domain)}
+	}
+	for _, values := range [][]int{record.Minutes, record.BusyMillis} {
+		for _, value := range values {
+			if value < 0 {
+				return nil, invalidPayloadError{fmt.Sprintf("negative counters of %s", record.Domain)}
+			}
+		}
+	}
+
+	return &consumptions.ConsumptionRecord{
+		Domain:            strings.ToLower(record.Domain),
+		Time:              t,
+		Files:             record.Files,
+		FilesCount:        record.FilesCount,
+		Dynamic:           record.Dynamic,
+		DynamicCount:      record.DynamicCount,
+		Other:             record.Other,
+		OtherCount:        record.OtherCount,
+		Probe:             record.Probe,
+		ProbeCount:        record.ProbeCount,
+		UploadBytes:       record.UploadBytes,
+		SlowCount:         record.SlowCount,
+		RangeRequests:     record.RangeCount,
+		ExpensiveCount:    record.Expensive,
+		ClientClosedCount: record.ClientClosed,
+		Port:              record.Port,
+		Minutes:           record.Minutes,
+		BusyMillis:        record.BusyMillis,
+	}, nil
+}
+
+// invalidPayloadError is returned for payloads agent should not retry
+type invalidPayloadError struct {
+	message string
+}
+
+func (e invalidPayloadError) Error() string {
+	return e.message
+}
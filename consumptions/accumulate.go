@@ -0,0 +1,90 @@
+package consumptions
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/alexanderromanov/nginx-logparser/azure-storage"
+)
+
+const (
+	maxAccumulateAttempts = 10
+)
+
+// accumulateRecords adds counters of records to the rows of corresponding website-hours.
+// Every record is saved separately and counted as a batch of one entity
+func accumulateRecords(ctx context.Context, client storage.TableServiceClient, strategy keyStrategy, columns ColumnMap, accountName, tableNameTemplate string, consumptions map[int][]*ConsumptionRecord, serverName string) (SaveStats, error) {
+	log.Println(serverName + " - " + "Accumulating consumptions in Azure")
+
+	var stats SaveStats
+	var failures firstError
+	var wg sync.WaitGroup
+	limiter := newAdaptiveLimiter()
+	for partitionID, records := range consumptions {
+		for _, record := range records {
+			table := getOrCreateUsageTable(ctx, client, accountName, tableNameTemplate, record.Time)
+			partitionKey, rowKey := strategy.recordKeys(partitionID, record, "")
+			wg.Add(1)
+			go func(record *ConsumptionRecord) {
+				defer wg.Done()
+				err := limiter.do(ctx, func() error {
+					return accumulateRecord(ctx, client, columns, table, partitionKey, rowKey, record)
+				})
+				atomic.AddInt64(&stats.Entities, 1)
+				atomic.AddInt64(&stats.Batches, 1)
+				if err != nil {
+					log.Println(err)
+					atomic.AddInt64(&stats.FailedBatches, 1)
+					failures.set(err)
+				}
+			}(record)
+		}
+	}
+	wg.Wait()
+
+	return stats, failures.get()
+}
+
+// accumulateRecord reads the row of the record's hour, adds record counters and writes it back.
+// The whole operation is retried if the row was concurrently created or modified
+func accumulateRecord(ctx context.Context, client storage.TableServiceClient, columns ColumnMap, table storage.AzureTable, partitionKey, rowKey string, record *ConsumptionRecord) error {
+	for attempt := 0; attempt < maxAccumulateAttempts; attempt++ {
+		existing, err := client.GetEntity(ctx, table, partitionKey, rowKey)
+		if isThrottled(err) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read %s/%s of %s: %w", partitionKey, rowKey, table, err)
+		}
+
+		if existing == nil {
+			entity := storage.TableEntity{PartitionKey: partitionKey, RowKey: rowKey, Fields: columns.project(consumptionFields(record))}
+			err = client.InsertEntity(ctx, table, entity)
+		} else {
+			var total *ConsumptionRecord
+			total, err = consumptionFromFields(columns.unproject(existing.Fields))
+			if err != nil {
+				return fmt.Errorf("cannot read entity %s/%s of %s: %v", partitionKey, rowKey, table, err)
+			}
+			total.Time = record.Time
+			total.add(record)
+
+			existing.Fields = columns.project(consumptionFields(total))
+			err = client.UpdateEntity(ctx, table, *existing)
+		}
+
+		if err == nil {
+			return nil
+		}
+		if isThrottled(err) {
+			return err
+		}
+		if !storage.IsConflict(err) {
+			return fmt.Errorf("cannot save %s/%s to %s: %w", partitionKey, rowKey, table, err)
+		}
+	}
+	return fmt.Errorf("cannot save %s/%s to %s: row is modified concurrently", partitionKey, rowKey, table)
+}
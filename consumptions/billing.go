@@ -0,0 +1,104 @@
+package consumptions
+
+import "time"
+
+// BillingMultipliers are cost multipliers of traffic classes BillableBytes are computed with
+type BillingMultipliers struct {
+	Files   float64
+	Dynamic float64
+	Other   float64
+}
+
+// DefaultBillingMultipliers bill bytes of all traffic classes equally
+var DefaultBillingMultipliers = BillingMultipliers{Files: 1, Dynamic: 1, Other: 1}
+
+// ApplyBilling sets BillableBytes of records. It is called after transforms so that billed bytes
+// match bytes that are saved
+func ApplyBilling(consumptions map[int][]*ConsumptionRecord, multipliers BillingMultipliers) {
+	for _, records := range consumptions {
+		for _, record := range records {
+			record.BillableBytes = multipliers.billableBytes(record)
+		}
+	}
+}
+
+// billableBytes applies multipliers to class bytes already weighted by status weights
+func (multipliers BillingMultipliers) billableBytes(record *ConsumptionRecord) int64 {
+	return int64(float64(record.weightedFiles)*multipliers.Files +
+		float64(record.weightedDynamic)*multipliers.Dynamic +
+		float64(record.weightedOther)*multipliers.Other)
+}
+
+// bytesPerGB is the size of gigabyte prices are specified for
+const bytesPerGB = 1 << 30
+
+// PriceTier is the price of traffic up to the monthly volume
+type PriceTier struct {
+	// UpToGB is the monthly volume above included quota the price applies up to. Zero means unbounded
+	UpToGB float64
+
+	PricePerGB float64
+}
+
+// PlanPricing describes price of traffic of websites with the plan
+type PlanPricing struct {
+	// IncludedGB is the monthly volume that is not charged
+	IncludedGB float64
+
+	// Tiers are ordered by volume, the last tier usually is unbounded. Traffic above the last bounded tier is not charged
+	Tiers []PriceTier
+}
+
+// Pricing maps plans supplied by websites provider to their prices
+type Pricing struct {
+	Plans map[string]PlanPricing
+
+	// DefaultPlan is used for websites with unknown plan. Cost of such websites is not computed if it is empty
+	DefaultPlan string
+}
+
+// ApplyPricing sets Cost of hourly website totals, e.g. loaded by LoadHistory, from their BillableBytes.
+// Monthly quota and tiers are prorated to the hour of the record. Cost of account records is not computed
+// because websites of the account can have different plans
+func ApplyPricing(records []*ConsumptionRecord, pricing Pricing) {
+	if len(pricing.Plans) == 0 {
+		return
+	}
+	for _, record := range records {
+		plan, ok := pricing.Plans[record.Plan]
+		if !ok {
+			plan, ok = pricing.Plans[pricing.DefaultPlan]
+		}
+		if ok {
+			record.Cost = plan.hourlyCost(record.BillableBytes, record.Time)
+		}
+	}
+}
+
+func (plan PlanPricing) hourlyCost(billableBytes int64, hour time.Time) float64 {
+	share := 1 / hoursInMonth(hour)
+	volume := float64(billableBytes)/bytesPerGB - plan.IncludedGB*share
+
+	cost := 0.0
+	from := 0.0
+	for _, tier := range plan.Tiers {
+		if volume <= from {
+			break
+		}
+		to := volume
+		if tier.UpToGB > 0 && tier.UpToGB*share < to {
+			to = tier.UpToGB * share
+		}
+		cost += (to - from) * tier.PricePerGB
+		if tier.UpToGB <= 0 {
+			break
+		}
+		from = to
+	}
+	return cost
+}
+
+func hoursInMonth(t time.Time) float64 {
+	start := monthStart(t)
+	return start.AddDate(0, 1, 0).Sub(start).Hours()
+}
@@ -0,0 +1,49 @@
+package consumptions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyPricing(t *testing.T) {
+	// January has 744 hours, so monthly volumes of 744 GB are 1 GB per hour
+	hour := time.Date(2020, 1, 15, 10, 0, 0, 0, time.UTC)
+	pricing := Pricing{
+		Plans: map[string]PlanPricing{
+			"basic": {
+				IncludedGB: 744,
+				Tiers:      []PriceTier{{UpToGB: 744, PricePerGB: 1}, {PricePerGB: 0.5}},
+			},
+			"capped": {
+				Tiers: []PriceTier{{UpToGB: 744, PricePerGB: 2}},
+			},
+		},
+		DefaultPlan: "basic",
+	}
+
+	tests := []struct {
+		name     string
+		plan     string
+		pricing  Pricing
+		gb       float64
+		expected float64
+	}{
+		{name: "within included quota", plan: "basic", pricing: pricing, gb: 1, expected: 0},
+		{name: "first tier", plan: "basic", pricing: pricing, gb: 1.5, expected: 0.5},
+		{name: "unbounded tier", plan: "basic", pricing: pricing, gb: 3, expected: 1.5},
+		{name: "traffic above bounded tiers", plan: "capped", pricing: pricing, gb: 3, expected: 2},
+		{name: "default plan", plan: "unknown", pricing: pricing, gb: 3, expected: 1.5},
+		{name: "no default plan", plan: "unknown", pricing: Pricing{Plans: pricing.Plans}, gb: 3, expected: 0},
+		{name: "no pricing", plan: "basic", pricing: Pricing{}, gb: 3, expected: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := &ConsumptionRecord{Plan: test.plan, Time: hour, BillableBytes: int64(test.gb * bytesPerGB)}
+			ApplyPricing([]*ConsumptionRecord{record}, test.pricing)
+			if record.Cost != test.expected {
+				t.Errorf("cost %v, want %v", record.Cost, test.expected)
+			}
+		})
+	}
+}
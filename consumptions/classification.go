@@ -0,0 +1,148 @@
+package consumptions
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+// trafficClass is the kind of traffic log record is billed as
+type trafficClass int
+
+const (
+	classExcluded trafficClass = iota
+	classFiles
+	classDynamic
+	classOther
+
+	// classProbe is counted separately from billable traffic, e.g. HEAD requests of monitoring probes
+	classProbe
+)
+
+var (
+	defaultExcludedStatusCodes = []int{410}
+	defaultOtherStatusCodes    = []int{400}
+)
+
+// classifier decides how log records are billed based on response status codes and paths.
+// All billing rules are applied here so that they can be audited in a single place
+type classifier struct {
+	excluded map[int]bool
+	other    map[int]bool
+	weights  map[int]float64
+
+	excludedVerbs map[string]bool
+	probeVerbs    map[string]bool
+
+	expensiveCalls []ExpensiveCall
+}
+
+// ExpensiveCall describes requests of dynamic endpoint that are costly to serve, e.g. /api/export with
+// format parameter. Such requests are counted in ConsumptionRecord.ExpensiveCount
+type ExpensiveCall struct {
+	// Path of the endpoint. Its subpaths match as well
+	Path string
+
+	// Params are query parameters presence of any of which makes the call expensive.
+	// Any query string does if it is empty
+	Params []string
+}
+
+func newClassifier(settings UsagesSettings) classifier {
+	excludedCodes := settings.ExcludedStatusCodes
+	if excludedCodes == nil {
+		excludedCodes = defaultExcludedStatusCodes
+	}
+	otherCodes := settings.OtherStatusCodes
+	if otherCodes == nil {
+		otherCodes = defaultOtherStatusCodes
+	}
+
+	result := classifier{
+		excluded:      map[int]bool{},
+		other:         map[int]bool{},
+		weights:       map[int]float64{},
+		excludedVerbs: verbsSet(settings.ExcludedVerbs),
+		probeVerbs:    verbsSet(settings.ProbeVerbs),
+
+		expensiveCalls: settings.ExpensiveCalls,
+	}
+	for _, code := range excludedCodes {
+		result.excluded[code] = true
+	}
+	for _, code := range otherCodes {
+		result.other[code] = true
+	}
+	for code, weight := range settings.StatusWeights {
+		result.weights[code] = weight
+	}
+	return result
+}
+
+// classify returns traffic class of the record and weight its bytes are billed with
+func (c classifier) classify(record *logsreader.LogRecord) (trafficClass, float64) {
+	if c.excluded[record.HTTPStatusCode] || c.excludedVerbs[record.Verb] {
+		return classExcluded, 0
+	}
+	if c.probeVerbs[record.Verb] {
+		return classProbe, 1
+	}
+
+	weight, ok := c.weights[record.HTTPStatusCode]
+	if !ok {
+		weight = 1
+	}
+
+	switch {
+	// partial content is served for downloads and video of any path
+	case isFile(record.Path) || record.HTTPStatusCode == http.StatusPartialContent:
+		return classFiles, weight
+	case c.other[record.HTTPStatusCode]:
+		return classOther, weight
+	default:
+		return classDynamic, weight
+	}
+}
+
+// verbsSet returns set of upper-cased HTTP verbs
+func verbsSet(verbs []string) map[string]bool {
+	result := make(map[string]bool, len(verbs))
+	for _, verb := range verbs {
+		result[strings.ToUpper(verb)] = true
+	}
+	return result
+}
+
+// isExpensive returns true if the record is a call of one of expensive endpoints with heavy query parameters
+func (c classifier) isExpensive(record *logsreader.LogRecord) bool {
+	if len(c.expensiveCalls) == 0 {
+		return false
+	}
+	i := strings.Index(record.Path, "?")
+	if i < 0 {
+		return false
+	}
+	path, rawQuery := record.Path[:i], record.Path[i+1:]
+
+	var query url.Values
+	for _, call := range c.expensiveCalls {
+		if path != call.Path && !strings.HasPrefix(path, strings.TrimSuffix(call.Path, "/")+"/") {
+			continue
+		}
+		if len(call.Params) == 0 {
+			return rawQuery != ""
+		}
+		if query == nil {
+			// malformed pairs are skipped, parameters that could be parsed are still checked
+			query, _ = url.ParseQuery(rawQuery)
+		}
+		for _, param := range call.Params {
+			if _, ok := query[param]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
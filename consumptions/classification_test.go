@@ -0,0 +1,57 @@
+package consumptions
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+	"github.com/alexanderromanov/nginx-logparser/websites"
+)
+
+func TestStatusClassification(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		path     string
+		expected ConsumptionRecord
+	}{
+		{name: "files", status: 200, path: "/filestore/a.jpg", expected: ConsumptionRecord{Files: 1000, FilesCount: 1, BillableBytes: 2000, weightedFiles: 1000}},
+		{name: "dynamic", status: 200, path: "/", expected: ConsumptionRecord{Dynamic: 1000, DynamicCount: 1, BillableBytes: 1000, weightedDynamic: 1000}},
+		{name: "other", status: 400, path: "/", expected: ConsumptionRecord{Other: 1000, OtherCount: 1, BillableBytes: 0, weightedOther: 1000}},
+		{name: "reduced weight keeps raw bytes", status: 404, path: "/", expected: ConsumptionRecord{Dynamic: 1000, DynamicCount: 1, BillableBytes: 500, weightedDynamic: 500}},
+		{name: "weight and multiplier are both applied", status: 404, path: "/filestore/a.jpg", expected: ConsumptionRecord{Files: 1000, FilesCount: 1, BillableBytes: 1000, weightedFiles: 500}},
+		{name: "excluded", status: 410, path: "/", expected: ConsumptionRecord{}},
+		{name: "excluded by settings", status: 499, path: "/", expected: ConsumptionRecord{}},
+	}
+
+	settings := UsagesSettings{
+		ExcludedStatusCodes: []int{410, 499},
+		StatusWeights:       map[int]float64{404: 0.5},
+	}
+	multipliers := BillingMultipliers{Files: 2, Dynamic: 1, Other: 0}
+	hour := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usages := NewUsagesCollection(websites.Domains{"example.com": {ID: 1}}, settings)
+			usages.AddRecord(&logsreader.LogRecord{
+				Time:           hour.Add(time.Minute),
+				Domain:         "example.com",
+				Path:           test.path,
+				HTTPStatusCode: test.status,
+				Size:           1000,
+			})
+
+			var actual ConsumptionRecord
+			consumptions := usages.GetTrafficConsumption()
+			ApplyBilling(consumptions, multipliers)
+			for _, record := range consumptions[1] {
+				actual = *record
+			}
+			actual.WebsiteID, actual.Time = 0, time.Time{}
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, actual)
+			}
+		})
+	}
+}
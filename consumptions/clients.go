@@ -0,0 +1,82 @@
+package consumptions
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+)
+
+// maxClients limits number of client addresses tracked by collection. Only the most recently seen addresses
+// are kept, so that spoofed or rotating addresses of a flood can't exhaust memory
+const maxClients = 100000
+
+// ClientCounter is the number of requests and bytes of client IP address, e.g. for abuse reports
+type ClientCounter struct {
+	IP       string
+	Requests int
+	Bytes    int64
+
+	// Host is the reverse DNS name of the address. It is empty unless the address is resolved
+	Host string
+}
+
+// clients counts requests by client address
+type clients struct {
+	sync.Mutex
+	order  *list.List
+	counts map[string]*list.Element
+}
+
+func newClients() *clients {
+	return &clients{order: list.New(), counts: map[string]*list.Element{}}
+}
+
+func (c *clients) add(ip string, bytes int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if element, ok := c.counts[ip]; ok {
+		counter := element.Value.(*ClientCounter)
+		counter.Requests++
+		counter.Bytes += bytes
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.counts[ip] = c.order.PushFront(&ClientCounter{IP: ip, Requests: 1, Bytes: bytes})
+	if c.order.Len() > maxClients {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.counts, oldest.Value.(*ClientCounter).IP)
+	}
+}
+
+// top returns size addresses with the most requests
+func (c *clients) top(size int) []ClientCounter {
+	c.Lock()
+	result := make([]ClientCounter, 0, c.order.Len())
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		result = append(result, *element.Value.(*ClientCounter))
+	}
+	c.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].IP < result[j].IP
+	})
+	if len(result) > size {
+		result = result[:size]
+	}
+	return result
+}
+
+// GetTopClients returns UsagesSettings.TopClients client addresses with the most requests. All read records
+// are counted, including ignored ones and records of unknown domains
+func (usages *UsagesCollection) GetTopClients() []ClientCounter {
+	if usages.settings.TopClients <= 0 {
+		return nil
+	}
+	return usages.clients.top(usages.settings.TopClients)
+}
@@ -0,0 +1,76 @@
+package consumptions
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestClientsTop(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []string
+		size     int
+		expected []string
+	}{
+		{
+			name:     "clients are ordered by requests",
+			requests: []string{"10.0.0.1", "10.0.0.2", "10.0.0.2", "10.0.0.3", "10.0.0.3", "10.0.0.3"},
+			size:     3,
+			expected: []string{"10.0.0.3", "10.0.0.2", "10.0.0.1"},
+		},
+		{
+			name:     "ties are ordered by address",
+			requests: []string{"10.0.0.2", "10.0.0.1"},
+			size:     2,
+			expected: []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:     "only size clients are returned",
+			requests: []string{"10.0.0.1", "10.0.0.2", "10.0.0.2"},
+			size:     1,
+			expected: []string{"10.0.0.2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newClients()
+			for _, ip := range test.requests {
+				c.add(ip, 100)
+			}
+			var actual []string
+			for _, client := range c.top(test.size) {
+				actual = append(actual, client.IP)
+			}
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestClientsEviction(t *testing.T) {
+	c := newClients()
+	c.add("10.0.0.1", 100)
+	c.add("10.0.0.2", 100)
+	// the first address is seen again, so the second one is the least recently seen
+	c.add("10.0.0.1", 100)
+	for i := 0; i < maxClients-1; i++ {
+		c.add("192.168.0."+strconv.Itoa(i), 1)
+	}
+
+	if len(c.counts) != maxClients || c.order.Len() != maxClients {
+		t.Fatalf("expected %d clients, got %d in map and %d in list", maxClients, len(c.counts), c.order.Len())
+	}
+	if _, ok := c.counts["10.0.0.2"]; ok {
+		t.Errorf("least recently seen address is not evicted")
+	}
+	counter, ok := c.counts["10.0.0.1"]
+	if !ok {
+		t.Fatalf("recently seen address is evicted")
+	}
+	if client := counter.Value.(*ClientCounter); client.Requests != 2 || client.Bytes != 200 {
+		t.Errorf("expected 2 requests and 200 bytes, got %d and %d", client.Requests, client.Bytes)
+	}
+}
@@ -0,0 +1,157 @@
+package consumptions
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+const (
+	// DedupByRequestID treats records with the same $request_id as duplicates. It requires
+	// request id to be passed from edge to origin, e.g. in X-Request-ID header
+	DedupByRequestID = "requestId"
+
+	// DedupByRequest treats records with the same IP address, domain, verb and path as duplicates. It can't be
+	// used with privacy modes: hashed addresses change at rotation periods and truncated ones merge clients
+	DedupByRequest = "request"
+
+	defaultDedupWindow = 5 * time.Second
+
+	// dedupPruneEvery is the number of added keys after which keys older than the window are removed
+	dedupPruneEvery = 10000
+)
+
+// DedupSettings control deduplication of requests logged by several servers, e.g. by CDN edge and origin
+type DedupSettings struct {
+	// Key is the way records are matched: DedupByRequestID or DedupByRequest. Records are not deduplicated if it is empty
+	Key string
+
+	// Window is the maximum difference between times of duplicate records. defaultDedupWindow is used if it is zero
+	Window time.Duration
+}
+
+// Deduplicator finds records of the same request logged by different servers processed in the same run.
+// Only the first of them is counted. Deduplicator lives for a single run: a server whose consumptions
+// failed to save re-reads its records in the next run and counts them again, while copies already
+// saved for other servers are not matched
+type Deduplicator struct {
+	settings DedupSettings
+
+	sync.Mutex
+	seen  map[uint64]dedupEntry
+	added int
+
+	// latest is the time of the newest record of every server that is still being processed
+	latest map[string]time.Time
+}
+
+// dedupEntry is the request identified by key. copies lists sources the request was logged by
+type dedupEntry struct {
+	time   time.Time
+	copies map[string]bool
+}
+
+// NewDeduplicator creates Deduplicator shared by servers processed in the same run
+func NewDeduplicator(settings DedupSettings) *Deduplicator {
+	if settings.Window <= 0 {
+		settings.Window = defaultDedupWindow
+	}
+	return &Deduplicator{
+		settings: settings,
+		seen:     map[uint64]dedupEntry{},
+		latest:   map[string]time.Time{},
+	}
+}
+
+// IsDuplicate returns true if the same request was logged by another source within the window
+func (d *Deduplicator) IsDuplicate(source string, record *logsreader.LogRecord) bool {
+	key, ok := d.key(record)
+	if !ok {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if record.Time.After(d.latest[source]) {
+		d.latest[source] = record.Time
+	}
+
+	entry, found := d.seen[key]
+	if found && !entry.copies[source] && absDuration(record.Time.Sub(entry.time)) <= d.settings.Window {
+		// key is kept for the whole window, so that copies of any number of sources are matched
+		entry.copies[source] = true
+		return true
+	}
+
+	// repeated request of the same source is a new request, its copies are matched from now on
+	d.seen[key] = dedupEntry{time: record.Time, copies: map[string]bool{source: true}}
+	d.added++
+	if d.added >= dedupPruneEvery {
+		d.prune()
+		d.added = 0
+	}
+	return false
+}
+
+// Done removes finished source, so that its records don't hold keys of other sources in memory
+func (d *Deduplicator) Done(source string) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.latest, source)
+}
+
+// prune removes keys that can't match records of any source anymore
+func (d *Deduplicator) prune() {
+	var watermark time.Time
+	for _, latest := range d.latest {
+		if watermark.IsZero() || latest.Before(watermark) {
+			watermark = latest
+		}
+	}
+	if watermark.IsZero() {
+		return
+	}
+
+	oldest := watermark.Add(-d.settings.Window)
+	for key, entry := range d.seen {
+		if entry.time.Before(oldest) {
+			delete(d.seen, key)
+		}
+	}
+}
+
+func (d *Deduplicator) key(record *logsreader.LogRecord) (uint64, bool) {
+	hash := fnv.New64a()
+	switch d.settings.Key {
+	case DedupByRequestID:
+		if record.RequestID == "" {
+			return 0, false
+		}
+		hash.Write([]byte(record.RequestID))
+	default:
+		for _, field := range []string{record.IPAddress, record.Domain, record.Verb, record.Path} {
+			hash.Write([]byte(field))
+			hash.Write([]byte{0})
+		}
+	}
+	return hash.Sum64(), true
+}
+
+// ValidateDedupKey checks that records can be matched with the key
+func ValidateDedupKey(key string) error {
+	if key != "" && key != DedupByRequestID && key != DedupByRequest {
+		return fmt.Errorf("unknown dedup key %s", key)
+	}
+	return nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,84 @@
+package consumptions
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+func TestDeduplicator(t *testing.T) {
+	type logged struct {
+		source    string
+		offset    time.Duration
+		requestID string
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		records  []logged
+		expected []bool
+	}{
+		{
+			name:     "copy of another source",
+			records:  []logged{{source: "edge"}, {source: "origin", offset: time.Second}},
+			expected: []bool{false, true},
+		},
+		{
+			name:     "copies of several sources",
+			records:  []logged{{source: "edge"}, {source: "origin"}, {source: "backup"}},
+			expected: []bool{false, true, true},
+		},
+		{
+			name:     "copy outside the window",
+			records:  []logged{{source: "edge"}, {source: "origin", offset: 10 * time.Second}},
+			expected: []bool{false, false},
+		},
+		{
+			name:     "repeated request of the same source",
+			records:  []logged{{source: "edge"}, {source: "edge"}},
+			expected: []bool{false, false},
+		},
+		{
+			name:     "copies of repeated requests",
+			records:  []logged{{source: "edge"}, {source: "origin"}, {source: "edge"}, {source: "origin"}},
+			expected: []bool{false, true, false, true},
+		},
+		{
+			name:     "request ids",
+			key:      DedupByRequestID,
+			records:  []logged{{source: "edge", requestID: "a"}, {source: "origin", requestID: "b"}, {source: "origin", requestID: "a"}},
+			expected: []bool{false, false, true},
+		},
+		{
+			name:     "records without request id",
+			key:      DedupByRequestID,
+			records:  []logged{{source: "edge"}, {source: "origin"}},
+			expected: []bool{false, false},
+		},
+	}
+
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dedup := NewDeduplicator(DedupSettings{Key: test.key})
+			var actual []bool
+			for _, r := range test.records {
+				record := &logsreader.LogRecord{
+					Time:      start.Add(r.offset),
+					IPAddress: "10.0.0.1",
+					Domain:    "example.com",
+					Verb:      "GET",
+					Path:      "/",
+					RequestID: r.requestID,
+				}
+				actual = append(actual, dedup.IsDuplicate(r.source, record))
+			}
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("duplicates %v, want %v", actual, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package consumptions
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	"github.com/alexanderromanov/nginx-logparser/azure-storage"
+)
+
+// ErrSinkUnavailable indicates that consumptions could not be saved because storage or database was unreachable,
+// throttled requests or timed out. Such failures are expected to go away when saving is repeated later
+var ErrSinkUnavailable = errors.New("consumptions sink is unavailable")
+
+// SinkError is the failure of saving consumptions to the sink, e.g. "azure" or "mysql". errors.Is matches it
+// with ErrSinkUnavailable if the sink was unavailable
+type SinkError struct {
+	Sink string
+	Err  error
+}
+
+func (e *SinkError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the original error
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true for ErrSinkUnavailable if the sink was unavailable
+func (e *SinkError) Is(target error) bool {
+	return target == ErrSinkUnavailable && isUnavailable(e.Err)
+}
+
+func sinkError(sink string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SinkError{Sink: sink, Err: err}
+}
+
+// isUnavailable returns true for network failures, timeouts and throttling
+func isUnavailable(err error) bool {
+	var throttled storage.ThrottledError
+	var netErr net.Error
+	return errors.As(err, &throttled) || errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn)
+}
@@ -0,0 +1,198 @@
+package consumptions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/azure-storage"
+)
+
+const (
+	tableNotFoundCode = "TableNotFound"
+)
+
+// LoadHistory returns hourly consumption records of the website for the period from <= Time < to.
+// Rows saved by different servers and runs for the same hour are summed into a single record, which Cost
+// is computed from. Records are sorted by time
+func LoadHistory(ctx context.Context, settings AzureStorageSettings, websiteID int, from, to time.Time) ([]*ConsumptionRecord, error) {
+	storageClient, err := settings.Client()
+	if err != nil {
+		return nil, err
+	}
+	client := storageClient.GetTableService()
+
+	filter := getKeyStrategy(settings.KeyStrategy).filter(websiteID, from, to)
+	hours := map[int64]*ConsumptionRecord{}
+	for month := monthStart(from); month.Before(to); month = month.AddDate(0, 1, 0) {
+		table := storage.AzureTable(settings.TableNameTemplate + month.Format("200601"))
+		entities, err := client.QueryEntities(ctx, table, filter)
+		if err != nil {
+			if serviceErr, ok := err.(storage.AzureStorageServiceError); ok && serviceErr.Code == tableNotFoundCode {
+				continue
+			}
+			return nil, fmt.Errorf("cannot query %s: %v", table, err)
+		}
+
+		for _, entity := range entities {
+			record, err := consumptionFromFields(settings.Columns.unproject(entity.Fields))
+			if err != nil {
+				return nil, fmt.Errorf("cannot read entity %s of %s: %v", entity.RowKey, table, err)
+			}
+			record.WebsiteID = websiteID
+
+			hour, ok := hours[record.Time.Unix()]
+			if !ok {
+				hours[record.Time.Unix()] = record
+				continue
+			}
+			hour.add(record)
+		}
+	}
+
+	result := make([]*ConsumptionRecord, 0, len(hours))
+	for _, record := range hours {
+		result = append(result, record)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	ApplyPricing(result, settings.Pricing)
+	return result, nil
+}
+
+// StoredWebsites returns IDs of websites with consumption rows saved for hours of the period from <= Time < to,
+// including websites that no longer have traffic in logs
+func StoredWebsites(ctx context.Context, settings AzureStorageSettings, from, to time.Time) ([]int, error) {
+	storageClient, err := settings.Client()
+	if err != nil {
+		return nil, err
+	}
+	client := storageClient.GetTableService()
+
+	strategy := getKeyStrategy(settings.KeyStrategy)
+	filter := strategy.periodFilter(from, to)
+	found := map[int]bool{}
+	for month := monthStart(from); month.Before(to); month = month.AddDate(0, 1, 0) {
+		table := storage.AzureTable(settings.TableNameTemplate + month.Format("200601"))
+		entities, err := client.QueryEntities(ctx, table, filter)
+		if err != nil {
+			if serviceErr, ok := err.(storage.AzureStorageServiceError); ok && serviceErr.Code == tableNotFoundCode {
+				continue
+			}
+			return nil, fmt.Errorf("cannot query %s: %v", table, err)
+		}
+		for _, entity := range entities {
+			if id, ok := strategy.partitionID(entity.PartitionKey, entity.RowKey); ok {
+				found[id] = true
+			}
+		}
+	}
+
+	result := make([]int, 0, len(found))
+	for id := range found {
+		result = append(result, id)
+	}
+	sort.Ints(result)
+	return result, nil
+}
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// consumptionFromFields is the reverse of consumptionFields
+func consumptionFromFields(fields map[string]interface{}) (*ConsumptionRecord, error) {
+	var err error
+	number := func(name string) int64 {
+		if err != nil {
+			return 0
+		}
+		var value int64
+		value, err = fieldToInt64(fields[name])
+		if err != nil {
+			err = fmt.Errorf("field %s: %v", name, err)
+		}
+		return value
+	}
+
+	record := &ConsumptionRecord{
+		Time:              time.Unix(number("Time"), 0).UTC(),
+		Files:             number("Files"),
+		FilesCount:        int(number("FilesCount")),
+		Dynamic:           number("Dynamic"),
+		DynamicCount:      int(number("DynamicCount")),
+		Other:             number("Other"),
+		OtherCount:        int(number("OtherCount")),
+		Probe:             number("Probe"),
+		ProbeCount:        int(number("ProbeCount")),
+		PostDeletionCount: int(number("PostDeletionCount")),
+		UploadBytes:       number("UploadBytes"),
+		BillableBytes:     number("BillableBytes"),
+		SlowCount:         int(number("SlowCount")),
+		RangeRequests:     int(number("RangeRequests")),
+	}
+	if plan, ok := fields["Plan"].(string); ok {
+		record.Plan = plan
+	}
+	if _, ok := fields["ExpensiveCount"]; ok {
+		record.ExpensiveCount = int(number("ExpensiveCount"))
+	}
+	if _, ok := fields["ClientClosedCount"]; ok {
+		record.ClientClosedCount = int(number("ClientClosedCount"))
+	}
+	if late, ok := fields["Late"].(bool); ok {
+		record.Late = late
+	}
+	if _, ok := fields["Port"]; ok {
+		record.Port = int(number("Port"))
+	}
+	if domain, ok := fields["Domain"].(string); ok {
+		record.Domain = domain
+	}
+	if minutes, ok := fields["Minutes"].(string); ok && err == nil {
+		record.Minutes, err = parseMinutes("Minutes", minutes)
+	}
+	if busy, ok := fields["BusyMillis"].(string); ok && err == nil {
+		record.BusyMillis, err = parseMinutes("BusyMillis", busy)
+	}
+	return record, err
+}
+
+// parseMinutes is the reverse of formatMinutes
+func parseMinutes(name, value string) ([]int, error) {
+	values := strings.Split(value, ",")
+	if len(values) != MinutesInHour {
+		return nil, fmt.Errorf("field %s: %d values instead of %d", name, len(values), MinutesInHour)
+	}
+	result := make([]int, MinutesInHour)
+	for i, v := range values {
+		requests, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", name, err)
+		}
+		result[i] = requests
+	}
+	return result, nil
+}
+
+// fieldToInt64 converts number returned by Table service. Int64 values are returned as strings
+func fieldToInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := v.Float64()
+		return int64(f), err
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	default:
+		return 0, fmt.Errorf("unexpected type %T", value)
+	}
+}
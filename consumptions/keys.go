@@ -0,0 +1,130 @@
+package consumptions
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// KeyStrategyWebsite partitions rows by website (or account) ID. Rows of a partition are ordered by hour
+	KeyStrategyWebsite = "website"
+
+	// KeyStrategyHour partitions rows by hour. Rows of a partition are ordered by website ID
+	KeyStrategyHour = "hour"
+
+	// KeyStrategyReverseTicks partitions rows by website ID like KeyStrategyWebsite, but row keys start with
+	// reverse .NET ticks of the hour, so that the latest hours are returned first
+	KeyStrategyReverseTicks = "reverseTicks"
+
+	// maxTicks is DateTime.MaxValue.Ticks, ticks are 100ns intervals since 0001-01-01
+	maxTicks   = 3155378975999999999
+	unixTicks  = 621355968000000000
+	tickLength = 100 * time.Nanosecond
+)
+
+// keyStrategy generates keys of consumption rows and filters rows of a single website
+type keyStrategy struct {
+	// keys returns partition key and row key of the record. rowSuffix makes row key unique, e.g. per server and save
+	keys func(partitionID int, record *ConsumptionRecord, rowSuffix string) (string, string)
+
+	// filter returns table query condition selecting rows of the partition ID saved for hours from <= Time < to
+	filter func(partitionID int, from, to time.Time) string
+
+	// periodFilter returns table query condition selecting rows of all partition IDs saved for hours from <= Time < to
+	periodFilter func(from, to time.Time) string
+
+	// partitionID returns partition ID of the row with given keys, false if keys are not generated by the strategy
+	partitionID func(partitionKey, rowKey string) (int, bool)
+}
+
+var keyStrategies = map[string]keyStrategy{
+	KeyStrategyWebsite: {
+		keys: func(partitionID int, record *ConsumptionRecord, rowSuffix string) (string, string) {
+			return strconv.Itoa(partitionID), strconv.FormatInt(record.Time.Unix(), 10) + rowSuffix
+		},
+		filter:       websiteFilter,
+		periodFilter: timeFilter,
+		partitionID:  partitionKeyID,
+	},
+	KeyStrategyHour: {
+		keys: func(partitionID int, record *ConsumptionRecord, rowSuffix string) (string, string) {
+			return strconv.FormatInt(record.Time.Unix(), 10), strconv.Itoa(partitionID) + rowSuffix
+		},
+		filter: func(partitionID int, from, to time.Time) string {
+			// row keys of the website are either the ID itself or start with "ID-", "." follows "-" in ASCII
+			return fmt.Sprintf("PartitionKey ge '%d' and PartitionKey lt '%d' and RowKey ge '%d' and RowKey lt '%d.'",
+				from.Unix(), to.Unix(), partitionID, partitionID)
+		},
+		periodFilter: func(from, to time.Time) string {
+			return fmt.Sprintf("PartitionKey ge '%d' and PartitionKey lt '%d'", from.Unix(), to.Unix())
+		},
+		partitionID: func(partitionKey, rowKey string) (int, bool) {
+			id, err := strconv.Atoi(strings.SplitN(rowKey, "-", 2)[0])
+			return id, err == nil
+		},
+	},
+	KeyStrategyReverseTicks: {
+		keys: func(partitionID int, record *ConsumptionRecord, rowSuffix string) (string, string) {
+			return strconv.Itoa(partitionID), reverseTicks(record.Time) + rowSuffix
+		},
+		filter:       websiteFilter,
+		periodFilter: timeFilter,
+		partitionID:  partitionKeyID,
+	},
+}
+
+// recordKeys returns keys of the record. Records of catch-all website are kept per domain and records
+// of alternate ports are kept per port, so the domain and the port are added to row key
+func (strategy keyStrategy) recordKeys(partitionID int, record *ConsumptionRecord, rowSuffix string) (string, string) {
+	if record.Port != 0 {
+		rowSuffix = "-p" + strconv.Itoa(record.Port) + rowSuffix
+	}
+	if record.Domain != "" {
+		rowSuffix = "-" + keyReplacer.Replace(record.Domain) + rowSuffix
+	}
+	return strategy.keys(partitionID, record, rowSuffix)
+}
+
+// keyReplacer removes characters that are not allowed in table keys
+var keyReplacer = strings.NewReplacer("/", "_", "\\", "_", "#", "_", "?", "_")
+
+// ValidateKeyStrategy returns error if there is no key strategy with given name. Empty name means KeyStrategyWebsite
+func ValidateKeyStrategy(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := keyStrategies[name]; !ok {
+		return fmt.Errorf("unknown key strategy %s", name)
+	}
+	return nil
+}
+
+// getKeyStrategy returns key strategy with given name. KeyStrategyWebsite is used for unknown names
+func getKeyStrategy(name string) keyStrategy {
+	strategy, ok := keyStrategies[name]
+	if !ok {
+		return keyStrategies[KeyStrategyWebsite]
+	}
+	return strategy
+}
+
+func websiteFilter(partitionID int, from, to time.Time) string {
+	return fmt.Sprintf("PartitionKey eq '%d' and %s", partitionID, timeFilter(from, to))
+}
+
+func timeFilter(from, to time.Time) string {
+	return fmt.Sprintf("Time ge %d and Time lt %d", from.Unix(), to.Unix())
+}
+
+func partitionKeyID(partitionKey, rowKey string) (int, bool) {
+	id, err := strconv.Atoi(partitionKey)
+	return id, err == nil
+}
+
+// reverseTicks returns zero padded number of ticks from t till the end of time, so that later times sort first
+func reverseTicks(t time.Time) string {
+	ticks := t.Unix()*int64(time.Second/tickLength) + unixTicks
+	return fmt.Sprintf("%019d", maxTicks-ticks)
+}
@@ -0,0 +1,103 @@
+package consumptions
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Late records belong to hours that were already flushed, e.g. because rotated file was processed late
+// or nginx logged long request after the hour was saved. LateData policy decides what is done with them
+const (
+	// LateDataInsert saves late records as rows of the run like any other records. It is the default
+	LateDataInsert = "insert"
+
+	// LateDataMerge adds late records to the hour row with read-modify-write, as AzureStorageSettings.Accumulate does
+	LateDataMerge = "merge"
+
+	// LateDataDelta saves late records as separate rows with Late column set
+	LateDataDelta = "delta"
+
+	// LateDataDrop doesn't count late records. They are counted in RecordStats.Late and RecordStats.Ignored only
+	LateDataDrop = "drop"
+)
+
+// ValidateLateData checks that policy is one of LateData constants or empty
+func ValidateLateData(policy string) error {
+	switch policy {
+	case "", LateDataInsert, LateDataMerge, LateDataDelta, LateDataDrop:
+		return nil
+	}
+	return fmt.Errorf("unknown late data policy %s", policy)
+}
+
+// SetClosedBefore marks hours before t as flushed by earlier runs, e.g. as saved in server state
+func (usages *UsagesCollection) SetClosedBefore(t time.Time) {
+	if !t.IsZero() {
+		atomic.StoreInt64(&usages.closedBefore, t.UnixNano())
+	}
+}
+
+// CloseHours marks hours before the hour of the newest counted record as flushed and returns the start of
+// the first open hour. It is called once consumptions are saved, records of closed hours added later are late.
+// Hours after the current one are never closed, so that a single record with future time doesn't make
+// records of the following hours late
+func (usages *UsagesCollection) CloseHours() time.Time {
+	return usages.closeHours(time.Now())
+}
+
+func (usages *UsagesCollection) closeHours(now time.Time) time.Time {
+	newest := atomic.LoadInt64(&usages.newestHour)
+	if current := getHour(now.UTC()).UnixNano(); newest > current {
+		newest = current
+	}
+	storeMax(&usages.closedBefore, newest)
+	return usages.ClosedBefore()
+}
+
+// ClosedBefore returns the start of the first hour that is not flushed yet. Zero time if no hours are closed
+func (usages *UsagesCollection) ClosedBefore() time.Time {
+	closed := atomic.LoadInt64(&usages.closedBefore)
+	if closed == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, closed).UTC()
+}
+
+// isLate returns true if the hour is closed. Otherwise the hour is remembered if it is the newest one
+func (usages *UsagesCollection) isLate(hour time.Time) bool {
+	nanos := hour.UnixNano()
+	if nanos < atomic.LoadInt64(&usages.closedBefore) {
+		return true
+	}
+	storeMax(&usages.newestHour, nanos)
+	return false
+}
+
+// storeMax atomically replaces value at addr with the given one if it is greater
+func storeMax(addr *int64, value int64) {
+	for {
+		current := atomic.LoadInt64(addr)
+		if value <= current || atomic.CompareAndSwapInt64(addr, current, value) {
+			return
+		}
+	}
+}
+
+// splitLate separates records of closed hours, so that they are merged into hour rows. Late flag of
+// their copies is cleared, since merged rows also contain records that were on time
+func splitLate(consumptions map[int][]*ConsumptionRecord) (current, late map[int][]*ConsumptionRecord) {
+	current, late = map[int][]*ConsumptionRecord{}, map[int][]*ConsumptionRecord{}
+	for id, records := range consumptions {
+		for _, record := range records {
+			if !record.Late {
+				current[id] = append(current[id], record)
+				continue
+			}
+			merged := record.clone()
+			merged.Late = false
+			late[id] = append(late[id], merged)
+		}
+	}
+	return current, late
+}
@@ -0,0 +1,75 @@
+package consumptions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+	"github.com/alexanderromanov/nginx-logparser/websites"
+)
+
+func TestLateData(t *testing.T) {
+	hour := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		policy          string
+		expectedRecords int
+		expectedLate    int
+		expectedIgnored int64
+	}{
+		{policy: "", expectedRecords: 2},
+		{policy: LateDataInsert, expectedRecords: 2},
+		{policy: LateDataMerge, expectedRecords: 2, expectedLate: 1},
+		{policy: LateDataDelta, expectedRecords: 2, expectedLate: 1},
+		{policy: LateDataDrop, expectedRecords: 1, expectedIgnored: 1},
+	}
+
+	for _, test := range tests {
+		t.Run("policy "+test.policy, func(t *testing.T) {
+			usages := NewUsagesCollection(websites.Domains{"example.com": {ID: 1}}, UsagesSettings{LateData: test.policy})
+			usages.SetClosedBefore(hour.Add(time.Hour))
+			usages.AddRecord(&logsreader.LogRecord{Time: hour.Add(time.Minute), Domain: "example.com", Size: 10})
+			usages.AddRecord(&logsreader.LogRecord{Time: hour.Add(time.Hour + time.Minute), Domain: "example.com", Size: 10})
+
+			records := usages.GetTrafficConsumption()[1]
+			late := 0
+			for _, record := range records {
+				if record.Late {
+					late++
+				}
+			}
+			if len(records) != test.expectedRecords || late != test.expectedLate {
+				t.Errorf("%d records with %d late ones, want %d records with %d late ones", len(records), late, test.expectedRecords, test.expectedLate)
+			}
+			if stats := usages.Stats(); stats.Late != 1 || stats.Ignored != test.expectedIgnored {
+				t.Errorf("%d late and %d ignored records, want 1 late and %d ignored", stats.Late, stats.Ignored, test.expectedIgnored)
+			}
+		})
+	}
+}
+
+func TestCloseHours(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		records  []time.Time
+		expected time.Time
+	}{
+		{name: "no records", expected: time.Time{}},
+		{name: "hours before the newest one", records: []time.Time{now.Add(-3 * time.Hour), now.Add(-time.Hour)}, expected: now.Add(-90 * time.Minute)},
+		{name: "future record", records: []time.Time{now.Add(-time.Hour), now.Add(5 * time.Hour)}, expected: now.Add(-30 * time.Minute)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usages := NewUsagesCollection(websites.Domains{"example.com": {ID: 1}}, UsagesSettings{})
+			for _, recordTime := range test.records {
+				usages.AddRecord(&logsreader.LogRecord{Time: recordTime, Domain: "example.com", Size: 10})
+			}
+			if actual := usages.closeHours(now); !actual.Equal(test.expected) {
+				t.Errorf("closed before %v, want %v", actual, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package consumptions
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	defaultMySQLTable = "consumptions"
+
+	// mysqlBatchSize limits number of rows of single INSERT statement
+	mysqlBatchSize = 500
+
+	// mysqlSavesSuffix names the table of saves written to the consumptions table
+	mysqlSavesSuffix = "_saves"
+
+	// mysqlDuplicateEntry is the error number of unique key violation
+	mysqlDuplicateEntry = 1062
+)
+
+var mysqlTableName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// mysqlColumns are counters accumulated on duplicate key. Key columns are website_id, domain, port and hour
+var mysqlColumns = []string{
+	"files", "files_count", "dynamic", "dynamic_count", "other", "other_count",
+	"probe", "probe_count", "upload_bytes", "billable_bytes", "slow_count", "range_requests", "expensive_count",
+	"client_closed_count",
+}
+
+// MySQLSettings describe MySQL or MariaDB database hourly consumptions are written to. The table must
+// have unique key of website_id, domain, port and hour columns, port is zero for standard ports. Saves are recorded
+// in the table with _saves suffix:
+//
+//	CREATE TABLE consumptions (
+//	    website_id INT NOT NULL, account_id INT NOT NULL, domain VARCHAR(255) NOT NULL, port INT NOT NULL DEFAULT 0,
+//	    hour DATETIME NOT NULL,
+//	    files BIGINT NOT NULL, files_count BIGINT NOT NULL, dynamic BIGINT NOT NULL, dynamic_count BIGINT NOT NULL,
+//	    other BIGINT NOT NULL, other_count BIGINT NOT NULL, probe BIGINT NOT NULL, probe_count BIGINT NOT NULL,
+//	    upload_bytes BIGINT NOT NULL, billable_bytes BIGINT NOT NULL, slow_count BIGINT NOT NULL,
+//	    range_requests BIGINT NOT NULL, expensive_count BIGINT NOT NULL, client_closed_count BIGINT NOT NULL,
+//	    PRIMARY KEY (website_id, domain, port, hour))
+//	CREATE TABLE consumptions_saves (
+//	    server VARCHAR(255) NOT NULL, save_id VARCHAR(64) NOT NULL, saved DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+//	    PRIMARY KEY (server, save_id))
+type MySQLSettings struct {
+	// DSN is the data source name, e.g. user:password@tcp(host:3306)/billing. Consumptions are not written if it is empty
+	DSN string
+
+	// Table consumptions are written to. defaultMySQLTable is used if it is empty
+	Table string
+}
+
+var (
+	mysqlSync      sync.Mutex
+	mysqlDatabases = map[string]*sql.DB{}
+)
+
+// ValidateMySQLTable checks that table name can be used in statements without quoting issues
+func ValidateMySQLTable(table string) error {
+	if table != "" && !mysqlTableName.MatchString(table) {
+		return fmt.Errorf("invalid mysql table name %q", table)
+	}
+	return nil
+}
+
+// SaveConsumptionsToMySQL adds consumptions to hourly rows of MySQL table. All records are written in single
+// transaction together with the row of saveID, so that failed save can be repeated without double counting
+// and save of the same records that is already committed is skipped
+func SaveConsumptionsToMySQL(ctx context.Context, settings MySQLSettings, consumptions WebsiteConsumptions, serverName, saveID string) error {
+	return sinkError("mysql", saveConsumptionsToMySQL(ctx, settings, consumptions, serverName, saveID))
+}
+
+func saveConsumptionsToMySQL(ctx context.Context, settings MySQLSettings, consumptions WebsiteConsumptions, serverName, saveID string) error {
+	ctx, span := tracer.Start(ctx, "SaveConsumptionsToMySQL")
+	defer span.End()
+	span.SetAttributes(attribute.String("server", serverName))
+
+	table := settings.Table
+	if table == "" {
+		table = defaultMySQLTable
+	}
+	db, err := openMySQL(settings.DSN)
+	if err != nil {
+		return err
+	}
+
+	var records []*ConsumptionRecord
+	for _, websiteRecords := range consumptions {
+		records = append(records, websiteRecords...)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cannot start mysql transaction: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, buildMySQLSaveInsert(table), serverName, saveID)
+	if isDuplicateEntry(err) {
+		tx.Rollback()
+		span.SetAttributes(attribute.Bool("skipped", true))
+		return nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("cannot record save %s in mysql table %s%s: %v", saveID, table, mysqlSavesSuffix, err)
+	}
+	for start := 0; start < len(records); start += mysqlBatchSize {
+		end := start + mysqlBatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		query, args := buildMySQLUpsert(table, records[start:end])
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("cannot upsert consumptions to mysql table %s: %w", table, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("cannot commit consumptions to mysql table %s: %w", table, err)
+	}
+	span.SetAttributes(attribute.Int("rows", len(records)))
+	return nil
+}
+
+// buildMySQLUpsert returns INSERT ... ON DUPLICATE KEY UPDATE statement adding counters of records to existing rows
+func buildMySQLUpsert(table string, records []*ConsumptionRecord) (string, []interface{}) {
+	columns := append([]string{"website_id", "account_id", "domain", "port", "hour"}, mysqlColumns...)
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+
+	var query strings.Builder
+	fmt.Fprintf(&query, "INSERT INTO %s (%s) VALUES ", table, strings.Join(columns, ","))
+	args := make([]interface{}, 0, len(records)*len(columns))
+	for i, record := range records {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		query.WriteString(placeholders)
+		args = append(args, record.WebsiteID, record.AccountID, record.Domain, record.Port, record.Time.UTC(),
+			record.Files, record.FilesCount, record.Dynamic, record.DynamicCount, record.Other, record.OtherCount,
+			record.Probe, record.ProbeCount, record.UploadBytes, record.BillableBytes, record.SlowCount, record.RangeRequests,
+			record.ExpensiveCount, record.ClientClosedCount)
+	}
+
+	query.WriteString(" ON DUPLICATE KEY UPDATE ")
+	for i, column := range mysqlColumns {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		fmt.Fprintf(&query, "%s=%s+VALUES(%s)", column, column, column)
+	}
+	return query.String(), args
+}
+
+// buildMySQLSaveInsert returns INSERT statement recording the save of the server in the table of saves
+func buildMySQLSaveInsert(table string) string {
+	return fmt.Sprintf("INSERT INTO %s%s (server,save_id) VALUES (?,?)", table, mysqlSavesSuffix)
+}
+
+// isDuplicateEntry checks whether err is unique key violation
+func isDuplicateEntry(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == mysqlDuplicateEntry
+}
+
+// openMySQL returns connection pool of the database. Pools are shared by all servers
+func openMySQL(dsn string) (*sql.DB, error) {
+	mysqlSync.Lock()
+	defer mysqlSync.Unlock()
+
+	if db, ok := mysqlDatabases[dsn]; ok {
+		return db, nil
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open mysql database: %w", err)
+	}
+	mysqlDatabases[dsn] = db
+	return db, nil
+}
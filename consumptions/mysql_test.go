@@ -0,0 +1,81 @@
+package consumptions
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestBuildMySQLUpsert(t *testing.T) {
+	hour := time.Date(2020, 1, 1, 10, 0, 0, 0, time.FixedZone("UTC+3", 3*60*60))
+	record := &ConsumptionRecord{WebsiteID: 1, AccountID: 2, Domain: "example.com", Time: hour, Files: 100, FilesCount: 1}
+
+	const columns = "(website_id,account_id,domain,port,hour,files,files_count,dynamic,dynamic_count,other,other_count," +
+		"probe,probe_count,upload_bytes,billable_bytes,slow_count,range_requests,expensive_count,client_closed_count)"
+	const values = "(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
+	const update = " ON DUPLICATE KEY UPDATE files=files+VALUES(files),files_count=files_count+VALUES(files_count)," +
+		"dynamic=dynamic+VALUES(dynamic),dynamic_count=dynamic_count+VALUES(dynamic_count),other=other+VALUES(other)," +
+		"other_count=other_count+VALUES(other_count),probe=probe+VALUES(probe),probe_count=probe_count+VALUES(probe_count)," +
+		"upload_bytes=upload_bytes+VALUES(upload_bytes),billable_bytes=billable_bytes+VALUES(billable_bytes)," +
+		"slow_count=slow_count+VALUES(slow_count),range_requests=range_requests+VALUES(range_requests)," +
+		"expensive_count=expensive_count+VALUES(expensive_count),client_closed_count=client_closed_count+VALUES(client_closed_count)"
+
+	tests := []struct {
+		name          string
+		records       []*ConsumptionRecord
+		expectedQuery string
+		expectedArgs  int
+	}{
+		{
+			name:          "single row",
+			records:       []*ConsumptionRecord{record},
+			expectedQuery: "INSERT INTO consumptions " + columns + " VALUES " + values + update,
+			expectedArgs:  19,
+		},
+		{
+			name:          "several rows",
+			records:       []*ConsumptionRecord{record, record},
+			expectedQuery: "INSERT INTO consumptions " + columns + " VALUES " + values + "," + values + update,
+			expectedArgs:  38,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, args := buildMySQLUpsert("consumptions", test.records)
+			if query != test.expectedQuery {
+				t.Errorf("query\n%s\nwant\n%s", query, test.expectedQuery)
+			}
+			if len(args) != test.expectedArgs {
+				t.Fatalf("%d args, want %d", len(args), test.expectedArgs)
+			}
+			if args[4] != hour.UTC() {
+				t.Errorf("hour %v, want %v", args[4], hour.UTC())
+			}
+		})
+	}
+}
+
+func TestMySQLSaves(t *testing.T) {
+	if query := buildMySQLSaveInsert("consumptions"); query != "INSERT INTO consumptions_saves (server,save_id) VALUES (?,?)" {
+		t.Errorf("unexpected query of saves %s", query)
+	}
+
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "no error", err: nil, expected: false},
+		{name: "duplicate entry", err: &mysql.MySQLError{Number: 1062}, expected: true},
+		{name: "another mysql error", err: &mysql.MySQLError{Number: 1146}, expected: false},
+		{name: "connection error", err: errors.New("connection refused"), expected: false},
+	}
+	for _, test := range tests {
+		if actual := isDuplicateEntry(test.err); actual != test.expected {
+			t.Errorf("%s: isDuplicateEntry() = %v, want %v", test.name, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package consumptions
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// odataTypeSuffix marks annotation of the property type written next to the property
+const odataTypeSuffix = "@odata.type"
+
+var columnName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,254}$`)
+
+// ColumnMap selects fields of consumption records written to tables and maps them to column names,
+// e.g. {"Time": "", "Files": "F"}. Fields missing in the map are not written, empty column name keeps
+// the field name. All fields are written with their names if the map is empty
+type ColumnMap map[string]string
+
+// ValidateColumns checks that columns refer to known fields, include Time rows are read back by,
+// and map them to distinct valid property names
+func ValidateColumns(columns ColumnMap) error {
+	if len(columns) == 0 {
+		return nil
+	}
+	if _, ok := columns["Time"]; !ok {
+		return fmt.Errorf("column of Time field is required")
+	}
+
+	known := consumptionFieldNames()
+	used := map[string]string{}
+	for field := range columns {
+		if !known[field] {
+			return fmt.Errorf("unknown consumption field %s", field)
+		}
+		column := columns.column(field)
+		if !columnName.MatchString(column) {
+			return fmt.Errorf("invalid column name %q of field %s", column, field)
+		}
+		if other, ok := used[column]; ok {
+			return fmt.Errorf("fields %s and %s are written to the same column %s", other, field, column)
+		}
+		used[column] = field
+	}
+	return nil
+}
+
+// consumptionFieldNames returns names of all fields consumptionFields can write. Optional fields are
+// written only if they are set, so they are set in the sample record
+func consumptionFieldNames() map[string]bool {
+	sample := &ConsumptionRecord{Plan: "-", Domain: "-", Port: 1, Late: true, Minutes: make([]int, MinutesInHour), BusyMillis: make([]int, MinutesInHour)}
+	result := map[string]bool{}
+	for name := range consumptionFields(sample) {
+		if !strings.HasSuffix(name, odataTypeSuffix) {
+			result[name] = true
+		}
+	}
+	return result
+}
+
+func (columns ColumnMap) column(field string) string {
+	if column := columns[field]; column != "" {
+		return column
+	}
+	return field
+}
+
+// project returns fields written to table. Type annotations follow their properties
+func (columns ColumnMap) project(fields map[string]interface{}) map[string]interface{} {
+	if len(columns) == 0 {
+		return fields
+	}
+	result := make(map[string]interface{}, len(columns))
+	for name, value := range fields {
+		field := strings.TrimSuffix(name, odataTypeSuffix)
+		if _, ok := columns[field]; ok {
+			result[columns.column(field)+name[len(field):]] = value
+		}
+	}
+	return result
+}
+
+// unproject is the reverse of project. Columns that don't belong to any field are dropped
+func (columns ColumnMap) unproject(fields map[string]interface{}) map[string]interface{} {
+	if len(columns) == 0 {
+		return fields
+	}
+	result := make(map[string]interface{}, len(columns))
+	for field := range columns {
+		column := columns.column(field)
+		if value, ok := fields[column]; ok {
+			result[field] = value
+		}
+		if value, ok := fields[column+odataTypeSuffix]; ok {
+			result[field+odataTypeSuffix] = value
+		}
+	}
+	return result
+}
@@ -0,0 +1,76 @@
+package consumptions
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestColumnMapRoundTrip(t *testing.T) {
+	hour := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	record := &ConsumptionRecord{Time: hour, Files: 100, FilesCount: 2, Dynamic: 50, DynamicCount: 1, Plan: "basic", Domain: "example.com", Port: 8443}
+
+	tests := []struct {
+		name            string
+		columns         ColumnMap
+		expectedColumns []string
+		expected        *ConsumptionRecord
+	}{
+		{
+			name:     "all fields",
+			columns:  nil,
+			expected: record,
+		},
+		{
+			name:            "renamed fields",
+			columns:         ColumnMap{"Time": "T", "Files": "F", "Domain": ""},
+			expectedColumns: []string{"Domain", "F", "T"},
+			expected:        &ConsumptionRecord{Time: hour, Files: 100, Domain: "example.com"},
+		},
+		{
+			name:            "time only",
+			columns:         ColumnMap{"Time": ""},
+			expectedColumns: []string{"Time"},
+			expected:        &ConsumptionRecord{Time: hour},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			projected := test.columns.project(consumptionFields(record))
+			if test.expectedColumns != nil {
+				var columns []string
+				for column := range projected {
+					columns = append(columns, column)
+				}
+				sort.Strings(columns)
+				if !reflect.DeepEqual(columns, test.expectedColumns) {
+					t.Errorf("columns %v, want %v", columns, test.expectedColumns)
+				}
+			}
+
+			// values are read back from the table service as JSON
+			data, err := json.Marshal(projected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			var stored map[string]interface{}
+			if err := decoder.Decode(&stored); err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := consumptionFromFields(test.columns.unproject(stored))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("record %+v, want %+v", actual, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package consumptions
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/azure-storage"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// maxReferrerHosts limits number of distinct referrer hosts counted per website and day
+	maxReferrerHosts = 1000
+
+	// otherReferrers collects hits of hosts over maxReferrerHosts
+	otherReferrers = "(other)"
+)
+
+// ReferrerRecord is the number of requests and bytes of the website referred by the host during the day
+type ReferrerRecord struct {
+	WebsiteID int
+	Day       time.Time
+	Host      string
+	Hits      int
+	Bytes     int64
+}
+
+type referrerKey struct {
+	websiteID int
+	day       int64
+}
+
+// referrers counts requests of websites by referrer host and day
+type referrers struct {
+	sync.Mutex
+	hosts map[referrerKey]map[string]*ReferrerRecord
+}
+
+func newReferrers() *referrers {
+	return &referrers{hosts: map[referrerKey]map[string]*ReferrerRecord{}}
+}
+
+// swap replaces collected hosts with empty ones and returns the collected hosts
+func (r *referrers) swap() *referrers {
+	r.Lock()
+	defer r.Unlock()
+	collected := &referrers{hosts: r.hosts}
+	r.hosts = map[referrerKey]map[string]*ReferrerRecord{}
+	return collected
+}
+
+// add counts request of the website referred by referrer URL. Direct requests and referrals from
+// the requested domain itself are not counted
+func (r *referrers) add(websiteID int, t time.Time, referrer, domain string, bytes int64) {
+	host := referrerHost(referrer)
+	if host == "" || host == domain {
+		return
+	}
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	key := referrerKey{websiteID: websiteID, day: day.Unix()}
+
+	r.Lock()
+	defer r.Unlock()
+	hosts, ok := r.hosts[key]
+	if !ok {
+		hosts = map[string]*ReferrerRecord{}
+		r.hosts[key] = hosts
+	}
+	record, ok := hosts[host]
+	if !ok {
+		if len(hosts) >= maxReferrerHosts {
+			host = otherReferrers
+			record = hosts[host]
+		}
+		if record == nil {
+			record = &ReferrerRecord{WebsiteID: websiteID, Day: day, Host: host}
+			hosts[host] = record
+		}
+	}
+	record.Hits++
+	record.Bytes += bytes
+}
+
+// records returns copies of referrer hosts counted for every website and day
+func (r *referrers) records() []*ReferrerRecord {
+	r.Lock()
+	defer r.Unlock()
+
+	var result []*ReferrerRecord
+	for _, hosts := range r.hosts {
+		for _, record := range hosts {
+			copied := *record
+			result = append(result, &copied)
+		}
+	}
+	return result
+}
+
+// topReferrers sorts records by hits and returns size records with the most hits
+func topReferrers(records []*ReferrerRecord, size int) []*ReferrerRecord {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Hits != records[j].Hits {
+			return records[i].Hits > records[j].Hits
+		}
+		return records[i].Host < records[j].Host
+	})
+	if len(records) > size {
+		records = records[:size]
+	}
+	return records
+}
+
+// referrerHost returns lower-cased host name of referrer URL. It is empty for "-" and invalid URLs
+func referrerHost(referrer string) string {
+	if referrer == "" || referrer == "-" {
+		return ""
+	}
+	parsed, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+// referrerRowKey returns row key of the host's row of the day. Characters not allowed in table keys
+// are replaced, so hosts differing only in them share the row
+func referrerRowKey(day time.Time, host string) string {
+	host = strings.Map(func(r rune) rune {
+		if r < 0x20 || (r >= 0x7f && r <= 0x9f) {
+			return '_'
+		}
+		return r
+	}, keyReplacer.Replace(host))
+	return day.Format("20060102") + "-" + host
+}
+
+// SaveReferrers adds hits and bytes of records to monthly tables of settings.ReferrerTableNameTemplate. Every
+// website, day and host has a single row, which counters are read, increased and written back, so that hosts
+// are ranked by their total over all servers and runs
+func SaveReferrers(ctx context.Context, settings AzureStorageSettings, records []*ReferrerRecord, serverName string) (SaveStats, error) {
+	ctx, span := tracer.Start(ctx, "SaveReferrers")
+	defer span.End()
+	span.SetAttributes(attribute.String("server", serverName), attribute.Int("records", len(records)))
+
+	var stats SaveStats
+	storageClient, err := settings.Client()
+	if err != nil {
+		return stats, sinkError("azure", err)
+	}
+	client := storageClient.GetTableService()
+
+	limiter := newAdaptiveLimiter()
+	var failures firstError
+	var wg sync.WaitGroup
+	for _, record := range records {
+		table := getOrCreateUsageTable(ctx, client, settings.AccountName, settings.ReferrerTableNameTemplate, record.Day)
+		wg.Add(1)
+		go func(record *ReferrerRecord) {
+			defer wg.Done()
+			err := limiter.do(ctx, func() error {
+				return accumulateReferrer(ctx, client, table, record)
+			})
+			atomic.AddInt64(&stats.Entities, 1)
+			atomic.AddInt64(&stats.Batches, 1)
+			if err != nil {
+				atomic.AddInt64(&stats.FailedBatches, 1)
+				failures.set(err)
+			}
+		}(record)
+	}
+	wg.Wait()
+	return stats, sinkError("azure", failures.get())
+}
+
+// accumulateReferrer adds counters of the record to its row. The whole operation is retried if the row
+// was concurrently created or modified
+func accumulateReferrer(ctx context.Context, client storage.TableServiceClient, table storage.AzureTable, record *ReferrerRecord) error {
+	partitionKey := strconv.Itoa(record.WebsiteID)
+	rowKey := referrerRowKey(record.Day, record.Host)
+	for attempt := 0; attempt < maxAccumulateAttempts; attempt++ {
+		existing, err := client.GetEntity(ctx, table, partitionKey, rowKey)
+		if isThrottled(err) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read %s/%s of %s: %w", partitionKey, rowKey, table, err)
+		}
+
+		if existing == nil {
+			entity := storage.TableEntity{PartitionKey: partitionKey, RowKey: rowKey, Fields: referrerFields(record)}
+			err = client.InsertEntity(ctx, table, entity)
+		} else {
+			var total *ReferrerRecord
+			total, err = referrerFromFields(existing.Fields)
+			if err != nil {
+				return fmt.Errorf("cannot read entity %s/%s of %s: %v", partitionKey, rowKey, table, err)
+			}
+			total.Hits += record.Hits
+			total.Bytes += record.Bytes
+
+			existing.Fields = referrerFields(total)
+			err = client.UpdateEntity(ctx, table, *existing)
+		}
+
+		if err == nil {
+			return nil
+		}
+		if isThrottled(err) {
+			return err
+		}
+		if !storage.IsConflict(err) {
+			return fmt.Errorf("cannot save %s/%s to %s: %w", partitionKey, rowKey, table, err)
+		}
+	}
+	return fmt.Errorf("cannot save %s/%s to %s: row is modified concurrently", partitionKey, rowKey, table)
+}
+
+// LoadTopReferrers returns size referrer hosts with the most hits of the website during the day
+func LoadTopReferrers(ctx context.Context, settings AzureStorageSettings, websiteID int, day time.Time, size int) ([]*ReferrerRecord, error) {
+	storageClient, err := settings.Client()
+	if err != nil {
+		return nil, err
+	}
+	client := storageClient.GetTableService()
+
+	day = day.UTC()
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	table := storage.AzureTable(settings.ReferrerTableNameTemplate + day.Format("200601"))
+	// row keys of the day start with its date followed by "-", and "." is the next character
+	filter := fmt.Sprintf("PartitionKey eq '%d' and RowKey gt '%s-' and RowKey lt '%s.'", websiteID, day.Format("20060102"), day.Format("20060102"))
+	entities, err := client.QueryEntities(ctx, table, filter)
+	if err != nil {
+		if serviceErr, ok := err.(storage.AzureStorageServiceError); ok && serviceErr.Code == tableNotFoundCode {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot query %s: %v", table, err)
+	}
+
+	records := make([]*ReferrerRecord, 0, len(entities))
+	for _, entity := range entities {
+		record, err := referrerFromFields(entity.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read entity %s of %s: %v", entity.RowKey, table, err)
+		}
+		record.WebsiteID = websiteID
+		records = append(records, record)
+	}
+	return topReferrers(records, size), nil
+}
+
+func referrerFields(record *ReferrerRecord) map[string]interface{} {
+	return map[string]interface{}{
+		"Day":   record.Day.Unix(),
+		"Host":  record.Host,
+		"Hits":  record.Hits,
+		"Bytes": record.Bytes,
+	}
+}
+
+// referrerFromFields is the reverse of referrerFields
+func referrerFromFields(fields map[string]interface{}) (*ReferrerRecord, error) {
+	record := &ReferrerRecord{}
+	if host, ok := fields["Host"].(string); ok {
+		record.Host = host
+	}
+	day, err := fieldToInt64(fields["Day"])
+	if err != nil {
+		return nil, fmt.Errorf("field Day: %v", err)
+	}
+	record.Day = time.Unix(day, 0).UTC()
+	hits, err := fieldToInt64(fields["Hits"])
+	if err != nil {
+		return nil, fmt.Errorf("field Hits: %v", err)
+	}
+	record.Hits = int(hits)
+	if record.Bytes, err = fieldToInt64(fields["Bytes"]); err != nil {
+		return nil, fmt.Errorf("field Bytes: %v", err)
+	}
+	return record, nil
+}
@@ -0,0 +1,49 @@
+package consumptions
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReferrers(t *testing.T) {
+	hour := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	r := newReferrers()
+	r.add(1, hour, "https://Search.example/?q=a", "example.com", 100)
+	r.add(1, hour.Add(time.Hour), "https://search.example/", "example.com", 50)
+	r.add(1, hour, "http://blog.example/post", "example.com", 10)
+	r.add(1, hour, "https://example.com/page", "example.com", 10)
+	r.add(1, hour, "-", "example.com", 10)
+	r.add(2, hour, "http://blog.example/post", "example.org", 10)
+
+	var hosts []string
+	for _, record := range topReferrers(r.records(), 10) {
+		hosts = append(hosts, record.Host)
+	}
+	if expected := []string{"search.example", "blog.example", "blog.example"}; !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("hosts %v, want %v", hosts, expected)
+	}
+
+	top := topReferrers(r.records(), 1)
+	if len(top) != 1 || top[0].Hits != 2 || top[0].Bytes != 150 {
+		t.Errorf("top referrer %+v, want 2 hits and 150 bytes of search.example", top[0])
+	}
+}
+
+func TestReferrerRowKey(t *testing.T) {
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{host: "search.example", expected: "20200101-search.example"},
+		{host: "a/b\\c#d?e", expected: "20200101-a_b_c_d_e"},
+		{host: "bad\x01host\x7f", expected: "20200101-bad_host_"},
+		{host: otherReferrers, expected: "20200101-(other)"},
+	}
+	for _, test := range tests {
+		if actual := referrerRowKey(day, test.host); actual != test.expected {
+			t.Errorf("referrerRowKey(%q) = %q, want %q", test.host, actual, test.expected)
+		}
+	}
+}
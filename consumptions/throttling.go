@@ -0,0 +1,103 @@
+package consumptions
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/azure-storage"
+)
+
+const (
+	// maxConcurrentBatches is the number of batches saved concurrently while storage doesn't throttle
+	maxConcurrentBatches = 18
+
+	maxThrottledAttempts     = 6
+	defaultThrottleRetryWait = time.Second
+)
+
+// adaptiveLimiter limits number of concurrent requests to storage. The limit is halved every time
+// storage throttles requests and grows back by one with every successful request
+type adaptiveLimiter struct {
+	sync.Mutex
+	cond        *sync.Cond
+	limit       int
+	inFlight    int
+	pausedUntil time.Time
+}
+
+func newAdaptiveLimiter() *adaptiveLimiter {
+	limiter := &adaptiveLimiter{limit: maxConcurrentBatches}
+	limiter.cond = sync.NewCond(limiter)
+	return limiter
+}
+
+// do runs request within the limit. Throttled requests are retried after the delay requested by storage
+func (l *adaptiveLimiter) do(ctx context.Context, request func() error) error {
+	wait := defaultThrottleRetryWait
+	for attempt := 1; ; attempt++ {
+		l.acquire(ctx)
+		err := request()
+		throttled, ok := err.(storage.ThrottledError)
+		l.release(ok, throttled.RetryAfter)
+
+		if !ok || attempt == maxThrottledAttempts || ctx.Err() != nil {
+			return err
+		}
+		if throttled.RetryAfter == 0 {
+			l.pause(wait)
+			wait *= 2
+		}
+	}
+}
+
+// isThrottled returns true for errors that are retried by adaptiveLimiter. They must not be wrapped
+func isThrottled(err error) bool {
+	_, ok := err.(storage.ThrottledError)
+	return ok
+}
+
+func (l *adaptiveLimiter) acquire(ctx context.Context) {
+	l.Lock()
+	for l.inFlight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inFlight++
+	pause := time.Until(l.pausedUntil)
+	l.Unlock()
+
+	if pause > 0 {
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (l *adaptiveLimiter) release(throttled bool, retryAfter time.Duration) {
+	l.Lock()
+	l.inFlight--
+	if throttled {
+		l.limit = l.limit / 2
+		if l.limit < 1 {
+			l.limit = 1
+		}
+		l.pauseLocked(retryAfter)
+	} else if l.limit < maxConcurrentBatches {
+		l.limit++
+	}
+	l.Unlock()
+	l.cond.Broadcast()
+}
+
+func (l *adaptiveLimiter) pause(d time.Duration) {
+	l.Lock()
+	l.pauseLocked(d)
+	l.Unlock()
+}
+
+func (l *adaptiveLimiter) pauseLocked(d time.Duration) {
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
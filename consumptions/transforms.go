@@ -0,0 +1,139 @@
+package consumptions
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Transform modifies consumption records of a single website (or account) before they are saved
+type Transform func(records []*ConsumptionRecord) []*ConsumptionRecord
+
+// TransformFactory creates Transform from parameters specified in settings
+type TransformFactory func(params map[string]float64) (Transform, error)
+
+// TransformSettings describes named transform and its parameters
+type TransformSettings struct {
+	Name   string
+	Params map[string]float64
+}
+
+var transformFactories = map[string]TransformFactory{
+	"mergeTiny": newMergeTinyTransform,
+	"overhead":  newOverheadTransform,
+	"units":     newUnitsTransform,
+}
+
+// RegisterTransform makes transform available in settings under given name
+func RegisterTransform(name string, factory TransformFactory) {
+	transformFactories[name] = factory
+}
+
+// BuildTransforms creates transforms listed in settings preserving their order
+func BuildTransforms(settings []TransformSettings) ([]Transform, error) {
+	result := make([]Transform, len(settings))
+	for i, s := range settings {
+		factory, ok := transformFactories[s.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %s", s.Name)
+		}
+
+		transform, err := factory(s.Params)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create transform %s: %v", s.Name, err)
+		}
+		result[i] = transform
+	}
+	return result, nil
+}
+
+// ApplyTransforms runs transforms over records of every website in order
+func ApplyTransforms(consumptions map[int][]*ConsumptionRecord, transforms []Transform) {
+	for id, records := range consumptions {
+		for _, transform := range transforms {
+			records = transform(records)
+		}
+		consumptions[id] = records
+	}
+}
+
+// newMergeTinyTransform merges buckets with less than minBytes of traffic into the largest bucket of the website
+// with the same hour, port and Late flag. Buckets are never merged across hours, so traffic stays in the hour and
+// the monthly table it was served in, nor across ports, so traffic of alternate ports stays separate, nor between
+// late and on-time buckets, which are saved differently. Tiny buckets of an hour without larger ones are merged together
+func newMergeTinyTransform(params map[string]float64) (Transform, error) {
+	minBytes, ok := params["minBytes"]
+	if !ok {
+		return nil, fmt.Errorf("minBytes parameter is required")
+	}
+
+	return func(records []*ConsumptionRecord) []*ConsumptionRecord {
+		// the largest bucket of the hour, port and Late flag comes first
+		sort.SliceStable(records, func(i, j int) bool {
+			if !records[i].Time.Equal(records[j].Time) {
+				return records[i].Time.Before(records[j].Time)
+			}
+			if records[i].Port != records[j].Port {
+				return records[i].Port < records[j].Port
+			}
+			if records[i].Late != records[j].Late {
+				return !records[i].Late
+			}
+			return records[i].totalBytes() > records[j].totalBytes()
+		})
+
+		result := make([]*ConsumptionRecord, 0, len(records))
+		var largest *ConsumptionRecord
+		for _, record := range records {
+			if largest != nil && largest.Time.Equal(record.Time) && largest.Port == record.Port && largest.Late == record.Late {
+				if float64(record.totalBytes()) < minBytes {
+					largest.add(record)
+					continue
+				}
+			} else {
+				largest = record
+			}
+			result = append(result, record)
+		}
+		return result
+	}, nil
+}
+
+// newOverheadTransform multiplies traffic by factor to account for TCP/TLS framing
+func newOverheadTransform(params map[string]float64) (Transform, error) {
+	factor, ok := params["factor"]
+	if !ok || factor <= 0 {
+		return nil, fmt.Errorf("positive factor parameter is required")
+	}
+
+	return scaleBytes(func(bytes int64) int64 {
+		return int64(math.Ceil(float64(bytes) * factor))
+	}), nil
+}
+
+// newUnitsTransform converts traffic from bytes to units of given size (e.g. 1024 for kilobytes)
+func newUnitsTransform(params map[string]float64) (Transform, error) {
+	divisor, ok := params["divisor"]
+	if !ok || divisor <= 0 {
+		return nil, fmt.Errorf("positive divisor parameter is required")
+	}
+
+	return scaleBytes(func(bytes int64) int64 {
+		return int64(math.Ceil(float64(bytes) / divisor))
+	}), nil
+}
+
+func scaleBytes(scale func(int64) int64) Transform {
+	return func(records []*ConsumptionRecord) []*ConsumptionRecord {
+		for _, record := range records {
+			record.Files = scale(record.Files)
+			record.Dynamic = scale(record.Dynamic)
+			record.Other = scale(record.Other)
+			record.UploadBytes = scale(record.UploadBytes)
+			record.weightedFiles = scale(record.weightedFiles)
+			record.weightedDynamic = scale(record.weightedDynamic)
+			record.weightedOther = scale(record.weightedOther)
+		}
+		return records
+	}
+}
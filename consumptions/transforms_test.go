@@ -0,0 +1,66 @@
+package consumptions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeTinyTransform(t *testing.T) {
+	hour := time.Date(2020, 1, 31, 23, 0, 0, 0, time.UTC)
+	nextHour := hour.Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		records  []*ConsumptionRecord
+		expected []int64
+	}{
+		{
+			name:     "tiny bucket is merged into the largest one of the hour",
+			records:  []*ConsumptionRecord{{Time: hour, Files: 10}, {Time: hour, Files: 500}, {Time: hour, Files: 200}},
+			expected: []int64{510, 200},
+		},
+		{
+			name:     "tiny buckets are not merged across hours and months",
+			records:  []*ConsumptionRecord{{Time: hour, Files: 10}, {Time: nextHour, Files: 500}},
+			expected: []int64{10, 500},
+		},
+		{
+			name:     "tiny buckets of the same hour are merged together",
+			records:  []*ConsumptionRecord{{Time: hour, Files: 10}, {Time: hour, Files: 20}, {Time: nextHour, Files: 30}},
+			expected: []int64{30, 30},
+		},
+		{
+			name:     "tiny buckets are not merged across ports",
+			records:  []*ConsumptionRecord{{Time: hour, Files: 500}, {Time: hour, Files: 10, Port: 8443}},
+			expected: []int64{500, 10},
+		},
+		{
+			name:     "late buckets are not merged into on-time ones",
+			records:  []*ConsumptionRecord{{Time: hour, Files: 10, Late: true}, {Time: hour, Files: 500}},
+			expected: []int64{500, 10},
+		},
+		{
+			name:     "large buckets are kept",
+			records:  []*ConsumptionRecord{{Time: hour, Files: 100}, {Time: hour, Dynamic: 100}},
+			expected: []int64{100, 100},
+		},
+	}
+
+	transform, err := newMergeTinyTransform(map[string]float64{"minBytes": 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := transform(test.records)
+			if len(result) != len(test.expected) {
+				t.Fatalf("expected %d records, got %d", len(test.expected), len(result))
+			}
+			for i, record := range result {
+				if record.totalBytes() != test.expected[i] {
+					t.Errorf("record %d: expected %d bytes, got %d", i, test.expected[i], record.totalBytes())
+				}
+			}
+		})
+	}
+}
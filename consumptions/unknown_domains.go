@@ -0,0 +1,88 @@
+package consumptions
+
+import (
+	"container/list"
+	"net"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// defaultMaxUnknownDomains limits number of unknown domains tracked by collection if UsagesSettings.MaxUnknownDomains is zero
+const defaultMaxUnknownDomains = 100000
+
+// unknownDomains counts requests of unknown domains. Only the most recently requested domains are kept,
+// so that random Host headers sent by scanners can't exhaust memory
+type unknownDomains struct {
+	maxSize int
+	order   *list.List
+	counts  map[string]*list.Element
+
+	// evicted is the number of domains dropped to keep the size limit
+	evicted int
+}
+
+type unknownDomain struct {
+	domain   string
+	requests int
+}
+
+func newUnknownDomains(maxSize int) *unknownDomains {
+	if maxSize <= 0 {
+		maxSize = defaultMaxUnknownDomains
+	}
+	return &unknownDomains{maxSize: maxSize, order: list.New(), counts: map[string]*list.Element{}}
+}
+
+func (u *unknownDomains) add(domain string, requests int) {
+	if element, ok := u.counts[domain]; ok {
+		element.Value.(*unknownDomain).requests += requests
+		u.order.MoveToFront(element)
+		return
+	}
+
+	u.counts[domain] = u.order.PushFront(&unknownDomain{domain: domain, requests: requests})
+	if u.order.Len() > u.maxSize {
+		oldest := u.order.Back()
+		u.order.Remove(oldest)
+		delete(u.counts, oldest.Value.(*unknownDomain).domain)
+		u.evicted++
+	}
+}
+
+func (u *unknownDomains) counters() []UnknownDomainsCounter {
+	result := make([]UnknownDomainsCounter, 0, u.order.Len())
+	for element := u.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*unknownDomain)
+		result = append(result, UnknownDomainsCounter{Domain: entry.domain, Requested: entry.requests})
+	}
+	return result
+}
+
+// registrableDomain returns domain collapsed to the registrable domain by public suffix list,
+// e.g. "random123.example.co.uk" to "example.co.uk". IP addresses and invalid domains are returned as is
+func registrableDomain(domain string) string {
+	if net.ParseIP(domain) != nil {
+		return domain
+	}
+	result, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return result
+}
+
+// isUnattributable returns true for Host values that cannot belong to any website: empty ones, nginx
+// placeholders and IP addresses with optional port
+func isUnattributable(domain string) bool {
+	switch domain {
+	case "", "-", "_":
+		return true
+	}
+	host := domain
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return net.ParseIP(host) != nil
+}
@@ -1,13 +1,19 @@
 package consumptions
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alexanderromanov/nginx-logparser/azure-storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // AzureStorageSettings contains information necessary to save consumption information into Azure Storage tables
@@ -15,46 +21,235 @@ type AzureStorageSettings struct {
 	AccountName       string
 	Key               string
 	TableNameTemplate string
+
+	// AccountTableNameTemplate is the template of tables with consumptions aggregated by account.
+	// Account consumptions are not saved if it is empty
+	AccountTableNameTemplate string
+
+	// ReferrerTableNameTemplate is the template of tables with daily hits of referrer hosts of websites.
+	// Referrers are saved to the main storage account only. They are not saved if it is empty
+	ReferrerTableNameTemplate string
+
+	// Routes direct consumptions of some websites to other storage accounts. The first matching
+	// route is used. Websites that don't match any route are saved to this storage account
+	Routes []StorageRoute
+
+	// BaseURL is the storage endpoint suffix. Endpoint of Cloud is used if it is empty
+	BaseURL string
+
+	// Cloud is the name of Azure cloud, e.g. storage.CloudChina. Public cloud is used if it is empty
+	Cloud string
+
+	// APIVersion of storage REST API. storage.DefaultAPIVersion is used if it is empty
+	APIVersion string
+
+	// HTTPClient sends requests to storage, e.g. through a proxy. Client with default storage.Timeouts is used if it is nil
+	HTTPClient *http.Client
+
+	// RequestTimeout limits every table request, see storage.Client.RequestTimeout
+	RequestTimeout time.Duration
+
+	// Accumulate keeps a single row per website-hour. Counters of the row are read, increased and written back
+	// with optimistic concurrency instead of inserting a new row for every run
+	Accumulate bool
+
+	// KeyStrategy is the name of strategy PartitionKey and RowKey of rows are generated with.
+	// KeyStrategyWebsite is used if it is empty
+	KeyStrategy string
+
+	// Pricing computes Cost of records loaded by LoadHistory. Cost is not computed if it has no plans
+	Pricing Pricing
+	// Columns select fields written to tables and their column names. All fields are written if it is empty
+	Columns ColumnMap
+
+	// LateData is the policy records of flushed hours are saved with. It has to match UsagesSettings.LateData
+	LateData string
+}
+
+// StorageRoute directs consumptions of websites to separate storage account
+type StorageRoute struct {
+	// MinWebsiteID and MaxWebsiteID specify inclusive range of routed website IDs.
+	// Zero MaxWebsiteID means that range is not bounded from above
+	MinWebsiteID int
+	MaxWebsiteID int
+
+	// Shard routes websites the provider has assigned this shard hint. ID range is ignored if it is set
+	Shard string
+
+	AccountName string
+	Key         string
+
+	// TableNameTemplate of the routed storage. Template of the default storage is used if it is empty
+	TableNameTemplate string
 }
 
 const (
 	maxBatchSize = 100
 )
 
-// SaveConsumptions saves report to azure storage table
-func SaveConsumptions(settings AzureStorageSettings, consumptions WebsiteConsumptions, serverName string) error {
-	storageClient, err := storage.NewBasicClient(settings.AccountName, settings.Key)
+// SaveStats contains statistics of saving consumptions to storage
+type SaveStats struct {
+	Entities      int64
+	Batches       int64
+	FailedBatches int64
+}
+
+// Add sums statistics of another save into stats
+func (stats *SaveStats) Add(other SaveStats) {
+	stats.Entities += other.Entities
+	stats.Batches += other.Batches
+	stats.FailedBatches += other.FailedBatches
+}
+
+var tracer = otel.Tracer("github.com/alexanderromanov/nginx-logparser/consumptions")
+
+// SaveConsumptions saves report to azure storage table. Records are split between storage accounts according to settings.Routes.
+// saveID identifies the data being saved, e.g. the position logs were read from. Rows of the same server and saveID
+// are replaced, so saving again after a failure overwrites batches that were saved the first time instead of duplicating them
+func SaveConsumptions(ctx context.Context, settings AzureStorageSettings, consumptions WebsiteConsumptions, serverName, saveID string) (SaveStats, error) {
+	type routedConsumptions struct {
+		settings    AzureStorageSettings
+		consumption WebsiteConsumptions
+	}
+
+	routed := map[string]*routedConsumptions{}
+	for websiteID, records := range consumptions {
+		if len(records) == 0 {
+			continue
+		}
+
+		storageSettings := settings.route(websiteID, records[0].Shard)
+		key := storageSettings.AccountName + "/" + storageSettings.TableNameTemplate
+		group, ok := routed[key]
+		if !ok {
+			group = &routedConsumptions{settings: storageSettings, consumption: WebsiteConsumptions{}}
+			routed[key] = group
+		}
+		group.consumption[websiteID] = records
+	}
+
+	var stats SaveStats
+	var result error
+	for _, group := range routed {
+		groupStats, err := saveRecords(ctx, group.settings, group.settings.TableNameTemplate, group.consumption, serverName, saveID)
+		stats.Add(groupStats)
+		if err != nil && result == nil {
+			result = fmt.Errorf("cannot save to %s: %w", group.settings.AccountName, err)
+		}
+	}
+	return stats, sinkError("azure", result)
+}
+
+// route returns settings of storage consumptions of the website are saved to
+func (settings AzureStorageSettings) route(websiteID int, shard string) AzureStorageSettings {
+	for _, route := range settings.Routes {
+		if !route.matches(websiteID, shard) {
+			continue
+		}
+
+		result := AzureStorageSettings{
+			AccountName:       route.AccountName,
+			Key:               route.Key,
+			TableNameTemplate: route.TableNameTemplate,
+			BaseURL:           settings.BaseURL,
+			Cloud:             settings.Cloud,
+			APIVersion:        settings.APIVersion,
+			HTTPClient:        settings.HTTPClient,
+			RequestTimeout:    settings.RequestTimeout,
+			Accumulate:        settings.Accumulate,
+			KeyStrategy:       settings.KeyStrategy,
+			Columns:           settings.Columns,
+			LateData:          settings.LateData,
+		}
+		if result.TableNameTemplate == "" {
+			result.TableNameTemplate = settings.TableNameTemplate
+		}
+		return result
+	}
+	return settings
+}
+
+// Client returns client of the storage account
+func (settings AzureStorageSettings) Client() (storage.Client, error) {
+	baseURL := settings.BaseURL
+	if baseURL == "" {
+		var err error
+		baseURL, err = storage.CloudBaseURL(settings.Cloud)
+		if err != nil {
+			return storage.Client{}, err
+		}
+	}
+	apiVersion := settings.APIVersion
+	if apiVersion == "" {
+		apiVersion = storage.DefaultAPIVersion
+	}
+	client, err := storage.NewClient(settings.AccountName, settings.Key, baseURL, apiVersion, settings.HTTPClient)
+	client.RequestTimeout = settings.RequestTimeout
+	return client, err
+}
+
+func (route StorageRoute) matches(websiteID int, shard string) bool {
+	if route.Shard != "" {
+		return route.Shard == shard
+	}
+	return websiteID >= route.MinWebsiteID && (route.MaxWebsiteID == 0 || websiteID <= route.MaxWebsiteID)
+}
+
+// SaveAccountConsumptions saves report aggregated by account to azure storage table
+func SaveAccountConsumptions(ctx context.Context, settings AzureStorageSettings, consumptions AccountConsumptions, serverName, saveID string) (SaveStats, error) {
+	stats, err := saveRecords(ctx, settings, settings.AccountTableNameTemplate, consumptions, serverName, saveID)
+	return stats, sinkError("azure", err)
+}
+
+// saveRecords saves consumption records grouped by partition key (website or account ID)
+// to tables built from tableNameTemplate
+func saveRecords(ctx context.Context, settings AzureStorageSettings, tableNameTemplate string, consumptions map[int][]*ConsumptionRecord, serverName, saveID string) (SaveStats, error) {
+	ctx, span := tracer.Start(ctx, "saveRecords")
+	defer span.End()
+	span.SetAttributes(attribute.String("server", serverName), attribute.String("tableTemplate", tableNameTemplate))
+
+	var stats SaveStats
+	storageClient, err := settings.Client()
 	if err != nil {
-		return err
+		return stats, err
 	}
 
 	client := storageClient.GetTableService()
-	now := time.Now()
-	batches := map[storage.AzureTable]map[int][][]*storage.TableEntity{}
+	strategy := getKeyStrategy(settings.KeyStrategy)
+	if settings.Accumulate {
+		return accumulateRecords(ctx, client, strategy, settings.Columns, settings.AccountName, tableNameTemplate, consumptions, serverName)
+	}
+	if settings.LateData == LateDataMerge {
+		var late map[int][]*ConsumptionRecord
+		consumptions, late = splitLate(consumptions)
+		if len(late) > 0 {
+			lateStats, err := accumulateRecords(ctx, client, strategy, settings.Columns, settings.AccountName, tableNameTemplate, late, serverName)
+			stats.Add(lateStats)
+			if err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	rowSuffix := generateRowSuffix(serverName, saveID)
+	batches := map[storage.AzureTable]map[string][][]*storage.TableEntity{}
 	log.Println(serverName + " - " + "Starting processing of consumptions")
-	for websiteID, records := range consumptions {
+	for partitionID, records := range consumptions {
 		for _, stat := range records {
-			fields := make(map[string]interface{})
-			fields["Time"] = stat.Time.Unix()
-			fields["Files"] = stat.Files
-			fields["FilesCount"] = stat.FilesCount
-			fields["Dynamic"] = stat.Dynamic
-			fields["DynamicCount"] = stat.DynamicCount
-			fields["Other"] = stat.Other
-			fields["OtherCount"] = stat.OtherCount
-
+			partitionKey, rowKey := strategy.recordKeys(partitionID, stat, rowSuffix)
 			entity := &storage.TableEntity{
-				PartitionKey: strconv.Itoa(websiteID),
-				RowKey:       generateRowKey(stat, serverName, now),
-				Fields:       fields,
+				PartitionKey: partitionKey,
+				RowKey:       rowKey,
+				Fields:       settings.Columns.project(consumptionFields(stat)),
 			}
-			usageTable := getOrCreateUsageTable(client, settings, stat.Time)
+			usageTable := getOrCreateUsageTable(ctx, client, settings.AccountName, tableNameTemplate, stat.Time)
 
+			// entities of a batch have to share partition key
 			tableBatches := batches[usageTable]
 			if tableBatches == nil {
-				tableBatches = map[int][][]*storage.TableEntity{}
+				tableBatches = map[string][][]*storage.TableEntity{}
 			}
-			websiteBatches := tableBatches[websiteID]
+			websiteBatches := tableBatches[partitionKey]
 			if len(websiteBatches) == 0 {
 				websiteBatches = [][]*storage.TableEntity{[]*storage.TableEntity{}}
 			}
@@ -63,83 +258,170 @@ func SaveConsumptions(settings AzureStorageSettings, consumptions WebsiteConsump
 				latestBatch = []*storage.TableEntity{}
 				websiteBatches = append(websiteBatches, latestBatch)
 			}
+			if len(latestBatch) == 0 {
+				stats.Batches++
+			}
+			stats.Entities++
 			latestBatch = append(latestBatch, entity)
 			websiteBatches[len(websiteBatches)-1] = latestBatch
-			tableBatches[websiteID] = websiteBatches
+			tableBatches[partitionKey] = websiteBatches
 			batches[usageTable] = tableBatches
 		}
 	}
 
 	log.Println(serverName + " - " + "Initiating saving to Azure")
+	limiter := newAdaptiveLimiter()
+	var failures firstError
 	var tablesWg sync.WaitGroup
 	for table, tableBatches := range batches {
 		tablesWg.Add(1)
-		go func(table storage.AzureTable, tableBatches map[int][][]*storage.TableEntity) {
+		go func(table storage.AzureTable, tableBatches map[string][][]*storage.TableEntity) {
 			defer tablesWg.Done()
-			err := processTableBatches(client, table, tableBatches)
+			err := processTableBatches(ctx, client, limiter, table, tableBatches, &stats)
 			if err != nil {
-				log.Println(err)
+				failures.set(err)
 			}
 		}(table, tableBatches)
 	}
 	tablesWg.Wait()
 
-	return nil
+	return stats, failures.get()
 }
 
-func processTableBatches(client storage.TableServiceClient, table storage.AzureTable, tableBatches map[int][][]*storage.TableEntity) error {
+func processTableBatches(ctx context.Context, client storage.TableServiceClient, limiter *adaptiveLimiter, table storage.AzureTable, tableBatches map[string][][]*storage.TableEntity, stats *SaveStats) error {
+	ctx, span := tracer.Start(ctx, "processTableBatches")
+	defer span.End()
+	span.SetAttributes(attribute.String("table", string(table)), attribute.Int("partitions", len(tableBatches)))
+
+	var failures firstError
 	var websitesWg sync.WaitGroup
-	throttle := make(chan bool, 3)
 	for _, websiteBatches := range tableBatches {
-		throttle <- true
 		websitesWg.Add(1)
 		go func(websiteBatches [][]*storage.TableEntity) {
 			defer websitesWg.Done()
-			err := processWebsiteBatches(client, table, websiteBatches)
+			err := processWebsiteBatches(ctx, client, limiter, table, websiteBatches, stats)
 			if err != nil {
-				log.Println(err)
+				failures.set(err)
 			}
-			<-throttle
 		}(websiteBatches)
 	}
 	websitesWg.Wait()
-	return nil
+	return failures.get()
 }
 
-func processWebsiteBatches(client storage.TableServiceClient, table storage.AzureTable, websiteBatches [][]*storage.TableEntity) error {
+func processWebsiteBatches(ctx context.Context, client storage.TableServiceClient, limiter *adaptiveLimiter, table storage.AzureTable, websiteBatches [][]*storage.TableEntity, stats *SaveStats) error {
+	var failures firstError
 	var wg sync.WaitGroup
-	throttle := make(chan bool, 6)
 	for _, batch := range websiteBatches {
-		throttle <- true
 		wg.Add(1)
 		go func(batch []*storage.TableEntity) {
 			defer wg.Done()
-			err := client.BatchInsert(table, batch)
+			err := limiter.do(ctx, func() error {
+				return client.BatchInsertOrReplace(ctx, table, batch)
+			})
 			if err != nil {
 				log.Println(err)
+				atomic.AddInt64(&stats.FailedBatches, 1)
+				failures.set(fmt.Errorf("cannot insert batch into %s: %w", table, err))
 			}
-			<-throttle
 		}(batch)
 	}
 	wg.Wait()
-	return nil
+	return failures.get()
+}
+
+// firstError keeps the first error reported by concurrently running goroutines
+type firstError struct {
+	sync.Mutex
+	err error
 }
 
-func generateRowKey(stats *ConsumptionRecord, server string, now time.Time) string {
-	return fmt.Sprintf("%d-%s-%d", stats.Time.Unix(), server, now.Unix())
+func (e *firstError) set(err error) {
+	e.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	e.Unlock()
 }
 
-var createdTables = make([]storage.AzureTable, 3)
+func (e *firstError) get() error {
+	e.Lock()
+	defer e.Unlock()
+	return e.err
+}
 
-func getOrCreateUsageTable(client storage.TableServiceClient, settings AzureStorageSettings, requestTime time.Time) storage.AzureTable {
-	result := storage.AzureTable(settings.TableNameTemplate + requestTime.Format("200601"))
-	for _, table := range createdTables {
-		if table == result {
-			return result
-		}
+func consumptionFields(stat *ConsumptionRecord) map[string]interface{} {
+	fields := make(map[string]interface{})
+	fields["Time"] = stat.Time.Unix()
+	fields["Files"] = stat.Files
+	fields["FilesCount"] = stat.FilesCount
+	fields["Dynamic"] = stat.Dynamic
+	fields["DynamicCount"] = stat.DynamicCount
+	fields["Other"] = stat.Other
+	fields["OtherCount"] = stat.OtherCount
+	fields["Probe"] = stat.Probe
+	fields["ProbeCount"] = stat.ProbeCount
+	fields["PostDeletionCount"] = stat.PostDeletionCount
+	fields["UploadBytes"] = stat.UploadBytes
+	fields["BillableBytes"] = stat.BillableBytes
+	if stat.Plan != "" {
+		fields["Plan"] = stat.Plan
+	}
+	fields["SlowCount"] = stat.SlowCount
+	fields["RangeRequests"] = stat.RangeRequests
+	fields["ExpensiveCount"] = stat.ExpensiveCount
+	fields["ClientClosedCount"] = stat.ClientClosedCount
+	if stat.Late {
+		fields["Late"] = true
+	}
+	if stat.Domain != "" {
+		fields["Domain"] = stat.Domain
+	}
+	if stat.Port != 0 {
+		fields["Port"] = stat.Port
+	}
+	if stat.Minutes != nil {
+		fields["Minutes"] = formatMinutes(stat.Minutes)
+		fields["PeakMinute"] = stat.PeakMinute()
+	}
+	if stat.BusyMillis != nil {
+		fields["BusyMillis"] = formatMinutes(stat.BusyMillis)
+		fields["PeakAverageConcurrency"] = stat.PeakAverageConcurrency()
+		fields["PeakAverageConcurrency@odata.type"] = "Edm.Double"
+	}
+	return fields
+}
+
+// formatMinutes joins per-minute counters with commas, table service doesn't support arrays
+func formatMinutes(minutes []int) string {
+	values := make([]string, len(minutes))
+	for i, requests := range minutes {
+		values[i] = strconv.Itoa(requests)
+	}
+	return strings.Join(values, ",")
+}
+
+// generateRowSuffix makes row keys of different servers unique. saveID makes them unique per save, but the same
+// for a retried save of the same records
+func generateRowSuffix(server, saveID string) string {
+	return fmt.Sprintf("-%s-%s", server, saveID)
+}
+
+// createdTables contains names of tables that were created during this run prefixed by storage account name
+var createdTables = map[string]bool{}
+var createdTablesSync sync.Mutex
+
+func getOrCreateUsageTable(ctx context.Context, client storage.TableServiceClient, accountName, tableNameTemplate string, requestTime time.Time) storage.AzureTable {
+	result := storage.AzureTable(tableNameTemplate + requestTime.Format("200601"))
+	key := accountName + "/" + string(result)
+
+	createdTablesSync.Lock()
+	defer createdTablesSync.Unlock()
+	if createdTables[key] {
+		return result
 	}
 
-	client.CreateTable(result)
-	createdTables = append(createdTables, result)
+	client.CreateTable(ctx, result)
+	createdTables[key] = true
 	return result
 }
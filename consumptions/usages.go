@@ -1,43 +1,198 @@
 package consumptions
 
 import (
+	"fmt"
+	"net"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"sync"
+	"sync/atomic"
 
 	"github.com/alexanderromanov/nginx-logparser/logsreader"
 	"github.com/alexanderromanov/nginx-logparser/websites"
 )
 
+// UsagesSettings contains settings that control how log records are counted
+type UsagesSettings struct {
+	// CountIncompleteRecords specifies whether records with missing ("-") numeric fields
+	// are counted toward request totals. Their bytes are counted anyway
+	CountIncompleteRecords bool
+
+	// Since and Until restrict the processing window: only records with Since <= Time < Until
+	// are aggregated. Zero value means the window is not bounded from that side
+	Since time.Time
+	Until time.Time
+
+	// AnonymousWebsites assigns websites.AnonymousWebsite to every domain that is not known
+	AnonymousWebsites bool
+
+	// ExcludedStatusCodes are not billed at all. 410 is excluded if it is nil
+	ExcludedStatusCodes []int
+
+	// OtherStatusCodes are billed as Other traffic. 400 is used if it is nil
+	OtherStatusCodes []int
+
+	// StatusWeights multiply BillableBytes of responses with given status codes, e.g. 0.5 for reduced billing
+	StatusWeights map[int]float64
+
+	// AggregateByDomain aggregates records by domain instead of website. Domains are not looked up,
+	// so it is used where websites are not known, e.g. by agents running on nginx hosts
+	AggregateByDomain bool
+
+	// TopClients is the number of client addresses with the most requests reported by GetTopClients.
+	// Clients are not counted if it is zero
+	TopClients int
+
+	// SlowRequestThreshold is the response time requests exceeding which are counted as SLO violations.
+	// Slow requests are not counted if it is zero
+	SlowRequestThreshold time.Duration
+
+	// CatchAllWebsiteID is the website traffic of unknown domains is attributed to. Records of the website
+	// are kept per domain. Traffic of unknown domains is not counted if it is zero
+	CatchAllWebsiteID int
+
+	// PerMinute tracks number of requests of every minute of the hour, e.g. to find peak RPS
+	PerMinute bool
+
+	// CountReferrers counts requests of every website and day by referrer host
+	CountReferrers bool
+
+	// TrackConcurrency approximates number of requests in flight in every minute of the hour
+	// from times and durations of requests, e.g. to find peak concurrency
+	TrackConcurrency bool
+
+	// ExcludedVerbs are HTTP methods of requests that are not billed at all, e.g. OPTIONS
+	ExcludedVerbs []string
+
+	// ProbeVerbs are HTTP methods of requests counted as Probe traffic instead of billable classes, e.g. HEAD
+	ProbeVerbs []string
+
+	// CDNNetworks are IP ranges of CDN servers requesting origin. Their traffic is attributed to CDNWebsiteID
+	// instead of the website, records of which are kept per domain. The traffic is ignored if CDNWebsiteID is zero
+	CDNNetworks  []*net.IPNet
+	CDNWebsiteID int
+
+	// CollapseUnknownDomains reports unknown domains as their registrable domains, e.g. example.co.uk
+	// instead of random subdomains of it sent by scanners
+	CollapseUnknownDomains bool
+
+	// MaxUnknownDomains limits number of unknown domains kept, the least recently requested ones are dropped.
+	// defaultMaxUnknownDomains is used if it is zero
+	MaxUnknownDomains int
+
+	// ExpensiveCalls are dynamic endpoints calls of which with heavy query parameters are counted separately
+	ExpensiveCalls []ExpensiveCall
+
+	// AlternatePorts are server ports, e.g. 8443 of staging, traffic of which is kept in separate records
+	// of the website with ConsumptionRecord.Port set. It requires $server_port in logs
+	AlternatePorts []int
+
+	// MaxFutureSkew limits how far ahead the time of processing timestamps of records can be, e.g. because
+	// of broken server clock. MaxPastSkew limits how far behind the newest record read so far they can be,
+	// so that old logs can still be re-read. Records beyond the limits are handled according to SkewAction.
+	// Timestamps are not checked if the limit is zero
+
+	MaxFutureSkew time.Duration
+	MaxPastSkew   time.Duration
+
+	// SkewAction is SkewQuarantine (default) or SkewClamp
+	SkewAction string
+
+	// CapRangeBytes limits counted bytes of partial responses to the size of the whole file if it is logged,
+	// so that broken clients re-requesting huge ranges don't inflate traffic
+	CapRangeBytes bool
+
+	// LateData is the policy of records of hours that were already flushed: LateDataInsert (default),
+	// LateDataMerge, LateDataDelta or LateDataDrop
+	LateData string
+}
+
 // UsagesCollection contains methods to calculate traffic stats from log records
 type UsagesCollection struct {
+	settings       UsagesSettings
+	classifier     classifier
+	stats          RecordStats
 	usagesSync     sync.RWMutex
 	domainsSync    sync.RWMutex
 	unknownSync    sync.RWMutex
+	ignoredSync    sync.Mutex
 	usages         map[string]*ConsumptionRecord
-	domains        map[string]*websites.WebsiteInfo
-	unknownDomains map[string]int
+	domains        websites.Domains
+	unknownDomains *unknownDomains
+	ignored        map[string]*IgnoredTraffic
+	markerRules    int
+	clients        *clients
+	referrers      *referrers
+
+	// dedup drops records already counted for another server. Records are not deduplicated if it is nil
+	dedup       *Deduplicator
+	dedupSource string
+
+	// newest is the time of the newest record added in Unix nanoseconds
+	newest int64
+
+	// newestHour is the hour of the newest counted record and closedBefore is the first hour that is not
+	// flushed yet, both in Unix nanoseconds. Records of hours before closedBefore are late
+	newestHour   int64
+	closedBefore int64
 }
 
 // NewUsagesCollection creates instance of UsagesCollection
-func NewUsagesCollection(domains map[string]*websites.WebsiteInfo) *UsagesCollection {
+func NewUsagesCollection(domains websites.Domains, settings UsagesSettings) *UsagesCollection {
 	usages := map[string]*ConsumptionRecord{}
-	unknownDomains := map[string]int{}
+	unknownDomains := newUnknownDomains(settings.MaxUnknownDomains)
 	return &UsagesCollection{
+		settings:       settings,
+		classifier:     newClassifier(settings),
 		usages:         usages,
 		domains:        domains,
 		unknownDomains: unknownDomains,
+		ignored:        map[string]*IgnoredTraffic{},
+		clients:        newClients(),
+		referrers:      newReferrers(),
 	}
 }
 
+// RecordStats contains numbers of log records passed to UsagesCollection
+type RecordStats struct {
+	Total       int64
+	Counted     int64
+	OutOfWindow int64
+	Excluded    int64
+	Ignored     int64
+	Marked      int64
+	Duplicate   int64
+	Unknown     int64
+
+	// Unattributable is the number of Unknown records requested by IP address or without Host. They are
+	// not listed as unknown domains
+	Unattributable int64
+
+	// Skewed is the number of records with timestamps beyond skew limits. They are also counted as
+	// Ignored if they were quarantined
+	Skewed int64
+
+	// Malformed is the number of records with invalid request line. Their traffic is counted as usual
+	Malformed int64
+
+	// Late is the number of records of hours that were already flushed. They are handled according to UsagesSettings.LateData
+	Late int64
+}
+
 // WebsiteConsumptions contains consumption records of the website for all the period
 type WebsiteConsumptions map[int][]*ConsumptionRecord
 
+// AccountConsumptions contains consumption records of all websites of the account for all the period
+type AccountConsumptions map[int][]*ConsumptionRecord
+
 // ConsumptionRecord contains information about traffic consumption of a website
 type ConsumptionRecord struct {
 	WebsiteID    int
+	AccountID    int
+	Shard        string
 	Time         time.Time
 	FilesCount   int
 	Files        int64
@@ -45,6 +200,105 @@ type ConsumptionRecord struct {
 	DynamicCount int
 	Other        int64
 	OtherCount   int
+
+	// Probe and ProbeCount are bytes and number of requests with UsagesSettings.ProbeVerbs. They are not billed
+	Probe      int64
+	ProbeCount int
+
+	// PostDeletionCount is the number of requests made after the website was deleted
+	PostDeletionCount int
+
+	// Domain is set instead of website fields when records are aggregated by domain.
+	// It is also set for records of catch-all website
+	Domain string
+
+	// UploadBytes is the size of requests. It is collected only if logs contain $request_length
+	UploadBytes int64
+
+	// BillableBytes is the sum of class bytes weighted by status weights and billing multipliers.
+	// It is set by ApplyBilling. Files, Dynamic and Other are not weighted
+	BillableBytes int64
+
+	// Plan is the pricing plan of the website supplied by provider
+	Plan string
+
+	// Cost is the price of BillableBytes. Tiered price of a sum is not the sum of prices, so Cost is not saved
+	// and is not added up. It is set by ApplyPricing from totals of the hour
+	Cost float64
+
+	// SlowCount is the number of requests served longer than UsagesSettings.SlowRequestThreshold
+	SlowCount int
+
+	// weightedFiles, weightedDynamic and weightedOther are class bytes weighted by status weights
+	weightedFiles   int64
+	weightedDynamic int64
+	weightedOther   int64
+	// RangeRequests is the number of 206 Partial Content responses. Their bytes are counted as Files traffic
+	RangeRequests int
+
+	// ExpensiveCount is the number of calls matching UsagesSettings.ExpensiveCalls
+	ExpensiveCount int
+
+	// ClientClosedCount is the number of requests nginx logged with 499 status because client closed connection
+	// before the response was sent. They are counted in their class as well, spikes usually mean slow upstreams
+	ClientClosedCount int
+
+	// Port is one of UsagesSettings.AlternatePorts requests of the record were received on.
+	// It is zero for requests to standard ports
+	Port int
+
+	// Minutes contains numbers of requests in every minute of the hour. It is nil unless UsagesSettings.PerMinute is set
+	Minutes []int
+
+	// Late is true for records of hours that were already flushed if UsagesSettings.LateData is LateDataMerge
+	// or LateDataDelta
+	Late bool
+
+	// BusyMillis contains total milliseconds requests were in flight during every minute of the hour, so that
+	// the value divided by a minute is the average concurrency of the minute. It is nil unless
+	// UsagesSettings.TrackConcurrency is set
+	BusyMillis []int
+}
+
+// MinutesInHour is the number of per-minute counters of ConsumptionRecord
+const MinutesInHour = 60
+
+const (
+	// StatusClientClosedRequest is the non-standard status nginx logs when client closes connection before the response
+	StatusClientClosedRequest = 499
+
+	// markerRulePrefix names ignore rules of records marked by nginx, e.g. "marker:healthcheck"
+	markerRulePrefix = "marker:"
+
+	// maxMarkerRules and maxMarkerLength limit rules of markers, which are arbitrary values logged by nginx,
+	// so that they can't blow up manifests and metric labels. Traffic of further markers is accounted by otherMarkerRule
+	maxMarkerRules  = 20
+	maxMarkerLength = 64
+	otherMarkerRule = markerRulePrefix + "other"
+)
+
+// cdnRule names ignore rule of records requested by CDN when CDN traffic is not attributed to a website
+const cdnRule = "cdn"
+
+// skewRule names ignore rule of quarantined records with skewed timestamps
+const skewRule = "clock-skew"
+
+// lateRule names ignore rule of records of flushed hours dropped by LateDataDrop policy
+const lateRule = "late"
+
+const (
+	// SkewQuarantine drops records with skewed timestamps from billing and reports them as ignored traffic
+	SkewQuarantine = "quarantine"
+
+	// SkewClamp counts records with skewed timestamps at the nearest allowed time
+	SkewClamp = "clamp"
+)
+
+// IgnoredTraffic contains amount of traffic dropped by an ignore rule or marked as not billable by nginx
+type IgnoredTraffic struct {
+	Rule     string
+	Requests int64
+	Bytes    int64
 }
 
 // UnknownDomainsCounter contains information about domains unknown to the system and number
@@ -54,72 +308,691 @@ type UnknownDomainsCounter struct {
 	Requested int
 }
 
+// NewestRecordTime returns time of the newest record added to the collection. Zero time if there were no records
+func (usages *UsagesCollection) NewestRecordTime() time.Time {
+	newest := atomic.LoadInt64(&usages.newest)
+	if newest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, newest)
+}
+
+func (usages *UsagesCollection) updateNewest(t time.Time) {
+	nanos := t.UnixNano()
+	for {
+		newest := atomic.LoadInt64(&usages.newest)
+		if nanos <= newest || atomic.CompareAndSwapInt64(&usages.newest, newest, nanos) {
+			return
+		}
+	}
+}
+
+// Deduplicate makes collection skip records of source that are already counted for other sources of deduplicator
+func (usages *UsagesCollection) Deduplicate(dedup *Deduplicator, source string) {
+	usages.dedup = dedup
+	usages.dedupSource = source
+}
+
 // AddRecord adds log record to UsagesCollection
 func (usages *UsagesCollection) AddRecord(record *logsreader.LogRecord) {
-	if shouldIgnore(record) {
+	atomic.AddInt64(&usages.stats.Total, 1)
+	if record.Malformed {
+		atomic.AddInt64(&usages.stats.Malformed, 1)
+	}
+	if usages.settings.TopClients > 0 {
+		usages.clients.add(record.IPAddress, int64(record.Size))
+	}
+	// parsed times are UTC, hours of clamped times are taken from their date fields as well
+	if t, skewed := usages.settings.skewLimit(record.Time, time.Now().UTC(), usages.NewestRecordTime().UTC()); skewed {
+		atomic.AddInt64(&usages.stats.Skewed, 1)
+		if usages.settings.SkewAction != SkewClamp {
+			atomic.AddInt64(&usages.stats.Ignored, 1)
+			usages.addIgnored(skewRule, record)
+			return
+		}
+		// record can be shared with other consumers, e.g. Graylog output, so it is not modified
+		clamped := *record
+		clamped.Time = t
+		record = &clamped
+	}
+	usages.updateNewest(record.Time)
+	if !usages.settings.inWindow(record.Time) {
+		atomic.AddInt64(&usages.stats.OutOfWindow, 1)
+		return
+	}
+	if record.Marker != "" {
+		atomic.AddInt64(&usages.stats.Marked, 1)
+		usages.addMarked(record)
+		return
+	}
+	class, weight := usages.classifier.classify(record)
+	if class == classExcluded {
+		atomic.AddInt64(&usages.stats.Excluded, 1)
+		return
+	}
+	if rule, ignored := shouldIgnore(record); ignored {
+		atomic.AddInt64(&usages.stats.Ignored, 1)
+		usages.addIgnored(rule, record)
 		return
 	}
 
-	usages.domainsSync.RLock()
-	website, ok := usages.domains[record.Domain]
-	usages.domainsSync.RUnlock()
-	if !ok {
-		usages.addUnknownDomain(record.Domain)
+	fromCDN := usages.settings.fromCDN(record)
+	if fromCDN && usages.settings.CDNWebsiteID == 0 {
+		atomic.AddInt64(&usages.stats.Ignored, 1)
+		usages.addIgnored(cdnRule, record)
 		return
 	}
 
 	hour := getHour(record.Time)
-	usageKey := strconv.Itoa(website.ID) + "-" + strconv.FormatInt(hour.Unix(), 10)
-	usages.usagesSync.RLock()
+	late := usages.isLate(hour)
+	if late {
+		atomic.AddInt64(&usages.stats.Late, 1)
+		if usages.settings.LateData == LateDataDrop {
+			atomic.AddInt64(&usages.stats.Ignored, 1)
+			usages.addIgnored(lateRule, record)
+			return
+		}
+	}
+	// records of closed hours are flagged only if they are saved differently
+	late = late && (usages.settings.LateData == LateDataMerge || usages.settings.LateData == LateDataDelta)
+
+	var website *websites.WebsiteInfo
+	var usageKey, catchAllDomain, aggregatedDomain string
+	if usages.settings.AggregateByDomain {
+		website, aggregatedDomain = &websites.WebsiteInfo{}, usages.canonicalDomain(record.Domain)
+		usageKey = aggregatedDomain + "-" + strconv.FormatInt(hour.Unix(), 10)
+	} else if fromCDN {
+		// CDN pseudo-website keeps records per domain like catch-all website
+		website, catchAllDomain = &websites.WebsiteInfo{ID: usages.settings.CDNWebsiteID}, record.Domain
+		usageKey = strconv.Itoa(website.ID) + "-" + strconv.FormatInt(hour.Unix(), 10) + "-" + catchAllDomain
+	} else {
+		var ok bool
+		website, ok = usages.lookupWebsite(record.Domain)
+		if !ok {
+			// unknown domains are reported even if their traffic is attributed to catch-all website
+			atomic.AddInt64(&usages.stats.Unknown, 1)
+			usages.addUnknownDomain(record.Domain)
+			if usages.settings.CatchAllWebsiteID == 0 {
+				return
+			}
+			website, catchAllDomain = usages.catchAllWebsite(), record.Domain
+		}
+		usageKey = strconv.Itoa(website.ID) + "-" + strconv.FormatInt(hour.Unix(), 10) + "-" + catchAllDomain
+	}
+	port := usages.settings.alternatePort(record.ServerPort)
+	if port != 0 {
+		usageKey += ":" + strconv.Itoa(port)
+	}
+	if late {
+		usageKey += "-late"
+	}
+	// only records that would be counted are matched, so that a copy dropped by other rules doesn't hide the counted one
+	if usages.dedup != nil && usages.dedup.IsDuplicate(usages.dedupSource, record) {
+		atomic.AddInt64(&usages.stats.Duplicate, 1)
+		return
+	}
+	atomic.AddInt64(&usages.stats.Counted, 1)
+
+	requests := 1
+	if record.Incomplete && !usages.settings.CountIncompleteRecords {
+		requests = 0
+	}
+	deleted := website.IsDeletedAt(record.Time)
+	slow := usages.settings.isSlow(record)
+	expensive := usages.classifier.isExpensive(record)
+
+	// counters are updated under the lock, so that Snapshot doesn't return records still being written
+	usages.usagesSync.Lock()
+	defer usages.usagesSync.Unlock()
 	usageRecord, ok := usages.usages[usageKey]
-	usages.usagesSync.RUnlock()
 	if !ok {
-		usageRecord = &ConsumptionRecord{WebsiteID: website.ID, Time: hour}
-		usages.usagesSync.Lock()
+		usageRecord = &ConsumptionRecord{WebsiteID: website.ID, AccountID: website.AccountID, Shard: website.Shard, Plan: website.Plan, Time: hour, Port: port, Late: late}
+		if usages.settings.AggregateByDomain {
+			usageRecord.Domain = aggregatedDomain
+		} else {
+			usageRecord.Domain = catchAllDomain
+		}
 		usages.usages[usageKey] = usageRecord
-		usages.usagesSync.Unlock()
 	}
 
-	switch {
-	case isFile(record.Path):
-		usageRecord.Files += int64(record.Size)
-		usageRecord.FilesCount++
-	case isOther(record.HTTPStatusCode):
-		usageRecord.Other += int64(record.Size)
-		usageRecord.OtherCount++
+	if deleted {
+		usageRecord.PostDeletionCount += requests
+	}
+
+	usageRecord.UploadBytes += int64(record.RequestLength)
+	if slow {
+		usageRecord.SlowCount += requests
+	}
+	if expensive {
+		usageRecord.ExpensiveCount += requests
+	}
+	if record.HTTPStatusCode == StatusClientClosedRequest {
+		usageRecord.ClientClosedCount += requests
+	}
+	bytes := record.Size
+	if record.HTTPStatusCode == http.StatusPartialContent {
+		usageRecord.RangeRequests += requests
+		if usages.settings.CapRangeBytes && record.RangeTotal > 0 && bytes > record.RangeTotal {
+			bytes = record.RangeTotal
+		}
+	}
+	if usages.settings.PerMinute {
+		if usageRecord.Minutes == nil {
+			usageRecord.Minutes = make([]int, MinutesInHour)
+		}
+		usageRecord.Minutes[record.Time.Minute()] += requests
+	}
+	if usages.settings.CountReferrers && requests > 0 {
+		usages.referrers.add(website.ID, record.Time, record.Referrer, record.Domain, int64(bytes))
+	}
+	if usages.settings.TrackConcurrency && requests > 0 {
+		usageRecord.addBusyTime(record.Time, time.Duration(record.Duration*float64(time.Second)))
+	}
+
+	size := int64(bytes)
+	weighted := int64(float64(size) * weight)
+
+	switch class {
+	case classFiles:
+		usageRecord.Files += size
+		usageRecord.FilesCount += requests
+		usageRecord.weightedFiles += weighted
+	case classOther:
+		usageRecord.Other += size
+		usageRecord.OtherCount += requests
+		usageRecord.weightedOther += weighted
+	case classProbe:
+		usageRecord.Probe += size
+		usageRecord.ProbeCount += requests
 	default:
-		usageRecord.Dynamic += int64(record.Size)
-		usageRecord.DynamicCount++
+		usageRecord.Dynamic += size
+		usageRecord.DynamicCount += requests
+		usageRecord.weightedDynamic += weighted
+	}
+}
+
+// SetDomains replaces domains list records are attributed with, e.g. after the list was refreshed
+func (usages *UsagesCollection) SetDomains(domains websites.Domains) {
+	usages.domainsSync.Lock()
+	usages.domains = domains
+	usages.domainsSync.Unlock()
+}
+
+// AddConsumption merges consumption pre-aggregated by domain, e.g. by an agent, into UsagesCollection
+func (usages *UsagesCollection) AddConsumption(consumption *ConsumptionRecord) {
+	requests := int64(consumption.FilesCount + consumption.DynamicCount + consumption.OtherCount)
+	atomic.AddInt64(&usages.stats.Total, requests)
+
+	var catchAllDomain string
+	website, ok := usages.lookupWebsite(consumption.Domain)
+	if !ok {
+		atomic.AddInt64(&usages.stats.Unknown, requests)
+		usages.addUnknownDomainRequests(consumption.Domain, int(requests))
+		if usages.settings.CatchAllWebsiteID == 0 {
+			return
+		}
+		website, catchAllDomain = usages.catchAllWebsite(), consumption.Domain
+	}
+	atomic.AddInt64(&usages.stats.Counted, requests)
+
+	hour := getHour(consumption.Time)
+	usageKey := strconv.Itoa(website.ID) + "-" + strconv.FormatInt(hour.Unix(), 10) + "-" + catchAllDomain
+	if consumption.Port != 0 {
+		usageKey += ":" + strconv.Itoa(consumption.Port)
+	}
+
+	usages.usagesSync.Lock()
+	defer usages.usagesSync.Unlock()
+	usageRecord, ok := usages.usages[usageKey]
+	if !ok {
+		usageRecord = &ConsumptionRecord{WebsiteID: website.ID, AccountID: website.AccountID, Shard: website.Shard, Plan: website.Plan, Time: hour, Domain: catchAllDomain, Port: consumption.Port}
+		usages.usages[usageKey] = usageRecord
+	}
+	usageRecord.add(consumption.unweighted())
+
+	// request times are not known, so post-deletion requests are detected with hour precision
+	if website.IsDeletedAt(hour) {
+		usageRecord.PostDeletionCount += int(requests)
+	}
+}
+
+// catchAllWebsite returns website traffic of unknown domains is attributed to
+func (usages *UsagesCollection) catchAllWebsite() *websites.WebsiteInfo {
+	return &websites.WebsiteInfo{ID: usages.settings.CatchAllWebsiteID}
+}
+
+// lookupWebsite returns website the domain belongs to
+func (usages *UsagesCollection) lookupWebsite(domain string) (*websites.WebsiteInfo, bool) {
+	usages.domainsSync.RLock()
+	website, ok := usages.domains.Lookup(domain)
+	usages.domainsSync.RUnlock()
+	if !ok && usages.settings.AnonymousWebsites {
+		website, ok = websites.AnonymousWebsite(domain), true
+	}
+	return website, ok
+}
+
+// canonicalDomain returns domain the domain is an alias of according to the provider
+func (usages *UsagesCollection) canonicalDomain(domain string) string {
+	usages.domainsSync.RLock()
+	defer usages.domainsSync.RUnlock()
+	return usages.domains.Canonical(domain)
+}
+
+// Stats returns numbers of log records added so far
+func (usages *UsagesCollection) Stats() RecordStats {
+	return RecordStats{
+		Total:          atomic.LoadInt64(&usages.stats.Total),
+		Counted:        atomic.LoadInt64(&usages.stats.Counted),
+		OutOfWindow:    atomic.LoadInt64(&usages.stats.OutOfWindow),
+		Excluded:       atomic.LoadInt64(&usages.stats.Excluded),
+		Ignored:        atomic.LoadInt64(&usages.stats.Ignored),
+		Marked:         atomic.LoadInt64(&usages.stats.Marked),
+		Duplicate:      atomic.LoadInt64(&usages.stats.Duplicate),
+		Unknown:        atomic.LoadInt64(&usages.stats.Unknown),
+		Skewed:         atomic.LoadInt64(&usages.stats.Skewed),
+		Unattributable: atomic.LoadInt64(&usages.stats.Unattributable),
+		Malformed:      atomic.LoadInt64(&usages.stats.Malformed),
+		Late:           atomic.LoadInt64(&usages.stats.Late),
 	}
 }
 
 // GetTrafficConsumption returns traffic consumptions of currently added log records
 func (usages *UsagesCollection) GetTrafficConsumption() WebsiteConsumptions {
-	result := WebsiteConsumptions{}
+	usages.usagesSync.RLock()
+	defer usages.usagesSync.RUnlock()
+	return trafficConsumption(usages.usages)
+}
+
+// GetDomainConsumption returns consumptions of currently added log records aggregated by domain.
+// Records are collected only if AggregateByDomain is set
+func (usages *UsagesCollection) GetDomainConsumption() []*ConsumptionRecord {
+	usages.usagesSync.RLock()
+	defer usages.usagesSync.RUnlock()
+
+	result := make([]*ConsumptionRecord, 0, len(usages.usages))
 	for _, value := range usages.usages {
-		result[value.WebsiteID] = append(result[value.WebsiteID], value)
+		result = append(result, value.clone())
+	}
+	return result
+}
+
+// ResetConsumption removes collected consumptions, e.g. after they were saved on checkpoint.
+// Record stats and unknown domains are kept
+func (usages *UsagesCollection) ResetConsumption() {
+	usages.Snapshot()
+}
+
+// Snapshot removes collected consumptions and returns them. Records added concurrently go either
+// to the snapshot or to the collection, so that periodic flushes neither lose nor double count them.
+// Record stats and unknown domains are kept
+func (usages *UsagesCollection) Snapshot() *UsagesSnapshot {
+	usages.usagesSync.Lock()
+	defer usages.usagesSync.Unlock()
+
+	snapshot := &UsagesSnapshot{usages: usages.usages, countReferrers: usages.settings.CountReferrers}
+	usages.usages = map[string]*ConsumptionRecord{}
+	snapshot.referrers = usages.referrers.swap()
+	return snapshot
+}
+
+// GetReferrers returns referrer hosts counted for every website and day. Hosts over the limit of
+// a website and day are summed into a single record
+func (usages *UsagesCollection) GetReferrers() []*ReferrerRecord {
+	if !usages.settings.CountReferrers {
+		return nil
+	}
+	return usages.referrers.records()
+}
+
+// GetAccountConsumption returns traffic consumptions of currently added log records aggregated
+// by account. Records of websites without account are skipped
+func (usages *UsagesCollection) GetAccountConsumption() AccountConsumptions {
+	usages.usagesSync.RLock()
+	defer usages.usagesSync.RUnlock()
+	return accountConsumption(usages.usages)
+}
+
+// UsagesSnapshot contains consumptions removed from UsagesCollection by Snapshot
+type UsagesSnapshot struct {
+	usages         map[string]*ConsumptionRecord
+	referrers      *referrers
+	countReferrers bool
+}
+
+// GetTrafficConsumption returns traffic consumptions of the snapshot
+func (snapshot *UsagesSnapshot) GetTrafficConsumption() WebsiteConsumptions {
+	return trafficConsumption(snapshot.usages)
+}
+
+// GetAccountConsumption returns traffic consumptions of the snapshot aggregated by account
+func (snapshot *UsagesSnapshot) GetAccountConsumption() AccountConsumptions {
+	return accountConsumption(snapshot.usages)
+}
+
+// GetReferrers returns referrer hosts of the snapshot
+func (snapshot *UsagesSnapshot) GetReferrers() []*ReferrerRecord {
+	if !snapshot.countReferrers {
+		return nil
+	}
+	return snapshot.referrers.records()
+}
+
+func trafficConsumption(usages map[string]*ConsumptionRecord) WebsiteConsumptions {
+	result := WebsiteConsumptions{}
+	for _, value := range usages {
+		// records are copied so that transforms applied before saving don't modify collected data
+		result[value.WebsiteID] = append(result[value.WebsiteID], value.clone())
+	}
+	return result
+}
+
+func accountConsumption(usages map[string]*ConsumptionRecord) AccountConsumptions {
+	result := AccountConsumptions{}
+	accountRecords := map[string]*ConsumptionRecord{}
+	for _, value := range usages {
+		if value.AccountID == 0 {
+			continue
+		}
+
+		key := strconv.Itoa(value.AccountID) + "-" + strconv.FormatInt(value.Time.Unix(), 10)
+		if value.Port != 0 {
+			key += ":" + strconv.Itoa(value.Port)
+		}
+		if value.Late {
+			key += "-late"
+		}
+		accountRecord, ok := accountRecords[key]
+		if !ok {
+			accountRecord = &ConsumptionRecord{AccountID: value.AccountID, Time: value.Time, Port: value.Port, Late: value.Late}
+			accountRecords[key] = accountRecord
+			result[value.AccountID] = append(result[value.AccountID], accountRecord)
+		}
+		accountRecord.add(value)
 	}
 	return result
 }
 
 // GetUnknownDomains return list of unknown domains found in log records
 func (usages *UsagesCollection) GetUnknownDomains() []UnknownDomainsCounter {
-	result := make([]UnknownDomainsCounter, len(usages.unknownDomains))
-	i := 0
-	for domain, count := range usages.unknownDomains {
-		result[i] = UnknownDomainsCounter{Domain: domain, Requested: count}
-		i++
-	}
+	usages.unknownSync.RLock()
+	defer usages.unknownSync.RUnlock()
+	return usages.unknownDomains.counters()
+}
+
+// EvictedUnknownDomains returns number of unknown domains dropped to keep UsagesSettings.MaxUnknownDomains
+func (usages *UsagesCollection) EvictedUnknownDomains() int {
+	usages.unknownSync.RLock()
+	defer usages.unknownSync.RUnlock()
+	return usages.unknownDomains.evicted
+}
+
+// GetIgnoredTraffic returns traffic dropped by each of ignore rules
+func (usages *UsagesCollection) GetIgnoredTraffic() []IgnoredTraffic {
+	usages.ignoredSync.Lock()
+	defer usages.ignoredSync.Unlock()
 
+	result := make([]IgnoredTraffic, 0, len(usages.ignored))
+	for _, traffic := range usages.ignored {
+		result = append(result, *traffic)
+	}
 	return result
 }
 
+func (usages *UsagesCollection) addIgnored(rule string, record *logsreader.LogRecord) {
+	usages.ignoredSync.Lock()
+	usages.addIgnoredLocked(rule, record)
+	usages.ignoredSync.Unlock()
+}
+
+func (usages *UsagesCollection) addIgnoredLocked(rule string, record *logsreader.LogRecord) {
+	traffic, ok := usages.ignored[rule]
+	if !ok {
+		traffic = &IgnoredTraffic{Rule: rule}
+		usages.ignored[rule] = traffic
+	}
+	traffic.Requests++
+	traffic.Bytes += int64(record.Size)
+}
+
+// addMarked accounts traffic of record marked by nginx by the rule of its marker
+func (usages *UsagesCollection) addMarked(record *logsreader.LogRecord) {
+	marker := record.Marker
+	if len(marker) > maxMarkerLength {
+		marker = marker[:maxMarkerLength]
+	}
+	rule := markerRulePrefix + marker
+
+	usages.ignoredSync.Lock()
+	defer usages.ignoredSync.Unlock()
+	if _, ok := usages.ignored[rule]; !ok {
+		if usages.markerRules >= maxMarkerRules {
+			rule = otherMarkerRule
+		} else {
+			usages.markerRules++
+		}
+	}
+	usages.addIgnoredLocked(rule, record)
+}
+
 func (usages *UsagesCollection) addUnknownDomain(domain string) {
+	usages.addUnknownDomainRequests(domain, 1)
+}
+
+func (usages *UsagesCollection) addUnknownDomainRequests(domain string, requests int) {
+	if isUnattributable(domain) {
+		atomic.AddInt64(&usages.stats.Unattributable, int64(requests))
+		return
+	}
+	if usages.settings.CollapseUnknownDomains {
+		domain = registrableDomain(domain)
+	}
 	usages.unknownSync.Lock()
-	usages.unknownDomains[domain] = usages.unknownDomains[domain] + 1
+	usages.unknownDomains.add(domain, requests)
 	usages.unknownSync.Unlock()
 }
 
+// alternatePort returns port if it is one of AlternatePorts, otherwise zero
+func (settings *UsagesSettings) alternatePort(port int) int {
+	for _, alternate := range settings.AlternatePorts {
+		if port == alternate {
+			return port
+		}
+	}
+	return 0
+}
+
+// skewLimit returns true if t is ahead of now or behind the newest record beyond skew limits, together
+// with the nearest allowed time. Past skew is not checked before the first record
+func (settings *UsagesSettings) skewLimit(t, now, newest time.Time) (time.Time, bool) {
+	if settings.MaxFutureSkew > 0 {
+		if limit := now.Add(settings.MaxFutureSkew); t.After(limit) {
+			return limit, true
+		}
+	}
+	if settings.MaxPastSkew > 0 && !newest.IsZero() {
+		if limit := newest.Add(-settings.MaxPastSkew); t.Before(limit) {
+			return limit, true
+		}
+	}
+	return t, false
+}
+
+func (settings *UsagesSettings) inWindow(t time.Time) bool {
+	if !settings.Since.IsZero() && t.Before(settings.Since) {
+		return false
+	}
+	if !settings.Until.IsZero() && !t.Before(settings.Until) {
+		return false
+	}
+	return true
+}
+
+// fromCDN returns true if record was requested from one of CDN networks
+func (settings *UsagesSettings) fromCDN(record *logsreader.LogRecord) bool {
+	if len(settings.CDNNetworks) == 0 {
+		return false
+	}
+	ip := net.ParseIP(record.IPAddress)
+	if ip == nil {
+		return false
+	}
+	for _, network := range settings.CDNNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetworks parses IP ranges in CIDR notation. Single addresses are treated as ranges of one address
+func ParseNetworks(ranges []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, value := range ranges {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %s", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %s: %v", value, err)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// isSlow returns true if record violates response time SLO. Duration is logged in seconds
+func (settings *UsagesSettings) isSlow(record *logsreader.LogRecord) bool {
+	threshold := settings.SlowRequestThreshold
+	return threshold > 0 && time.Duration(record.Duration*float64(time.Second)) > threshold
+}
+
+func (record *ConsumptionRecord) add(other *ConsumptionRecord) {
+	record.Files += other.Files
+	record.FilesCount += other.FilesCount
+	record.Dynamic += other.Dynamic
+	record.DynamicCount += other.DynamicCount
+	record.Other += other.Other
+	record.OtherCount += other.OtherCount
+	record.Probe += other.Probe
+	record.ProbeCount += other.ProbeCount
+	record.PostDeletionCount += other.PostDeletionCount
+	record.UploadBytes += other.UploadBytes
+	record.BillableBytes += other.BillableBytes
+	if record.Plan == "" {
+		record.Plan = other.Plan
+	}
+	record.SlowCount += other.SlowCount
+	record.weightedFiles += other.weightedFiles
+	record.weightedDynamic += other.weightedDynamic
+	record.weightedOther += other.weightedOther
+	record.RangeRequests += other.RangeRequests
+	record.ExpensiveCount += other.ExpensiveCount
+	record.ClientClosedCount += other.ClientClosedCount
+	if len(other.Minutes) > 0 {
+		if record.Minutes == nil {
+			record.Minutes = make([]int, MinutesInHour)
+		}
+		for minute, requests := range other.Minutes {
+			record.Minutes[minute] += requests
+		}
+	}
+	if len(other.BusyMillis) > 0 {
+		if record.BusyMillis == nil {
+			record.BusyMillis = make([]int, MinutesInHour)
+		}
+		for minute, busy := range other.BusyMillis {
+			record.BusyMillis[minute] += busy
+		}
+	}
+}
+
+// unweighted returns copy of pre-aggregated record which status codes are not known, so that its bytes
+// are billed as they are
+func (record *ConsumptionRecord) unweighted() *ConsumptionRecord {
+	result := *record
+	result.weightedFiles = record.Files
+	result.weightedDynamic = record.Dynamic
+	result.weightedOther = record.Other
+	return &result
+}
+
+func (record *ConsumptionRecord) clone() *ConsumptionRecord {
+	result := *record
+	if record.Minutes != nil {
+		result.Minutes = append([]int(nil), record.Minutes...)
+	}
+	if record.BusyMillis != nil {
+		result.BusyMillis = append([]int(nil), record.BusyMillis...)
+	}
+	return &result
+}
+
+// addBusyTime distributes time the request finished at the given time was in flight over minutes of the hour.
+// Nginx logs requests when they are finished. Part of the request made in the previous hour is not counted,
+// since consumption of that hour may be saved already, and time beyond the end of the hour is dropped
+func (record *ConsumptionRecord) addBusyTime(finished time.Time, duration time.Duration) {
+	if record.BusyMillis == nil {
+		record.BusyMillis = make([]int, MinutesInHour)
+	}
+	if end := record.Time.Add(time.Hour); finished.After(end) {
+		finished = end
+	}
+	start := finished.Add(-duration)
+	if start.Before(record.Time) {
+		start = record.Time
+	}
+	for start.Before(finished) {
+		end := start.Truncate(time.Minute).Add(time.Minute)
+		if end.After(finished) {
+			end = finished
+		}
+		minute := int(start.Sub(record.Time) / time.Minute)
+		if minute < 0 || minute >= MinutesInHour {
+			return
+		}
+		record.BusyMillis[minute] += int(end.Sub(start) / time.Millisecond)
+		start = end
+	}
+}
+
+// PeakAverageConcurrency returns the peak of per-minute averages of requests in flight, i.e. busy time of
+// the busiest minute divided by a minute. Bursts shorter than a minute are averaged out. It is zero unless
+// concurrency is tracked
+func (record *ConsumptionRecord) PeakAverageConcurrency() float64 {
+	peak := 0
+	for _, busy := range record.BusyMillis {
+		if busy > peak {
+			peak = busy
+		}
+	}
+	return float64(peak) / float64(time.Minute/time.Millisecond)
+}
+
+// PeakMinute returns the largest number of requests made in a minute. It is zero unless minutes are tracked
+func (record *ConsumptionRecord) PeakMinute() int {
+	peak := 0
+	for _, requests := range record.Minutes {
+		if requests > peak {
+			peak = requests
+		}
+	}
+	return peak
+}
+
+func (record *ConsumptionRecord) totalBytes() int64 {
+	return record.Files + record.Dynamic + record.Other
+}
+
 func getHour(t time.Time) time.Time {
 	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.UTC)
 }
@@ -128,21 +1001,23 @@ func isFile(path string) bool {
 	return strings.HasPrefix(path, "/filestore/")
 }
 
-func isOther(statusCode int) bool {
-	return statusCode == 400
-}
-
 var domainsToIgnore = map[string]bool{
 	"cdn.redham.ru": true,
 	"*":             true,
 }
 
-func shouldIgnore(record *logsreader.LogRecord) bool {
-	if record.HTTPStatusCode == 410 {
-		return true
+// shouldIgnore returns the rule record is ignored by. Rules are named by ignored domains
+func shouldIgnore(record *logsreader.LogRecord) (string, bool) {
+	if !domainsToIgnore[record.Domain] {
+		return "", false
 	}
+	return record.Domain, true
+}
 
-	_, found := domainsToIgnore[record.Domain]
-
-	return found
+// ValidateSkewAction checks that records with skewed timestamps can be handled with the action
+func ValidateSkewAction(action string) error {
+	if action != "" && action != SkewQuarantine && action != SkewClamp {
+		return fmt.Errorf("unknown clock skew action %s", action)
+	}
+	return nil
 }
@@ -0,0 +1,67 @@
+package consumptions
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+	"github.com/alexanderromanov/nginx-logparser/websites"
+)
+
+func BenchmarkAddRecord(b *testing.B) {
+	domains := websites.Domains{}
+	for i := 0; i < 100; i++ {
+		domains[fmt.Sprintf("website%d.com", i)] = &websites.WebsiteInfo{ID: i + 1}
+	}
+	started := time.Now().UTC().Truncate(time.Hour)
+	records := make([]*logsreader.LogRecord, 1000)
+	for i := range records {
+		records[i] = &logsreader.LogRecord{
+			IPAddress:      "111.111.111.111",
+			Time:           started.Add(time.Duration(i) * time.Second),
+			Duration:       0.247,
+			Verb:           "GET",
+			Path:           fmt.Sprintf("/filestore/%d.jpg", i),
+			HTTPStatusCode: 200,
+			Size:           32327,
+			Domain:         fmt.Sprintf("website%d.com", i%len(domains)),
+			Referrer:       "http://some-referrer.com/",
+			UserAgent:      "User Agent String",
+		}
+	}
+
+	usages := NewUsagesCollection(domains, UsagesSettings{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		usages.AddRecord(records[i%len(records)])
+	}
+}
+
+func TestMarkerRules(t *testing.T) {
+	usages := NewUsagesCollection(websites.Domains{}, UsagesSettings{})
+	for i := 0; i < maxMarkerRules+5; i++ {
+		usages.AddRecord(&logsreader.LogRecord{Domain: "example.com", Size: 10, Marker: fmt.Sprintf("marker%d", i)})
+	}
+	usages.AddRecord(&logsreader.LogRecord{Domain: "example.com", Size: 10, Marker: "marker0"})
+	usages.AddRecord(&logsreader.LogRecord{Domain: "example.com", Size: 10, Marker: strings.Repeat("x", 1000)})
+
+	rules := map[string]IgnoredTraffic{}
+	for _, traffic := range usages.GetIgnoredTraffic() {
+		rules[traffic.Rule] = traffic
+	}
+	if len(rules) != maxMarkerRules+1 {
+		t.Errorf("expected %d rules, got %d", maxMarkerRules+1, len(rules))
+	}
+	if rules["marker:marker0"].Requests != 2 {
+		t.Errorf("expected 2 requests of known marker, got %d", rules["marker:marker0"].Requests)
+	}
+	if other := rules[otherMarkerRule]; other.Requests != 6 || other.Bytes != 60 {
+		t.Errorf("expected 6 requests and 60 bytes of other markers, got %d and %d", other.Requests, other.Bytes)
+	}
+	if stats := usages.Stats(); stats.Marked != maxMarkerRules+7 {
+		t.Errorf("expected %d marked records, got %d", maxMarkerRules+7, stats.Marked)
+	}
+}
@@ -0,0 +1,122 @@
+// Package cron parses five-field cron expressions: minute, hour, day of month, month and day of week.
+// Fields support "*", lists, ranges and steps, e.g. "0 2 * * 0" or "*/15 1-5 * * 1,3"
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is the parsed cron expression
+type Schedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+
+	// anyDay and anyWeekday keep standard cron behavior: if both day fields are restricted,
+	// time matches when either of them matches
+	anyDay     bool
+	anyWeekday bool
+}
+
+type field struct {
+	min, max int
+}
+
+var fields = []field{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 6},  // day of week, 0 is Sunday
+}
+
+// Parse parses cron expression
+func Parse(expression string) (*Schedule, error) {
+	parts := strings.Fields(expression)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron expression %q must have %d fields", expression, len(fields))
+	}
+
+	var bits [5]uint64
+	for i, part := range parts {
+		var err error
+		bits[i], err = parseField(part, fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", expression, err)
+		}
+	}
+	return &Schedule{
+		minutes:    bits[0],
+		hours:      bits[1],
+		days:       bits[2],
+		months:     bits[3],
+		weekdays:   bits[4],
+		anyDay:     parts[2] == "*",
+		anyWeekday: parts[4] == "*",
+	}, nil
+}
+
+// Matches returns true if the minute of t matches the schedule
+func (s *Schedule) Matches(t time.Time) bool {
+	if !has(s.minutes, t.Minute()) || !has(s.hours, t.Hour()) || !has(s.months, int(t.Month())) {
+		return false
+	}
+	day, weekday := has(s.days, t.Day()), has(s.weekdays, int(t.Weekday()))
+	if !s.anyDay && !s.anyWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// parseField returns bit set of values of comma separated list of "*", "a", "a-b" with optional "/step"
+func parseField(value string, f field) (uint64, error) {
+	var result uint64
+	for _, item := range strings.Split(value, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %s", item[i+1:])
+			}
+			item = item[:i]
+		}
+
+		from, to := f.min, f.max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %s", bounds[0])
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %s", bounds[1])
+				}
+			} else if step > 1 {
+				// "a/step" means from a to the maximum
+				to = f.max
+			}
+		}
+		if from < f.min || to > f.max || from > to {
+			return 0, fmt.Errorf("range %d-%d is out of %d-%d", from, to, f.min, f.max)
+		}
+
+		for v := from; v <= to; v += step {
+			result |= 1 << uint(v)
+		}
+	}
+	return result, nil
+}
+
+func has(bits uint64, value int) bool {
+	return bits&(1<<uint(value)) != 0
+}
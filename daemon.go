@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/consumptions"
+	"github.com/alexanderromanov/nginx-logparser/metrics"
+	"github.com/alexanderromanov/nginx-logparser/systemd"
+	"github.com/alexanderromanov/nginx-logparser/websites"
+)
+
+const (
+	defaultDaemonInterval = 5 * time.Minute
+	defaultMaxWebsites    = 10000
+
+	websiteBytesMetric    = "nginx_logparser_website_bytes_total"
+	websiteRequestsMetric = "nginx_logparser_website_requests_total"
+	websiteUploadMetric   = "nginx_logparser_website_upload_bytes_total"
+	websiteClosedMetric   = "nginx_logparser_website_client_closed_requests_total"
+	ignoredBytesMetric    = "nginx_logparser_ignored_bytes_total"
+	ignoredRequestsMetric = "nginx_logparser_ignored_requests_total"
+	serverLinesRateMetric = "nginx_logparser_server_lines_per_second"
+	serverBytesRateMetric = "nginx_logparser_server_bytes_per_second"
+	serverLagMetric       = "nginx_logparser_server_lag_seconds"
+	serverFileReadMetric  = "nginx_logparser_server_file_read_bytes"
+	domainChangesMetric   = "nginx_logparser_domain_changes_total"
+)
+
+// daemonSettings control how logs are processed in daemon mode
+type daemonSettings struct {
+	// Interval between runs
+	Interval time.Duration
+
+	// DomainsRefresh is the interval domains list is re-fetched from the provider with in daemon and
+	// collector modes. The list is not refreshed if it is zero
+	DomainsRefresh time.Duration
+
+	// DomainsChangeLog is the file domains added, removed or moved by refreshes are appended to as JSON lines.
+	// Changes are only logged if it is empty
+	DomainsChangeLog string
+
+	// MinInterval and MaxInterval enable adaptive polling if MaxInterval is not zero: every server is polled
+	// with its own interval that is doubled while the server is idle and halved while it is busy.
+	// MinInterval defaults to Interval
+	MinInterval time.Duration
+	MaxInterval time.Duration
+
+	// IdleRecords is the number of records per poll up to which the server is considered idle
+	IdleRecords int64
+
+	// StatusListen is the address gRPC service returning live aggregation state listens on. It is not started if it is empty
+	StatusListen string
+
+	// QueueDirectory keeps consumptions waiting to be saved to storage, so that slow storage doesn't block
+	// reading logs. Consumptions are saved while logs are read if it is empty
+	QueueDirectory string
+}
+
+// metricsSettings control metrics endpoint
+type metricsSettings struct {
+	// Listen is the address metrics endpoint listens on. Metrics are not exposed if it is empty
+	Listen string
+
+	// MaxWebsites limits number of websites that get their own series, traffic of
+	// websites above the limit is reported with website_id="_overflow"
+	MaxWebsites int
+
+	// Pprof exposes runtime profiles under /debug/pprof/. It is set by -pprof flag
+	Pprof bool
+
+	// PprofToken is the bearer token required to get profiles. Profiles are not protected if it is empty
+	PprofToken string
+
+	// Textfile is the file counters of every run are written to in node_exporter textfile collector format,
+	// e.g. /var/lib/node_exporter/textfile/nginx_logparser.prom. It is not written if it is empty
+	Textfile string
+}
+
+var metricsRegistry = metrics.NewRegistry()
+
+// runDaemon processes logs of all servers every settings.Daemon.Interval. With adaptive polling
+// only servers whose own interval has passed are processed in every run
+func runDaemon(ctx context.Context, settings applicationSettings, domains *domainsCache) {
+	interval := settings.Daemon.Interval
+	if interval <= 0 {
+		interval = defaultDaemonInterval
+	}
+	poller := newAdaptivePoller(settings.Daemon, interval)
+
+	for ctx.Err() == nil {
+		if poller == nil {
+			runOnce(ctx, settings, domains)
+		} else if due := poller.due(settings.Servers, time.Now()); len(due) > 0 {
+			runSettings := settings
+			runSettings.Servers = due
+			report := runOnce(ctx, runSettings, domains)
+			poller.update(due, report, time.Now())
+		}
+		if err := domains.wait(); err != nil {
+			// initial domains list is not obtained, runs can't succeed without it
+			return
+		}
+
+		wait := interval
+		if poller != nil {
+			wait = poller.untilNext(settings.Servers, time.Now())
+		}
+		log.Printf("next run in %v\n", wait)
+		if !sleep(ctx, wait) {
+			return
+		}
+	}
+}
+
+// sleep waits for the interval and returns false if ctx is cancelled meanwhile. systemd watchdog is pinged
+// while waiting, so that it stops being pinged if the daemon loop is stuck
+func sleep(ctx context.Context, interval time.Duration) bool {
+	deadline := time.Now().Add(interval)
+	for {
+		systemd.PingWatchdog()
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return true
+		}
+		if ping := systemd.WatchdogInterval() / 2; ping > 0 && ping < wait {
+			wait = ping
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+	}
+}
+
+// shutdownContext returns context cancelled on SIGINT or SIGTERM, so that in-flight storage requests
+// are cancelled and state of unfinished servers is not saved. The next signal terminates the process
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("received %v, cancelling in-flight requests\n", sig)
+		signal.Stop(signals)
+		cancel()
+	}()
+	return ctx
+}
+
+// domainsCache provides current domains list to usages collections. Collections that are being
+// filled when the list is refreshed are switched to the new list
+type domainsCache struct {
+	sync.Mutex
+	domains     websites.Domains
+	collections map[*consumptions.UsagesCollection]bool
+
+	// ready is closed when initial domains list is obtained or failed to be obtained with err
+	ready chan struct{}
+	err   error
+}
+
+// fetchDomainsCache starts fetching domains list in background, so that servers can be connected meanwhile.
+// wait has to be called before usages collections are created
+func fetchDomainsCache(settings websites.DomainsInfoProviderSettings) *domainsCache {
+	c := &domainsCache{collections: map[*consumptions.UsagesCollection]bool{}, ready: make(chan struct{})}
+	go func() {
+		log.Println("Getting domains list")
+		domains, err := websites.GetDomains(settings)
+		if err != nil {
+			c.err = fmt.Errorf("failed to get domains list: %v", err)
+			log.Println(c.err)
+		} else {
+			c.Lock()
+			c.domains = domains
+			c.Unlock()
+			log.Printf("%d domain records obtained\n", len(domains))
+		}
+		close(c.ready)
+	}()
+	return c
+}
+
+// wait blocks until initial domains list is obtained
+func (c *domainsCache) wait() error {
+	<-c.ready
+	return c.err
+}
+
+// newUsagesCollection creates collection that is kept up to date with domains list until it is released
+func (c *domainsCache) newUsagesCollection(settings consumptions.UsagesSettings) *consumptions.UsagesCollection {
+	c.Lock()
+	defer c.Unlock()
+
+	usages := consumptions.NewUsagesCollection(c.domains, settings)
+	c.collections[usages] = true
+	return usages
+}
+
+func (c *domainsCache) release(usages *consumptions.UsagesCollection) {
+	c.Lock()
+	delete(c.collections, usages)
+	c.Unlock()
+}
+
+// set replaces domains list and returns the previous one
+func (c *domainsCache) set(domains websites.Domains) websites.Domains {
+	c.Lock()
+	defer c.Unlock()
+
+	previous := c.domains
+	c.domains = domains
+	for usages := range c.collections {
+		usages.SetDomains(domains)
+	}
+	return previous
+}
+
+// refreshEvery re-fetches domains list in background. Previous list is kept if provider fails.
+// Differences of lists are reported and appended to changeLog if it is not empty
+func (c *domainsCache) refreshEvery(settings websites.DomainsInfoProviderSettings, interval time.Duration, changeLog string) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			domains, err := websites.GetDomains(settings)
+			if err != nil {
+				log.Println("failed to refresh domains list: " + err.Error())
+				continue
+			}
+			previous := c.set(domains)
+			log.Printf("domains list is refreshed, %d domain records obtained\n", len(domains))
+			if previous != nil {
+				reportDomainChanges(websites.Diff(previous, domains), changeLog)
+			}
+		}
+	}()
+}
+
+// setupMetrics registers application metrics
+func setupMetrics(settings metricsSettings) {
+	maxWebsites := settings.MaxWebsites
+	if maxWebsites <= 0 {
+		maxWebsites = defaultMaxWebsites
+	}
+
+	metricsRegistry.Register(websiteBytesMetric, "Bytes sent by website and traffic class", metrics.Counter, "website_id", maxWebsites)
+	metricsRegistry.Register(websiteRequestsMetric, "Requests served by website and traffic class", metrics.Counter, "website_id", maxWebsites)
+	metricsRegistry.Register(websiteUploadMetric, "Bytes received by website", metrics.Counter, "website_id", maxWebsites)
+	metricsRegistry.Register(websiteClosedMetric, "Requests of website closed by client before response", metrics.Counter, "website_id", maxWebsites)
+	metricsRegistry.Register(ignoredBytesMetric, "Bytes of records dropped by ignore rules", metrics.Counter, "", 0)
+	metricsRegistry.Register(ignoredRequestsMetric, "Records dropped by ignore rules", metrics.Counter, "", 0)
+	metricsRegistry.Register(serverLinesRateMetric, "Log lines read per second during the last run of the server", metrics.Gauge, "", 0)
+	metricsRegistry.Register(serverBytesRateMetric, "Log bytes read per second during the last run of the server", metrics.Gauge, "", 0)
+	metricsRegistry.Register(serverLagMetric, "Time between the newest parsed record of the server and the end of reading", metrics.Gauge, "", 0)
+	metricsRegistry.Register(serverFileReadMetric, "Bytes fetched from log file of the server by the current run", metrics.Gauge, "", 0)
+	metricsRegistry.Register(domainChangesMetric, "Domains added, removed or moved to another website by refreshes of domains list", metrics.Counter, "", 0)
+}
+
+// serveMetrics starts metrics endpoint if it is configured. Metrics are served only in daemon mode,
+// counters of a single run are gone once the process exits
+func serveMetrics(settings metricsSettings) {
+	// socket passed by systemd socket activation takes precedence over configured address
+	listener, err := systemd.Listener()
+	if err != nil {
+		log.Println("failed to use activated socket for metrics: " + err.Error())
+	}
+	if listener == nil && settings.Listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsRegistry.Handler())
+	if settings.Pprof {
+		log.Println("exposing runtime profiles under /debug/pprof/")
+		mux.Handle("/debug/pprof/", bearerAuth(settings.PprofToken, http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", bearerAuth(settings.PprofToken, http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", bearerAuth(settings.PprofToken, http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", bearerAuth(settings.PprofToken, http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", bearerAuth(settings.PprofToken, http.HandlerFunc(pprof.Trace)))
+	}
+	go func() {
+		var err error
+		if listener != nil {
+			log.Printf("exposing metrics on activated socket %s\n", listener.Addr())
+			err = http.Serve(listener, mux)
+		} else {
+			log.Printf("exposing metrics on %s\n", settings.Listen)
+			err = http.ListenAndServe(settings.Listen, mux)
+		}
+		if err != nil {
+			log.Println("metrics endpoint failed: " + err.Error())
+		}
+	}()
+}
+
+// bearerAuth rejects requests without given bearer token. Requests are not checked if token is empty
+func bearerAuth(token string, handler http.Handler) http.Handler {
+	if token == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// notifyReady tells systemd that long running service is initialized. Watchdog is pinged by daemon loop
+// and while records are processed, so it is enabled only in daemon mode
+
+func notifyReady() {
+	if _, err := systemd.Notify("READY=1"); err != nil {
+		log.Println("failed to notify systemd: " + err.Error())
+		return
+	}
+	if !*daemon {
+		if systemd.WatchdogInterval() > 0 {
+			log.Println("systemd watchdog is supported only in daemon mode, watchdog pings are not sent")
+		}
+		return
+	}
+	systemd.EnableWatchdog()
+}
+
+func recordConsumptionMetrics(records consumptions.WebsiteConsumptions) {
+	for websiteID, websiteRecords := range records {
+		id := strconv.Itoa(websiteID)
+		for _, record := range websiteRecords {
+			addClassMetrics(id, "files", record.Files, record.FilesCount)
+			addClassMetrics(id, "dynamic", record.Dynamic, record.DynamicCount)
+			addClassMetrics(id, "other", record.Other, record.OtherCount)
+			addClassMetrics(id, "probe", record.Probe, record.ProbeCount)
+			metricsRegistry.Add(websiteUploadMetric, metrics.Labels{"website_id": id}, float64(record.UploadBytes))
+			metricsRegistry.Add(websiteClosedMetric, metrics.Labels{"website_id": id}, float64(record.ClientClosedCount))
+		}
+	}
+}
+
+func addClassMetrics(websiteID, class string, bytes int64, requests int) {
+	labels := metrics.Labels{"website_id": websiteID, "class": class}
+	metricsRegistry.Add(websiteBytesMetric, labels, float64(bytes))
+	metricsRegistry.Add(websiteRequestsMetric, labels, float64(requests))
+}
+
+func recordIgnoredMetrics(ignored []consumptions.IgnoredTraffic) {
+	for _, traffic := range ignored {
+		labels := metrics.Labels{"rule": traffic.Rule}
+		metricsRegistry.Add(ignoredBytesMetric, labels, float64(traffic.Bytes))
+		metricsRegistry.Add(ignoredRequestsMetric, labels, float64(traffic.Requests))
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+const (
+	// dashboardRefresh is the interval the terminal status view is redrawn with
+	dashboardRefresh = time.Second
+
+	// dashboardLogLines is the number of the latest log lines shown below servers
+	dashboardLogLines = 10
+
+	progressBarWidth = 30
+	serverNameWidth  = 24
+	stateWidth       = 60
+)
+
+// dashboard renders status of servers processed by the run in the terminal
+type dashboard struct {
+	out     io.Writer
+	logs    *logTail
+	servers []string
+
+	// records of servers at the previous frame, lines per second are measured between frames
+	records map[string]int64
+	drawnAt time.Time
+}
+
+// startDashboard redraws status of servers in the terminal until returned function is called. The latest log lines
+// are shown below the status instead of scrolling it away, the whole log is written to a temporary file which path
+// is printed when the view is closed. Status is not rendered if standard output is not a terminal
+func startDashboard(servers []logsreader.ConnectionInfo) func() {
+	if !isTerminal(os.Stdout) {
+		log.Println("status view needs a terminal, logs are written as usual")
+		return func() {}
+	}
+
+	now := time.Now()
+	d := &dashboard{out: os.Stdout, logs: &logTail{size: dashboardLogLines}, records: map[string]int64{}, drawnAt: now}
+	for _, conn := range servers {
+		if !conn.Disabled && !conn.InMaintenance(now) {
+			d.servers = append(d.servers, conn.ServerName())
+		}
+	}
+	logFile, err := ioutil.TempFile("", "nginx-logparser-*.log")
+	if err != nil {
+		log.Printf("cannot create log file of status view, only the latest lines are kept: %v\n", err)
+		log.SetOutput(d.logs)
+	} else {
+		log.SetOutput(io.MultiWriter(logFile, d.logs))
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(dashboardRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				d.draw(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		d.draw(time.Now())
+		log.SetOutput(os.Stderr)
+		if logFile != nil {
+			logFile.Close()
+			log.Printf("logs of the run are written to %s\n", logFile.Name())
+		}
+	}
+}
+
+func (d *dashboard) draw(now time.Time) {
+	var frame strings.Builder
+	// cursor is moved to the top left corner and screen is cleared, so that frames don't scroll
+	frame.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&frame, "%-*s %-*s %10s %10s %12s  %s\n", serverNameWidth, "SERVER", progressBarWidth+7, "PROGRESS",
+		"READ", "LINES/S", "LINES", "STATE")
+
+	elapsed := now.Sub(d.drawnAt).Seconds()
+	for _, name := range d.servers {
+		view, started := status.view(name)
+		var rate float64
+		if view.processing && elapsed > 0 && view.records >= d.records[name] {
+			rate = float64(view.records-d.records[name]) / elapsed
+		}
+		d.records[name] = view.records
+
+		fmt.Fprintf(&frame, "%-*s %s %10s %10.0f %12d  %s\n", serverNameWidth, truncate(name, serverNameWidth),
+			progressBar(view.read, view.expected), formatSize(view.read), rate, view.records, truncate(view.state(started), stateWidth))
+	}
+	d.drawnAt = now
+
+	frame.WriteString("\n")
+	for _, line := range d.logs.lines() {
+		frame.WriteString(truncate(line, 160) + "\n")
+	}
+	fmt.Fprint(d.out, frame.String())
+}
+
+func (view serverView) state(started bool) string {
+	switch {
+	case view.err != nil:
+		return "failed: " + view.err.Error()
+	case !started:
+		return "waiting"
+	case view.processing && view.file != "":
+		return "reading " + path.Base(view.file)
+	case view.processing:
+		return "connecting"
+	default:
+		return "done"
+	}
+}
+
+// progressBar returns bar of progressBarWidth filled proportionally to read part of expected bytes with percentage
+func progressBar(read, expected int64) string {
+	if expected <= 0 {
+		return "[" + strings.Repeat(" ", progressBarWidth) + "]    "
+	}
+	ratio := float64(read) / float64(expected)
+	if ratio > 1 {
+		// logs are written while they are read
+		ratio = 1
+	}
+	filled := int(ratio * progressBarWidth)
+	return fmt.Sprintf("[%s%s] %3.0f%%", strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled), ratio*100)
+}
+
+// formatSize returns number of bytes in binary units, e.g. 1.5 GiB
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value, exponent := float64(bytes)/unit, 0
+	for value >= unit && exponent < 4 {
+		value /= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exponent])
+}
+
+func truncate(value string, length int) string {
+	if len(value) <= length {
+		return value
+	}
+	return value[:length-3] + "..."
+}
+
+// isTerminal returns true if file is a character device, e.g. terminal the program is run in
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// logTail keeps the last lines written to log
+type logTail struct {
+	sync.Mutex
+	size    int
+	entries []string
+}
+
+func (t *logTail) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		t.entries = append(t.entries, line)
+	}
+	if len(t.entries) > t.size {
+		t.entries = append([]string(nil), t.entries[len(t.entries)-t.size:]...)
+	}
+	return len(p), nil
+}
+
+func (t *logTail) lines() []string {
+	t.Lock()
+	defer t.Unlock()
+	return append([]string(nil), t.entries...)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+const defaultSampleLines = 100
+
+// runDetectFormat reads sample lines of the server and prints settings of the best matching log format
+func runDetectFormat(settings applicationSettings, server string, sampleLines int) {
+	if sampleLines <= 0 {
+		sampleLines = defaultSampleLines
+	}
+
+	var conn *logsreader.ConnectionInfo
+	for i, c := range settings.Servers {
+		if c.Address == server || c.ServerName() == server {
+			conn = &settings.Servers[i]
+			break
+		}
+	}
+	if conn == nil {
+		log.Printf("server %s is not found in settings\n", server)
+		return
+	}
+
+	lines, err := logsreader.ReadSampleLines(*conn, sampleLines)
+	if err != nil {
+		log.Printf("failed to read sample lines of %s: %v\n", conn, err)
+		return
+	}
+
+	match := logsreader.DetectFormat(lines)
+	if match.Parsed == 0 {
+		log.Printf("none of known formats matches %d sample lines of %s\n", len(lines), conn)
+		return
+	}
+	log.Printf("%d of %d sample lines of %s are parsed\n", match.Parsed, len(lines), conn)
+
+	format := logFormatJSON{
+		Type:       match.Format.Type,
+		Delimiter:  match.Format.Delimiter,
+		Columns:    match.Format.Columns,
+		TimeLayout: match.Format.TimeLayout,
+		Escape:     match.Format.Escape,
+	}
+	output, err := json.MarshalIndent(map[string]logFormatJSON{"logFormat": format}, "", "  ")
+	if err != nil {
+		log.Println("failed to format settings: " + err.Error())
+		return
+	}
+	fmt.Println(string(output))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/metrics"
+	"github.com/alexanderromanov/nginx-logparser/websites"
+)
+
+// maxLoggedDomainChanges limits number of changes of each kind written to the application log on refresh
+const maxLoggedDomainChanges = 100
+
+// reportDomainChanges logs differences of refreshed domains list and counts them in metrics, so that sudden
+// attribution changes in billing can be correlated with control panel actions. Changes are also appended
+// to changeLog if it is not empty. Nothing is reported if the list didn't change
+func reportDomainChanges(diff websites.DomainsDiff, changeLog string) {
+	if diff.Empty() {
+		return
+	}
+	kinds := []struct {
+		name    string
+		changes []websites.DomainChange
+	}{
+		{"added", diff.Added},
+		{"removed", diff.Removed},
+		{"moved", diff.Moved},
+	}
+
+	var entries []domainChangeJSON
+	now := time.Now().UTC()
+	for _, kind := range kinds {
+		metricsRegistry.Add(domainChangesMetric, metrics.Labels{"change": kind.name}, float64(len(kind.changes)))
+		for i, change := range kind.changes {
+			if i == maxLoggedDomainChanges {
+				log.Printf("... %d more domains are %s\n", len(kind.changes)-i, kind.name)
+				break
+			}
+			switch kind.name {
+			case "added":
+				log.Printf("domain %s is added to website %d\n", change.Domain, change.NewWebsiteID)
+			case "removed":
+				log.Printf("domain %s is removed from website %d\n", change.Domain, change.OldWebsiteID)
+			default:
+				log.Printf("domain %s is moved from website %d to website %d\n", change.Domain, change.OldWebsiteID, change.NewWebsiteID)
+			}
+		}
+		if changeLog == "" {
+			continue
+		}
+		for _, change := range kind.changes {
+			entries = append(entries, domainChangeJSON{
+				Time:         now,
+				Domain:       change.Domain,
+				Change:       kind.name,
+				OldWebsiteID: change.OldWebsiteID,
+				NewWebsiteID: change.NewWebsiteID,
+			})
+		}
+	}
+
+	if len(entries) > 0 {
+		err := appendDomainChanges(changeLog, entries)
+		if err != nil {
+			log.Println("WARNING: " + err.Error())
+		}
+	}
+}
+
+// appendDomainChanges appends JSON line of every change to the change log
+func appendDomainChanges(fileName string, entries []domainChangeJSON) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open domains change log %s: %v", fileName, err)
+	}
+	encoder := json.NewEncoder(file)
+	for _, entry := range entries {
+		err = encoder.Encode(entry)
+		if err != nil {
+			break
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot append to domains change log %s: %v", fileName, err)
+	}
+	return nil
+}
+
+type domainChangeJSON struct {
+	Time         time.Time `json:"time"`
+	Domain       string    `json:"domain"`
+	Change       string    `json:"change"`
+	OldWebsiteID int       `json:"oldWebsiteId,omitempty"`
+	NewWebsiteID int       `json:"newWebsiteId,omitempty"`
+}
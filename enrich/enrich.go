@@ -0,0 +1,151 @@
+// Package enrich passes log records through an external program, so that custom business logic
+// can modify records without recompiling the parser
+package enrich
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+const (
+	defaultBatchSize = 1000
+
+	// maxResponseSize limits size of a line the program responds with
+	maxResponseSize = 256 * 1024 * 1024
+
+	initialResponseBuffer = 64 * 1024
+)
+
+// Settings describe enrichment program
+type Settings struct {
+	// Command is the program started once per server. Records are not enriched if it is empty.
+	// The program reads batches of records from stdin, one JSON array of logsreader.LogRecord per line,
+	// and writes a JSON array of enriched records per line to stdout. Records can be modified or dropped
+	Command string
+	Args    []string
+
+	// BatchSize is the number of records sent at once. defaultBatchSize is used if it is zero
+	BatchSize int
+}
+
+// Enricher sends records to the program in batches and passes enriched records to processor
+type Enricher struct {
+	settings  Settings
+	processor func(*logsreader.LogRecord)
+
+	sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+	batch  []*logsreader.LogRecord
+	err    error
+}
+
+// Start starts the program. processor receives enriched records
+func Start(settings Settings, processor func(*logsreader.LogRecord)) (*Enricher, error) {
+	if settings.BatchSize <= 0 {
+		settings.BatchSize = defaultBatchSize
+	}
+
+	cmd := exec.Command(settings.Command, settings.Args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open stdin of %s: %v", settings.Command, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open stdout of %s: %v", settings.Command, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start %s: %v", settings.Command, err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, initialResponseBuffer), maxResponseSize)
+	return &Enricher{
+		settings:  settings,
+		processor: processor,
+		cmd:       cmd,
+		stdin:     stdin,
+		stdout:    scanner,
+	}, nil
+}
+
+// Add queues record for enrichment. It is safe for concurrent use. Failures are returned by Flush
+func (e *Enricher) Add(record *logsreader.LogRecord) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.batch = append(e.batch, record)
+	if len(e.batch) >= e.settings.BatchSize {
+		e.flush()
+	}
+}
+
+// Flush enriches queued records. It has to be called before records passed to processor are saved
+func (e *Enricher) Flush() error {
+	e.Lock()
+	defer e.Unlock()
+
+	e.flush()
+	return e.err
+}
+
+// Close stops the program
+func (e *Enricher) Close() error {
+	e.stdin.Close()
+	return e.cmd.Wait()
+}
+
+func (e *Enricher) flush() {
+	if len(e.batch) == 0 {
+		return
+	}
+	batch := e.batch
+	e.batch = nil
+	if e.err != nil {
+		// program is in unknown state after failure, records are not counted and the run fails
+		return
+	}
+
+	records, err := e.enrich(batch)
+	if err != nil {
+		e.err = fmt.Errorf("enrichment by %s failed: %v", e.settings.Command, err)
+		return
+	}
+	for _, record := range records {
+		e.processor(record)
+	}
+}
+
+func (e *Enricher) enrich(batch []*logsreader.LogRecord) ([]*logsreader.LogRecord, error) {
+	request, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.stdin.Write(append(request, '\n')); err != nil {
+		return nil, fmt.Errorf("cannot send records: %v", err)
+	}
+
+	if !e.stdout.Scan() {
+		err := e.stdout.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("cannot read enriched records: %v", err)
+	}
+	response := e.stdout.Bytes()
+	var records []*logsreader.LogRecord
+	if err := json.Unmarshal(response, &records); err != nil {
+		return nil, fmt.Errorf("cannot parse enriched records: %v", err)
+	}
+	return records, nil
+}
@@ -0,0 +1,224 @@
+// Package gelf ships parsed log records to Graylog as GELF messages over UDP. Messages larger than
+// a datagram are split into GELF chunks
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+const (
+	// CompressionGzip, CompressionZlib and CompressionNone are supported compressions of messages
+	CompressionGzip = "gzip"
+	CompressionZlib = "zlib"
+	CompressionNone = "none"
+
+	// defaultChunkSize fits chunk into datagram of the most common MTU
+	defaultChunkSize = 1420
+
+	// maxChunks is the number of chunks Graylog accepts for a single message
+	maxChunks = 128
+
+	chunkHeaderSize = 12
+
+	// levelInfo is syslog severity of messages
+	levelInfo = 6
+)
+
+var chunkMagic = []byte{0x1e, 0x0f}
+
+// compressor is implemented by gzip and zlib writers which can be reused after Reset
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// gzipWriters and zlibWriters keep compressors between messages, a new writer allocates
+// hundreds of kilobytes of compression state
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+// Settings describe Graylog GELF UDP input
+type Settings struct {
+	// Address is host:port of the input. Records are not shipped if it is empty
+	Address string
+
+	// Compression of messages: CompressionGzip (default), CompressionZlib or CompressionNone
+	Compression string
+
+	// ChunkSize is the maximum size of datagram. defaultChunkSize is used if it is zero
+	ChunkSize int
+}
+
+// Validate checks that settings can be used to ship records
+func (settings Settings) Validate() error {
+	switch settings.Compression {
+	case "", CompressionGzip, CompressionZlib, CompressionNone:
+	default:
+		return fmt.Errorf("unknown gelf compression %s", settings.Compression)
+	}
+	if settings.ChunkSize < 0 || (settings.ChunkSize > 0 && settings.ChunkSize <= chunkHeaderSize) {
+		return fmt.Errorf("gelf chunk size %d is too small", settings.ChunkSize)
+	}
+	return nil
+}
+
+// Writer sends records to Graylog. It is safe for concurrent use
+type Writer struct {
+	settings Settings
+	conn     net.Conn
+	host     string
+
+	// idPrefix and counter build unique IDs of chunked messages
+	idPrefix uint32
+	counter  uint32
+
+	// failed is the number of records that couldn't be sent
+	failed int64
+}
+
+// Dial opens UDP socket to the input. host is reported as the source of messages, e.g. name of the server logs are read from
+func Dial(settings Settings, host string) (*Writer, error) {
+	if settings.ChunkSize <= 0 {
+		settings.ChunkSize = defaultChunkSize
+	}
+	conn, err := net.Dial("udp", settings.Address)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to gelf input %s: %v", settings.Address, err)
+	}
+
+	var prefix [4]byte
+	if _, err := rand.Read(prefix[:]); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot generate gelf message id: %v", err)
+	}
+	return &Writer{settings: settings, conn: conn, host: host, idPrefix: binary.BigEndian.Uint32(prefix[:])}, nil
+}
+
+// Close closes the socket
+func (w *Writer) Close() error {
+	return w.conn.Close()
+}
+
+// Failed returns number of records that couldn't be sent
+func (w *Writer) Failed() int64 {
+	return atomic.LoadInt64(&w.failed)
+}
+
+// Send ships the record. Delivery is not confirmed by UDP, only local failures are counted
+func (w *Writer) Send(record *logsreader.LogRecord) {
+	if err := w.send(record); err != nil {
+		atomic.AddInt64(&w.failed, 1)
+	}
+}
+
+func (w *Writer) send(record *logsreader.LogRecord) error {
+	data, err := json.Marshal(w.message(record))
+	if err != nil {
+		return err
+	}
+	data, err = w.compress(data)
+	if err != nil {
+		return err
+	}
+
+	if len(data) <= w.settings.ChunkSize {
+		_, err = w.conn.Write(data)
+		return err
+	}
+
+	payloadSize := w.settings.ChunkSize - chunkHeaderSize
+	count := (len(data) + payloadSize - 1) / payloadSize
+	if count > maxChunks {
+		return fmt.Errorf("gelf message of %d bytes needs more than %d chunks", len(data), maxChunks)
+	}
+
+	var id [8]byte
+	binary.BigEndian.PutUint32(id[:4], w.idPrefix)
+	binary.BigEndian.PutUint32(id[4:], atomic.AddUint32(&w.counter, 1))
+	chunk := make([]byte, 0, w.settings.ChunkSize)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * payloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk = append(chunk[:0], chunkMagic...)
+		chunk = append(chunk, id[:]...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, data[i*payloadSize:end]...)
+		if _, err := w.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) compress(data []byte) ([]byte, error) {
+	var pool *sync.Pool
+	switch w.settings.Compression {
+	case "", CompressionGzip:
+		pool = &gzipWriters
+	case CompressionZlib:
+		pool = &zlibWriters
+	default:
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	writer := pool.Get().(compressor)
+	defer pool.Put(writer)
+	writer.Reset(&buf)
+
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// message builds GELF 1.1 message of the record. Fields of the record are sent as additional fields
+func (w *Writer) message(record *logsreader.LogRecord) map[string]interface{} {
+	message := map[string]interface{}{
+		"version":       "1.1",
+		"host":          w.host,
+		"short_message": record.Verb + " " + record.Domain + record.Path + " " + strconv.Itoa(record.HTTPStatusCode),
+		"timestamp":     float64(record.Time.UnixNano()) / 1e9,
+		"level":         levelInfo,
+
+		"_client_ip":  record.IPAddress,
+		"_duration":   record.Duration,
+		"_verb":       record.Verb,
+		"_path":       record.Path,
+		"_status":     record.HTTPStatusCode,
+		"_size":       record.Size,
+		"_domain":     record.Domain,
+		"_referrer":   record.Referrer,
+		"_user_agent": record.UserAgent,
+	}
+	if record.RequestID != "" {
+		message["_request_id"] = record.RequestID
+	}
+	if record.RequestLength != 0 {
+		message["_request_length"] = record.RequestLength
+	}
+	if record.Marker != "" {
+		message["_marker"] = record.Marker
+	}
+	return message
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alexanderromanov/nginx-logparser/consumptions"
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+const defaultImportStateFile = "import_state.json"
+
+// importSettings describe blob container with archived access logs that can be imported
+type importSettings struct {
+	// Container of the main storage account archived logs are stored in
+	Container string
+
+	// LogFormat of archived logs
+	LogFormat logsreader.LogFormat
+
+	// Server is the name consumptions are saved under. Container name is used if it is empty
+	Server string
+
+	// StateFile lists blobs that are already imported, so that import can be resumed
+	StateFile string
+}
+
+// importState maps names of imported blobs to their etags
+type importState map[string]string
+
+// runImport imports consumptions from archived logs with names starting with prefix. Blobs are
+// imported one by one and each of them is recorded in the state file once its consumptions are saved
+func runImport(ctx context.Context, settings applicationSettings, domains *domainsCache, prefix string) error {
+	ctx, span := tracer.Start(ctx, "import")
+	defer span.End()
+
+	container := settings.Import.Container
+	if container == "" {
+		return fmt.Errorf("container of archived logs is not configured")
+	}
+	if settings.AzureStorage.AccountName == "" {
+		return fmt.Errorf("azure storage is not configured")
+	}
+	serverName := settings.Import.Server
+	if serverName == "" {
+		serverName = container
+	}
+	stateFile := settings.Import.StateFile
+	if stateFile == "" {
+		stateFile = defaultImportStateFile
+	}
+
+	state, err := readImportState(stateFile)
+	if err != nil {
+		return err
+	}
+
+	client, err := settings.AzureStorage.Client()
+	if err != nil {
+		return err
+	}
+	blobService := client.GetBlobService()
+	blobs, err := blobService.ListBlobs(ctx, container, prefix)
+	if err != nil {
+		return fmt.Errorf("cannot list blobs of %s: %v", container, err)
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Name < blobs[j].Name })
+	log.Printf("%d blobs of %s start with %q\n", len(blobs), container, prefix)
+
+	err = domains.wait()
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range blobs {
+		if state[blob.Name] == blob.Etag {
+			log.Printf("%s is already imported\n", blob.Name)
+			continue
+		}
+		// blob modified before the processing window can only contain older records
+		if since := settings.Usages.Since; !since.IsZero() && blob.LastModified.Before(since) {
+			continue
+		}
+
+		log.Printf("importing %s (%d bytes)\n", blob.Name, blob.Size)
+		err = importBlob(ctx, settings, domains, serverName, blob.Name)
+		if err != nil {
+			return fmt.Errorf("cannot import %s: %v", blob.Name, err)
+		}
+
+		state[blob.Name] = blob.Etag
+		err = saveImportState(stateFile, state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importBlob parses single archived log and saves its consumptions
+func importBlob(ctx context.Context, settings applicationSettings, domains *domainsCache, serverName, name string) error {
+	usages := domains.newUsagesCollection(settings.Usages)
+	defer domains.release(usages)
+
+	err := readBlob(ctx, settings, name, usages.AddRecord)
+	if err != nil {
+		return err
+	}
+
+	var accountRecords consumptions.AccountConsumptions
+	if settings.AzureStorage.AccountTableNameTemplate != "" {
+		accountRecords = usages.GetAccountConsumption()
+	}
+	// blob is imported from its beginning, so repeated import of the blob replaces rows saved before
+	saveID := importSaveID(name, 0)
+	var stats consumptions.SaveStats
+	return storeConsumptions(ctx, settings, serverName, saveID, usages.GetTrafficConsumption(), accountRecords, &stats)
+}
+
+// readBlob passes records of archived log to recordProcessor. Logs with .gz extension are unzipped
+func readBlob(ctx context.Context, settings applicationSettings, name string, recordProcessor func(*logsreader.LogRecord)) error {
+	client, err := settings.AzureStorage.Client()
+	if err != nil {
+		return err
+	}
+	body, err := client.GetBlobService().GetBlob(ctx, settings.Import.Container, name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var reader io.Reader = body
+	if strings.HasSuffix(name, ".gz") {
+		unzipped, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer unzipped.Close()
+		reader = unzipped
+	}
+
+	_, err = logsreader.ReadStream(ctx, name, reader, settings.Import.LogFormat, recordProcessor)
+	return err
+}
+
+// importSaveID identifies records of blob read from offset. Blob names can contain characters
+// not allowed in row keys, so they are hashed
+func importSaveID(name string, offset int) string {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%s|%d", name, offset)
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+func readImportState(fileName string) (importState, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return importState{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read import state from %s: %v", fileName, err)
+	}
+
+	var state importState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse json from %s: %v", fileName, err)
+	}
+	if state == nil {
+		state = importState{}
+	}
+	return state, nil
+}
+
+func saveImportState(fileName string, state importState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("cannot serialize import state: %v", err)
+	}
+	err = ioutil.WriteFile(fileName, data, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot save import state to %s: %v", fileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package logsreader
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authMethods returns SSH authentication methods of the connection. Key is offered before password.
+// Password is used alone if key file is not specified
+func authMethods(conn ConnectionInfo) ([]ssh.AuthMethod, error) {
+	var result []ssh.AuthMethod
+	if conn.KeyFile != "" {
+		signer, err := loadSigner(conn)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ssh.PublicKeys(signer))
+	}
+	if conn.Password != "" || conn.KeyFile == "" {
+		result = append(result, ssh.Password(conn.Password))
+	}
+	return result, nil
+}
+
+// loadSigner reads private key of the connection, e.g. RSA, ECDSA or ed25519 one, and combines it with
+// OpenSSH certificate if it is specified. Files are read on every connection, so that short-lived
+// certificates can be renewed without restart
+func loadSigner(conn ConnectionInfo) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(conn.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read private key: %v", err)
+	}
+	var signer ssh.Signer
+	if conn.KeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(conn.KeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse private key %s: %v", conn.KeyFile, err)
+	}
+	if conn.CertificateFile == "" {
+		return signer, nil
+	}
+
+	data, err = ioutil.ReadFile(conn.CertificateFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read certificate: %v", err)
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse certificate %s: %v", conn.CertificateFile, err)
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", conn.CertificateFile)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("certificate %s is not issued for key %s", conn.CertificateFile, conn.KeyFile)
+	}
+	// server would reject expired certificate with generic authentication error
+	if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().Unix() >= int64(cert.ValidBefore) {
+		return nil, &Error{Cause: ErrAuthFailed, Err: fmt.Errorf("certificate %s expired at %v", conn.CertificateFile, time.Unix(int64(cert.ValidBefore), 0).UTC())}
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
@@ -0,0 +1,94 @@
+package logsreader
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// RotatedLogsKeep leaves rotated log files on the server
+	RotatedLogsKeep = "keep"
+
+	// RotatedLogsDelete deletes rotated log files once they are processed
+	RotatedLogsDelete = "delete"
+
+	// RotatedLogsArchive moves rotated log files to ConnectionInfo.ArchiveDirectory once they are processed
+	RotatedLogsArchive = "archive"
+)
+
+// CleanupRotatedLogs deletes or archives rotated log files fully processed by previous runs. It has to be
+// called only after consumption read up to newState is stored. The newest rotated file is kept because
+// it is used to detect the next rotation. Other files are cleaned up only if they are known to be processed,
+// so that files rotated before the server was first read or skipped by reader are not lost. Names of cleaned
+// up files are returned
+func CleanupRotatedLogs(conn ConnectionInfo, prevState, newState State) ([]string, error) {
+	switch conn.RotatedLogs {
+	case "", RotatedLogsKeep:
+		return nil, nil
+	case RotatedLogsDelete:
+	case RotatedLogsArchive:
+		if conn.ArchiveDirectory == "" {
+			return nil, fmt.Errorf("archive directory is not specified for %s", conn)
+		}
+	default:
+		return nil, fmt.Errorf("unknown rotated logs action %s", conn.RotatedLogs)
+	}
+
+	if prevState.RotatedLog.Name == "" || newState.RotatedLog.Name == "" || prevState.RotatedLog.isSame(newState.RotatedLog) {
+		return nil, nil
+	}
+
+	source, err := openLogSource(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer source.close()
+
+	logPath := conn.logPath()
+	logDir := remoteDir(logPath)
+	logName := remoteBase(logPath)
+	entries, err := source.readDir(logDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read directory %s: %v", logDir, err)
+	}
+
+	var cleaned []string
+	for _, entry := range entries {
+		fileName := remoteJoin(logDir, entry.Name())
+		if entry.IsDir() || entry.Name() == logName || !strings.HasPrefix(entry.Name(), logName) || fileName == newState.RotatedLog.Name {
+			continue
+		}
+		if !wasProcessed(entry, prevState) {
+			continue
+		}
+
+		if conn.RotatedLogs == RotatedLogsDelete {
+			err = source.remove(fileName)
+		} else {
+			err = source.rename(fileName, remoteJoin(conn.ArchiveDirectory, entry.Name()))
+		}
+		if err != nil {
+			return cleaned, fmt.Errorf("cannot %s %s: %v", conn.RotatedLogs, fileName, err)
+		}
+		cleaned = append(cleaned, fileName)
+	}
+	return cleaned, nil
+}
+
+// wasProcessed returns true if the file is the rotated log of the previous run. It was read to the end by
+// the run that found the next rotated log. The file is matched by modification time as well, so that it is
+// found after logrotate renames or compresses it, e.g. access.log.1 to access.log.2.gz. Files listed in
+// SeenRotated were read to the end by the previous run too
+func wasProcessed(entry os.FileInfo, prevState State) bool {
+	modified := entry.ModTime().Unix()
+	if modified == prevState.RotatedLog.ModifiedDate {
+		return true
+	}
+	for _, seen := range prevState.SeenRotated {
+		if modified == seen.ModifiedDate {
+			return true
+		}
+	}
+	return false
+}
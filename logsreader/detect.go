@@ -0,0 +1,108 @@
+package logsreader
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FormatMatch is the result of trying a log format on sample lines
+type FormatMatch struct {
+	Format LogFormat
+
+	// Parsed is the number of sample lines the format parsed
+	Parsed int
+}
+
+// defaultCSVColumns is the order of columns in CSV formats tried by DetectFormat, the same as in nginx format
+var defaultCSVColumns = []string{"ip", "time", "duration", "request", "status", "size", "domain", "referrer", "userAgent"}
+
+// candidateFormats returns formats DetectFormat tries in order of preference
+func candidateFormats() []LogFormat {
+	result := []LogFormat{{Type: FormatNginx}}
+	for _, delimiter := range []string{",", "\t", "|", ";"} {
+		for _, layout := range []string{defaultCSVTimeLayout, time.RFC3339} {
+			format := LogFormat{Type: FormatCSV, Delimiter: delimiter, Columns: defaultCSVColumns}
+			if layout != defaultCSVTimeLayout {
+				format.TimeLayout = layout
+			}
+			result = append(result, format)
+		}
+	}
+	return result
+}
+
+// DetectFormat tries known format templates on sample lines and returns the one parsing most of them.
+// Formats listed first win ties
+func DetectFormat(lines []string) FormatMatch {
+	var best FormatMatch
+	for _, format := range candidateFormats() {
+		parse, err := newLineParser(format)
+		if err != nil {
+			continue
+		}
+
+		match := FormatMatch{Format: format}
+		for _, line := range lines {
+			if _, err := parse(line); err == nil {
+				match.Parsed++
+			}
+		}
+		if match.Parsed > best.Parsed {
+			best = match
+		}
+	}
+	if best.Parsed > 0 {
+		best.Format.Escape = detectEscape(lines)
+	}
+	return best
+}
+
+// detectEscape returns escape mode of the first sample line with escape sequences. Empty string is
+// returned if none of lines have them
+func detectEscape(lines []string) string {
+	for _, line := range lines {
+		switch {
+		// backslash itself is escaped as \\ in JSON, but as \x5C by default
+		case strings.Contains(line, `\"`), strings.Contains(line, `\u00`), strings.Contains(line, `\\`):
+			return EscapeJSON
+		case strings.Contains(line, `\x`):
+			return EscapeDefault
+		}
+	}
+	return ""
+}
+
+// ReadSampleLines returns up to count first lines of access log of the server
+func ReadSampleLines(conn ConnectionInfo, count int) ([]string, error) {
+	source, err := openLogSource(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer source.close()
+
+	logPath := conn.logPath()
+	file, err := source.open(logPath, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	limits := newLineLimits(conn)
+	reader := bufio.NewReaderSize(file, limits.bufferSize)
+	var result []string
+	for len(result) < count {
+		line, _, err := readLine(reader, limits.maxLineLength)
+		if err != nil {
+			break
+		}
+		if line != nil {
+			result = append(result, string(line))
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%s of %s is empty", logPath, conn)
+	}
+	return result, nil
+}
@@ -0,0 +1,51 @@
+package logsreader
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrAuthFailed indicates that the server rejected credentials of the connection
+	ErrAuthFailed = errors.New("authentication failed")
+
+	// ErrLogNotFound indicates that log file doesn't exist on the server
+	ErrLogNotFound = errors.New("log file not found")
+
+	// ErrRotationMismatch indicates that rotated log file the state points to cannot be found on the server,
+	// e.g. logs were rotated more than once since the last run
+	ErrRotationMismatch = errors.New("rotated log file doesn't match saved state")
+)
+
+// errBudgetReached stops reading once ConnectionInfo.MaxRunBytes are read. It is not returned by exported functions
+var errBudgetReached = errors.New("byte budget of the run is reached")
+
+// Error is the failure of reading logs with known cause. errors.Is reports whether the cause
+// is one of the Err variables of the package, errors.As gives access to the error itself
+type Error struct {
+	// Cause is one of ErrAuthFailed, ErrLogNotFound and ErrRotationMismatch
+	Cause error
+
+	// Err is the original error
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the original error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is the cause of the error
+func (e *Error) Is(target error) bool {
+	return target == e.Cause
+}
+
+// isAuthError returns true if ssh handshake failed because none of the auth methods were accepted.
+// ssh package doesn't export the error, so it is recognized by its message
+func isAuthError(err error) bool {
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
@@ -0,0 +1,179 @@
+package logsreader
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// FormatNginx is the default quoted nginx log format parsed by parseLine
+	FormatNginx = "nginx"
+
+	// FormatCSV is the format of logs written as delimiter separated values
+	FormatCSV = "csv"
+
+	defaultCSVTimeLayout = "02/Jan/2006:15:04:05 -0700"
+	ignoredColumn        = "-"
+)
+
+// Escape modes match escape parameter of nginx log_format, so that values are decoded the same way
+// whatever servers are configured with
+const (
+	// EscapeAuto decodes sequences of both escape=default and escape=json. It is used for nginx format by default
+	EscapeAuto = "auto"
+
+	// EscapeDefault decodes \xHH sequences of escape=default
+	EscapeDefault = "default"
+
+	// EscapeJSON decodes \", \\, \n, \uHHHH and other sequences of escape=json
+	EscapeJSON = "json"
+
+	// EscapeNone keeps values as they are logged with escape=none. Backslash doesn't escape quotes then
+	EscapeNone = "none"
+)
+
+// LogFormat describes format of log lines on the server
+type LogFormat struct {
+	// Type is FormatNginx (default) or FormatCSV
+	Type string
+
+	// Delimiter separates CSV columns. Comma is used if it is empty
+	Delimiter string
+
+	// Columns lists CSV columns in order. Supported names are ip, time, duration, request, status,
+	// size, domain, referrer, userAgent, requestId, requestLength and marker. Columns named "-" are ignored
+	Columns []string
+
+	// TimeLayout is Go layout of CSV time column. nginx $time_local layout is used if it is empty
+	TimeLayout string
+
+	// Escape is the escape mode of log_format: EscapeAuto, EscapeDefault, EscapeJSON or EscapeNone.
+	// If it is empty, values of nginx format are decoded with EscapeAuto and CSV values are not decoded
+	Escape string
+}
+
+// lineParser parses line of log file into LogRecord
+type lineParser func(line string) (*LogRecord, error)
+
+// NewLineParser returns function parsing lines of given format, e.g. lines received from agents
+func NewLineParser(format LogFormat) (func(line string) (*LogRecord, error), error) {
+	return newLineParser(format)
+}
+
+func newLineParser(format LogFormat) (lineParser, error) {
+	switch format.Type {
+	case "", FormatNginx:
+		escape := format.Escape
+		if escape == "" {
+			escape = EscapeAuto
+		}
+		unescape, err := unescaper(escape)
+		if err != nil {
+			return nil, err
+		}
+		return func(line string) (*LogRecord, error) { return parseLine(line, unescape) }, nil
+	case FormatCSV:
+		return newCSVParser(format)
+	default:
+		return nil, fmt.Errorf("unknown log format %s", format.Type)
+	}
+}
+
+var csvColumns = map[string]func(raw *rawRecord, value string){
+	"ip":            func(raw *rawRecord, value string) { raw.IPAddress = value },
+	"time":          func(raw *rawRecord, value string) { raw.Time = value },
+	"duration":      func(raw *rawRecord, value string) { raw.Duration = value },
+	"request":       func(raw *rawRecord, value string) { raw.Request = value },
+	"status":        func(raw *rawRecord, value string) { raw.HTTPStatusCode = value },
+	"size":          func(raw *rawRecord, value string) { raw.Size = value },
+	"domain":        func(raw *rawRecord, value string) { raw.Domain = value },
+	"referrer":      func(raw *rawRecord, value string) { raw.Referrer = value },
+	"userAgent":     func(raw *rawRecord, value string) { raw.UserAgent = value },
+	"requestId":     func(raw *rawRecord, value string) { raw.RequestID = value },
+	"requestLength": func(raw *rawRecord, value string) { raw.RequestLength = value },
+	"marker":        func(raw *rawRecord, value string) { raw.Marker = value },
+	"contentRange":  func(raw *rawRecord, value string) { raw.ContentRange = value },
+	"serverPort":    func(raw *rawRecord, value string) { raw.ServerPort = value },
+}
+
+func newCSVParser(format LogFormat) (lineParser, error) {
+	delimiter := ','
+	if format.Delimiter != "" {
+		if utf8.RuneCountInString(format.Delimiter) != 1 {
+			return nil, fmt.Errorf("CSV delimiter must be a single character, got %q", format.Delimiter)
+		}
+		delimiter, _ = utf8.DecodeRuneInString(format.Delimiter)
+	}
+
+	if len(format.Columns) == 0 {
+		return nil, errors.New("CSV columns are not specified")
+	}
+	setters := make([]func(raw *rawRecord, value string), len(format.Columns))
+	for i, column := range format.Columns {
+		if column == ignoredColumn {
+			continue
+		}
+		setter, ok := csvColumns[column]
+		if !ok {
+			return nil, fmt.Errorf("unknown CSV column %s", column)
+		}
+		setters[i] = setter
+	}
+
+	timeLayout := format.TimeLayout
+	if timeLayout == "" {
+		timeLayout = defaultCSVTimeLayout
+	}
+
+	var unescape func(string) string
+	if format.Escape != "" {
+		var err error
+		unescape, err = unescaper(format.Escape)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(line string) (*LogRecord, error) {
+		reader := csv.NewReader(strings.NewReader(line))
+		reader.Comma = delimiter
+		reader.LazyQuotes = true
+		reader.FieldsPerRecord = len(setters)
+
+		values, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("cannot split CSV line %s: %v", line, err)
+		}
+
+		var raw rawRecord
+		for i, value := range values {
+			if setters[i] == nil {
+				continue
+			}
+			if unescape != nil && strings.Contains(value, `\`) {
+				value = unescape(value)
+			}
+			setters[i](&raw, value)
+		}
+		return raw.parse(timeLayout)
+	}, nil
+}
+
+// unescaper returns function decoding values logged with the escape mode. Nil is returned if values are kept as is
+func unescaper(escape string) (func(string) string, error) {
+	switch escape {
+	case EscapeAuto:
+		return unescapeField, nil
+	case EscapeDefault:
+		return unescapeDefault, nil
+	case EscapeJSON:
+		return unescapeJSON, nil
+	case EscapeNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown escape mode %s", escape)
+	}
+}
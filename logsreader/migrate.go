@@ -0,0 +1,72 @@
+package logsreader
+
+import (
+	"context"
+	"fmt"
+)
+
+// MigrationResult describes how state of the server was reconciled with its log files
+type MigrationResult struct {
+	// FromVersion is the schema version of the state before migration. 0 if server has no state
+	FromVersion int
+
+	// Rotated is true if logs were rotated since the state was saved. The next run reads the rest
+	// of the rotated file from the saved offset
+	Rotated bool
+
+	// Reset is true if saved offset was beyond the end of access.log, e.g. because log was truncated
+	// by copytruncate rotation, and reading is restarted from the beginning of the file
+	Reset bool
+
+	// StateBefore and StateAfter are the state read from the server and the state saved by migration.
+	// They are zero if state is not migrated
+	StateBefore State
+	StateAfter  State
+}
+
+// MigrateState reconciles state of the server saved with older schema with log files on the server and saves
+// it with CurrentStateVersion. Missing state and state of the current version are left as is. State is not
+// changed and error with ErrRotationMismatch cause is returned if its rotated log is not found on the server
+func MigrateState(ctx context.Context, conn ConnectionInfo) (MigrationResult, error) {
+	state, err := GetState(conn)
+	if err == ErrNoStateFile {
+		return MigrationResult{}, nil
+	}
+	if err != nil {
+		return MigrationResult{}, err
+	}
+	result := MigrationResult{FromVersion: state.Version}
+	if state.Version == CurrentStateVersion {
+		return result, nil
+	}
+	before := state
+
+	source, err := openLogSource(conn)
+	if err != nil {
+		return result, err
+	}
+	defer source.close()
+
+	logPath := conn.logPath()
+	rotatedFiles, logSize := findRotatedFiles(ctx, source.readDir, logPath)
+	rotated := newestRotated(rotatedFiles)
+	switch {
+	case rotated.isSame(state.RotatedLog):
+		if int64(state.BytesRead) > logSize {
+			result.Reset = true
+			state.BytesRead = 0
+		}
+	case rotated.Name == "":
+		return result, &Error{Cause: ErrRotationMismatch, Err: fmt.Errorf("rotated log file %s is not found in %s", state.RotatedLog.Name, remoteDir(logPath))}
+	default:
+		result.Rotated = true
+	}
+
+	err = SaveState(conn, state)
+	if err != nil {
+		return result, err
+	}
+	state.Version = CurrentStateVersion
+	result.StateBefore, result.StateAfter = before, state
+	return result, nil
+}
@@ -3,7 +3,6 @@ package logsreader
 import (
 	"errors"
 	"fmt"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -21,72 +20,342 @@ type LogRecord struct {
 	Domain         string
 	Referrer       string
 	UserAgent      string
+
+	// Incomplete is true when some of numeric fields were logged as "-" and were treated as zero
+	Incomplete bool
+
+	// RequestID is nginx $request_id correlating the record with application traces. Empty if it is not logged
+	RequestID string
+
+	// RequestLength is nginx $request_length, the size of request including headers and body. 0 if it is not logged
+	RequestLength int
+
+	// Marker is set by nginx for records that are not billed, e.g. internal health checks tagged with map. Empty if it is not logged
+	Marker string
+
+	// RangeTotal is the size of the whole file from $sent_http_content_range of partial responses. 0 if it is not logged or unknown
+	RangeTotal int
+
+	// ServerPort is nginx $server_port the request was received on. 0 if it is not logged
+	ServerPort int
+
+	// Malformed is true if request line is not a valid HTTP request, e.g. binary junk sent by port scanners.
+	// Verb of such records is InvalidVerb
+	Malformed bool
+}
+
+// InvalidVerb replaces verbs of malformed request lines
+const InvalidVerb = "INVALID"
+
+// knownVerbs are methods of HTTP, WebDAV and cache purging requests
+var knownVerbs = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true, "CONNECT": true, "OPTIONS": true,
+	"TRACE": true, "PATCH": true, "PROPFIND": true, "PROPPATCH": true, "MKCOL": true, "COPY": true, "MOVE": true,
+	"LOCK": true, "UNLOCK": true, "PURGE": true,
 }
 
+// missingValue is written by nginx instead of values that are not available
+const missingValue = "-"
+
+const nginxTimeLayout = "[02/Jan/2006:15:04:05 -0700]"
+
 // ParseLine parses line of nginx logs
 // Expected line looks like this: "111.111.111.111(-)" "[31/Jul/2016:22:54:30 +0400]" "0.247" "GET /some/file.jpg HTTP/1.1" "200" "32327" "some-domain.com" "http://some-referrer.com/" "User Agent String"
-func parseLine(line string) (*LogRecord, error) {
-	results, err := splitLine(line)
+// optionally followed by "$request_id", "$request_length", "$marker", "$sent_http_content_range" and "$server_port"
+func parseLine(line string, unescape func(string) string) (*LogRecord, error) {
+	results, err := splitLine(line, unescape)
 	if err != nil {
 		return nil, err
 	}
-	if len(results) != 9 {
-		return nil, errors.New("Please double check nginx log line format. It should contain Ip Address, Date, Request Duration, Path, Response Status, Response Size, Domain, Referrer, User Agent in this particular order")
+	if len(results) < 9 || len(results) > 14 {
+		return nil, errors.New("Please double check nginx log line format. It should contain Ip Address, Date, Request Duration, Path, Response Status, Response Size, Domain, Referrer, User Agent and optional Request ID, Request Length, Marker, Content Range and Server Port in this particular order")
 	}
 
-	date, err := time.Parse("[02/Jan/2006:15:04:05 -0700]", results[1])
-	if err != nil {
-		return nil, fmt.Errorf("cannot parse date %s: %v", results[1], err)
+	raw := rawRecord{
+		IPAddress:      stripForwardedFor(results[0]),
+		Time:           results[1],
+		Duration:       results[2],
+		Request:        results[3],
+		HTTPStatusCode: results[4],
+		Size:           results[5],
+		Domain:         results[6],
+		Referrer:       results[7],
+		UserAgent:      results[8],
+	}
+	if len(results) >= 10 {
+		raw.RequestID = results[9]
+	}
+	if len(results) >= 11 {
+		raw.RequestLength = results[10]
+	}
+	if len(results) >= 12 {
+		raw.Marker = results[11]
 	}
+	if len(results) >= 13 {
+		raw.ContentRange = results[12]
+	}
+	if len(results) == 14 {
+		raw.ServerPort = results[13]
+	}
+
+	return raw.parse(nginxTimeLayout)
+}
+
+// stripForwardedFor removes "(X-Forwarded-For)" part that follows IP address
+func stripForwardedFor(value string) string {
+	if i := strings.Index(value, "("); i >= 0 {
+		return value[:i]
+	}
+	return value
+}
 
-	duration, err := strconv.ParseFloat(results[2], 64)
+// rawRecord contains fields of log line that are not parsed yet
+type rawRecord struct {
+	IPAddress      string
+	Time           string
+	Duration       string
+	Request        string
+	HTTPStatusCode string
+	Size           string
+	Domain         string
+	Referrer       string
+	UserAgent      string
+	RequestID      string
+	RequestLength  string
+	Marker         string
+	ContentRange   string
+	ServerPort     string
+}
+
+func (raw rawRecord) parse(timeLayout string) (*LogRecord, error) {
+	date, err := time.Parse(timeLayout, raw.Time)
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse duration %s: %v", results[2], err)
+		return nil, fmt.Errorf("cannot parse date %s: %v", raw.Time, err)
 	}
 
-	requestStrings := strings.Split(results[3], " ")
-	if len(requestStrings) < 3 {
-		return nil, errors.New("failed to parse request string: " + results[3])
+	incomplete := false
+
+	var duration float64
+	if raw.Duration == missingValue {
+		incomplete = true
+	} else {
+		duration, err = strconv.ParseFloat(raw.Duration, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse duration %s: %v", raw.Duration, err)
+		}
 	}
-	verb := requestStrings[0]
-	path := strings.Join(requestStrings[1:len(requestStrings)-1], " ")
 
-	httpStatusCode, err := strconv.Atoi(results[4])
+	verb, path, malformed := parseRequest(raw.Request)
+
+	httpStatusCode, err := strconv.Atoi(raw.HTTPStatusCode)
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse response code %s: %v", results[4], err)
+		return nil, fmt.Errorf("cannot parse response code %s: %v", raw.HTTPStatusCode, err)
 	}
 
-	size, err := strconv.Atoi(results[5])
-	if err != nil {
-		return nil, fmt.Errorf("cannot parse response size %s: %v", results[5], err)
+	var size int
+	if raw.Size == missingValue {
+		incomplete = true
+	} else {
+		size, err = strconv.Atoi(raw.Size)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse response size %s: %v", raw.Size, err)
+		}
+	}
+
+	if size < 0 {
+		return nil, fmt.Errorf("negative response size %d", size)
+	}
+
+	var requestLength int
+	if raw.RequestLength != "" && raw.RequestLength != missingValue {
+		requestLength, err = strconv.Atoi(raw.RequestLength)
+		if err != nil || requestLength < 0 {
+			return nil, fmt.Errorf("invalid request length %s", raw.RequestLength)
+		}
+	}
+
+	var serverPort int
+	if raw.ServerPort != "" && raw.ServerPort != missingValue {
+		serverPort, err = strconv.Atoi(raw.ServerPort)
+		if err != nil || serverPort < 0 || serverPort > 65535 {
+			return nil, fmt.Errorf("invalid server port %s", raw.ServerPort)
+		}
+	}
+
+	requestID := raw.RequestID
+	if requestID == missingValue {
+		requestID = ""
+	}
+	marker := raw.Marker
+	if marker == missingValue {
+		marker = ""
 	}
 
+	// request line, referrer and user agent are controlled by clients and may contain invalid UTF-8
 	return &LogRecord{
-		Domain:         results[6],
+		Domain:         validUTF8(raw.Domain),
 		Duration:       duration,
-		Path:           path,
-		Verb:           verb,
-		IPAddress:      results[0][:strings.Index(results[0], "(")],
+		Path:           validUTF8(path),
+		Verb:           validUTF8(verb),
+		IPAddress:      validUTF8(raw.IPAddress),
 		HTTPStatusCode: httpStatusCode,
 		Time:           date.UTC(),
-		Referrer:       results[7],
-		UserAgent:      results[8],
+		Referrer:       validUTF8(raw.Referrer),
+		UserAgent:      validUTF8(raw.UserAgent),
 		Size:           size,
+		Incomplete:     incomplete,
+		RequestID:      validUTF8(requestID),
+		RequestLength:  requestLength,
+		Marker:         validUTF8(marker),
+		RangeTotal:     parseRangeTotal(raw.ContentRange),
+		ServerPort:     serverPort,
+		Malformed:      malformed,
 	}, nil
 }
 
-var lineSplitRegex = regexp.MustCompile(`\"(.*?)\"`)
+// parseRequest returns verb and path of request line like "GET /path HTTP/1.1". Lines without protocol,
+// e.g. "GET /path" of HTTP/0.9 clients, are accepted. Lines with unknown verb or without path are malformed,
+// their verb is InvalidVerb and path is empty, so that records are still counted
+func parseRequest(request string) (verb, path string, malformed bool) {
+	parts := strings.Split(request, " ")
+	if len(parts) < 2 {
+		return InvalidVerb, "", true
+	}
 
-func splitLine(line string) ([]string, error) {
-	matches := lineSplitRegex.FindAllStringSubmatch(line, -1)
-	if len(matches) == 0 {
-		return nil, errors.New("cannot split line: " + line)
+	verb = strings.ToUpper(parts[0])
+	if !knownVerbs[verb] {
+		return InvalidVerb, "", true
+	}
+	if last := parts[len(parts)-1]; len(parts) > 2 && strings.HasPrefix(last, "HTTP/") {
+		parts = parts[:len(parts)-1]
+	}
+	path = strings.Join(parts[1:], " ")
+	if path == "" {
+		return InvalidVerb, "", true
 	}
+	return verb, path, false
+}
+
+// parseRangeTotal returns complete length of Content-Range header value like "bytes 0-1023/146515".
+// Malformed values and unknown length "*" are treated as 0, they don't make the record invalid
+func parseRangeTotal(contentRange string) int {
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 || !strings.HasPrefix(contentRange, "bytes ") {
+		return 0
+	}
+	total, err := strconv.Atoi(contentRange[i+1:])
+	if err != nil || total < 0 {
+		return 0
+	}
+	return total
+}
+
+func validUTF8(value string) string {
+	return strings.ToValidUTF8(value, "\uFFFD")
+}
+
+// splitLine returns values of quoted fields of the line. Text outside of quotes is skipped.
+// Quotes escaped with backslash don't end the field, escape sequences are decoded by unescape.
+// Backslash is an ordinary character if unescape is nil
+func splitLine(line string, unescape func(string) string) ([]string, error) {
+	var result []string
+	for i := 0; i < len(line); i++ {
+		if line[i] != '"' {
+			continue
+		}
+
+		start := i + 1
+		escaped := false
+		for i = start; i < len(line); i++ {
+			if line[i] == '\\' && unescape != nil {
+				escaped = true
+				i++
+				continue
+			}
+			if line[i] == '"' {
+				break
+			}
+		}
+		if i >= len(line) {
+			// the last quote is not closed, the line is likely truncated
+			break
+		}
 
-	result := make([]string, len(matches))
-	for i, str := range matches {
-		result[i] = str[1]
+		value := line[start:i]
+		if escaped {
+			value = unescape(value)
+		}
+		result = append(result, value)
 	}
 
+	if len(result) == 0 {
+		return nil, errors.New("cannot split line: " + line)
+	}
 	return result, nil
 }
+
+// unescapeField decodes escape sequences nginx writes with escape=default (\xHH) and escape=json
+// (\", \\, \n, \uHHHH etc.). Unknown sequences are kept as is
+func unescapeField(value string) string {
+	return unescapeSequences(value, true, true)
+}
+
+// unescapeDefault decodes only \xHH sequences nginx writes with escape=default
+func unescapeDefault(value string) string {
+	return unescapeSequences(value, true, false)
+}
+
+// unescapeJSON decodes only sequences nginx writes with escape=json
+func unescapeJSON(value string) string {
+	return unescapeSequences(value, false, true)
+}
+
+// jsonEscapes are characters of single character JSON escape sequences
+var jsonEscapes = map[byte]byte{'"': '"', '\\': '\\', '/': '/', 'n': '\n', 'r': '\r', 't': '\t', 'b': '\b', 'f': '\f'}
+
+// unescapeSequences decodes \xHH sequences if hex is true and JSON sequences if json is true
+func unescapeSequences(value string, hex, json bool) string {
+	var result strings.Builder
+	result.Grow(len(value))
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' || i+1 == len(value) {
+			result.WriteByte(c)
+			continue
+		}
+
+		next := value[i+1]
+		if decoded, ok := jsonEscapes[next]; ok && json {
+			result.WriteByte(decoded)
+			i++
+			continue
+		}
+		switch {
+		case next == 'x' && hex:
+			if b, err := strconv.ParseUint(hexDigits(value, i+2, 2), 16, 8); err == nil {
+				result.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+			result.WriteByte(c)
+		case next == 'u' && json:
+			if r, err := strconv.ParseUint(hexDigits(value, i+2, 4), 16, 32); err == nil {
+				result.WriteRune(rune(r))
+				i += 5
+				continue
+			}
+			result.WriteByte(c)
+		default:
+			result.WriteByte(c)
+		}
+	}
+	return result.String()
+}
+
+// hexDigits returns count characters of value starting at start or empty string if value is shorter
+func hexDigits(value string, start, count int) string {
+	if start+count > len(value) {
+		return ""
+	}
+	return value[start : start+count]
+}
@@ -0,0 +1,69 @@
+package logsreader
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+// parserSeeds are well-formed lines and lines broken in ways seen in real logs or sent by scanners
+var parserSeeds = []string{
+	`"111.111.111.111(-)" "[31/Jul/2016:22:54:30 +0400]" "0.247" "GET /some/file.jpg HTTP/1.1" "200" "32327" "some-domain.com" "http://some-referrer.com/" "User Agent String"`,
+	`"111.111.111.111(10.0.0.1)" "[31/Jul/2016:22:54:30 +0400]" "-" "GET / HTTP/1.1" "200" "-" "some-domain.com" "-" "-" "5f2b"`,
+	// escaped quotes and backslashes
+	`"111.111.111.111(-)" "[31/Jul/2016:22:54:30 +0400]" "0.1" "GET /a\"b HTTP/1.1" "200" "1" "some-domain.com" "-" "Agent \"quoted\" \\ \x22"`,
+	`"a\"`,
+	`"\\"`,
+	// truncated lines
+	`"111.111.111.111(-)" "[31/Jul/2016:22:54:30 +0400]" "0.247" "GET /some/file.jpg HTTP/1.1" "200" "32`,
+	`"111.111.111.111(`,
+	`"`,
+	``,
+	// invalid UTF-8 in client-controlled fields
+	"\"111.111.111.111(-)\" \"[31/Jul/2016:22:54:30 +0400]\" \"0.1\" \"GET /\xff\xfe HTTP/1.1\" \"200\" \"1\" \"some-domain.com\" \"\xc3\x28\" \"\xed\xa0\x80\"",
+	"\"\x80\x81\" \"\xff\"",
+	// negative and overflowing sizes
+	`"111.111.111.111(-)" "[31/Jul/2016:22:54:30 +0400]" "0.1" "GET / HTTP/1.1" "200" "-1" "some-domain.com" "-" "-"`,
+	`"111.111.111.111(-)" "[31/Jul/2016:22:54:30 +0400]" "0.1" "GET / HTTP/1.1" "200" "99999999999999999999999" "some-domain.com" "-" "-"`,
+	// binary junk of port scanners
+	`"111.111.111.111(-)" "[31/Jul/2016:22:54:30 +0400]" "0.001" "\x16\x03\x01\x00" "400" "0" "-" "-" "-"`,
+}
+
+func FuzzParseLine(f *testing.F) {
+	for _, seed := range parserSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		record, err := parseLine(line, unescapeField)
+		if err != nil {
+			return
+		}
+		if record.Size < 0 {
+			t.Errorf("negative size in record %+v of line %q", record, line)
+		}
+		for _, value := range []string{record.IPAddress, record.Verb, record.Path, record.Domain, record.Referrer, record.UserAgent, record.RequestID} {
+			if !utf8.ValidString(value) {
+				t.Errorf("invalid UTF-8 %q in record of line %q", value, line)
+			}
+		}
+	})
+}
+
+func FuzzSplitLine(f *testing.F) {
+	for _, seed := range parserSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		fields, err := splitLine(line, unescapeField)
+		if err == nil && len(fields) == 0 {
+			t.Errorf("no fields and no error for line %q", line)
+		}
+		// fields are substrings of the line without quotes
+		total := 0
+		for _, field := range fields {
+			total += len(field) + 2
+		}
+		if total > len(line) {
+			t.Errorf("fields %q are longer than line %q", fields, line)
+		}
+	})
+}
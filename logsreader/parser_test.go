@@ -0,0 +1,78 @@
+package logsreader
+
+import "testing"
+
+func BenchmarkParseLine(b *testing.B) {
+	line := parserSeeds[0]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseLine(line, unescapeField); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		request   string
+		verb      string
+		path      string
+		malformed bool
+	}{
+		{name: "request with protocol", request: "GET /index.html HTTP/1.1", verb: "GET", path: "/index.html"},
+		{name: "request without protocol", request: "GET /index.html", verb: "GET", path: "/index.html"},
+		{name: "path with spaces", request: "GET /a b.html HTTP/1.0", verb: "GET", path: "/a b.html"},
+		{name: "lowercase verb", request: "post /form HTTP/1.1", verb: "POST", path: "/form"},
+		{name: "path looking like protocol", request: "GET HTTP/1.1", verb: "GET", path: "HTTP/1.1"},
+		{name: "webdav verb", request: "PROPFIND /dav/ HTTP/1.1", verb: "PROPFIND", path: "/dav/"},
+		{name: "unknown verb", request: "FOO /index.html HTTP/1.1", verb: InvalidVerb, malformed: true},
+		{name: "binary junk", request: "\\x16\\x03\\x01\\x02\\x00\\x01", verb: InvalidVerb, malformed: true},
+		{name: "verb only", request: "GET", verb: InvalidVerb, malformed: true},
+		{name: "empty path", request: "GET  HTTP/1.1", verb: InvalidVerb, malformed: true},
+		{name: "empty request", request: "", verb: InvalidVerb, malformed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verb, path, malformed := parseRequest(test.request)
+			if verb != test.verb || path != test.path || malformed != test.malformed {
+				t.Errorf("parseRequest(%q) = %q, %q, %v, want %q, %q, %v",
+					test.request, verb, path, malformed, test.verb, test.path, test.malformed)
+			}
+		})
+	}
+}
+
+func TestEscapeModes(t *testing.T) {
+	const field = `Mozilla \"x\" \x22y\x22 é a\\b`
+	tests := []struct {
+		escape   string
+		expected string
+	}{
+		{escape: EscapeAuto, expected: `Mozilla "x" "y" é a\b`},
+		{escape: EscapeDefault, expected: `Mozilla \"x\" "y" é a\\b`},
+		{escape: EscapeJSON, expected: `Mozilla "x" \x22y\x22 é a\b`},
+		{escape: EscapeNone, expected: field},
+	}
+
+	for _, test := range tests {
+		t.Run(test.escape, func(t *testing.T) {
+			unescape, err := unescaper(test.escape)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual := field
+			if unescape != nil {
+				actual = unescape(field)
+			}
+			if actual != test.expected {
+				t.Errorf("%q decoded as %q, want %q", field, actual, test.expected)
+			}
+		})
+	}
+
+	if _, err := unescaper("html"); err == nil {
+		t.Errorf("unknown escape mode is accepted")
+	}
+}
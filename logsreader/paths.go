@@ -0,0 +1,71 @@
+package logsreader
+
+import (
+	"path"
+	"strings"
+)
+
+// Paths of log files are paths on the server, not on the machine running the parser, so they are handled
+// with these functions instead of path/filepath. Windows paths like C:\nginx\logs\access.log or
+// C:/nginx/logs/access.log accept both separators, other paths are slash separated
+
+// isWindowsPath returns true for paths starting with drive letter, e.g. C:, or UNC paths
+func isWindowsPath(p string) bool {
+	if strings.HasPrefix(p, `\\`) {
+		return true
+	}
+	if len(p) < 2 || p[1] != ':' {
+		return false
+	}
+	drive := p[0] | 0x20
+	return drive >= 'a' && drive <= 'z'
+}
+
+// remoteSplit returns directory of the path with trailing separator and the last element
+func remoteSplit(p string) (dir, file string) {
+	separators := "/"
+	if isWindowsPath(p) {
+		separators = `/\`
+	}
+	i := strings.LastIndexAny(p, separators)
+	return p[:i+1], p[i+1:]
+}
+
+// remoteDir returns all but the last element of the path
+func remoteDir(p string) string {
+	if !isWindowsPath(p) {
+		return path.Dir(p)
+	}
+	dir, _ := remoteSplit(p)
+	if len(dir) > len(`C:\`) || strings.HasPrefix(dir, `\\`) {
+		dir = strings.TrimRight(dir, `/\`)
+	}
+	if dir == "" {
+		return "."
+	}
+	return dir
+}
+
+// remoteBase returns the last element of the path
+func remoteBase(p string) string {
+	if !isWindowsPath(p) {
+		return path.Base(p)
+	}
+	_, file := remoteSplit(p)
+	return file
+}
+
+// remoteJoin appends file name to the directory with separator the directory is written with
+func remoteJoin(dir, name string) string {
+	if !isWindowsPath(dir) {
+		return path.Join(dir, name)
+	}
+	if strings.HasSuffix(dir, "/") || strings.HasSuffix(dir, `\`) {
+		return dir + name
+	}
+	separator := "/"
+	if strings.Contains(dir, `\`) {
+		separator = `\`
+	}
+	return dir + separator + name
+}
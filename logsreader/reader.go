@@ -2,153 +2,627 @@ package logsreader
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"path"
-	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/ssh"
 )
 
 const (
-	logPath = "/var/log/nginx/access.log"
+	defaultLogPath = "/var/log/nginx/access.log"
+
+	defaultReadBufferSize = 64 * 1024
+	defaultMaxLineLength  = 1024 * 1024
+
+	// progressStep is the number of bytes fetched from a file between calls of Hooks.OnProgress
+	progressStep = 1024 * 1024
 )
 
+var tracer = otel.Tracer("github.com/alexanderromanov/nginx-logparser/logsreader")
+
 // FileInfo provides information about file
 type FileInfo struct {
 	Name         string
 	ModifiedDate int64
 }
 
+// Checkpoint allows to persist intermediate state while large files are read
+type Checkpoint struct {
+	// Bytes is the number of bytes read between checkpoints. Checkpoints are disabled if it is zero
+	Bytes int
+
+	// Save is called with state reflecting all records passed to record processor so far.
+	// Reading is stopped if it returns error
+	Save func(State) error
+}
+
+// Hooks are optional callbacks reporting progress of ReadLogs. They are called by the reading goroutine,
+// so they have to return quickly
+type Hooks struct {
+	// OnFileStart is called when the file is opened for reading from offset. Size is the size of the file
+	// when log files were listed, it is zero if unknown
+	OnFileStart func(fileName string, offset, size int64)
+
+	// OnProgress is called with the number of bytes fetched from the file since offset every progressStep bytes
+	// and at the end of the file
+	OnProgress func(fileName string, bytesRead int64)
+
+	// OnFileEnd is called with the number of bytes of processed lines when reading of the file is finished.
+	// Error is not nil if reading failed
+	OnFileEnd func(fileName string, bytesRead int64, err error)
+}
+
+// Server is an open connection to log files of the server
+type Server struct {
+	conn   ConnectionInfo
+	source *logSource
+
+	// Hooks report progress of ReadLogs. They have to be set before reading starts
+	Hooks Hooks
+
+	bytesRead     int64
+	budgetReached int32
+
+	// transferred and expected are the number of bytes fetched from log files by the current ReadLogs
+	// and the number of bytes it is going to read
+	transferred int64
+	expected    int64
+}
+
+// Connect opens connection to log files of the server. It allows to connect to the server while
+// other preparations for reading are in progress
+func Connect(conn ConnectionInfo) (*Server, error) {
+	source, err := openLogSource(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{conn: conn, source: source}, nil
+}
+
+// Close closes connection to the server
+func (server *Server) Close() {
+	server.source.close()
+}
+
+// BytesRead returns number of bytes read from log files of the server since it was connected
+func (server *Server) BytesRead() int64 {
+	return atomic.LoadInt64(&server.bytesRead)
+}
+
+// BudgetReached returns true if reading stopped because ConnectionInfo.MaxRunBytes were read.
+// Returned state points to the end of the last read line then
+func (server *Server) BudgetReached() bool {
+	return atomic.LoadInt32(&server.budgetReached) != 0
+}
+
+// Progress returns number of bytes fetched by ReadLogs in progress and number of bytes it is going to read.
+// Expected size is zero until log files are found and may be exceeded if logs are written while they are read
+func (server *Server) Progress() (transferred, expected int64) {
+	return atomic.LoadInt64(&server.transferred), atomic.LoadInt64(&server.expected)
+}
+
 // ReadLogs read logs from server
-func ReadLogs(conn ConnectionInfo, readerState State, recordProcessor func(*LogRecord)) (*State, error) {
-	sftp, err := connectToServer(conn)
+func ReadLogs(ctx context.Context, conn ConnectionInfo, readerState State, recordProcessor func(*LogRecord), checkpoint Checkpoint) (*State, error) {
+	server, err := Connect(conn)
 	if err != nil {
-		return nil, fmt.Errorf("fail to connect to server %s: %v", conn, err)
+		return nil, err
 	}
-	defer sftp.Close()
+	defer server.Close()
 
-	previouslyRotated := findPreviouslyRotatedFile(sftp)
+	return server.ReadLogs(ctx, readerState, recordProcessor, checkpoint)
+}
+
+// ReadLogs read logs from connected server
+func (server *Server) ReadLogs(ctx context.Context, readerState State, recordProcessor func(*LogRecord), checkpoint Checkpoint) (*State, error) {
+	ctx, span := tracer.Start(ctx, "ReadLogs")
+	defer span.End()
+
+	conn := server.conn
+	parse, err := newLineParser(conn.LogFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	source := server.source
+	limits := newLineLimits(conn)
+
+	logPath := conn.logPath()
+	rotated, logSize := findRotatedFiles(ctx, source.readDir, logPath)
+	previouslyRotated := newestRotated(rotated)
+	sizes := map[string]int64{logPath: logSize}
+	for _, file := range rotated {
+		sizes[file.Name] = file.size
+	}
+	// compressed bytes are counted, so that progress is compared with sizes of files
+	open := gzipOpener(server.countingOpener(source.open, sizes))
 
 	var logOffset int
+	seen := readerState.SeenRotated
 	if previouslyRotated.isSame(readerState.RotatedLog) {
 		logOffset = readerState.BytesRead
+		server.expect(logSize-int64(logOffset), limits.maxBytes)
 	} else {
 		logOffset = 0
+		if previouslyRotated.Name == "" {
+			return nil, &Error{Cause: ErrRotationMismatch, Err: fmt.Errorf("rotated log file %s is not found in %s", readerState.RotatedLog.Name, remoteDir(logPath))}
+		}
 
-		_, err = processRecords(sftp, previouslyRotated.Name, readerState.BytesRead, recordProcessor)
-		if err != nil {
-			return nil, err
+		// access.log might have been rotated several times since the last run. The oldest unseen file is
+		// the one that was access.log then, the rest are read from the start
+		unseen := unseenRotatedFiles(rotated, readerState)
+		expected := logSize - int64(readerState.BytesRead)
+		for _, file := range unseen {
+			expected += file.size
+		}
+		server.expect(expected, limits.maxBytes)
+
+		// until access.log is reached state keeps pointing to the file rotated before the one being read
+		// as if the file being read was access.log
+		current, offset := readerState.RotatedLog, readerState.BytesRead
+		for _, file := range unseen {
+			fileState := State{RotatedLog: current, BytesRead: offset, SeenRotated: seen}
+			rotatedCheckpoint := checkpoint.at(func(bytesRead int) State {
+				state := fileState
+				state.BytesRead += bytesRead
+				return state
+			})
+			rotatedBytes, err := processRecords(ctx, open, parse, file.Name, offset, recordProcessor, limits, checkpoint.Bytes, rotatedCheckpoint)
+			atomic.AddInt64(&server.bytesRead, int64(rotatedBytes))
+			server.fileEnd(file.Name, rotatedBytes, err)
+			if err == errBudgetReached {
+				atomic.StoreInt32(&server.budgetReached, 1)
+				return &State{RotatedLog: current, BytesRead: offset + rotatedBytes, SeenRotated: seen}, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if limits.maxBytes > 0 {
+				limits.maxBytes -= rotatedBytes
+			}
+			seen = appendSeen(seen, current)
+			current, offset = file.FileInfo, 0
 		}
 	}
 
-	bytesRead, err := processRecords(sftp, logPath, logOffset, recordProcessor)
-	if err != nil {
+	logCheckpoint := checkpoint.at(func(bytesRead int) State {
+		return State{RotatedLog: previouslyRotated, BytesRead: logOffset + bytesRead, SeenRotated: seen}
+	})
+	bytesRead, err := processRecords(ctx, open, parse, logPath, logOffset, recordProcessor, limits, checkpoint.Bytes, logCheckpoint)
+	atomic.AddInt64(&server.bytesRead, int64(bytesRead))
+	server.fileEnd(logPath, bytesRead, err)
+	if err == errBudgetReached {
+		atomic.StoreInt32(&server.budgetReached, 1)
+	} else if err != nil {
 		return nil, err
 	}
 
 	newState := &State{
-		RotatedLog: previouslyRotated,
-		BytesRead:  bytesRead + logOffset,
+		RotatedLog:  previouslyRotated,
+		BytesRead:   bytesRead + logOffset,
+		SeenRotated: seen,
 	}
 
 	return newState, nil
 }
 
-func connectToServer(connection ConnectionInfo) (*sftp.Client, error) {
+// ReadStream parses records of given format from reader, e.g. archived log file, and returns number of bytes read
+func ReadStream(ctx context.Context, name string, reader io.Reader, format LogFormat, recordProcessor func(*LogRecord)) (int, error) {
+	parse, err := newLineParser(format)
+	if err != nil {
+		return 0, err
+	}
+	open := func(string, int) (io.ReadCloser, error) { return ioutil.NopCloser(reader), nil }
+	return processRecords(ctx, open, parse, name, 0, recordProcessor, newLineLimits(ConnectionInfo{LogFormat: format}), 0, nil)
+}
+
+func connectToServer(connection ConnectionInfo) (*ssh.Client, *sftp.Client, error) {
+	client, err := dialServer(connection)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sftp, err := sftp.NewClient(client, connection.SFTP.clientOptions()...)
+	if err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("fail to create sftp client: %v", err)
+	}
+
+	return client, sftp, nil
+}
+
+func dialServer(connection ConnectionInfo) (*ssh.Client, error) {
+	auth, err := authMethods(connection)
+	if err != nil {
+		return nil, err
+	}
 	clientConfig := &ssh.ClientConfig{
 		User: connection.UserName,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(connection.Password),
-		},
+		Auth: auth,
 	}
 
 	addressWithPort := fmt.Sprintf("%s:%d", connection.Address, connection.Port)
 	client, err := ssh.Dial("tcp", addressWithPort, clientConfig)
 
 	if err != nil {
-		return nil, fmt.Errorf("cannot dial remote server: %v", err)
+		err = fmt.Errorf("cannot dial remote server: %v", err)
+		if isAuthError(err) {
+			err = &Error{Cause: ErrAuthFailed, Err: err}
+		}
+		return nil, err
 	}
+	return client, nil
+}
 
-	sftp, err := sftp.NewClient(client)
-	if err != nil {
-		return nil, fmt.Errorf("fail to create sftp client: %v", err)
+// expect sets the number of bytes ReadLogs is going to read limited by byte budget of the run
+func (server *Server) expect(size int64, maxBytes int) {
+	if size < 0 {
+		size = 0
 	}
+	if maxBytes > 0 && size > int64(maxBytes) {
+		size = int64(maxBytes)
+	}
+	atomic.StoreInt64(&server.transferred, 0)
+	atomic.StoreInt64(&server.expected, size)
+}
 
-	return sftp, nil
+// countingOpener wraps opener, so that bytes fetched from opened files are added to Progress and reported
+// to Hooks. Sizes are listed sizes of files
+func (server *Server) countingOpener(open logOpener, sizes map[string]int64) logOpener {
+	return func(fileName string, offset int) (io.ReadCloser, error) {
+		file, err := open(fileName, offset)
+		if err != nil {
+			return nil, err
+		}
+		if server.Hooks.OnFileStart != nil {
+			server.Hooks.OnFileStart(fileName, int64(offset), sizes[fileName])
+		}
+		return &countingReader{ReadCloser: file, fileName: fileName, count: &server.transferred, onProgress: server.Hooks.OnProgress}, nil
+	}
 }
 
-func findPreviouslyRotatedFile(sftp *sftp.Client) (result FileInfo) {
-	logDir := filepath.Dir(logPath)
-	logName := filepath.Base(logPath)
+// fileEnd reports the end of reading of the file. Reaching byte budget is not an error
+func (server *Server) fileEnd(fileName string, bytesRead int, err error) {
+	if server.Hooks.OnFileEnd == nil {
+		return
+	}
+	if err == errBudgetReached {
+		err = nil
+	}
+	server.Hooks.OnFileEnd(fileName, int64(bytesRead), err)
+}
 
-	w := sftp.Walk(logDir)
-	for w.Step() {
-		if w.Err() != nil {
-			continue
-		}
+// countingReader counts bytes read from the underlying reader
+type countingReader struct {
+	io.ReadCloser
+	fileName string
+	count    *int64
+
+	onProgress func(fileName string, bytesRead int64)
+	read       int64
+	reported   int64
+}
 
-		fullPath := w.Path()
-		fileName := path.Base(fullPath)
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	r.read += int64(n)
+	if r.onProgress != nil && (r.read-r.reported >= progressStep || (err == io.EOF && r.read != r.reported)) {
+		r.onProgress(r.fileName, r.read)
+		r.reported = r.read
+	}
+	return n, err
+}
+
+// rotatedFile is rotated log file with its size when the directory was listed
+type rotatedFile struct {
+	FileInfo
+	size int64
+}
 
-		if fileName != logName && strings.HasPrefix(fileName, logName) && !strings.HasSuffix(fileName, ".gz") {
-			return FileInfo{Name: fullPath, ModifiedDate: w.Stat().ModTime().Unix()}
+// newestRotated returns the file nginx has written to before access.log. Empty if there are no rotated files
+func newestRotated(rotated []rotatedFile) FileInfo {
+	if len(rotated) == 0 {
+		return FileInfo{}
+	}
+	return rotated[len(rotated)-1].FileInfo
+}
+
+// findRotatedFiles returns rotated files from the oldest to the newest and size of access.log. Files compressed
+// by logrotate are included, they are read with gzipOpener. Duration of discovery is traced
+func findRotatedFiles(ctx context.Context, readDir func(dir string) ([]os.FileInfo, error), logPath string) (rotated []rotatedFile, logSize int64) {
+	_, span := tracer.Start(ctx, "findRotatedFiles")
+	defer span.End()
+
+	logDir := remoteDir(logPath)
+	logName := remoteBase(logPath)
+
+	entries, err := readDir(logDir)
+	if err != nil {
+		log.Printf("cannot read directory %s: %v\n", logDir, err)
+		return
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].ModTime().Before(entries[j].ModTime()) })
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if fileName == logName {
+			logSize = entry.Size()
+		}
+		if !entry.IsDir() && fileName != logName && strings.HasPrefix(fileName, logName) {
+			file := FileInfo{Name: remoteJoin(logDir, fileName), ModifiedDate: entry.ModTime().Unix()}
+			rotated = append(rotated, rotatedFile{FileInfo: file, size: entry.Size()})
 		}
 	}
 
+	span.SetAttributes(attribute.String("dir", logDir), attribute.Int("entries", len(entries)), attribute.Int("rotated", len(rotated)))
 	return
 }
 
+// gzipOpener opens files compressed by logrotate through gzip reader. Offsets of compressed files are offsets
+// in decompressed data, so decompressed bytes before the offset are discarded. Other files are opened by open
+func gzipOpener(open logOpener) logOpener {
+	return func(fileName string, offset int) (io.ReadCloser, error) {
+		if !strings.HasSuffix(fileName, ".gz") {
+			return open(fileName, offset)
+		}
+		file, err := open(fileName, 0)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cannot decompress %s: %v", fileName, err)
+		}
+		compressed := &gzipFile{Reader: reader, file: file}
+		if _, err := io.CopyN(ioutil.Discard, reader, int64(offset)); err != nil {
+			compressed.Close()
+			return nil, fmt.Errorf("cannot skip %d bytes of %s: %v", offset, fileName, err)
+		}
+		return compressed, nil
+	}
+}
+
+// gzipFile closes both gzip reader and the compressed file
+type gzipFile struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (f *gzipFile) Close() error {
+	err := f.Reader.Close()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// unseenRotatedFiles returns rotated files that appeared since the state was saved, from the oldest to the newest.
+// Files not newer than the rotated file of the state and files listed as seen were processed before. Names are
+// not enough, numbered rotation renames access.log.1 to access.log.2 keeping its modification time. Without
+// previous state only the newest file is returned, so that history of the server is not read on the first run
+func unseenRotatedFiles(rotated []rotatedFile, state State) []rotatedFile {
+	if state.RotatedLog.Name == "" {
+		return rotated[len(rotated)-1:]
+	}
+	var result []rotatedFile
+	for _, file := range rotated {
+		if file.ModifiedDate <= state.RotatedLog.ModifiedDate || state.wasSeen(file.FileInfo) {
+			continue
+		}
+		result = append(result, file)
+	}
+	if len(result) == 0 {
+		// e.g. rotated file was renamed, the newest one is what access.log was
+		return rotated[len(rotated)-1:]
+	}
+	return result
+}
+
 func (f FileInfo) isSame(other FileInfo) bool {
 	return other.Name == f.Name && other.ModifiedDate == f.ModifiedDate
 }
 
-func processRecords(client *sftp.Client, fileName string, readFrom int, recordProcessor func(*LogRecord)) (int, error) {
-	log.Printf("opening file %s\n", fileName)
-	file, err := client.Open(fileName)
-	if err != nil {
-		return 0, fmt.Errorf("cannot open %s: %v", fileName, err)
+// at returns function saving state built from number of bytes read from the current file
+func (checkpoint Checkpoint) at(state func(bytesRead int) State) func(int) error {
+	if checkpoint.Bytes <= 0 || checkpoint.Save == nil {
+		return nil
+	}
+	return func(bytesRead int) error {
+		return checkpoint.Save(state(bytesRead))
 	}
+}
 
-	defer file.Close()
+func processRecords(ctx context.Context, open logOpener, parse lineParser, fileName string, readFrom int, recordProcessor func(*LogRecord), limits lineLimits, checkpointBytes int, checkpoint func(bytesRead int) error) (int, error) {
+	_, span := tracer.Start(ctx, "processRecords")
+	defer span.End()
+	span.SetAttributes(attribute.String("file", fileName), attribute.Int("offset", readFrom))
 
-	_, err = file.Seek(int64(readFrom), os.SEEK_SET)
+	log.Printf("opening file %s\n", fileName)
+	file, err := open(fileName, readFrom)
 	if err != nil {
-		return 0, fmt.Errorf("cannot seek to %d in %s: %v", readFrom, fileName, err)
+		return 0, err
 	}
 
+	defer file.Close()
+
 	log.Printf("reading file %s from position %d\n", fileName, readFrom)
 
 	bytesRead := 0
-	scanner := bufio.NewScanner(file)
+	checkpointAt := 0
+	skipped := 0
+	continuations := 0
+	reader := bufio.NewReaderSize(file, limits.bufferSize)
 
 	var throttle = make(chan bool, 200)
 	var wg sync.WaitGroup
-	for scanner.Scan() {
-		logLine := scanner.Text()
-
+	dispatch := func(logLine string) {
 		throttle <- true
 		wg.Add(1)
 		go func(logLine string) {
 			defer wg.Done()
-			logRecord, err := parseLine(logLine)
+			defer func() { <-throttle }()
+
+			logRecord, err := parse(logLine)
 			if err != nil {
-				log.Printf("fail to parse %s\n", logLine)
+				log.Printf("fail to parse %q: %v\n", logLine, err)
 				return
 			}
 
 			recordProcessor(logRecord)
-			<-throttle
 		}(logLine)
+	}
 
-		// 1 is length of line separator (\n)
-		bytesRead += len(logLine) + 1
+	// in multi-line mode the last line is dispatched only when the next line shows it has no continuation
+	var pending *string
+	pendingBytes := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			wg.Wait()
+			return bytesRead, err
+		}
+		line, length, err := readLine(reader, limits.maxLineLength)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			wg.Wait()
+			return bytesRead, fmt.Errorf("cannot read %s: %v", fileName, err)
+		}
+		bytesRead += length
+		if line == nil {
+			skipped++
+			continue
+		}
+		logLine := string(line)
+
+		switch {
+		case limits.multiLine == "":
+			dispatch(logLine)
+		case isContinuation(logLine):
+			continuations++
+			if limits.multiLine == MultiLineJoin && pending != nil {
+				joined := *pending + "\n" + logLine
+				pending = &joined
+				pendingBytes += length
+			}
+		default:
+			if pending != nil {
+				dispatch(*pending)
+			}
+			pending, pendingBytes = &logLine, length
+		}
+
+		if checkpoint != nil && bytesRead-checkpointAt >= checkpointBytes {
+			// all records read so far have to be processed before the state can be saved,
+			// pending line is read again after restart
+			wg.Wait()
+			if err := checkpoint(bytesRead - pendingBytes); err != nil {
+				return bytesRead, fmt.Errorf("checkpoint of %s failed: %v", fileName, err)
+			}
+			checkpointAt = bytesRead
+		}
+
+		if limits.maxBytes > 0 && bytesRead >= limits.maxBytes {
+			// pending line is not dispatched, it is read again by the next run
+			wg.Wait()
+			log.Printf("reading of %s stopped at position %d, byte budget of the run is reached\n", fileName, readFrom+bytesRead-pendingBytes)
+			return bytesRead - pendingBytes, errBudgetReached
+		}
+	}
+	if pending != nil {
+		dispatch(*pending)
 	}
 	wg.Wait()
 
+	if skipped > 0 {
+		log.Printf("%d lines of %s longer than %d bytes are skipped\n", skipped, fileName, limits.maxLineLength)
+	}
+	if continuations > 0 {
+		log.Printf("%d continuation lines of %s are handled in %s mode\n", continuations, fileName, limits.multiLine)
+	}
+	span.SetAttributes(attribute.Int("bytesRead", bytesRead), attribute.Int("skippedLines", skipped), attribute.Int("continuationLines", continuations))
 	return bytesRead, nil
 }
+
+// isContinuation returns true if line is not the beginning of nginx log record, which starts with quoted IP address
+func isContinuation(line string) bool {
+	return !strings.HasPrefix(line, `"`)
+}
+
+// lineLimits control how lines of log files are read
+type lineLimits struct {
+	bufferSize    int
+	maxLineLength int
+
+	// multiLine is the mode of handling continuation lines. It is empty if lines are not checked for continuation
+	multiLine string
+
+	// maxBytes is the number of bytes left to read in the run. Not limited if it is zero
+	maxBytes int
+}
+
+func newLineLimits(conn ConnectionInfo) lineLimits {
+	result := lineLimits{bufferSize: conn.ReadBufferSize, maxLineLength: conn.MaxLineLength, maxBytes: conn.MaxRunBytes}
+	// only records of nginx format are known to start with quote
+	if conn.LogFormat.Type == "" || conn.LogFormat.Type == FormatNginx {
+		result.multiLine = conn.MultiLine
+	}
+	if result.bufferSize <= 0 {
+		result.bufferSize = defaultReadBufferSize
+	}
+	if result.maxLineLength <= 0 {
+		result.maxLineLength = defaultMaxLineLength
+	}
+	return result
+}
+
+// readLine returns the next line without line separator and number of bytes it occupies in the file.
+// Lines longer than maxLength are consumed, but nil is returned instead of them. io.EOF is returned
+// for the last line that is not terminated yet, it is read again next time
+func readLine(reader *bufio.Reader, maxLength int) ([]byte, int, error) {
+	var line []byte
+	length := 0
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		length += len(chunk)
+		if !tooLong {
+			// the chunk can include line separator
+			if len(line)+len(chunk) > maxLength+1 {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, length, err
+		}
+		if tooLong {
+			return nil, length, nil
+		}
+
+		line = line[:len(line)-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		return line, length, nil
+	}
+}
@@ -0,0 +1,162 @@
+package logsreader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type readFile struct {
+	name   string
+	offset int64
+}
+
+// writeLog writes log file with given modification time
+func writeLog(t *testing.T, fileName, content string, modified time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fileName, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLocalLogs runs ReadLogs on local directory and returns files it opened
+func readLocalLogs(t *testing.T, logPath string, state State) (*State, []readFile) {
+	t.Helper()
+	server, err := Connect(ConnectionInfo{TransferMode: TransferLocal, LogPath: logPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var files []readFile
+	server.Hooks.OnFileStart = func(fileName string, offset, size int64) {
+		files = append(files, readFile{name: filepath.Base(fileName), offset: offset})
+	}
+	newState, err := server.ReadLogs(context.Background(), state, func(*LogRecord) {}, Checkpoint{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newState, files
+}
+
+func TestReadLogsNumberedRotation(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "access.log")
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	writeLog(t, logPath+".1", "first\n", start)
+	writeLog(t, logPath, "second\n", start.Add(10*time.Minute))
+	state, _ := readLocalLogs(t, logPath, State{})
+
+	// logrotate renames access.log.1 to access.log.2 keeping its modification time, then access.log to access.log.1
+	writeLog(t, logPath, "second\nthird\n", start.Add(20*time.Minute))
+	if err := os.Rename(logPath+".1", logPath+".2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeLog(t, logPath, "fourth\n", start.Add(30*time.Minute))
+
+	newState, files := readLocalLogs(t, logPath, *state)
+	expected := []readFile{{name: "access.log.1", offset: int64(len("second\n"))}, {name: "access.log", offset: 0}}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("files read after rotation: %v, expected %v", files, expected)
+	}
+	if newState.RotatedLog.Name != logPath+".1" || newState.BytesRead != len("fourth\n") {
+		t.Errorf("unexpected state after rotation: %+v", newState)
+	}
+}
+
+func TestReadLogsSeveralRotations(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "access.log")
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	writeLog(t, logPath+"-01", "first\n", start)
+	writeLog(t, logPath, "second\n", start.Add(10*time.Minute))
+	state, _ := readLocalLogs(t, logPath, State{})
+
+	writeLog(t, logPath, "second\nthird\n", start.Add(20*time.Minute))
+	if err := os.Rename(logPath, logPath+"-02"); err != nil {
+		t.Fatal(err)
+	}
+	writeLog(t, logPath+"-03", "fourth\n", start.Add(30*time.Minute))
+	writeLog(t, logPath, "fifth\n", start.Add(40*time.Minute))
+
+	newState, files := readLocalLogs(t, logPath, *state)
+	expected := []readFile{
+		{name: "access.log-02", offset: int64(len("second\n"))},
+		{name: "access.log-03", offset: 0},
+		{name: "access.log", offset: 0},
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("files read after rotations: %v, expected %v", files, expected)
+	}
+	if newState.RotatedLog.Name != logPath+"-03" || len(newState.SeenRotated) != 2 {
+		t.Errorf("unexpected state after rotations: %+v", newState)
+	}
+
+	// nothing is read twice once state is saved
+	_, files = readLocalLogs(t, logPath, *newState)
+	expected = []readFile{{name: "access.log", offset: int64(len("fifth\n"))}}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("files read without rotation: %v, expected %v", files, expected)
+	}
+}
+
+func TestReadLogsCompressedRotation(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "access.log")
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	writeLog(t, logPath, "first\n", start)
+	state, _ := readLocalLogs(t, logPath, State{})
+
+	// access.log is rotated and compressed before the next run, e.g. by logrotate without delaycompress
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte("first\nsecond\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeLog(t, logPath+".1.gz", compressed.String(), start.Add(10*time.Minute))
+	writeLog(t, logPath, "third\n", start.Add(20*time.Minute))
+
+	server, err := Connect(ConnectionInfo{TransferMode: TransferLocal, LogPath: logPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// rest of the compressed file is read from the position in the uncompressed log
+	read := make(map[string]int64)
+	server.Hooks.OnFileEnd = func(fileName string, bytesRead int64, err error) {
+		if err != nil {
+			t.Errorf("cannot read %s: %v", fileName, err)
+		}
+		read[filepath.Base(fileName)] = bytesRead
+	}
+	newState, err := server.ReadLogs(context.Background(), *state, func(*LogRecord) {}, Checkpoint{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"access.log.1.gz": int64(len("second\n")), "access.log": int64(len("third\n"))}
+	if !reflect.DeepEqual(read, expected) {
+		t.Errorf("bytes read after compressed rotation: %v, expected %v", read, expected)
+	}
+	if newState.RotatedLog.Name != logPath+".1.gz" || newState.BytesRead != len("third\n") {
+		t.Errorf("unexpected state after compressed rotation: %+v", newState)
+	}
+}
@@ -0,0 +1,247 @@
+package logsreader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SCP protocol messages are lines starting with message type. Receiver confirms every message with zero byte
+// or rejects it with scpWarning followed by text line, then sender skips the file or directory
+const (
+	scpOK      = 0
+	scpWarning = 1
+	scpFatal   = 2
+)
+
+// scpSession is scp command running on the server in source mode
+type scpSession struct {
+	session *ssh.Session
+	in      io.Writer
+	out     *bufio.Reader
+}
+
+func startSCP(client *ssh.Client, args, fileName string) (*scpSession, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open ssh session to copy %s: %v", fileName, err)
+	}
+	in, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("cannot get input of ssh session to copy %s: %v", fileName, err)
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("cannot get output of ssh session to copy %s: %v", fileName, err)
+	}
+
+	command := "scp " + args + " " + remoteQuote(fileName)
+	err = session.Start(command)
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("cannot run %s: %v", command, err)
+	}
+	s := &scpSession{session: session, in: in, out: bufio.NewReader(out)}
+	// receiver starts the transfer
+	err = s.reply(scpOK)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *scpSession) reply(response byte) error {
+	message := []byte{response}
+	if response != scpOK {
+		message = append(message, "skipped\n"...)
+	}
+	_, err := s.in.Write(message)
+	if err != nil {
+		return fmt.Errorf("cannot reply to scp: %v", err)
+	}
+	return nil
+}
+
+// next returns the next message. Errors reported by the sender are returned as errors
+func (s *scpSession) next() (string, error) {
+	line, err := s.out.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if line == "" {
+		return "", fmt.Errorf("empty scp message")
+	}
+	if line[0] == scpWarning || line[0] == scpFatal {
+		message := strings.TrimSpace(line[1:])
+		if strings.Contains(message, "No such file or directory") {
+			return "", fmt.Errorf("%s: %w", message, os.ErrNotExist)
+		}
+		return "", fmt.Errorf("scp failed: %s", message)
+	}
+	return line, nil
+}
+
+// scpEntry is the file or directory announced by C or D message, e.g. "C0644 1024 access.log"
+type scpEntry struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (e *scpEntry) Name() string       { return e.name }
+func (e *scpEntry) Size() int64        { return e.size }
+func (e *scpEntry) Mode() os.FileMode  { return e.mode }
+func (e *scpEntry) ModTime() time.Time { return e.modTime }
+func (e *scpEntry) IsDir() bool        { return e.mode.IsDir() }
+func (e *scpEntry) Sys() interface{}   { return nil }
+
+func parseSCPEntry(message string) (*scpEntry, error) {
+	parts := strings.SplitN(message[1:], " ", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid scp message %q", message)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mode of scp message %q", message)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid size of scp message %q", message)
+	}
+	entry := &scpEntry{name: parts[2], size: size, mode: os.FileMode(mode)}
+	if message[0] == 'D' {
+		entry.mode |= os.ModeDir
+	}
+	return entry, nil
+}
+
+// parseSCPTime returns modification time of "T<mtime> 0 <atime> 0" message
+func parseSCPTime(message string) (time.Time, error) {
+	parts := strings.Fields(message[1:])
+	if len(parts) != 4 {
+		return time.Time{}, fmt.Errorf("invalid scp message %q", message)
+	}
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid scp message %q", message)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// scpOpener copies files with scp, for servers that allow only scp over ssh. SCP can't seek,
+// so the part of the file before offset is transferred and skipped
+func scpOpener(client *ssh.Client) logOpener {
+	return func(fileName string, offset int) (io.ReadCloser, error) {
+		s, err := startSCP(client, "-f", fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		message, err := s.next()
+		if err == nil && message[0] != 'C' {
+			err = fmt.Errorf("unexpected scp message %q", message)
+		}
+		var entry *scpEntry
+		if err == nil {
+			entry, err = parseSCPEntry(message)
+		}
+		if err == nil {
+			err = s.reply(scpOK)
+		}
+		if err != nil {
+			s.session.Close()
+			return nil, openError(fileName, err)
+		}
+
+		skip := int64(offset)
+		if skip > entry.size {
+			skip = entry.size
+		}
+		_, err = io.CopyN(ioutil.Discard, s.out, skip)
+		if err != nil {
+			s.session.Close()
+			return nil, fmt.Errorf("cannot skip %d bytes of %s: %v", skip, fileName, err)
+		}
+		return &commandOutput{Reader: io.LimitReader(s.out, entry.size-skip), session: s.session}, nil
+	}
+}
+
+// scpReadDir lists directory with recursive scp. Every file is rejected once it is announced,
+// so that only names, sizes and modification times are transferred
+func scpReadDir(client *ssh.Client) func(dir string) ([]os.FileInfo, error) {
+	return func(dir string) ([]os.FileInfo, error) {
+		s, err := startSCP(client, "-r -p -f", dir)
+		if err != nil {
+			return nil, err
+		}
+		defer s.session.Close()
+
+		var result []os.FileInfo
+		var modTime time.Time
+		depth := 0
+		for {
+			message, err := s.next()
+			if err == io.EOF && depth == 0 {
+				return result, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			switch message[0] {
+			case 'T':
+				modTime, err = parseSCPTime(message)
+				if err == nil {
+					err = s.reply(scpOK)
+				}
+			case 'C', 'D':
+				var entry *scpEntry
+				entry, err = parseSCPEntry(message)
+				if err != nil {
+					break
+				}
+				entry.modTime = modTime
+				if message[0] == 'D' && depth == 0 {
+					// the listed directory itself
+					depth++
+					err = s.reply(scpOK)
+					break
+				}
+				result = append(result, entry)
+				err = s.reply(scpWarning)
+			case 'E':
+				depth--
+				err = s.reply(scpOK)
+				if err == nil && depth == 0 {
+					return result, nil
+				}
+			default:
+				err = fmt.Errorf("unexpected scp message %q", message)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// remoteQuote quotes path for the shell of the server. Windows servers run cmd.exe that doesn't
+// support single quotes
+func remoteQuote(p string) string {
+	if isWindowsPath(p) {
+		return `"` + p + `"`
+	}
+	return shellQuote(p)
+}
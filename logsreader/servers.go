@@ -1,6 +1,20 @@
 package logsreader
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/cron"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// MultiLineJoin appends continuation lines to the previous record
+	MultiLineJoin = "join"
+
+	// MultiLineSkip drops continuation lines without reporting them as parse failures
+	MultiLineSkip = "skip"
+)
 
 // ConnectionInfo represents information about connection to server with nginx logs
 type ConnectionInfo struct {
@@ -8,6 +22,107 @@ type ConnectionInfo struct {
 	Port     int
 	UserName string
 	Password string
+
+	// KeyFile is the private key file, e.g. id_ed25519, used before password. Keys can be in PEM or OpenSSH format
+	KeyFile       string
+	KeyPassphrase string
+
+	// CertificateFile is the OpenSSH certificate signed for the key, e.g. id_ed25519-cert.pub
+	CertificateFile string
+
+	// TransferMode specifies how log files are transferred from server: TransferSFTP (default), TransferTail,
+	// TransferGzip or TransferSCP
+	TransferMode string
+
+	// LogPath is the access log on the server. Rotated logs are looked up in its directory. Windows paths,
+	// e.g. C:\nginx\logs\access.log, are supported. defaultLogPath is used if it is empty
+	LogPath string
+
+	// SFTP tunes SFTP client of TransferSFTP mode
+	SFTP SFTPOptions
+
+	// LogFormat describes format of log lines on this server
+	LogFormat LogFormat
+
+	// ReadBufferSize is the size of buffer log files are read with. defaultReadBufferSize is used if it is zero
+	ReadBufferSize int
+
+	// MaxLineLength limits length of log lines. Longer lines are skipped. defaultMaxLineLength is used if it is zero
+	MaxLineLength int
+
+	// MaxRunBytes limits number of bytes read from the server in one run. Once it is reached reading stops at
+	// line boundary and the next run continues from there. Not limited if it is zero
+	MaxRunBytes int
+
+	// StubStatusURL is the nginx stub_status endpoint used to check that all requests are logged. Not checked if it is empty
+	StubStatusURL string
+
+	// MultiLine specifies what is done with lines of nginx format that don't start with quoted IP address,
+	// e.g. parts of upstream error bodies: MultiLineJoin, MultiLineSkip or nothing if it is empty
+	MultiLine string
+
+	// RotatedLogs specifies what is done with rotated log files that are already processed:
+	// RotatedLogsKeep (default), RotatedLogsDelete or RotatedLogsArchive
+	RotatedLogs string
+
+	// ArchiveDirectory is the directory on the server rotated log files are moved to if RotatedLogs is RotatedLogsArchive
+	ArchiveDirectory string
+
+	// Disabled servers are skipped, e.g. decommissioned ones. Their state is kept
+	Disabled bool
+
+	// Maintenance lists periods the server is skipped in
+	Maintenance []MaintenanceWindow
+}
+
+// SFTPOptions tune throughput of SFTP reads, e.g. for distant servers with high latency.
+// Zero values keep defaults of the SFTP client
+type SFTPOptions struct {
+	// MaxPacket is the maximum size of data requested in single packet. Values above 32768 are not
+	// supported by all servers
+	MaxPacket int
+
+	// MaxConcurrentRequests is the number of requests of one file that can be in flight at the same time
+	MaxConcurrentRequests int
+
+	// DisableConcurrentReads makes reads sequential, e.g. for servers that don't handle out of order requests
+	DisableConcurrentReads bool
+}
+
+func (options SFTPOptions) clientOptions() []sftp.ClientOption {
+	var result []sftp.ClientOption
+	if options.MaxPacket > 0 {
+		result = append(result, sftp.MaxPacketUnchecked(options.MaxPacket))
+	}
+	if options.MaxConcurrentRequests > 0 {
+		result = append(result, sftp.MaxConcurrentRequestsPerFile(options.MaxConcurrentRequests))
+	}
+	if options.DisableConcurrentReads {
+		result = append(result, sftp.UseConcurrentReads(false))
+	}
+	return result
+}
+
+// MaintenanceWindow is the period server is not processed in
+type MaintenanceWindow struct {
+	// Start is the schedule of window starts in UTC
+	Start *cron.Schedule
+
+	Duration time.Duration
+}
+
+// InMaintenance returns true if t falls into one of maintenance windows of the server
+func (conn ConnectionInfo) InMaintenance(t time.Time) bool {
+	t = t.UTC().Truncate(time.Minute)
+	for _, window := range conn.Maintenance {
+		// window is active if it started within its duration before t
+		for start := t; t.Sub(start) < window.Duration; start = start.Add(-time.Minute) {
+			if window.Start.Matches(start) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // ServerName returns server name as Address:Port
@@ -18,3 +133,10 @@ func (conn ConnectionInfo) ServerName() string {
 func (conn ConnectionInfo) String() string {
 	return conn.ServerName()
 }
+
+func (conn ConnectionInfo) logPath() string {
+	if conn.LogPath == "" {
+		return defaultLogPath
+	}
+	return conn.LogPath
+}
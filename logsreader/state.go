@@ -4,12 +4,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"time"
 )
 
 const (
 	stateFileNamePattern = "state_%d.json"
+
+	// CurrentStateVersion is the version of state schema written by SaveState. States of version 1 have
+	// no version field and store modification time of rotated log under "Modified" key
+	CurrentStateVersion = 2
 )
 
 // ErrNoStateFile indicates that state file doesn't exist. Most likely this happens
@@ -24,6 +31,57 @@ type State struct {
 
 	// BytesRead stores Number of bytes that were already read from access.log
 	BytesRead int
+
+	// StubStatusRequests is the number of requests reported by stub_status when logs were read. 0 if unknown
+	StubStatusRequests int64
+
+	// SucceededAt is the time of the last run that read logs to the end and saved their consumptions.
+	// Zero if it is unknown
+	SucceededAt time.Time
+
+	// Version is the schema version state was saved with. SaveState always writes CurrentStateVersion
+	Version int
+
+	// FlushedUntil is the start of the first hour consumptions of which were not completely saved yet.
+	// Records of earlier hours read later are late. Zero if it is unknown
+	FlushedUntil time.Time
+
+	// SeenRotated lists recently processed rotated files other than RotatedLog, at most maxSeenRotated of them.
+	// Rotated files that are not listed and are newer than RotatedLog were created since the last run
+	SeenRotated []FileInfo
+}
+
+// maxSeenRotated limits the number of files in State.SeenRotated, e.g. a day of hourly rotated logs
+const maxSeenRotated = 24
+
+// wasSeen returns true if the file is listed in SeenRotated
+func (state State) wasSeen(file FileInfo) bool {
+	for _, seen := range state.SeenRotated {
+		if seen.isSame(file) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendSeen adds the file to the list of seen rotated files dropping the oldest ones
+func appendSeen(seen []FileInfo, file FileInfo) []FileInfo {
+	if file.Name == "" {
+		return seen
+	}
+	result := append(append([]FileInfo{}, seen...), file)
+	if len(result) > maxSeenRotated {
+		result = result[len(result)-maxSeenRotated:]
+	}
+	return result
+}
+
+// ID identifies the position in logs the state points to. Logs read from the same position produce
+// the same records, possibly extended by lines written since then
+func (s State) ID() string {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%s|%d|%d", s.RotatedLog.Name, s.RotatedLog.ModifiedDate, s.BytesRead)
+	return strconv.FormatUint(hash.Sum64(), 16)
 }
 
 // GetState returns State object for given server
@@ -44,18 +102,42 @@ func GetState(conn ConnectionInfo) (State, error) {
 	if err != nil {
 		return State{}, fmt.Errorf("cannot parse json from %s: %v", fileName, err)
 	}
+	if stats.Version == 0 {
+		stats.Version = 1
+	}
+	if stats.Version > CurrentStateVersion {
+		// offsets of unknown schema can't be trusted, server would be re-read or skipped
+		return State{}, fmt.Errorf("state in %s is saved with newer schema version %d", fileName, stats.Version)
+	}
+
+	var seenRotated []FileInfo
+	for _, file := range stats.SeenRotated {
+		seenRotated = append(seenRotated, FileInfo{Name: file.Name, ModifiedDate: file.Modified})
+	}
 
 	return State{
-		RotatedLog: FileInfo{Name: stats.RotatedLog.Name, ModifiedDate: stats.RotatedLog.Modified},
-		BytesRead:  stats.BytesRead,
+		RotatedLog:         FileInfo{Name: stats.RotatedLog.Name, ModifiedDate: stats.RotatedLog.Modified},
+		BytesRead:          stats.BytesRead,
+		StubStatusRequests: stats.StubStatusRequests,
+		Version:            stats.Version,
+		FlushedUntil:       unixTime(stats.FlushedUntil),
+		SeenRotated:        seenRotated,
 	}, nil
 }
 
 // SaveState saves State for given server
 func SaveState(conn ConnectionInfo, stats State) error {
 	s := stateJSON{
-		RotatedLog: fileInfoJSON{Name: stats.RotatedLog.Name, Modified: stats.RotatedLog.ModifiedDate},
-		BytesRead:  stats.BytesRead,
+		Version:            CurrentStateVersion,
+		RotatedLog:         fileInfoJSON{Name: stats.RotatedLog.Name, Modified: stats.RotatedLog.ModifiedDate},
+		BytesRead:          stats.BytesRead,
+		StubStatusRequests: stats.StubStatusRequests,
+	}
+	if !stats.FlushedUntil.IsZero() {
+		s.FlushedUntil = stats.FlushedUntil.Unix()
+	}
+	for _, file := range stats.SeenRotated {
+		s.SeenRotated = append(s.SeenRotated, fileInfoJSON{Name: file.Name, Modified: file.ModifiedDate})
 	}
 
 	data, err := json.Marshal(s)
@@ -77,11 +159,22 @@ func buildStateFileName(conn ConnectionInfo) string {
 }
 
 type stateJSON struct {
-	RotatedLog fileInfoJSON `json:"log"`
-	BytesRead  int          `json:"read"`
+	Version            int            `json:"version,omitempty"`
+	RotatedLog         fileInfoJSON   `json:"log"`
+	BytesRead          int            `json:"read"`
+	StubStatusRequests int64          `json:"stubRequests,omitempty"`
+	FlushedUntil       int64          `json:"flushedUntil,omitempty"`
+	SeenRotated        []fileInfoJSON `json:"seen,omitempty"`
+}
+
+func unixTime(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0).UTC()
 }
 
 type fileInfoJSON struct {
 	Name     string `json:"name"`
-	Modified int64  `modified:"modified"`
+	Modified int64  `json:"modified"`
 }
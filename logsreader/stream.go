@@ -0,0 +1,40 @@
+package logsreader
+
+import "context"
+
+const (
+	streamBufferSize = 1000
+)
+
+// Stream reads logs from server and sends parsed records to the returned channel, so that caller
+// can process them with its own concurrency model. Records channel is closed when reading is finished.
+// After that errors channel provides error of reading if any and, when there is no error, returned State
+// contains new reader state. Checkpoints are not supported because records are processed asynchronously.
+// Records are sent in no particular order. Records are not sent anymore once ctx is cancelled,
+// so that caller that stops receiving records has to cancel ctx
+func Stream(ctx context.Context, conn ConnectionInfo, readerState State) (<-chan *LogRecord, <-chan error, *State) {
+	records := make(chan *LogRecord, streamBufferSize)
+	errs := make(chan error, 1)
+	newState := &State{}
+
+	go func() {
+		defer close(errs)
+
+		state, err := ReadLogs(ctx, conn, readerState, func(record *LogRecord) {
+			select {
+			case records <- record:
+			case <-ctx.Done():
+			}
+		}, Checkpoint{})
+		if state != nil {
+			*newState = *state
+		}
+		close(records)
+
+		if err != nil {
+			errs <- err
+		}
+	}()
+
+	return records, errs, newState
+}
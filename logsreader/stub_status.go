@@ -0,0 +1,43 @@
+package logsreader
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const stubStatusTimeout = 10 * time.Second
+
+// ScrapeStubStatus returns total number of requests handled by nginx reported by its stub_status endpoint
+func ScrapeStubStatus(url string) (int64, error) {
+	client := &http.Client{Timeout: stubStatusTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, fmt.Errorf("cannot get stub status: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("stub status responded with %d", resp.StatusCode)
+	}
+
+	// the third line contains numbers of accepted connections, handled connections and requests:
+	// Active connections: 291
+	// server accepts handled requests
+	//  16630948 16630948 31070465
+	scanner := bufio.NewScanner(resp.Body)
+	for i := 0; scanner.Scan(); i++ {
+		if i != 2 {
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			break
+		}
+		return strconv.ParseInt(fields[2], 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected stub status format")
+}
@@ -0,0 +1,237 @@
+package logsreader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// TransferSFTP opens log files over SFTP and seeks to the position where reading should start
+	TransferSFTP = "sftp"
+
+	// TransferTail runs tail command on the server and streams only unread part of log files.
+	// It is useful for servers where SFTP seek is unreliable
+	TransferTail = "tail"
+
+	// TransferGzip works like TransferTail, but compresses unread part of log files on the server with gzip.
+	// It transfers far fewer bytes over slow links at the cost of server CPU
+	TransferGzip = "gzip"
+
+	// TransferLocal reads log files from the local file system. It is used by agents running on nginx hosts
+	TransferLocal = "local"
+
+	// TransferSCP copies log files with scp for servers without SFTP subsystem. The whole file is transferred
+	// every time and rotated logs can't be cleaned up, so it is the last resort
+	TransferSCP = "scp"
+)
+
+// logOpener opens log file on the server for reading from given offset
+type logOpener func(fileName string, offset int) (io.ReadCloser, error)
+
+// logSource provides access to log files of the server
+type logSource struct {
+	open    logOpener
+	readDir func(dir string) ([]os.FileInfo, error)
+	remove  func(fileName string) error
+	rename  func(oldName, newName string) error
+	close   func()
+}
+
+func openLogSource(conn ConnectionInfo) (*logSource, error) {
+	if conn.TransferMode == TransferLocal {
+		return &logSource{open: localOpener, readDir: ioutil.ReadDir, remove: os.Remove, rename: os.Rename, close: func() {}}, nil
+	}
+
+	if conn.TransferMode == TransferSCP {
+		client, err := dialServer(conn)
+		if err != nil {
+			return nil, fmt.Errorf("fail to connect to server %s: %w", conn, err)
+		}
+		unsupported := func(string) error { return fmt.Errorf("not supported with %s transfer", TransferSCP) }
+		return &logSource{
+			open:    scpOpener(client),
+			readDir: scpReadDir(client),
+			remove:  unsupported,
+			rename:  func(oldName, _ string) error { return unsupported(oldName) },
+			close:   func() { client.Close() },
+		}, nil
+	}
+
+	client, sftpClient, err := connectToServer(conn)
+	if err != nil {
+		return nil, fmt.Errorf("fail to connect to server %s: %w", conn, err)
+	}
+	source := &logSource{
+		readDir: sftpClient.ReadDir,
+		remove:  sftpClient.Remove,
+		rename:  sftpClient.Rename,
+		close: func() {
+			sftpClient.Close()
+			client.Close()
+		},
+	}
+
+	switch conn.TransferMode {
+	case "", TransferSFTP:
+		source.open = sftpOpener(sftpClient)
+	case TransferTail:
+		source.open = tailOpener(client, false)
+	case TransferGzip:
+		source.open = tailOpener(client, true)
+	default:
+		source.close()
+		return nil, fmt.Errorf("unknown transfer mode %s", conn.TransferMode)
+	}
+	return source, nil
+}
+
+func localOpener(fileName string, offset int) (io.ReadCloser, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, openError(fileName, err)
+	}
+
+	_, err = file.Seek(int64(offset), os.SEEK_SET)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot seek to %d in %s: %v", offset, fileName, err)
+	}
+
+	return file, nil
+}
+
+func sftpOpener(client *sftp.Client) logOpener {
+	return func(fileName string, offset int) (io.ReadCloser, error) {
+		file, err := client.Open(fileName)
+		if err != nil {
+			return nil, openError(fileName, err)
+		}
+
+		_, err = file.Seek(int64(offset), os.SEEK_SET)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cannot seek to %d in %s: %v", offset, fileName, err)
+		}
+
+		return file, nil
+	}
+}
+
+// tailOpener reads files with tail command. Output of tail is compressed with gzip if compress is true
+func tailOpener(client *ssh.Client, compress bool) logOpener {
+	return func(fileName string, offset int) (io.ReadCloser, error) {
+		session, err := client.NewSession()
+		if err != nil {
+			return nil, fmt.Errorf("cannot open ssh session to read %s: %v", fileName, err)
+		}
+
+		stdout, err := session.StdoutPipe()
+		if err != nil {
+			session.Close()
+			return nil, fmt.Errorf("cannot get output of ssh session to read %s: %v", fileName, err)
+		}
+
+		stderr := &bytes.Buffer{}
+		session.Stderr = stderr
+
+		// tail counts bytes starting from 1
+		command := fmt.Sprintf("tail -c +%d %s", offset+1, shellQuote(fileName))
+		if compress {
+			// exit status of the pipeline is the status of gzip, failure of tail is detected by its stderr output
+			command += " | gzip -c -1"
+		}
+		err = session.Start(command)
+		if err != nil {
+			session.Close()
+			return nil, fmt.Errorf("cannot run %s: %v", command, err)
+		}
+
+		output := &commandOutput{Reader: stdout, session: session, command: command, stderr: stderr}
+		if !compress {
+			return output, nil
+		}
+		unzipped, err := gzip.NewReader(stdout)
+		if err != nil {
+			// failed command leaves no output, its own error explains the failure better
+			if waitErr := output.wait(); waitErr != nil {
+				err = waitErr
+			}
+			session.Close()
+			return nil, fmt.Errorf("cannot read compressed output of %s: %w", command, err)
+		}
+		output.Reader = unzipped
+		return output, nil
+	}
+}
+
+// commandOutput is the output of command running in ssh session. The command is checked for failure
+// once its output is read, so that missing file or failed command is not taken for empty output
+type commandOutput struct {
+	io.Reader
+	session *ssh.Session
+
+	command string
+	stderr  *bytes.Buffer
+	waitErr error
+	waited  bool
+}
+
+func (c *commandOutput) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if err == io.EOF {
+		if waitErr := c.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// wait returns error if the command exited with non-zero status or wrote anything to stderr
+func (c *commandOutput) wait() error {
+	if c.waited {
+		return c.waitErr
+	}
+	c.waited = true
+
+	err := c.session.Wait()
+	message := strings.TrimSpace(c.stderr.String())
+	switch {
+	case err == nil && message == "":
+		return nil
+	case err != nil:
+		c.waitErr = fmt.Errorf("%s failed: %v: %s", c.command, err, message)
+	default:
+		c.waitErr = fmt.Errorf("%s failed: %s", c.command, message)
+	}
+	// tail reports missing file only in stderr, also when its output is piped to gzip
+	if strings.Contains(message, "No such file or directory") {
+		c.waitErr = &Error{Cause: ErrLogNotFound, Err: c.waitErr}
+	}
+	return c.waitErr
+}
+
+func (c *commandOutput) Close() error {
+	return c.session.Close()
+}
+
+// openError returns error of opening log file, caused by ErrLogNotFound if the file doesn't exist
+func openError(fileName string, err error) error {
+	result := fmt.Errorf("cannot open %s: %w", fileName, err)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Error{Cause: ErrLogNotFound, Err: result}
+	}
+	return result
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
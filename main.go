@@ -1,55 +1,278 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/alexanderromanov/nginx-logparser/azure-storage"
 	"github.com/alexanderromanov/nginx-logparser/consumptions"
+	"github.com/alexanderromanov/nginx-logparser/cron"
+	"github.com/alexanderromanov/nginx-logparser/enrich"
+	"github.com/alexanderromanov/nginx-logparser/gelf"
 	"github.com/alexanderromanov/nginx-logparser/logsreader"
+	"github.com/alexanderromanov/nginx-logparser/metrics"
+	"github.com/alexanderromanov/nginx-logparser/privacy"
+	"github.com/alexanderromanov/nginx-logparser/rdns"
+	"github.com/alexanderromanov/nginx-logparser/systemd"
+	"github.com/alexanderromanov/nginx-logparser/tracing"
 	"github.com/alexanderromanov/nginx-logparser/websites"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
-	settingsFile = "settings.json"
+	defaultSettingsFile = "settings.json"
+
+	// profileEnv selects settings profile if -profile flag is not specified
+	profileEnv = "LOGPARSER_PROFILE"
+
+	defaultStubStatusTolerance = 0.05
+)
+
+var tracer = otel.Tracer("github.com/alexanderromanov/nginx-logparser")
+
+var (
+	since = flag.String("since", "", "aggregate only records logged at or after this time (RFC3339)")
+	until = flag.String("until", "", "aggregate only records logged before this time (RFC3339)")
+
+	daemon  = flag.Bool("daemon", false, "keep running and process logs periodically")
+	agent   = flag.Bool("agent", false, "run on nginx host and push pre-aggregated consumptions to collector")
+	collect = flag.Bool("collector", false, "receive consumptions pushed by agents")
+
+	detectFormat = flag.String("detect-format", "", "print log format settings matching sample lines of the server (address or address:port)")
+	sampleLines  = flag.Int("sample-lines", defaultSampleLines, "number of lines -detect-format reads")
+
+	importBlobs  = flag.Bool("import", false, "import consumptions from archived logs in blob container of import settings")
+	importPrefix = flag.String("import-prefix", "", "import only blobs with names starting with prefix, e.g. nginx/2023-05")
+	verify       = flag.Bool("verify", false, "compare consumptions of archived logs of -since to -until period with stored ones without writing anything")
+
+	migrateState = flag.Bool("migrate-state", false, "reconcile states of all servers with their log files and save them in the current format")
+
+	statusView = flag.Bool("status", false, "show live status of servers in the terminal instead of scrolling logs, e.g. during backfills")
+
+	pprofEnabled = flag.Bool("pprof", false, "expose runtime profiles under /debug/pprof/ of metrics endpoint")
+
+	profile = flag.String("profile", "", "settings profile to use, e.g. prod or staging (defaults to $"+profileEnv+")")
+
+	settingsFiles stringsFlag
 )
 
+func init() {
+	flag.Var(&settingsFiles, "config", "settings file, can be repeated to layer overrides over base settings (defaults to "+defaultSettingsFile+")")
+}
+
+// stringsFlag collects values of flag passed multiple times
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func main() {
+	flag.Parse()
+
 	log.Println("Initializing application. Reading settings")
-	settings, err := getSettings(settingsFile)
+	profileName := *profile
+	if profileName == "" {
+		profileName = os.Getenv(profileEnv)
+	}
+	if len(settingsFiles) == 0 {
+		settingsFiles = stringsFlag{defaultSettingsFile}
+	}
+	settings, err := getSettings(settingsFiles, profileName)
 	if err != nil {
 		log.Println("failed to read settings: " + err.Error())
 		return
 	}
 
-	log.Println("Getting domains list")
-	domains, err := websites.GetDomains(settings.WebsitesProvider)
+	settings.Usages.Since, err = parseTimeFlag(*since)
+	if err != nil {
+		log.Println("failed to parse since: " + err.Error())
+		return
+	}
+	settings.Usages.Until, err = parseTimeFlag(*until)
+	if err != nil {
+		log.Println("failed to parse until: " + err.Error())
+		return
+	}
+
+	if *migrateState {
+		if failed := runMigrateState(context.Background(), settings); failed > 0 {
+			// scripts running the migration before upgrade stop if some states have to be fixed manually
+			os.Exit(1)
+		}
+		return
+	}
+
+	flushTraces, err := tracing.Setup(settings.Tracing)
 	if err != nil {
-		log.Println("failed to get domains list: " + err.Error())
+		log.Println("failed to initialize tracing: " + err.Error())
+		return
+	}
+	defer flushTraces()
+
+	if *detectFormat != "" {
+		runDetectFormat(settings, *detectFormat, *sampleLines)
+		return
+	}
+
+	settings.Metrics.Pprof = *pprofEnabled
+	setupMetrics(settings.Metrics)
+
+	if *agent {
+		runAgent(context.Background(), settings)
+		return
+	}
+
+	// servers are connected while domains list is fetched, parsing waits for it
+	cache := fetchDomainsCache(settings.WebsitesProvider)
+
+	if *importBlobs {
+		err = runImport(context.Background(), settings, cache, *importPrefix)
+		if err != nil {
+			log.Println("failed to import archived logs: " + err.Error())
+		}
+		return
+	}
+	if *verify {
+		err = runVerify(context.Background(), settings, cache, *importPrefix)
+		if err != nil {
+			log.Println("failed to verify stored consumptions: " + err.Error())
+		}
+		return
+	}
+
+	if (*collect || *daemon) && settings.Daemon.DomainsRefresh > 0 {
+		cache.refreshEvery(settings.WebsitesProvider, settings.Daemon.DomainsRefresh, settings.Daemon.DomainsChangeLog)
+	}
+	if *collect {
+		if cache.wait() != nil {
+			return
+		}
+		notifyReady()
+		runCollector(context.Background(), settings, cache)
 		return
 	}
-	log.Printf("%d domain records obtained\n", len(domains))
+	ctx := shutdownContext()
+	if *daemon {
+		if settings.Daemon.QueueDirectory != "" && settings.AzureStorage.AccountName != "" {
+			err = startUploader(ctx, settings, settings.Daemon.QueueDirectory)
+			if err != nil {
+				log.Println("failed to open upload queue: " + err.Error())
+				return
+			}
+		}
+		serveMetrics(settings.Metrics)
+		serveStatus(settings.Daemon.StatusListen)
+		notifyReady()
+		runDaemon(ctx, settings, cache)
+		return
+	}
+	if *statusView {
+		defer startDashboard(settings.Servers)()
+	}
+	runOnce(ctx, settings, cache)
+}
+
+// runOnce processes logs of all servers and returns report of the run
+func runOnce(ctx context.Context, settings applicationSettings, domains *domainsCache) runReport {
+	ctx, span := tracer.Start(ctx, "run")
+	defer span.End()
+
+	startedAt := time.Now()
+	settings.Servers = activeServers(settings.Servers, startedAt)
+	report := runReport{
+		StartedAt:  startedAt,
+		ConfigHash: settings.ConfigHash,
+		Servers:    make([]*serverReport, len(settings.Servers)),
+	}
 
+	var dedup *consumptions.Deduplicator
+	if settings.Dedup.Key != "" {
+		dedup = consumptions.NewDeduplicator(settings.Dedup)
+	}
+
+	scheduler := newScheduler(settings.Scheduler)
 	var wg sync.WaitGroup
 	wg.Add(len(settings.Servers))
-	for _, conn := range settings.Servers {
-		go func(connection logsreader.ConnectionInfo) {
+	for position, server := range scheduler.order(settings.Servers, report.StartedAt) {
+		report.Servers[server.index] = &serverReport{Server: server.conn.ServerName()}
+		go func(position int, server scheduledServer, serverReport *serverReport) {
 			defer wg.Done()
-			err := processLogs(settings, connection, domains)
+			release, ok := scheduler.start(ctx, position, server)
+			if !ok {
+				serverReport.Err = ctx.Err()
+				return
+			}
+			defer release()
+
+			connection := server.conn
+			err := processLogs(ctx, settings, connection, domains, dedup, serverReport)
 			if err != nil {
+				serverReport.Err = err
+				status.failed(serverReport.Server, err)
 				log.Printf("error when processing logs for %s: %v\n", connection, err)
 			}
 			log.Printf("%s logs are processed\n", connection)
-		}(conn)
+		}(position, server, report.Servers[server.index])
 	}
 	wg.Wait()
+
+	reportUnknownDomains(settings, report)
+
+	report.FinishedAt = time.Now()
+	err := writeManifest(ctx, settings, report)
+	if err != nil {
+		log.Println("failed to write run manifest: " + err.Error())
+	}
+	if settings.Metrics.Textfile != "" {
+		err = writeTextfile(settings.Metrics.Textfile, report)
+		if err != nil {
+			log.Println("failed to write metrics textfile: " + err.Error())
+		}
+	}
+	return report
+}
+
+// activeServers returns servers that are enabled and not in maintenance at the given time
+func activeServers(servers []logsreader.ConnectionInfo, now time.Time) []logsreader.ConnectionInfo {
+	var result []logsreader.ConnectionInfo
+	for _, conn := range servers {
+		switch {
+		case conn.Disabled:
+			log.Printf("%s - server is disabled, skipping\n", conn.ServerName())
+		case conn.InMaintenance(now):
+			log.Printf("%s - server is in maintenance, skipping\n", conn.ServerName())
+		default:
+			result = append(result, conn)
+		}
+	}
+	return result
 }
 
-func processLogs(settings applicationSettings, conn logsreader.ConnectionInfo, domains map[string]*websites.WebsiteInfo) error {
+func processLogs(ctx context.Context, settings applicationSettings, conn logsreader.ConnectionInfo, domains *domainsCache, dedup *consumptions.Deduplicator, report *serverReport) error {
 	serverName := conn.ServerName()
+	ctx, span := tracer.Start(ctx, "processLogs")
+	defer span.End()
+	span.SetAttributes(attribute.String("server", serverName))
+
 	logForServer := func(format string, v ...interface{}) {
 		log.Printf(serverName+" - "+format+"\n", v...)
 	}
@@ -59,45 +282,499 @@ func processLogs(settings applicationSettings, conn logsreader.ConnectionInfo, d
 	if err != nil && err != logsreader.ErrNoStateFile {
 		return fmt.Errorf("cannot get connection state for %s: %v", conn, err)
 	}
+	report.StateBefore = prevState
+
+	logForServer("Connecting to server")
+	server, err := logsreader.Connect(conn)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	err = domains.wait()
+	if err != nil {
+		return err
+	}
+	usages := domains.newUsagesCollection(settings.Usages)
+	defer domains.release(usages)
+	usages.SetClosedBefore(prevState.FlushedUntil)
+	if dedup != nil {
+		usages.Deduplicate(dedup, serverName)
+		defer dedup.Done(serverName)
+	}
+	status.started(serverName, usages, prevState)
+	status.reading(serverName, server)
+	defer status.finished(serverName)
+	server.Hooks = logsreader.Hooks{
+		OnFileStart: func(fileName string, offset, size int64) {
+			status.readingFile(serverName, fileName)
+			if size > offset {
+				logForServer("%d bytes of %s are to be read", size-offset, fileName)
+			}
+		},
+		OnProgress: func(fileName string, bytesRead int64) {
+			metricsRegistry.Set(serverFileReadMetric, metrics.Labels{"server": serverName, "file": fileName}, float64(bytesRead))
+		},
+		OnFileEnd: func(fileName string, bytesRead int64, err error) {
+			if err == nil {
+				logForServer("%d bytes of %s are processed", bytesRead, fileName)
+			}
+		},
+	}
+
+	consumeRecord := usages.AddRecord
+	if settings.GELF.Address != "" {
+		writer, err := gelf.Dial(settings.GELF, serverName)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if failed := writer.Failed(); failed > 0 {
+				logForServer("%d records are not shipped to Graylog", failed)
+			}
+			writer.Close()
+		}()
+		consumeRecord = func(record *logsreader.LogRecord) {
+			usages.AddRecord(record)
+			writer.Send(record)
+		}
+	}
+
+	processRecord := consumeRecord
+	flushRecords := func() error { return nil }
+	if settings.Enrich.Command != "" {
+		enricher, err := enrich.Start(settings.Enrich, consumeRecord)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := enricher.Close(); err != nil {
+				logForServer("Enrichment program failed: %v", err)
+			}
+		}()
+		processRecord, flushRecords = enricher.Add, enricher.Flush
+	}
+	if anonymizer := privacy.New(settings.Privacy); anonymizer != nil {
+		// addresses are anonymized before records reach enrichment, Graylog or usages
+		next := processRecord
+		processRecord = func(record *logsreader.LogRecord) {
+			anonymizer.Anonymize(record)
+			next(record)
+		}
+	}
 
-	usages := consumptions.NewUsagesCollection(domains)
+	// rows of every save are keyed by the state its records were read from, so that re-reading
+	// after a failure replaces rows saved by the failed attempt
+	savedState := prevState
+	checkpoint := logsreader.Checkpoint{
+		Bytes: settings.CheckpointBytes,
+		Save: func(state logsreader.State) error {
+			logForServer("Checkpoint at %d bytes of %s", state.BytesRead, state.RotatedLog.Name)
+			// records waiting for enrichment are part of the checkpoint
+			err := flushRecords()
+			if err != nil {
+				return err
+			}
+			// records added while the snapshot is saved belong to the next checkpoint
+			archive, err := saveConsumptions(ctx, settings, usages.Snapshot(), serverName, savedState.ID(), report)
+			if err != nil {
+				return err
+			}
+			// checkpoint doesn't complete the run, time of the last successful run is kept
+			state.SucceededAt = prevState.SucceededAt
+			state.FlushedUntil = usages.CloseHours()
+			if err := saveState(settings, conn, &state, usages.Stats(), report); err != nil {
+				return err
+			}
+			if err := archive.upload(ctx, settings); err != nil {
+				logForServer("WARNING: %v", err)
+			}
+			savedState = state
+			status.flushed(serverName, state)
+			return nil
+		},
+	}
+
+	addRecord := func(record *logsreader.LogRecord) {
+		processRecord(record)
+		systemd.PingWatchdog()
+	}
+	readStarted := time.Now()
+	newState, err := server.ReadLogs(ctx, prevState, addRecord, checkpoint)
 
-	newState, err := logsreader.ReadLogs(conn, prevState, usages.AddRecord)
+	if err == nil {
+		err = flushRecords()
+	}
+
+	report.Records = usages.Stats()
+	if report.Records.Skewed > 0 {
+		logForServer("WARNING: %d records have timestamps beyond clock skew limits, server clock may be broken", report.Records.Skewed)
+	}
+	if report.Records.Late > 0 {
+		logForServer("%d records belong to already saved hours", report.Records.Late)
+	}
+	if report.Records.Malformed > 0 {
+		logForServer("%d records have malformed request lines, they are counted with %s verb", report.Records.Malformed, logsreader.InvalidVerb)
+	}
+	report.Throughput = measureThroughput(serverName, readStarted, report.Records.Total, server.BytesRead(), usages.NewestRecordTime())
+	logForServer("Read %d lines (%.0f lines/s, %.0f bytes/s), lag %v", report.Throughput.Lines,
+		report.Throughput.LinesPerSecond(), report.Throughput.BytesPerSecond(), report.Throughput.Lag)
 	if err != nil {
-		return fmt.Errorf("cannot read logs for %s: %v", conn, err)
+		return fmt.Errorf("cannot read logs for %s: %w", conn, err)
+	}
+
+	if server.BudgetReached() {
+		// requests handled by nginx are compared with logged ones only when all of them are read
+		logForServer("Byte budget of the run is reached, the next run continues from the saved state")
+	} else if conn.StubStatusURL != "" {
+		checkStubStatus(conn, prevState, newState, report, settings.StubStatusTolerance)
 	}
 
-	for _, domain := range usages.GetUnknownDomains() {
-		logForServer("Cannot find info for %s requested %d times", domain.Domain, domain.Requested)
+	report.Ignored = usages.GetIgnoredTraffic()
+	recordIgnoredMetrics(report.Ignored)
+	for _, ignored := range report.Ignored {
+		logForServer("Ignored %d requests (%d bytes) to %s", ignored.Requests, ignored.Bytes, ignored.Rule)
 	}
 
-	logForServer("Saving connection state")
-	err = logsreader.SaveState(conn, *newState)
+	report.UnknownDomains = usages.GetUnknownDomains()
+	logForServer("%d unknown domains requested, %d requests by IP address or without Host", len(report.UnknownDomains), report.Records.Unattributable)
+	if evicted := usages.EvictedUnknownDomains(); evicted > 0 {
+		logForServer("%d least requested unknown domains are dropped to limit memory", evicted)
+	}
+
+	report.TopClients = usages.GetTopClients()
+	clientNames := resolveClients(ctx, settings.ReverseDNS, report.TopClients)
+
+	archive, err := saveConsumptions(ctx, settings, usages, serverName, savedState.ID(), report)
 	if err != nil {
-		return fmt.Errorf("cannot save state for %s: %v", conn, err)
+		return err
+	}
+	reportTopClients(serverName, report.TopClients, <-clientNames)
+
+	// state is saved only after consumptions are stored, so that failed run is re-read next time
+	newState.SucceededAt = time.Now().UTC()
+	newState.FlushedUntil = usages.CloseHours()
+	err = saveState(settings, conn, newState, report.Records, report)
+	if err != nil {
+		return err
+	}
+	status.flushed(serverName, *newState)
+	if err := archive.upload(ctx, settings); err != nil {
+		logForServer("WARNING: %v", err)
+	}
+
+	if conn.RotatedLogs != "" && conn.RotatedLogs != logsreader.RotatedLogsKeep {
+		cleaned, err := logsreader.CleanupRotatedLogs(conn, prevState, *newState)
+		if err != nil {
+			// consumption is already stored, files are cleaned up next time
+			logForServer("Cannot clean up rotated logs: %v", err)
+		}
+		for _, fileName := range cleaned {
+			logForServer("Rotated log %s is processed and %sd", fileName, conn.RotatedLogs)
+		}
+	}
+	return nil
+}
+
+// consumptionSource is either UsagesCollection or its snapshot taken on checkpoint
+type consumptionSource interface {
+	GetTrafficConsumption() consumptions.WebsiteConsumptions
+	GetAccountConsumption() consumptions.AccountConsumptions
+	GetReferrers() []*consumptions.ReferrerRecord
+}
+
+// saveConsumptions stores consumptions collected so far to Azure storage and metrics. saveID identifies
+// the state records were read from. Archive of the consumptions is returned if it is configured, it is
+// uploaded by the caller once state is saved, so that only complete saves are archived
+func saveConsumptions(ctx context.Context, settings applicationSettings, usages consumptionSource, serverName, saveID string, report *serverReport) (*pendingArchive, error) {
+	logForServer := func(format string, v ...interface{}) {
+		log.Printf(serverName+" - "+format+"\n", v...)
 	}
 
 	consumptionRecords := usages.GetTrafficConsumption()
+	recordConsumptionMetrics(consumptionRecords)
+	if settings.AzureStorage.AccountName == "" && settings.MySQL.DSN == "" {
+		logForServer("Neither Azure storage nor MySQL is configured, consumption records are not saved")
+		return nil, nil
+	}
+
+	var accountRecords consumptions.AccountConsumptions
+	if settings.AzureStorage.AccountTableNameTemplate != "" {
+		accountRecords = usages.GetAccountConsumption()
+	}
+
+	if referrers := usages.GetReferrers(); len(referrers) > 0 && settings.AzureStorage.ReferrerTableNameTemplate != "" {
+		// referrers are reported, not billed, so their failure doesn't make consumptions re-read
+		logForServer("Saving %d referrers", len(referrers))
+		_, err := consumptions.SaveReferrers(ctx, settings.AzureStorage, referrers, serverName)
+		if err != nil {
+			logForServer("WARNING: cannot save referrers: %v", err)
+		}
+	}
+
+	var archive *pendingArchive
+	if settings.Archive.Container != "" && len(consumptionRecords) > 0 {
+		// archive is a copy for replays, failure to make it doesn't stop saving to tables
+		var err error
+		archive, err = newArchive(serverName, saveID, consumptionRecords, accountRecords)
+		if err != nil {
+			logForServer("WARNING: %v", err)
+		}
+	}
+
+	if uploadQueue != nil {
+		logForServer("Queueing consumption records for %d websites", len(consumptionRecords))
+		return archive, enqueueConsumptions(serverName, saveID, consumptionRecords, accountRecords)
+	}
+	return archive, storeConsumptions(ctx, settings, serverName, saveID, consumptionRecords, accountRecords, &report.Saved)
+}
+
+// storeConsumptions saves website and, if they are collected, account consumptions to Azure storage
+func storeConsumptions(ctx context.Context, settings applicationSettings, serverName, saveID string, consumptionRecords consumptions.WebsiteConsumptions, accountRecords consumptions.AccountConsumptions, stats *consumptions.SaveStats) error {
+	logForServer := func(format string, v ...interface{}) {
+		log.Printf(serverName+" - "+format+"\n", v...)
+	}
+
+	consumptions.ApplyTransforms(consumptionRecords, settings.Transforms)
+	consumptions.ApplyBilling(consumptionRecords, settings.Billing)
+	if settings.AzureStorage.AccountName != "" {
+		err := storeAzureConsumptions(ctx, settings, serverName, saveID, consumptionRecords, accountRecords, stats)
+		if err != nil {
+			return err
+		}
+	}
+
+	// MySQL rows are accumulated rather than replaced, so they are written after Azure storage rows,
+	// which are replaced by a retried save. Repeated save of saveID is skipped by MySQL sink
+	if settings.MySQL.DSN != "" {
+		logForServer("Saving consumption records for %d websites to MySQL", len(consumptionRecords))
+		err := consumptions.SaveConsumptionsToMySQL(ctx, settings.MySQL, consumptionRecords, serverName, saveID)
+		if err != nil {
+			return fmt.Errorf("error when saving consumptions for %s to mysql: %w", serverName, err)
+		}
+	}
+	return nil
+}
+
+// storeAzureConsumptions saves website and account consumptions to Azure storage tables
+func storeAzureConsumptions(ctx context.Context, settings applicationSettings, serverName, saveID string, consumptionRecords consumptions.WebsiteConsumptions, accountRecords consumptions.AccountConsumptions, stats *consumptions.SaveStats) error {
+	logForServer := func(format string, v ...interface{}) {
+		log.Printf(serverName+" - "+format+"\n", v...)
+	}
+
 	logForServer("Saving consumption records for %d websites", len(consumptionRecords))
-	err = consumptions.SaveConsumptions(settings.AzureStorage, consumptionRecords, serverName)
+	saved, err := consumptions.SaveConsumptions(ctx, settings.AzureStorage, consumptionRecords, serverName, saveID)
+	stats.Add(saved)
+
 	if err != nil {
-		return fmt.Errorf("error when saving consumptions for %s: %v", conn, err)
+		return fmt.Errorf("error when saving consumptions for %s: %w", serverName, err)
+	}
+
+	if accountRecords != nil {
+		consumptions.ApplyTransforms(accountRecords, settings.Transforms)
+		consumptions.ApplyBilling(accountRecords, settings.Billing)
+		logForServer("Saving consumption records for %d accounts", len(accountRecords))
+		saved, err = consumptions.SaveAccountConsumptions(ctx, settings.AzureStorage, accountRecords, serverName, saveID)
+		stats.Add(saved)
+
+		if err != nil {
+			return fmt.Errorf("error when saving account consumptions for %s: %w", serverName, err)
+		}
 	}
 	return nil
 }
 
-// getSettings returns application settings stored in settingsFile
-func getSettings(settingsFile string) (applicationSettings, error) {
-	fullPath, err := filepath.Abs(settingsFile)
+// saveState saves new state of the server and appends the change to audit log if it is configured
+func saveState(settings applicationSettings, conn logsreader.ConnectionInfo, newState *logsreader.State, records consumptions.RecordStats, report *serverReport) error {
+	log.Printf("%s - Saving connection state\n", conn.ServerName())
+	err := logsreader.SaveState(conn, *newState)
 	if err != nil {
-		return applicationSettings{}, err
+		return fmt.Errorf("cannot save state for %s: %v", conn, err)
+	}
+
+	oldState := report.StateBefore
+	if report.StateAfter != nil {
+		oldState = *report.StateAfter
+	}
+	report.StateAfter = newState
+
+	if settings.AuditLog != "" {
+		// records are counted since the beginning of the run, entry contains records of its change only
+		audited := report.audited
+		report.audited = records
+		err = appendAudit(settings.AuditLog, conn.ServerName(), oldState, *newState, records.Total-audited.Total, records.Counted-audited.Counted)
+		if err != nil {
+			// state is already saved, missing entry is reported but doesn't stop processing
+			log.Printf("%s - WARNING: %v\n", conn.ServerName(), err)
+		}
+	}
+	return nil
+}
+
+// checkStubStatus compares number of requests nginx has handled since the previous run with number
+// of log records read and flags the server if noticeably fewer records were logged
+func checkStubStatus(conn logsreader.ConnectionInfo, prevState logsreader.State, newState *logsreader.State, report *serverReport, tolerance float64) {
+	requests, err := logsreader.ScrapeStubStatus(conn.StubStatusURL)
+	if err != nil {
+		log.Printf("%s - Cannot check stub status: %v\n", conn.ServerName(), err)
+		return
+	}
+	newState.StubStatusRequests = requests
+
+	// counter is reset when nginx restarts
+	if prevState.StubStatusRequests == 0 || requests < prevState.StubStatusRequests {
+		return
+	}
+
+	if tolerance <= 0 {
+		tolerance = defaultStubStatusTolerance
+	}
+	handled := requests - prevState.StubStatusRequests
+	report.StubStatus = &stubStatusReport{
+		Handled: handled,
+		Logged:  report.Records.Total,
+		Missing: float64(report.Records.Total) < float64(handled)*(1-tolerance),
+	}
+	if report.StubStatus.Missing {
+		log.Printf("%s - WARNING: nginx handled %d requests but only %d were logged\n", conn.ServerName(), handled, report.Records.Total)
+	}
+}
+
+// reportUnknownDomains sends unknown domains found on all servers to the provider
+func reportUnknownDomains(settings applicationSettings, report runReport) {
+	requests := map[string]int{}
+	for _, server := range report.Servers {
+		for _, domain := range server.UnknownDomains {
+			requests[domain.Domain] += domain.Requested
+		}
+	}
+
+	requests, err := websites.SuppressUnknownDomains(settings.WebsitesProvider, requests)
+	if err != nil {
+		log.Println("failed to apply unknown domains suppression list: " + err.Error())
+		return
+	}
+	for domain, requested := range requests {
+		log.Printf("Cannot find info for %s requested %d times\n", domain, requested)
+	}
+
+	reported, err := websites.ReportUnknownDomains(settings.WebsitesProvider, requests)
+	if err != nil {
+		log.Println("failed to report unknown domains: " + err.Error())
+		return
 	}
+	err = websites.SuppressReportedDomains(settings.WebsitesProvider, reported, time.Now())
+	if err != nil {
+		log.Println("failed to update unknown domains suppression list: " + err.Error())
+	}
+}
+
+// parseTimeFlag parses RFC3339 time passed in command line. Empty value results in zero time
+func parseTimeFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// applyProfile replaces top level sections of settings with sections of the profile listed
+// in "profiles" object, e.g. {"servers": [...], "profiles": {"staging": {"servers": [...]}}}
+func applyProfile(data []byte, profile string) ([]byte, error) {
+	var sections map[string]json.RawMessage
+	err := json.Unmarshal(data, &sections)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles map[string]map[string]json.RawMessage
+	if raw, ok := sections["profiles"]; ok {
+		err = json.Unmarshal(raw, &profiles)
+		if err != nil {
+			return nil, fmt.Errorf("invalid profiles: %v", err)
+		}
+	}
+	profileSections, ok := profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("profile %s is not found", profile)
+	}
+
+	delete(sections, "profiles")
+	for name, section := range profileSections {
+		sections[name] = section
+	}
+	return json.Marshal(sections)
+}
+
+// configHash returns hash of settings file content identifying configuration the run used
+func configHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// mergeSettings merges override into base settings JSON. Objects are merged key by key recursively,
+// any other value of override, including arrays, replaces the value of base
+func mergeSettings(base, override json.RawMessage) json.RawMessage {
+	var baseObject, overrideObject map[string]json.RawMessage
+	if json.Unmarshal(base, &baseObject) != nil || json.Unmarshal(override, &overrideObject) != nil ||
+		baseObject == nil || overrideObject == nil {
+		return override
+	}
+
+	for name, value := range overrideObject {
+		if baseValue, ok := baseObject[name]; ok {
+			value = mergeSettings(baseValue, value)
+		}
+		baseObject[name] = value
+	}
+	result, err := json.Marshal(baseObject)
+	if err != nil {
+		return override
+	}
+	return result
+}
 
-	data, err := ioutil.ReadFile(fullPath)
+// readSettingsFiles reads settings files and merges them in order, so that later files override earlier ones
+func readSettingsFiles(settingsFiles []string) ([]byte, error) {
+	var result json.RawMessage
+	for _, settingsFile := range settingsFiles {
+		fullPath, err := filepath.Abs(settingsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadFile(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(data) {
+			return nil, fmt.Errorf("settings file %s is not valid JSON", settingsFile)
+		}
+
+		if result == nil {
+			result = data
+		} else {
+			result = mergeSettings(result, data)
+		}
+	}
+	return result, nil
+}
+
+// getSettings returns application settings stored in settingsFiles merged in order. Sections of the named
+// profile replace top level sections if profile is not empty. Only the merged result is validated, so that
+// override files can contain just the changed values
+func getSettings(settingsFiles []string, profile string) (applicationSettings, error) {
+	data, err := readSettingsFiles(settingsFiles)
 	if err != nil {
 		return applicationSettings{}, err
 	}
 
+	if profile != "" {
+		data, err = applyProfile(data, profile)
+		if err != nil {
+			return applicationSettings{}, err
+		}
+	}
+
 	var settings settingsJSON
 	err = json.Unmarshal(data, &settings)
 
@@ -105,60 +782,710 @@ func getSettings(settingsFile string) (applicationSettings, error) {
 		return applicationSettings{}, err
 	}
 
+	serviceDomains := make([]websites.ServiceDomain, len(settings.WebsitesProvider.ServiceDomains))
+	for i, d := range settings.WebsitesProvider.ServiceDomains {
+		serviceDomains[i] = websites.ServiceDomain{
+			Suffix:        d.Suffix,
+			AddWWW:        d.AddWWW,
+			MapSubdomains: d.MapSubdomains,
+		}
+	}
+
+	if settings.WebsitesProvider.UnknownDomainsThreshold < 0 {
+		return applicationSettings{}, fmt.Errorf("unknown domains threshold must not be negative, got %d", settings.WebsitesProvider.UnknownDomainsThreshold)
+	}
+
+	transformSettings := make([]consumptions.TransformSettings, len(settings.Transforms))
+	for i, t := range settings.Transforms {
+		transformSettings[i] = consumptions.TransformSettings{Name: t.Name, Params: t.Params}
+	}
+	transforms, err := consumptions.BuildTransforms(transformSettings)
+	if err != nil {
+		return applicationSettings{}, err
+	}
+
+	expensiveCalls := make([]consumptions.ExpensiveCall, len(settings.Usages.ExpensiveCalls))
+	for i, call := range settings.Usages.ExpensiveCalls {
+		if call.Path == "" {
+			return applicationSettings{}, fmt.Errorf("path of expensive call %d is not specified", i)
+		}
+		expensiveCalls[i] = consumptions.ExpensiveCall{Path: call.Path, Params: call.Params}
+	}
+
+	cdnNetworks, err := consumptions.ParseNetworks(settings.Usages.CDN.Ranges)
+	if err != nil {
+		return applicationSettings{}, err
+	}
+
+	if err := consumptions.ValidateKeyStrategy(settings.Azure.KeyStrategy); err != nil {
+		return applicationSettings{}, err
+	}
+	if err := consumptions.ValidateDedupKey(settings.Dedup.Key); err != nil {
+		return applicationSettings{}, err
+	}
+	if settings.Dedup.Key != "" && settings.Daemon.MaxIntervalSeconds > 0 {
+		// copies of a request are matched only if servers logging them are processed in the same run
+		return applicationSettings{}, fmt.Errorf("adaptive polling processes servers in separate runs, it can't be used with dedup")
+	}
+	if settings.Archive.Container != "" && settings.Azure.AccountName == "" {
+		return applicationSettings{}, fmt.Errorf("archive container requires azure storage account")
+	}
+	if err := consumptions.ValidateColumns(settings.Azure.Columns); err != nil {
+		return applicationSettings{}, err
+	}
+	if err := consumptions.ValidateMySQLTable(settings.MySQL.Table); err != nil {
+		return applicationSettings{}, err
+	}
+	if err := consumptions.ValidateLateData(settings.Usages.LateData); err != nil {
+		return applicationSettings{}, err
+	}
+	if err := consumptions.ValidateSkewAction(settings.Usages.SkewAction); err != nil {
+		return applicationSettings{}, err
+	}
+	gelfSettings := gelf.Settings{
+		Address:     settings.GELF.Address,
+		Compression: settings.GELF.Compression,
+		ChunkSize:   settings.GELF.ChunkSize,
+	}
+	if err := gelfSettings.Validate(); err != nil {
+		return applicationSettings{}, err
+	}
+	privacySettings := privacy.Settings{
+		Mode:     settings.Privacy.Mode,
+		Key:      settings.Privacy.Key,
+		Rotation: time.Duration(settings.Privacy.RotationHours) * time.Hour,
+	}
+	if err := privacySettings.Validate(); err != nil {
+		return applicationSettings{}, err
+	}
+	for _, network := range cdnNetworks {
+		if !privacySettings.Matches(network) {
+			return applicationSettings{}, fmt.Errorf("CDN range %s can't be matched with %s privacy mode", network, privacySettings.Mode)
+		}
+	}
+	if settings.Dedup.Key == consumptions.DedupByRequest && privacySettings.Mode != "" {
+		return applicationSettings{}, fmt.Errorf("dedup key %s can't match addresses anonymized by %s privacy mode", settings.Dedup.Key, privacySettings.Mode)
+	}
+	if _, err := storage.CloudBaseURL(settings.Azure.Cloud); err != nil {
+		return applicationSettings{}, err
+	}
+	if settings.Azure.APIVersion != "" {
+		if err := storage.ValidateAPIVersion(settings.Azure.APIVersion); err != nil {
+			return applicationSettings{}, err
+		}
+	}
+
+	storageRoutes := make([]consumptions.StorageRoute, len(settings.Azure.Routes))
+	for i, r := range settings.Azure.Routes {
+		storageRoutes[i] = consumptions.StorageRoute{
+			MinWebsiteID:      r.MinWebsiteID,
+			MaxWebsiteID:      r.MaxWebsiteID,
+			Shard:             r.Shard,
+			AccountName:       r.AccountName,
+			Key:               r.Key,
+			TableNameTemplate: r.TableTemplate,
+		}
+	}
+
 	servers := make([]logsreader.ConnectionInfo, len(settings.Servers))
 	for i, c := range settings.Servers {
 		servers[i] = logsreader.ConnectionInfo{
-			Address:  c.Address,
-			Port:     c.Port,
-			UserName: c.UserName,
-			Password: c.Password,
+			Address:       c.Address,
+			Port:          c.Port,
+			UserName:      c.UserName,
+			Password:      c.Password,
+			TransferMode:  c.TransferMode,
+			LogPath:       c.LogPath,
+			LogFormat:     toLogFormat(c.LogFormat),
+			StubStatusURL: c.StubStatusURL,
+
+			KeyFile:         c.KeyFile,
+			KeyPassphrase:   c.KeyPassphrase,
+			CertificateFile: c.CertificateFile,
+
+			MultiLine:        c.MultiLine,
+			RotatedLogs:      c.RotatedLogs,
+			ArchiveDirectory: c.ArchiveDirectory,
+
+			ReadBufferSize: settings.Reader.BufferKB * 1024,
+			MaxLineLength:  settings.Reader.MaxLineKB * 1024,
+			MaxRunBytes:    settings.Reader.MaxRunMB * 1024 * 1024,
+
+			Disabled: c.Enabled != nil && !*c.Enabled,
+
+			SFTP: logsreader.SFTPOptions{
+				MaxPacket:              c.SFTP.MaxPacket,
+				MaxConcurrentRequests:  c.SFTP.ConcurrentRequests,
+				DisableConcurrentReads: c.SFTP.ConcurrentReads != nil && !*c.SFTP.ConcurrentReads,
+			},
 		}
+		if c.TransferMode == logsreader.TransferSCP && c.RotatedLogs != "" && c.RotatedLogs != logsreader.RotatedLogsKeep {
+			return applicationSettings{}, fmt.Errorf("rotated logs of %s can't be %sd with %s transfer", servers[i], c.RotatedLogs, c.TransferMode)
+		}
+		for _, window := range c.Maintenance {
+			start, err := cron.Parse(window.Cron)
+			if err != nil {
+				return applicationSettings{}, fmt.Errorf("invalid maintenance window of %s: %v", servers[i], err)
+			}
+			servers[i].Maintenance = append(servers[i].Maintenance, logsreader.MaintenanceWindow{
+				Start:    start,
+				Duration: time.Duration(window.DurationMinutes) * time.Minute,
+			})
+		}
+	}
+
+	reverseDNSSettings := rdns.Settings{
+		Enabled:     settings.ReverseDNS.Enabled,
+		Timeout:     time.Duration(settings.ReverseDNS.TimeoutMs) * time.Millisecond,
+		CacheTTL:    time.Duration(settings.ReverseDNS.CacheHours) * time.Hour,
+		Concurrency: settings.ReverseDNS.Concurrency,
+	}
+	if err := reverseDNSSettings.Validate(); err != nil {
+		return applicationSettings{}, err
+	}
+	if reverseDNSSettings.Enabled && privacySettings.Mode != "" {
+		return applicationSettings{}, fmt.Errorf("reverse dns can't resolve addresses anonymized by %s privacy mode", privacySettings.Mode)
+	}
+
+	var storageProxy *url.URL
+	if settings.Azure.Proxy != "" {
+		storageProxy, err = url.Parse(settings.Azure.Proxy)
+		if err != nil {
+			return applicationSettings{}, fmt.Errorf("invalid storage proxy %s: %v", settings.Azure.Proxy, err)
+		}
+	}
+	storageTimeouts := storage.Timeouts{
+		Connect:        time.Duration(settings.Azure.Timeouts.ConnectSeconds) * time.Second,
+		TLSHandshake:   time.Duration(settings.Azure.Timeouts.TLSSeconds) * time.Second,
+		ResponseHeader: time.Duration(settings.Azure.Timeouts.ResponseHeaderSeconds) * time.Second,
+		Request:        time.Duration(settings.Azure.Timeouts.RequestSeconds) * time.Second,
+	}
+	storageHTTPClient := storage.NewHTTPClient(storageTimeouts, storageProxy)
+
+	collectorAgents := map[string]string{}
+	for _, a := range settings.Collector.Agents {
+		collectorAgents[a.Token] = a.Server
 	}
 
 	return applicationSettings{
 		WebsitesProvider: websites.DomainsInfoProviderSettings{
-			URL:                 settings.WebsitesProvider.URL,
-			UserName:            settings.WebsitesProvider.UserName,
-			Password:            settings.WebsitesProvider.Password,
-			ServiceDomainSuffix: settings.WebsitesProvider.ServiceDomainSuffix,
+			URL:                        settings.WebsitesProvider.URL,
+			UserName:                   settings.WebsitesProvider.UserName,
+			Password:                   settings.WebsitesProvider.Password,
+			ServiceDomainSuffix:        settings.WebsitesProvider.ServiceDomainSuffix,
+			ServiceDomains:             serviceDomains,
+			Anonymous:                  settings.WebsitesProvider.Anonymous,
+			UnknownDomainsURL:          settings.WebsitesProvider.UnknownDomainsURL,
+			UnknownDomainsThreshold:    settings.WebsitesProvider.UnknownDomainsThreshold,
+			DeletedRetentionDays:       settings.WebsitesProvider.DeletedRetentionDays,
+			SuppressionFile:            settings.WebsitesProvider.SuppressionFile,
+			SuppressedDomainsThreshold: settings.WebsitesProvider.SuppressedDomainsThreshold,
 		},
 		Servers: servers,
 		AzureStorage: consumptions.AzureStorageSettings{
-			AccountName:       settings.Azure.AccountName,
-			Key:               settings.Azure.Key,
-			TableNameTemplate: settings.Azure.TableTemplate,
+			AccountName:               settings.Azure.AccountName,
+			Key:                       settings.Azure.Key,
+			TableNameTemplate:         settings.Azure.TableTemplate,
+			AccountTableNameTemplate:  settings.Azure.AccountTableTemplate,
+			ReferrerTableNameTemplate: settings.Azure.ReferrerTableTemplate,
+			Routes:                    storageRoutes,
+			BaseURL:                   settings.Azure.BaseURL,
+			Cloud:                     settings.Azure.Cloud,
+			APIVersion:                settings.Azure.APIVersion,
+			HTTPClient:                storageHTTPClient,
+			RequestTimeout:            storageTimeouts.Request,
+			Accumulate:                settings.Azure.Accumulate,
+			KeyStrategy:               settings.Azure.KeyStrategy,
+			Pricing:                   toPricing(settings.Pricing),
+			Columns:                   settings.Azure.Columns,
+			LateData:                  settings.Usages.LateData,
+		},
+		Usages: consumptions.UsagesSettings{
+			CountIncompleteRecords: settings.Usages.CountIncompleteRecords,
+			AnonymousWebsites:      settings.WebsitesProvider.Anonymous,
+			ExcludedStatusCodes:    settings.Usages.ExcludedStatusCodes,
+			OtherStatusCodes:       settings.Usages.OtherStatusCodes,
+			StatusWeights:          settings.Usages.StatusWeights,
+			TopClients:             settings.Usages.TopClients,
+			SlowRequestThreshold:   time.Duration(settings.Usages.SlowRequestMs) * time.Millisecond,
+			CatchAllWebsiteID:      settings.Usages.CatchAllWebsiteID,
+			PerMinute:              settings.Usages.PerMinute,
+			TrackConcurrency:       settings.Usages.TrackConcurrency,
+			CountReferrers:         settings.Usages.CountReferrers,
+			ExcludedVerbs:          settings.Usages.ExcludedVerbs,
+			ProbeVerbs:             settings.Usages.ProbeVerbs,
+			CDNNetworks:            cdnNetworks,
+			CDNWebsiteID:           settings.Usages.CDN.WebsiteID,
+			CapRangeBytes:          settings.Usages.CapRangeBytes,
+			CollapseUnknownDomains: settings.Usages.CollapseUnknownDomains,
+			MaxUnknownDomains:      settings.Usages.MaxUnknownDomains,
+			ExpensiveCalls:         expensiveCalls,
+			AlternatePorts:         settings.Usages.AlternatePorts,
+			MaxFutureSkew:          time.Duration(settings.Usages.MaxFutureSkewMinutes) * time.Minute,
+			MaxPastSkew:            time.Duration(settings.Usages.MaxPastSkewHours) * time.Hour,
+			SkewAction:             settings.Usages.SkewAction,
+			LateData:               settings.Usages.LateData,
+		},
+		Tracing: tracing.Settings{
+			Endpoint:    settings.Tracing.Endpoint,
+			Insecure:    settings.Tracing.Insecure,
+			ServiceName: settings.Tracing.ServiceName,
+		},
+		Transforms: transforms,
+		ReverseDNS: reverseDNSSettings,
+		Billing:    toBillingMultipliers(settings.Billing),
+		MySQL: consumptions.MySQLSettings{
+			DSN:   settings.MySQL.DSN,
+			Table: settings.MySQL.Table,
+		},
+		Dedup: consumptions.DedupSettings{
+			Key:    settings.Dedup.Key,
+			Window: time.Duration(settings.Dedup.WindowSeconds) * time.Second,
+		},
+		Enrich: enrich.Settings{
+			Command:   settings.Enrich.Command,
+			Args:      settings.Enrich.Args,
+			BatchSize: settings.Enrich.BatchSize,
+		},
+		GELF:    gelfSettings,
+		Privacy: privacySettings,
+		Manifest: manifestSettings{
+			Directory: settings.Manifest.Directory,
+			Container: settings.Manifest.Container,
+		},
+		Archive:    archiveSettings{Container: settings.Archive.Container},
+		ConfigHash: configHash(data),
+		Metrics: metricsSettings{
+			Listen:      settings.Metrics.Listen,
+			MaxWebsites: settings.Metrics.MaxWebsites,
+			PprofToken:  settings.Metrics.PprofToken,
+			Textfile:    settings.Metrics.Textfile,
+		},
+		Daemon: daemonSettings{
+			Interval:         time.Duration(settings.Daemon.IntervalSeconds) * time.Second,
+			DomainsRefresh:   time.Duration(settings.Daemon.DomainsRefreshSeconds) * time.Second,
+			DomainsChangeLog: settings.Daemon.DomainsChangeLog,
+			StatusListen:     settings.Daemon.StatusListen,
+			QueueDirectory:   settings.Daemon.QueueDirectory,
+			MinInterval:      time.Duration(settings.Daemon.MinIntervalSeconds) * time.Second,
+			MaxInterval:      time.Duration(settings.Daemon.MaxIntervalSeconds) * time.Second,
+			IdleRecords:      settings.Daemon.IdleRecords,
+		},
+		Scheduler: schedulerSettings{
+			MaxConcurrent: settings.Scheduler.MaxConcurrent,
+			Stagger:       time.Duration(settings.Scheduler.StaggerMs) * time.Millisecond,
+			BackfillAfter: time.Duration(settings.Scheduler.BackfillAfterMinutes) * time.Minute,
+			MaxBackfills:  settings.Scheduler.MaxBackfills,
+		},
+		CheckpointBytes: settings.CheckpointMB * 1024 * 1024,
+		Agent: agentSettings{
+			CollectorURL: settings.Agent.CollectorURL,
+			Token:        settings.Agent.Token,
+			Server:       settings.Agent.Server,
+			Interval:     time.Duration(settings.Agent.IntervalSeconds) * time.Second,
+			LogFormat:    toLogFormat(settings.Agent.LogFormat),
+
+			ReadBufferSize: settings.Reader.BufferKB * 1024,
+			MaxLineLength:  settings.Reader.MaxLineKB * 1024,
 		},
+		Collector: collectorSettings{
+			Listen:    settings.Collector.Listen,
+			CertFile:  settings.Collector.CertFile,
+			KeyFile:   settings.Collector.KeyFile,
+			Agents:    collectorAgents,
+			LogFormat: toLogFormat(settings.Collector.LogFormat),
+		},
+		Import: importSettings{
+			Container: settings.Import.Container,
+			LogFormat: toLogFormat(settings.Import.LogFormat),
+			Server:    settings.Import.Server,
+			StateFile: settings.Import.StateFile,
+		},
+		Verify: verifySettings{
+			Tolerance:  settings.Verify.Tolerance,
+			ReportFile: settings.Verify.ReportFile,
+		},
+		AuditLog:            settings.AuditLog,
+		StubStatusTolerance: settings.StubStatusTolerance,
 	}, nil
 }
 
+func toPricing(pricing pricingJSON) consumptions.Pricing {
+	result := consumptions.Pricing{Plans: map[string]consumptions.PlanPricing{}, DefaultPlan: pricing.DefaultPlan}
+	for name, plan := range pricing.Plans {
+		tiers := make([]consumptions.PriceTier, len(plan.Tiers))
+		for i, tier := range plan.Tiers {
+			tiers[i] = consumptions.PriceTier{UpToGB: tier.UpToGB, PricePerGB: tier.PricePerGB}
+		}
+		result.Plans[name] = consumptions.PlanPricing{IncludedGB: plan.IncludedGB, Tiers: tiers}
+	}
+	return result
+}
+
+// toBillingMultipliers keeps default multiplier of classes that are not specified
+func toBillingMultipliers(billing billingJSON) consumptions.BillingMultipliers {
+	result := consumptions.DefaultBillingMultipliers
+	if billing.Files != nil {
+		result.Files = *billing.Files
+	}
+	if billing.Dynamic != nil {
+		result.Dynamic = *billing.Dynamic
+	}
+	if billing.Other != nil {
+		result.Other = *billing.Other
+	}
+	return result
+}
+
+func toLogFormat(format logFormatJSON) logsreader.LogFormat {
+	return logsreader.LogFormat{
+		Type:       format.Type,
+		Delimiter:  format.Delimiter,
+		Columns:    format.Columns,
+		TimeLayout: format.TimeLayout,
+		Escape:     format.Escape,
+	}
+}
+
 type applicationSettings struct {
 	AzureStorage     consumptions.AzureStorageSettings
+	MySQL            consumptions.MySQLSettings
 	Servers          []logsreader.ConnectionInfo
 	WebsitesProvider websites.DomainsInfoProviderSettings
+	Usages           consumptions.UsagesSettings
+	Tracing          tracing.Settings
+	Transforms       []consumptions.Transform
+	ReverseDNS       rdns.Settings
+	Billing          consumptions.BillingMultipliers
+	Dedup            consumptions.DedupSettings
+	Enrich           enrich.Settings
+	GELF             gelf.Settings
+	Privacy          privacy.Settings
+	Manifest         manifestSettings
+	Archive          archiveSettings
+	ConfigHash       string
+	Metrics          metricsSettings
+	Daemon           daemonSettings
+	Scheduler        schedulerSettings
+
+	// CheckpointBytes is the number of bytes read between intermediate saves of consumptions and state.
+	// State is saved only at the end of the run if it is zero
+	CheckpointBytes int
+
+	Agent     agentSettings
+	Collector collectorSettings
+	Import    importSettings
+	Verify    verifySettings
+
+	// AuditLog is the file every state change is appended to. State changes are not audited if it is empty
+	AuditLog string
+
+	// StubStatusTolerance is the fraction of requests handled by nginx that may be missing in logs
+	// before the server is flagged
+	StubStatusTolerance float64
 }
 
 type settingsJSON struct {
 	Azure            azureJSON            `json:"azure"`
+	MySQL            mysqlJSON            `json:"mysql"`
 	Servers          []connectionInfoJSON `json:"servers"`
 	WebsitesProvider websitesProviderJSON `json:"websitesProvider"`
+	Usages           usagesJSON           `json:"usages"`
+	Tracing          tracingJSON          `json:"tracing"`
+	Transforms       []transformJSON      `json:"transforms"`
+	ReverseDNS       reverseDNSJSON       `json:"reverseDNS"`
+	Billing          billingJSON          `json:"billing"`
+	Pricing          pricingJSON          `json:"pricing"`
+	Dedup            dedupJSON            `json:"dedup"`
+	Enrich           enrichJSON           `json:"enrich"`
+	GELF             gelfJSON             `json:"gelf"`
+	Privacy          privacyJSON          `json:"privacy"`
+	Manifest         manifestSettingsJSON `json:"manifest"`
+	Archive          archiveJSON          `json:"archive"`
+	Metrics          metricsJSON          `json:"metrics"`
+	Daemon           daemonJSON           `json:"daemon"`
+	Scheduler        schedulerJSON        `json:"scheduler"`
+	CheckpointMB     int                  `json:"checkpointMB"`
+	Agent            agentJSON            `json:"agent"`
+	Collector        collectorJSON        `json:"collector"`
+	Import           importJSON           `json:"import"`
+	Verify           verifyJSON           `json:"verify"`
+
+	StubStatusTolerance float64 `json:"stubStatusTolerance"`
+	AuditLog            string  `json:"auditLog"`
+
+	Reader readerJSON `json:"reader"`
+}
+
+type readerJSON struct {
+	BufferKB  int `json:"bufferKB"`
+	MaxLineKB int `json:"maxLineKB"`
+	MaxRunMB  int `json:"maxRunMB"`
+}
+
+type collectorJSON struct {
+	Listen    string               `json:"listen"`
+	CertFile  string               `json:"certFile"`
+	KeyFile   string               `json:"keyFile"`
+	Agents    []collectorAgentJSON `json:"agents"`
+	LogFormat logFormatJSON        `json:"logFormat"`
+}
+
+type importJSON struct {
+	Container string        `json:"container"`
+	LogFormat logFormatJSON `json:"logFormat"`
+	Server    string        `json:"server"`
+	StateFile string        `json:"stateFile"`
+}
+
+type archiveJSON struct {
+	Container string `json:"container"`
+}
+
+type verifyJSON struct {
+	Tolerance  float64 `json:"tolerance"`
+	ReportFile string  `json:"reportFile"`
+}
+
+type mysqlJSON struct {
+	DSN   string `json:"dsn"`
+	Table string `json:"table"`
+}
+
+type dedupJSON struct {
+	Key           string `json:"key"`
+	WindowSeconds int    `json:"windowSeconds"`
+}
+
+type collectorAgentJSON struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+type agentJSON struct {
+	CollectorURL    string        `json:"collectorUrl"`
+	Token           string        `json:"token"`
+	Server          string        `json:"server"`
+	IntervalSeconds int           `json:"intervalSeconds"`
+	LogFormat       logFormatJSON `json:"logFormat"`
+}
+
+type metricsJSON struct {
+	Listen      string `json:"listen"`
+	MaxWebsites int    `json:"maxWebsites"`
+	PprofToken  string `json:"pprofToken"`
+	Textfile    string `json:"textfile"`
+}
+
+type schedulerJSON struct {
+	MaxConcurrent        int `json:"maxConcurrent"`
+	StaggerMs            int `json:"staggerMs"`
+	BackfillAfterMinutes int `json:"backfillAfterMinutes"`
+	MaxBackfills         int `json:"maxBackfills"`
+}
+
+type daemonJSON struct {
+	IntervalSeconds       int    `json:"intervalSeconds"`
+	DomainsRefreshSeconds int    `json:"domainsRefreshSeconds"`
+	DomainsChangeLog      string `json:"domainsChangeLog"`
+	StatusListen          string `json:"statusListen"`
+	QueueDirectory        string `json:"queueDirectory"`
+	MinIntervalSeconds    int    `json:"minIntervalSeconds"`
+	MaxIntervalSeconds    int    `json:"maxIntervalSeconds"`
+	IdleRecords           int64  `json:"idleRecords"`
 }
 
 type azureJSON struct {
+	AccountName           string             `json:"accountName"`
+	Key                   string             `json:"key"`
+	TableTemplate         string             `json:"tableTemplate"`
+	AccountTableTemplate  string             `json:"accountTableTemplate"`
+	ReferrerTableTemplate string             `json:"referrerTableTemplate"`
+	Routes                []storageRouteJSON `json:"routes"`
+	Accumulate            bool               `json:"accumulate"`
+	BaseURL               string             `json:"baseUrl"`
+	Cloud                 string             `json:"cloud"`
+	APIVersion            string             `json:"apiVersion"`
+	Proxy                 string             `json:"proxy"`
+	KeyStrategy           string             `json:"keyStrategy"`
+	Timeouts              timeoutsJSON       `json:"timeouts"`
+	Columns               map[string]string  `json:"columns"`
+}
+
+type timeoutsJSON struct {
+	ConnectSeconds        int `json:"connectSeconds"`
+	TLSSeconds            int `json:"tlsSeconds"`
+	ResponseHeaderSeconds int `json:"responseHeaderSeconds"`
+	RequestSeconds        int `json:"requestSeconds"`
+}
+
+type storageRouteJSON struct {
+	MinWebsiteID  int    `json:"minWebsiteId"`
+	MaxWebsiteID  int    `json:"maxWebsiteId"`
+	Shard         string `json:"shard"`
 	AccountName   string `json:"accountName"`
 	Key           string `json:"key"`
 	TableTemplate string `json:"tableTemplate"`
 }
 
+type usagesJSON struct {
+	CountIncompleteRecords bool            `json:"countIncompleteRecords"`
+	ExcludedStatusCodes    []int           `json:"excludedStatusCodes"`
+	OtherStatusCodes       []int           `json:"otherStatusCodes"`
+	StatusWeights          map[int]float64 `json:"statusWeights"`
+	TopClients             int             `json:"topClients"`
+	SlowRequestMs          int             `json:"slowRequestMs"`
+	CatchAllWebsiteID      int             `json:"catchAllWebsiteId"`
+	PerMinute              bool            `json:"perMinute"`
+	TrackConcurrency       bool            `json:"trackConcurrency"`
+	CountReferrers         bool            `json:"countReferrers"`
+	ExcludedVerbs          []string        `json:"excludedVerbs"`
+	ProbeVerbs             []string        `json:"probeVerbs"`
+	CDN                    cdnJSON         `json:"cdn"`
+	CapRangeBytes          bool            `json:"capRangeBytes"`
+	CollapseUnknownDomains bool            `json:"collapseUnknownDomains"`
+	MaxUnknownDomains      int             `json:"maxUnknownDomains"`
+	ExpensiveCalls         []apiCallJSON   `json:"expensiveCalls"`
+	AlternatePorts         []int           `json:"alternatePorts"`
+	MaxFutureSkewMinutes   int             `json:"maxFutureSkewMinutes"`
+	MaxPastSkewHours       int             `json:"maxPastSkewHours"`
+	SkewAction             string          `json:"skewAction"`
+	LateData               string          `json:"lateData"`
+}
+
+type apiCallJSON struct {
+	Path   string   `json:"path"`
+	Params []string `json:"params"`
+}
+
+type cdnJSON struct {
+	Ranges    []string `json:"ranges"`
+	WebsiteID int      `json:"websiteId"`
+}
+
+type reverseDNSJSON struct {
+	Enabled     bool `json:"enabled"`
+	TimeoutMs   int  `json:"timeoutMs"`
+	CacheHours  int  `json:"cacheHours"`
+	Concurrency int  `json:"concurrency"`
+}
+
+type enrichJSON struct {
+	Command   string   `json:"command"`
+	Args      []string `json:"args"`
+	BatchSize int      `json:"batchSize"`
+}
+
+type gelfJSON struct {
+	Address     string `json:"address"`
+	Compression string `json:"compression"`
+	ChunkSize   int    `json:"chunkSize"`
+}
+
+type privacyJSON struct {
+	Mode          string `json:"mode"`
+	Key           string `json:"key"`
+	RotationHours int    `json:"rotationHours"`
+}
+
+type pricingJSON struct {
+	Plans       map[string]planPricingJSON `json:"plans"`
+	DefaultPlan string                     `json:"defaultPlan"`
+}
+
+type planPricingJSON struct {
+	IncludedGB float64         `json:"includedGB"`
+	Tiers      []priceTierJSON `json:"tiers"`
+}
+
+type priceTierJSON struct {
+	UpToGB     float64 `json:"upToGB"`
+	PricePerGB float64 `json:"pricePerGB"`
+}
+
+type billingJSON struct {
+	Files   *float64 `json:"files"`
+	Dynamic *float64 `json:"dynamic"`
+	Other   *float64 `json:"other"`
+}
+
+type manifestSettingsJSON struct {
+	Directory string `json:"directory"`
+	Container string `json:"container"`
+}
+
+type transformJSON struct {
+	Name   string             `json:"name"`
+	Params map[string]float64 `json:"params"`
+}
+
+type tracingJSON struct {
+	Endpoint    string `json:"endpoint"`
+	Insecure    bool   `json:"insecure"`
+	ServiceName string `json:"serviceName"`
+}
+
 type websitesProviderJSON struct {
-	URL                 string `json:"url"`
-	UserName            string `json:"username"`
-	Password            string `json:"password"`
-	ServiceDomainSuffix string `json:"serviceDomainSuffix"`
+	URL                        string              `json:"url"`
+	UserName                   string              `json:"username"`
+	Password                   string              `json:"password"`
+	ServiceDomainSuffix        string              `json:"serviceDomainSuffix"`
+	ServiceDomains             []serviceDomainJSON `json:"serviceDomains"`
+	Anonymous                  bool                `json:"anonymous"`
+	UnknownDomainsURL          string              `json:"unknownDomainsUrl"`
+	UnknownDomainsThreshold    int                 `json:"unknownDomainsThreshold"`
+	DeletedRetentionDays       int                 `json:"deletedRetentionDays"`
+	SuppressionFile            string              `json:"suppressionFile"`
+	SuppressedDomainsThreshold int                 `json:"suppressedDomainsThreshold"`
+}
+
+type serviceDomainJSON struct {
+	Suffix        string `json:"suffix"`
+	AddWWW        bool   `json:"addWww"`
+	MapSubdomains bool   `json:"mapSubdomains"`
 }
 
 type connectionInfoJSON struct {
-	Address  string `json:"address"`
-	Port     int    `json:"port"`
-	UserName string `json:"userName"`
-	Password string `json:"password"`
+	Address       string        `json:"address"`
+	Port          int           `json:"port"`
+	UserName      string        `json:"userName"`
+	Password      string        `json:"password"`
+	TransferMode  string        `json:"transferMode"`
+	LogPath       string        `json:"logPath"`
+	SFTP          sftpJSON      `json:"sftp"`
+	LogFormat     logFormatJSON `json:"logFormat"`
+	StubStatusURL string        `json:"stubStatusUrl"`
+
+	KeyFile         string `json:"keyFile"`
+	KeyPassphrase   string `json:"keyPassphrase"`
+	CertificateFile string `json:"certificateFile"`
+
+	MultiLine        string `json:"multiLine"`
+	RotatedLogs      string `json:"rotatedLogs"`
+	ArchiveDirectory string `json:"archiveDirectory"`
+
+	// Enabled is true if it is not specified
+	Enabled     *bool                   `json:"enabled"`
+	Maintenance []maintenanceWindowJSON `json:"maintenance"`
+}
+
+type sftpJSON struct {
+	MaxPacket          int `json:"maxPacket"`
+	ConcurrentRequests int `json:"concurrentRequests"`
+
+	// ConcurrentReads is true if it is not specified
+	ConcurrentReads *bool `json:"concurrentReads"`
+}
+
+type maintenanceWindowJSON struct {
+	Cron            string `json:"cron"`
+	DurationMinutes int    `json:"durationMinutes"`
+}
+
+type logFormatJSON struct {
+	Type       string   `json:"type"`
+	Delimiter  string   `json:"delimiter,omitempty"`
+	Columns    []string `json:"columns,omitempty"`
+	TimeLayout string   `json:"timeLayout,omitempty"`
+	Escape     string   `json:"escape,omitempty"`
 }
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/consumptions"
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+const (
+	manifestFileNamePattern = "manifest_%s.json"
+	manifestTimeFormat      = "20060102T150405Z"
+)
+
+// manifestSettings specifies where run manifests are stored
+type manifestSettings struct {
+	// Directory manifests are written to. Manifests are not written if it is empty
+	Directory string
+
+	// Container is the blob container of the main storage account manifests are uploaded to.
+	// Manifests are not uploaded if it is empty
+	Container string
+}
+
+// runReport collects information about the run for the manifest
+type runReport struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	ConfigHash string
+	Servers    []*serverReport
+}
+
+// serverReport collects information about processing of a single server
+type serverReport struct {
+	Server      string
+	StateBefore logsreader.State
+	StateAfter  *logsreader.State
+	Records     consumptions.RecordStats
+	Saved       consumptions.SaveStats
+	Err         error
+
+	// Throughput of reading. nil if logs weren't read
+	Throughput *throughputReport
+
+	// StubStatus is the result of comparison with nginx stub_status. nil if it wasn't checked
+	StubStatus *stubStatusReport
+
+	// Ignored is traffic dropped by ignore rules
+	Ignored []consumptions.IgnoredTraffic
+
+	// TopClients are client addresses with the most requests, e.g. for abuse reports. Empty unless they are counted
+	TopClients []consumptions.ClientCounter
+
+	// UnknownDomains is not written to manifest. It is collected to report unknown domains to the provider
+	UnknownDomains []consumptions.UnknownDomainsCounter
+
+	// audited are record stats of the state change written to audit log last
+	audited consumptions.RecordStats
+}
+
+// stubStatusReport compares number of requests handled by nginx since the previous run with number of logged ones
+type stubStatusReport struct {
+	Handled int64
+	Logged  int64
+	Missing bool
+}
+
+// writeManifest saves report as JSON manifest locally and uploads it to blob storage if configured
+func writeManifest(ctx context.Context, settings applicationSettings, report runReport) error {
+	if settings.Manifest.Directory == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(toManifestJSON(report), "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot serialize manifest: %v", err)
+	}
+
+	fileName := fmt.Sprintf(manifestFileNamePattern, report.StartedAt.UTC().Format(manifestTimeFormat))
+	fullPath := filepath.Join(settings.Manifest.Directory, fileName)
+	err = ioutil.WriteFile(fullPath, data, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot save manifest to %s: %v", fullPath, err)
+	}
+
+	if settings.Manifest.Container == "" {
+		return nil
+	}
+
+	client, err := settings.AzureStorage.Client()
+	if err != nil {
+		return err
+	}
+	err = client.GetBlobService().PutBlockBlob(ctx, settings.Manifest.Container, fileName, data, "application/json")
+	if err != nil {
+		return fmt.Errorf("cannot upload manifest %s: %v", fileName, err)
+	}
+	return nil
+}
+
+func toManifestJSON(report runReport) manifestJSON {
+	result := manifestJSON{
+		StartedAt:  report.StartedAt.UTC(),
+		FinishedAt: report.FinishedAt.UTC(),
+		ConfigHash: report.ConfigHash,
+		Servers:    make([]serverManifestJSON, len(report.Servers)),
+	}
+
+	for i, s := range report.Servers {
+		server := serverManifestJSON{
+			Server:      s.Server,
+			StateBefore: toStateManifestJSON(s.StateBefore),
+			Records: recordsManifestJSON{
+				Total:          s.Records.Total,
+				Counted:        s.Records.Counted,
+				OutOfWindow:    s.Records.OutOfWindow,
+				Excluded:       s.Records.Excluded,
+				Ignored:        s.Records.Ignored,
+				Marked:         s.Records.Marked,
+				Duplicate:      s.Records.Duplicate,
+				Unknown:        s.Records.Unknown,
+				Skewed:         s.Records.Skewed,
+				Unattributable: s.Records.Unattributable,
+				Malformed:      s.Records.Malformed,
+				Late:           s.Records.Late,
+			},
+			Saved: savedManifestJSON{
+				Entities:      s.Saved.Entities,
+				Batches:       s.Saved.Batches,
+				FailedBatches: s.Saved.FailedBatches,
+			},
+		}
+		for _, client := range s.TopClients {
+			server.TopClients = append(server.TopClients, clientManifestJSON{
+				IP:       client.IP,
+				Host:     client.Host,
+				Requests: client.Requests,
+				Bytes:    client.Bytes,
+			})
+		}
+		for _, ignored := range s.Ignored {
+			server.Ignored = append(server.Ignored, ignoredManifestJSON{
+				Rule:     ignored.Rule,
+				Requests: ignored.Requests,
+				Bytes:    ignored.Bytes,
+			})
+		}
+		if s.Throughput != nil {
+			server.Throughput = &throughputManifestJSON{
+				Lines:          s.Throughput.Lines,
+				Bytes:          s.Throughput.Bytes,
+				Seconds:        s.Throughput.Duration.Seconds(),
+				LinesPerSecond: s.Throughput.LinesPerSecond(),
+				BytesPerSecond: s.Throughput.BytesPerSecond(),
+			}
+			if !s.Throughput.NewestRecord.IsZero() {
+				newest := s.Throughput.NewestRecord.UTC()
+				lag := s.Throughput.Lag.Seconds()
+				server.Throughput.NewestRecord, server.Throughput.LagSeconds = &newest, &lag
+			}
+		}
+		if s.StubStatus != nil {
+			server.StubStatus = &stubStatusManifestJSON{
+				Handled: s.StubStatus.Handled,
+				Logged:  s.StubStatus.Logged,
+				Missing: s.StubStatus.Missing,
+			}
+		}
+		if s.StateAfter != nil {
+			stateAfter := toStateManifestJSON(*s.StateAfter)
+			server.StateAfter = &stateAfter
+		}
+		if s.Err != nil {
+			server.Error = s.Err.Error()
+		}
+		result.Servers[i] = server
+	}
+	return result
+}
+
+func toStateManifestJSON(state logsreader.State) stateManifestJSON {
+	return stateManifestJSON{
+		RotatedLog:         state.RotatedLog.Name,
+		RotatedLogModified: state.RotatedLog.ModifiedDate,
+		BytesRead:          state.BytesRead,
+	}
+}
+
+type manifestJSON struct {
+	StartedAt  time.Time            `json:"startedAt"`
+	FinishedAt time.Time            `json:"finishedAt"`
+	ConfigHash string               `json:"configHash"`
+	Servers    []serverManifestJSON `json:"servers"`
+}
+
+type serverManifestJSON struct {
+	Server      string                  `json:"server"`
+	StateBefore stateManifestJSON       `json:"stateBefore"`
+	StateAfter  *stateManifestJSON      `json:"stateAfter,omitempty"`
+	Records     recordsManifestJSON     `json:"records"`
+	Saved       savedManifestJSON       `json:"saved"`
+	Ignored     []ignoredManifestJSON   `json:"ignored,omitempty"`
+	TopClients  []clientManifestJSON    `json:"topClients,omitempty"`
+	Throughput  *throughputManifestJSON `json:"throughput,omitempty"`
+	StubStatus  *stubStatusManifestJSON `json:"stubStatus,omitempty"`
+	Error       string                  `json:"error,omitempty"`
+}
+
+type stateManifestJSON struct {
+	RotatedLog         string `json:"rotatedLog"`
+	RotatedLogModified int64  `json:"rotatedLogModified"`
+	BytesRead          int    `json:"bytesRead"`
+}
+
+type recordsManifestJSON struct {
+	Total          int64 `json:"total"`
+	Counted        int64 `json:"counted"`
+	OutOfWindow    int64 `json:"outOfWindow"`
+	Excluded       int64 `json:"excluded"`
+	Ignored        int64 `json:"ignored"`
+	Marked         int64 `json:"marked"`
+	Duplicate      int64 `json:"duplicate"`
+	Unknown        int64 `json:"unknown"`
+	Skewed         int64 `json:"skewed"`
+	Unattributable int64 `json:"unattributable"`
+	Malformed      int64 `json:"malformed"`
+	Late           int64 `json:"late"`
+}
+
+type throughputManifestJSON struct {
+	Lines          int64      `json:"lines"`
+	Bytes          int64      `json:"bytes"`
+	Seconds        float64    `json:"seconds"`
+	LinesPerSecond float64    `json:"linesPerSecond"`
+	BytesPerSecond float64    `json:"bytesPerSecond"`
+	NewestRecord   *time.Time `json:"newestRecord,omitempty"`
+	LagSeconds     *float64   `json:"lagSeconds,omitempty"`
+}
+
+type stubStatusManifestJSON struct {
+	Handled int64 `json:"handled"`
+	Logged  int64 `json:"logged"`
+	Missing bool  `json:"missing"`
+}
+
+type ignoredManifestJSON struct {
+	Rule     string `json:"rule"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type clientManifestJSON struct {
+	IP       string `json:"ip"`
+	Host     string `json:"host,omitempty"`
+	Requests int    `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type savedManifestJSON struct {
+	Entities      int64 `json:"entities"`
+	Batches       int64 `json:"batches"`
+	FailedBatches int64 `json:"failedBatches"`
+}
@@ -0,0 +1,200 @@
+// Package metrics keeps application counters and exposes them in Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Counter is the type of metrics that only grow
+	Counter = "counter"
+
+	// Gauge is the type of metrics that can go up and down
+	Gauge = "gauge"
+
+	// overflowLabelValue replaces value of the limited label once family reaches its limit
+	overflowLabelValue = "_overflow"
+)
+
+// Labels are names and values of metric labels
+type Labels map[string]string
+
+// Registry contains metric families
+type Registry struct {
+	sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name        string
+	help        string
+	kind        string
+	limitLabel  string
+	maxValues   int
+	labelValues map[string]bool
+	series      map[string]*series
+}
+
+type series struct {
+	labels Labels
+	value  float64
+}
+
+// NewRegistry creates empty Registry
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// Register describes metric family. maxValues limits number of distinct values of limitLabel to guard
+// against high cardinality, new values above the limit are replaced with "_overflow". Zero means no limit
+func (r *Registry) Register(name, help, kind, limitLabel string, maxValues int) {
+	r.Lock()
+	defer r.Unlock()
+
+	f := r.getFamily(name)
+	f.help = help
+	f.kind = kind
+	f.limitLabel = limitLabel
+	f.maxValues = maxValues
+}
+
+// Add increases value of the series
+func (r *Registry) Add(name string, labels Labels, value float64) {
+	r.Lock()
+	defer r.Unlock()
+	r.getSeries(name, labels).value += value
+}
+
+// Set sets value of the series
+func (r *Registry) Set(name string, labels Labels, value float64) {
+	r.Lock()
+	defer r.Unlock()
+	r.getSeries(name, labels).value = value
+}
+
+func (r *Registry) getFamily(name string) *family {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, kind: Counter, labelValues: map[string]bool{}, series: map[string]*series{}}
+		r.families[name] = f
+	}
+	return f
+}
+
+func (r *Registry) getSeries(name string, labels Labels) *series {
+	f := r.getFamily(name)
+
+	if f.maxValues > 0 {
+		value, ok := labels[f.limitLabel]
+		if ok && !f.labelValues[value] {
+			if len(f.labelValues) < f.maxValues {
+				f.labelValues[value] = true
+			} else {
+				limited := Labels{}
+				for name, value := range labels {
+					limited[name] = value
+				}
+				limited[f.limitLabel] = overflowLabelValue
+				labels = limited
+			}
+		}
+	}
+
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		f.series[key] = s
+	}
+	return s
+}
+
+// WriteText writes all metrics in Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.Lock()
+	defer r.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bufio.NewWriter(w)
+	for _, name := range names {
+		f := r.families[name]
+		if f.help != "" {
+			fmt.Fprintf(buf, "# HELP %s %s\n", f.name, f.help)
+		}
+		fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, key, strconv.FormatFloat(f.series[key].value, 'g', -1, 64))
+		}
+	}
+	return buf.Flush()
+}
+
+// WriteFile writes all metrics to file in Prometheus text format, e.g. for node_exporter textfile collector.
+// The file is replaced atomically, so that the collector never reads partially written metrics
+func (r *Registry) WriteFile(fileName string) error {
+	tempName := fileName + ".tmp"
+	file, err := os.Create(tempName)
+	if err != nil {
+		return fmt.Errorf("cannot create %s: %v", tempName, err)
+	}
+	err = r.WriteText(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempName)
+		return fmt.Errorf("cannot write metrics to %s: %v", tempName, err)
+	}
+	if err := os.Rename(tempName, fileName); err != nil {
+		os.Remove(tempName)
+		return fmt.Errorf("cannot replace %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// Handler returns http.Handler exposing metrics to Prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueEscaper.Replace(labels[name]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+// runMigrateState converts states of all servers to the current schema. Servers are migrated concurrently
+// with the limit of scheduler settings, since each of them has to be connected to check its log files.
+// Migrated states are appended to the audit log. It returns the number of servers which states are not migrated
+func runMigrateState(ctx context.Context, settings applicationSettings) int {
+	var (
+		wg      sync.WaitGroup
+		limit   chan struct{}
+		failed  int
+		counter sync.Mutex
+	)
+	if settings.Scheduler.MaxConcurrent > 0 {
+		limit = make(chan struct{}, settings.Scheduler.MaxConcurrent)
+	}
+
+	wg.Add(len(settings.Servers))
+	for _, conn := range settings.Servers {
+		go func(conn logsreader.ConnectionInfo) {
+			defer wg.Done()
+			if limit != nil {
+				limit <- struct{}{}
+				defer func() { <-limit }()
+			}
+
+			serverName := conn.ServerName()
+			result, err := logsreader.MigrateState(ctx, conn)
+			switch {
+			case errors.Is(err, logsreader.ErrRotationMismatch):
+				log.Printf("%s - state is not migrated, it has to be fixed manually: %v\n", serverName, err)
+			case err != nil:
+				log.Printf("%s - cannot migrate state: %v\n", serverName, err)
+			case result.FromVersion == 0:
+				log.Printf("%s - server has no state\n", serverName)
+			case result.FromVersion == logsreader.CurrentStateVersion:
+				log.Printf("%s - state is up to date\n", serverName)
+			case result.Reset:
+				log.Printf("%s - state is migrated from version %d, access.log is shorter than saved offset and is re-read from the beginning\n", serverName, result.FromVersion)
+			case result.Rotated:
+				log.Printf("%s - state is migrated from version %d, logs were rotated since the last run\n", serverName, result.FromVersion)
+			default:
+				log.Printf("%s - state is migrated from version %d\n", serverName, result.FromVersion)
+			}
+			if err != nil {
+				counter.Lock()
+				failed++
+				counter.Unlock()
+				return
+			}
+			if settings.AuditLog != "" && result.FromVersion != 0 && result.FromVersion != logsreader.CurrentStateVersion {
+				// migration doesn't read records, the entry only records the change of state
+				err = appendAudit(settings.AuditLog, serverName, result.StateBefore, result.StateAfter, 0, 0)
+				if err != nil {
+					log.Printf("%s - WARNING: %v\n", serverName, err)
+				}
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	log.Printf("migration to state version %d is finished for %d servers, %d failed\n", logsreader.CurrentStateVersion, len(settings.Servers), failed)
+	return failed
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+// adaptivePoller polls every server with its own interval. Interval of idle server is doubled up to
+// MaxInterval, interval of busy server is halved down to MinInterval
+type adaptivePoller struct {
+	initial     time.Duration
+	minInterval time.Duration
+	maxInterval time.Duration
+	idleRecords int64
+
+	intervals map[string]time.Duration
+	next      map[string]time.Time
+}
+
+// newAdaptivePoller returns nil if adaptive polling is not configured
+func newAdaptivePoller(settings daemonSettings, interval time.Duration) *adaptivePoller {
+	if settings.MaxInterval <= 0 {
+		return nil
+	}
+	minInterval := settings.MinInterval
+	if minInterval <= 0 {
+		minInterval = interval
+	}
+	maxInterval := settings.MaxInterval
+	if maxInterval < minInterval {
+		maxInterval = minInterval
+	}
+	initial := interval
+	if initial < minInterval {
+		initial = minInterval
+	}
+	if initial > maxInterval {
+		initial = maxInterval
+	}
+	return &adaptivePoller{
+		initial:     initial,
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+		idleRecords: settings.IdleRecords,
+		intervals:   map[string]time.Duration{},
+		next:        map[string]time.Time{},
+	}
+}
+
+// due returns servers that have to be polled now
+func (p *adaptivePoller) due(servers []logsreader.ConnectionInfo, now time.Time) []logsreader.ConnectionInfo {
+	var result []logsreader.ConnectionInfo
+	for _, conn := range servers {
+		if !now.Before(p.next[conn.ServerName()]) {
+			result = append(result, conn)
+		}
+	}
+	return result
+}
+
+// update adapts intervals of servers polled in the run. Interval of failed server is not changed.
+// Due servers missing in the report were skipped, e.g. for maintenance, they are polled after their interval
+func (p *adaptivePoller) update(due []logsreader.ConnectionInfo, report runReport, now time.Time) {
+	for _, conn := range due {
+		serverName := conn.ServerName()
+		interval, ok := p.intervals[serverName]
+		if !ok {
+			interval = p.initial
+		}
+		p.next[serverName] = now.Add(interval)
+	}
+
+	for _, server := range report.Servers {
+		interval, ok := p.intervals[server.Server]
+		if !ok {
+			interval = p.initial
+		}
+
+		switch {
+		case errors.Is(server.Err, logsreader.ErrAuthFailed):
+			// credentials are not going to be fixed by polling more often
+			interval = p.maxInterval
+		case server.Err != nil:
+			// failed run says nothing about the load of the server
+		case server.Records.Total <= p.idleRecords:
+			interval *= 2
+		default:
+			interval /= 2
+		}
+		if interval < p.minInterval {
+			interval = p.minInterval
+		}
+		if interval > p.maxInterval {
+			interval = p.maxInterval
+		}
+
+		if interval != p.intervals[server.Server] && ok {
+			log.Printf("%s - polling interval is %v\n", server.Server, interval)
+		}
+		p.intervals[server.Server] = interval
+		p.next[server.Server] = now.Add(interval)
+	}
+}
+
+// untilNext returns time until the next server has to be polled
+func (p *adaptivePoller) untilNext(servers []logsreader.ConnectionInfo, now time.Time) time.Duration {
+	wait := p.maxInterval
+	for _, conn := range servers {
+		if next := p.next[conn.ServerName()].Sub(now); next < wait {
+			wait = next
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
@@ -0,0 +1,138 @@
+// Package privacy anonymizes client IP addresses of log records before they are shipped anywhere,
+// e.g. to enrichment program or Graylog, as required by GDPR
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+const (
+	// ModeTruncate zeroes the last octet of IPv4 addresses and all but the first 64 bits of IPv6 addresses
+	ModeTruncate = "truncate"
+
+	// ModeHMAC replaces addresses with HMAC-SHA256 of them. The key is derived from Settings.Key and the period
+	// the record belongs to, so that addresses of different periods can't be correlated
+	ModeHMAC = "hmac"
+
+	defaultRotation = 24 * time.Hour
+
+	// hashSize is the number of bytes of HMAC addresses are replaced with
+	hashSize = 16
+)
+
+var (
+	ipv4Mask = net.CIDRMask(24, 32)
+	ipv6Mask = net.CIDRMask(64, 128)
+)
+
+// Settings describe how IP addresses are anonymized
+type Settings struct {
+	// Mode is ModeTruncate or ModeHMAC. Addresses are not anonymized if it is empty
+	Mode string
+
+	// Key is the secret HMAC keys are derived from
+	Key string
+
+	// Rotation is the period HMAC key changes with. defaultRotation is used if it is zero
+	Rotation time.Duration
+}
+
+// Validate checks that addresses can be anonymized with settings
+func (settings Settings) Validate() error {
+	switch settings.Mode {
+	case "", ModeTruncate:
+		return nil
+	case ModeHMAC:
+		if settings.Key == "" {
+			return errors.New("privacy key is required for hmac mode")
+		}
+		if settings.Rotation < 0 {
+			return fmt.Errorf("invalid privacy key rotation %v", settings.Rotation)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown privacy mode %s", settings.Mode)
+	}
+}
+
+// Matches returns true if anonymized addresses can still be matched against the network, e.g. CDN range
+func (settings Settings) Matches(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	switch settings.Mode {
+	case "":
+		return true
+	case ModeTruncate:
+		if bits == 32 {
+			return ones <= 24
+		}
+		return ones <= 64
+	default:
+		return false
+	}
+}
+
+// Anonymizer replaces IP addresses of records
+type Anonymizer struct {
+	settings Settings
+
+	sync.Mutex
+	period int64
+	key    []byte
+}
+
+// New returns anonymizer of settings or nil if addresses are not anonymized
+func New(settings Settings) *Anonymizer {
+	if settings.Mode == "" {
+		return nil
+	}
+	if settings.Rotation <= 0 {
+		settings.Rotation = defaultRotation
+	}
+	return &Anonymizer{settings: settings, period: -1}
+}
+
+// Anonymize replaces IP address of the record. Values that are not IP addresses, e.g. "-", are kept
+func (a *Anonymizer) Anonymize(record *logsreader.LogRecord) {
+	ip := net.ParseIP(record.IPAddress)
+	if ip == nil {
+		return
+	}
+
+	if a.settings.Mode == ModeTruncate {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			record.IPAddress = ipv4.Mask(ipv4Mask).String()
+		} else {
+			record.IPAddress = ip.Mask(ipv6Mask).String()
+		}
+		return
+	}
+
+	mac := hmac.New(sha256.New, a.periodKey(record.Time))
+	mac.Write(ip)
+	record.IPAddress = hex.EncodeToString(mac.Sum(nil)[:hashSize])
+}
+
+// periodKey returns HMAC key of the rotation period t belongs to. The key of the last period is cached,
+// since records mostly come in order
+func (a *Anonymizer) periodKey(t time.Time) []byte {
+	period := t.UnixNano() / int64(a.settings.Rotation)
+
+	a.Lock()
+	defer a.Unlock()
+	if period != a.period {
+		mac := hmac.New(sha256.New, []byte(a.settings.Key))
+		mac.Write([]byte(strconv.FormatInt(period, 10)))
+		a.key, a.period = mac.Sum(nil), period
+	}
+	return a.key
+}
@@ -0,0 +1,47 @@
+package privacy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+func TestAnonymize(t *testing.T) {
+	day := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	truncate := New(Settings{Mode: ModeTruncate})
+	hmacMode := New(Settings{Mode: ModeHMAC, Key: "secret"})
+
+	anonymize := func(a *Anonymizer, address string, t time.Time) string {
+		record := &logsreader.LogRecord{IPAddress: address, Time: t}
+		a.Anonymize(record)
+		return record.IPAddress
+	}
+
+	tests := []struct {
+		name     string
+		actual   string
+		expected string
+	}{
+		{name: "truncated ipv4", actual: anonymize(truncate, "192.168.10.77", day), expected: "192.168.10.0"},
+		{name: "truncated ipv6", actual: anonymize(truncate, "2001:db8:1:2:3:4:5:6", day), expected: "2001:db8:1:2::"},
+		{name: "not an address", actual: anonymize(truncate, "-", day), expected: "-"},
+		{name: "same hash in the period", actual: anonymize(hmacMode, "10.0.0.1", day), expected: anonymize(hmacMode, "10.0.0.1", day.Add(time.Hour))},
+	}
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("%s: %q, want %q", test.name, test.actual, test.expected)
+		}
+	}
+
+	hashed := anonymize(hmacMode, "10.0.0.1", day)
+	if len(hashed) != 2*hashSize || hashed == anonymize(hmacMode, "10.0.0.2", day) {
+		t.Errorf("unexpected hash %q", hashed)
+	}
+	if hashed == anonymize(hmacMode, "10.0.0.1", day.Add(defaultRotation)) {
+		t.Errorf("hash of the next period is the same")
+	}
+	if New(Settings{}) != nil {
+		t.Errorf("anonymizer is created without privacy mode")
+	}
+}
@@ -0,0 +1,184 @@
+// Package queue implements persistent FIFO queue. Every entry is a segment file of the queue directory,
+// so appended entries survive restarts until they are removed by the consumer
+package queue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix = ".segment"
+	tempSuffix    = ".tmp"
+
+	// deadLetterDirectory is the subdirectory of the queue entries that cannot be processed are moved to
+	deadLetterDirectory = "dead-letter"
+)
+
+// Queue is a persistent FIFO queue stored in a directory
+type Queue struct {
+	dir string
+
+	sync.Mutex
+	next     uint64
+	appended chan struct{}
+}
+
+// Open opens queue stored in dir creating the directory if needed. Segments that were not completely
+// written before the application stopped are removed
+func Open(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create queue directory %s: %v", dir, err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read queue directory %s: %v", dir, err)
+	}
+	q := &Queue{dir: dir, appended: make(chan struct{}, 1)}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, tempSuffix) {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if seq, ok := segmentNumber(name); ok && seq >= q.next {
+			q.next = seq + 1
+		}
+	}
+	return q, nil
+}
+
+// Append durably stores data as the last entry of the queue
+func (q *Queue) Append(data []byte) error {
+	q.Lock()
+	seq := q.next
+	q.next++
+	q.Unlock()
+
+	if err := q.write(fmt.Sprintf("%020d%s", seq, segmentSuffix), data); err != nil {
+		return err
+	}
+
+	select {
+	case q.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Oldest returns the first entry of the queue. Empty name is returned if the queue is empty
+func (q *Queue) Oldest() (string, []byte, error) {
+	segments, err := q.segments()
+	if err != nil || len(segments) == 0 {
+		return "", nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, segments[0]))
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot read queue segment %s: %v", segments[0], err)
+	}
+	return segments[0], data, nil
+}
+
+// Remove removes entry returned by Oldest after it is processed
+func (q *Queue) Remove(name string) error {
+	err := os.Remove(filepath.Join(q.dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove queue segment %s: %v", name, err)
+	}
+	return nil
+}
+
+// Update replaces data of entry returned by Oldest keeping its position in the queue
+func (q *Queue) Update(name string, data []byte) error {
+	return q.write(name, data)
+}
+
+// DeadLetter moves entry returned by Oldest out of the queue to the dead-letter subdirectory,
+// so that it doesn't block the entries behind it
+func (q *Queue) DeadLetter(name string) error {
+	dir := filepath.Join(q.dir, deadLetterDirectory)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create dead-letter directory %s: %v", dir, err)
+	}
+	if err := os.Rename(filepath.Join(q.dir, name), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("cannot move queue segment %s to %s: %v", name, dir, err)
+	}
+	return nil
+}
+
+// Len returns number of entries in the queue
+func (q *Queue) Len() int {
+	segments, _ := q.segments()
+	return len(segments)
+}
+
+// Wait blocks until an entry is appended or timeout expires
+func (q *Queue) Wait(timeout time.Duration) {
+	select {
+	case <-q.appended:
+	case <-time.After(timeout):
+	}
+}
+
+// write durably stores data as the segment name. The segment appears in the queue only
+// when it is completely written
+func (q *Queue) write(name string, data []byte) error {
+	name = filepath.Join(q.dir, name)
+	tempName := name + tempSuffix
+	file, err := os.Create(tempName)
+	if err != nil {
+		return fmt.Errorf("cannot create queue segment: %v", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempName)
+		return fmt.Errorf("cannot write queue segment %s: %v", tempName, err)
+	}
+
+	if err := os.Rename(tempName, name); err != nil {
+		os.Remove(tempName)
+		return fmt.Errorf("cannot commit queue segment %s: %v", name, err)
+	}
+	return nil
+}
+
+// segments returns names of segment files in order they were appended
+func (q *Queue) segments() ([]string, error) {
+	entries, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read queue directory %s: %v", q.dir, err)
+	}
+
+	var result []string
+	for _, entry := range entries {
+		if _, ok := segmentNumber(entry.Name()); ok {
+			result = append(result, entry.Name())
+		}
+	}
+	// names are zero padded, so lexical order is the order of numbers
+	sort.Strings(result)
+	return result, nil
+}
+
+func segmentNumber(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, segmentSuffix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+	return seq, err == nil
+}
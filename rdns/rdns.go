@@ -0,0 +1,144 @@
+// Package rdns resolves host names of client addresses for reports, e.g. to tell crawl-66-249-66-1.googlebot.com
+// from an unknown scanner. Lookups run concurrently with a timeout and their results are cached
+package rdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout     = 2 * time.Second
+	defaultCacheTTL    = 24 * time.Hour
+	defaultConcurrency = 10
+
+	// failedCacheTTL is how long failed lookups are cached, so that addresses without PTR records
+	// don't cost a timeout on every run
+	failedCacheTTL = time.Hour
+)
+
+// Settings describe reverse DNS lookups
+type Settings struct {
+	// Enabled turns lookups on
+	Enabled bool
+
+	// Timeout limits a single lookup. defaultTimeout is used if it is zero
+	Timeout time.Duration
+
+	// CacheTTL is how long resolved names are reused. defaultCacheTTL is used if it is zero
+	CacheTTL time.Duration
+
+	// Concurrency is the number of lookups run at once. defaultConcurrency is used if it is zero
+	Concurrency int
+}
+
+// Validate checks that lookups can run with settings
+func (settings Settings) Validate() error {
+	if settings.Timeout < 0 || settings.CacheTTL < 0 || settings.Concurrency < 0 {
+		return fmt.Errorf("invalid reverse dns settings: timeout %v, cache ttl %v, concurrency %d",
+			settings.Timeout, settings.CacheTTL, settings.Concurrency)
+	}
+	return nil
+}
+
+type cachedName struct {
+	host    string
+	expires time.Time
+}
+
+// cache keeps names between runs of the daemon
+var (
+	cacheSync sync.Mutex
+	cache     = map[string]cachedName{}
+)
+
+// lookupAddr resolves names of an address. It is replaced in tests
+var lookupAddr = net.DefaultResolver.LookupAddr
+
+// Lookup returns host names of addresses. Addresses that can't be resolved in time, don't have names
+// or aren't valid IP addresses, e.g. anonymized ones, are missing in the result
+func Lookup(ctx context.Context, settings Settings, addresses []string) map[string]string {
+	result := map[string]string{}
+	if !settings.Enabled {
+		return result
+	}
+	timeout, ttl, concurrency := settings.Timeout, settings.CacheTTL, settings.Concurrency
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if ttl == 0 {
+		ttl = defaultCacheTTL
+	}
+	if concurrency == 0 {
+		concurrency = defaultConcurrency
+	}
+
+	now := time.Now()
+	cacheSync.Lock()
+	for address, cached := range cache {
+		if !now.Before(cached.expires) {
+			delete(cache, address)
+		}
+	}
+	cacheSync.Unlock()
+
+	var resultSync sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan bool, concurrency)
+	for _, address := range addresses {
+		if net.ParseIP(address) == nil {
+			continue
+		}
+		cacheSync.Lock()
+		cached, ok := cache[address]
+		cacheSync.Unlock()
+		if ok && now.Before(cached.expires) {
+			if cached.host != "" {
+				result[address] = cached.host
+			}
+			continue
+		}
+
+		wg.Add(1)
+		slots <- true
+		go func(address string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			host, err := lookup(ctx, address, timeout)
+			if err != nil && ctx.Err() != nil {
+				// cancelled lookups say nothing about the address
+				return
+			}
+			expires := time.Now().Add(ttl)
+			if host == "" {
+				expires = time.Now().Add(failedCacheTTL)
+			}
+			cacheSync.Lock()
+			cache[address] = cachedName{host: host, expires: expires}
+			cacheSync.Unlock()
+			if host != "" {
+				resultSync.Lock()
+				result[address] = host
+				resultSync.Unlock()
+			}
+		}(address)
+	}
+	wg.Wait()
+	return result
+}
+
+// lookup returns the first name of the address without trailing dot. Empty if the address has no names
+func lookup(ctx context.Context, address string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	names, err := lookupAddr(ctx, address)
+	if err != nil || len(names) == 0 {
+		return "", err
+	}
+	return strings.TrimSuffix(names[0], "."), nil
+}
@@ -0,0 +1,125 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver replaces lookupAddr and counts lookups of every address
+type fakeResolver struct {
+	sync.Mutex
+	names   map[string]string
+	slow    map[string]bool
+	lookups map[string]int
+}
+
+func (r *fakeResolver) lookupAddr(ctx context.Context, address string) ([]string, error) {
+	r.Lock()
+	r.lookups[address]++
+	r.Unlock()
+	if r.slow[address] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if name, ok := r.names[address]; ok {
+		return []string{name + "."}, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func useResolver(t *testing.T, names map[string]string, slow ...string) *fakeResolver {
+	resolver := &fakeResolver{names: names, slow: map[string]bool{}, lookups: map[string]int{}}
+	for _, address := range slow {
+		resolver.slow[address] = true
+	}
+	original := lookupAddr
+	lookupAddr = resolver.lookupAddr
+	cacheSync.Lock()
+	cache = map[string]cachedName{}
+	cacheSync.Unlock()
+	t.Cleanup(func() {
+		lookupAddr = original
+	})
+	return resolver
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name      string
+		settings  Settings
+		addresses []string
+		expected  map[string]string
+	}{
+		{
+			name:      "names are resolved without trailing dot",
+			settings:  Settings{Enabled: true},
+			addresses: []string{"66.249.66.1"},
+			expected:  map[string]string{"66.249.66.1": "crawl-66-249-66-1.googlebot.com"},
+		},
+		{
+			name:      "addresses without names and invalid addresses are missing",
+			settings:  Settings{Enabled: true},
+			addresses: []string{"10.0.0.1", "10.0.0.x"},
+			expected:  map[string]string{},
+		},
+		{
+			name:      "lookups exceeding timeout are missing",
+			settings:  Settings{Enabled: true, Timeout: 10 * time.Millisecond, Concurrency: 1},
+			addresses: []string{"10.0.0.2", "66.249.66.1"},
+			expected:  map[string]string{"66.249.66.1": "crawl-66-249-66-1.googlebot.com"},
+		},
+		{
+			name:      "nothing is resolved when disabled",
+			settings:  Settings{},
+			addresses: []string{"66.249.66.1"},
+			expected:  map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useResolver(t, map[string]string{"66.249.66.1": "crawl-66-249-66-1.googlebot.com"}, "10.0.0.2")
+			actual := Lookup(context.Background(), test.settings, test.addresses)
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	resolver := useResolver(t, map[string]string{"66.249.66.1": "crawl-66-249-66-1.googlebot.com"})
+	settings := Settings{Enabled: true}
+	addresses := []string{"66.249.66.1", "10.0.0.1"}
+
+	Lookup(context.Background(), settings, addresses)
+	actual := Lookup(context.Background(), settings, addresses)
+
+	expected := map[string]string{"66.249.66.1": "crawl-66-249-66-1.googlebot.com"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	// both resolved names and failures are cached
+	for _, address := range addresses {
+		if resolver.lookups[address] != 1 {
+			t.Errorf("expected 1 lookup of %s, got %d", address, resolver.lookups[address])
+		}
+	}
+}
+
+func TestLookupCancelledNotCached(t *testing.T) {
+	resolver := useResolver(t, nil, "10.0.0.2")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	Lookup(ctx, Settings{Enabled: true}, []string{"10.0.0.2"})
+	Lookup(ctx, Settings{Enabled: true}, []string{"10.0.0.2"})
+
+	if resolver.lookups["10.0.0.2"] != 2 {
+		t.Errorf("expected cancelled lookup to be retried, got %d lookups", resolver.lookups["10.0.0.2"])
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+)
+
+// schedulerSettings control how processing of servers is spread over time within a run
+type schedulerSettings struct {
+	// MaxConcurrent limits number of servers processed at the same time. Not limited if it is zero
+	MaxConcurrent int
+
+	// Stagger is the delay between starts of consecutive servers
+	Stagger time.Duration
+
+	// BackfillAfter is the age of the last successful run after which server is expected to have
+	// large backlog. Servers without successful runs are backfills as well
+	BackfillAfter time.Duration
+
+	// MaxBackfills limits number of backfills processed at the same time. Not limited if it is zero
+	MaxBackfills int
+}
+
+// scheduledServer is the server with its place in the run
+type scheduledServer struct {
+	index    int
+	conn     logsreader.ConnectionInfo
+	lastRun  time.Time
+	backfill bool
+}
+
+// scheduler starts processing of servers staggered and with limited concurrency
+type scheduler struct {
+	settings  schedulerSettings
+	slots     chan struct{}
+	backfills chan struct{}
+}
+
+func newScheduler(settings schedulerSettings) *scheduler {
+	s := &scheduler{settings: settings}
+	if settings.MaxConcurrent > 0 {
+		s.slots = make(chan struct{}, settings.MaxConcurrent)
+	}
+	if settings.MaxBackfills > 0 {
+		s.backfills = make(chan struct{}, settings.MaxBackfills)
+	}
+	return s
+}
+
+// order returns servers ordered by time of their last successful run, the oldest first
+func (s *scheduler) order(servers []logsreader.ConnectionInfo, now time.Time) []scheduledServer {
+	result := make([]scheduledServer, len(servers))
+	for i, conn := range servers {
+		var lastRun time.Time
+		state, err := logsreader.GetState(conn)
+		if err == nil {
+			lastRun = state.SucceededAt
+		} else if err != logsreader.ErrNoStateFile {
+			log.Printf("%s - cannot get time of the last run: %v\n", conn.ServerName(), err)
+		}
+		result[i] = scheduledServer{
+			index:    i,
+			conn:     conn,
+			lastRun:  lastRun,
+			backfill: lastRun.IsZero() || (s.settings.BackfillAfter > 0 && now.Sub(lastRun) > s.settings.BackfillAfter),
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].lastRun.Before(result[j].lastRun) })
+	return result
+}
+
+// start waits until the server at the position of the order can be processed. It returns false if ctx is done
+// before that, otherwise the returned function has to be called when processing is finished
+func (s *scheduler) start(ctx context.Context, position int, server scheduledServer) (func(), bool) {
+	if delay := time.Duration(position) * s.settings.Stagger; delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+
+	var acquired []chan struct{}
+	release := func() {
+		for _, semaphore := range acquired {
+			<-semaphore
+		}
+	}
+	// backfill slot is taken first, so that waiting backfills don't hold regular slots
+	for _, semaphore := range []chan struct{}{s.backfillSlots(server), s.slots} {
+		if semaphore == nil {
+			continue
+		}
+		select {
+		case semaphore <- struct{}{}:
+			acquired = append(acquired, semaphore)
+		case <-ctx.Done():
+			release()
+			return nil, false
+		}
+	}
+	return release, true
+}
+
+func (s *scheduler) backfillSlots(server scheduledServer) chan struct{} {
+	if !server.backfill {
+		return nil
+	}
+	return s.backfills
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/consumptions"
+	"github.com/alexanderromanov/nginx-logparser/logsreader"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	statusServiceName = "nginxlogparser.LiveStatus"
+	statusMethodName  = "GetStatus"
+)
+
+// serverStatus is the state of processing logs of a server between flushes
+type serverStatus struct {
+	// usages are counters not flushed to storage yet. nil if server is not being processed
+	usages *consumptions.UsagesCollection
+
+	// reader of logs of the server. nil until the server is connected
+	reader *logsreader.Server
+
+	// file is the name of log file being read
+	file string
+
+	// err is the error processing of the server failed with
+	err error
+
+	// records is the number of records read by the finished processing
+	records int64
+
+	// state is the reader offset of the last flush
+	state     logsreader.State
+	updatedAt time.Time
+}
+
+// serverView is the copy of server status shown by terminal dashboard
+type serverView struct {
+	processing bool
+	records    int64
+	read       int64
+	expected   int64
+	file       string
+	err        error
+}
+
+// liveStatus keeps in-memory aggregation state of servers for status service
+type liveStatus struct {
+	sync.Mutex
+	servers map[string]*serverStatus
+}
+
+var status = &liveStatus{servers: map[string]*serverStatus{}}
+
+// started registers collection counters of the server are added to
+func (s *liveStatus) started(server string, usages *consumptions.UsagesCollection, state logsreader.State) {
+	s.Lock()
+	s.servers[server] = &serverStatus{usages: usages, state: state, updatedAt: time.Now()}
+	s.Unlock()
+}
+
+// reading registers reader of logs of the server, so that progress of reading can be shown
+func (s *liveStatus) reading(server string, reader *logsreader.Server) {
+	s.Lock()
+	if current, ok := s.servers[server]; ok {
+		current.reader = reader
+	}
+	s.Unlock()
+}
+
+// readingFile records the name of log file the server is reading
+func (s *liveStatus) readingFile(server, fileName string) {
+	s.Lock()
+	if current, ok := s.servers[server]; ok {
+		current.file = fileName
+	}
+	s.Unlock()
+}
+
+// failed records the error processing of the server failed with. Server may fail before it is started
+func (s *liveStatus) failed(server string, err error) {
+	s.Lock()
+	if current, ok := s.servers[server]; ok {
+		current.err = err
+	} else {
+		s.servers[server] = &serverStatus{err: err, updatedAt: time.Now()}
+	}
+	s.Unlock()
+}
+
+// flushed updates reader offset of the server after counters were saved
+func (s *liveStatus) flushed(server string, state logsreader.State) {
+	s.Lock()
+	if current, ok := s.servers[server]; ok {
+		current.state = state
+		current.updatedAt = time.Now()
+	}
+	s.Unlock()
+}
+
+// finished marks the server as not being processed
+func (s *liveStatus) finished(server string) {
+	s.Lock()
+	if current, ok := s.servers[server]; ok && current.usages != nil {
+		current.records = current.usages.Stats().Total
+		current.usages = nil
+		current.updatedAt = time.Now()
+	}
+	s.Unlock()
+}
+
+// view returns status of the server. It returns false if processing of the server hasn't started yet
+func (s *liveStatus) view(server string) (serverView, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	current, ok := s.servers[server]
+	if !ok {
+		return serverView{}, false
+	}
+	result := serverView{processing: current.usages != nil, records: current.records, file: current.file, err: current.err}
+	if current.usages != nil {
+		result.records = current.usages.Stats().Total
+	}
+	if current.reader != nil {
+		result.read, result.expected = current.reader.Progress()
+	}
+	return result, true
+}
+
+// snapshot returns status of all servers in form of google.protobuf.Struct fields
+func (s *liveStatus) snapshot() map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+
+	names := make([]string, 0, len(s.servers))
+	for name := range s.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	servers := make([]interface{}, len(names))
+	for i, name := range names {
+		server := s.servers[name]
+		result := map[string]interface{}{
+			"server":     name,
+			"processing": server.usages != nil,
+			"updatedAt":  server.updatedAt.UTC().Format(time.RFC3339),
+			"rotatedLog": server.state.RotatedLog.Name,
+			"file":       server.file,
+			"bytesRead":  server.state.BytesRead,
+		}
+		if server.usages != nil {
+			stats := server.usages.Stats()
+			result["records"] = map[string]interface{}{
+				"total":          stats.Total,
+				"counted":        stats.Counted,
+				"outOfWindow":    stats.OutOfWindow,
+				"excluded":       stats.Excluded,
+				"ignored":        stats.Ignored,
+				"marked":         stats.Marked,
+				"duplicate":      stats.Duplicate,
+				"unknown":        stats.Unknown,
+				"skewed":         stats.Skewed,
+				"unattributable": stats.Unattributable,
+				"malformed":      stats.Malformed,
+				"late":           stats.Late,
+			}
+			result["websites"] = websitesStatus(server.usages.GetTrafficConsumption())
+
+			var unknown []interface{}
+			for _, domain := range server.usages.GetUnknownDomains() {
+				unknown = append(unknown, map[string]interface{}{"domain": domain.Domain, "requested": domain.Requested})
+			}
+			result["unknownDomains"] = unknown
+		}
+		servers[i] = result
+	}
+	return map[string]interface{}{"servers": servers}
+}
+
+func websitesStatus(records consumptions.WebsiteConsumptions) []interface{} {
+	var result []interface{}
+	for websiteID, websiteRecords := range records {
+		var total consumptions.ConsumptionRecord
+		for _, record := range websiteRecords {
+			total.Files += record.Files
+			total.FilesCount += record.FilesCount
+			total.Dynamic += record.Dynamic
+			total.DynamicCount += record.DynamicCount
+			total.Other += record.Other
+			total.OtherCount += record.OtherCount
+			total.UploadBytes += record.UploadBytes
+		}
+		result = append(result, map[string]interface{}{
+			"websiteId":    strconv.Itoa(websiteID),
+			"files":        total.Files,
+			"filesCount":   total.FilesCount,
+			"dynamic":      total.Dynamic,
+			"dynamicCount": total.DynamicCount,
+			"other":        total.Other,
+			"otherCount":   total.OtherCount,
+			"uploadBytes":  total.UploadBytes,
+		})
+	}
+	return result
+}
+
+// statusServer is the gRPC service nginxlogparser.LiveStatus with the single method
+// GetStatus(google.protobuf.Empty) returns (google.protobuf.Struct), so clients need only well-known types
+type statusServer interface {
+	getStatus(ctx context.Context, request *emptypb.Empty) (*structpb.Struct, error)
+}
+
+type liveStatusServer struct{}
+
+func (liveStatusServer) getStatus(ctx context.Context, request *emptypb.Empty) (*structpb.Struct, error) {
+	return structpb.NewStruct(status.snapshot())
+}
+
+var statusServiceDesc = grpc.ServiceDesc{
+	ServiceName: statusServiceName,
+	HandlerType: (*statusServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: statusMethodName,
+		Handler: func(srv interface{}, ctx context.Context, decode func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			request := new(emptypb.Empty)
+			if err := decode(request); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return srv.(statusServer).getStatus(ctx, request)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + statusServiceName + "/" + statusMethodName}
+			return interceptor(ctx, request, info, func(ctx context.Context, request interface{}) (interface{}, error) {
+				return srv.(statusServer).getStatus(ctx, request.(*emptypb.Empty))
+			})
+		},
+	}},
+	Streams: []grpc.StreamDesc{},
+}
+
+// serveStatus starts gRPC status service if it is configured
+func serveStatus(listen string) {
+	if listen == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Println("failed to start status service: " + err.Error())
+		return
+	}
+	server := grpc.NewServer()
+	server.RegisterService(&statusServiceDesc, liveStatusServer{})
+	go func() {
+		log.Printf("status service listens on %s\n", listen)
+		if err := server.Serve(listener); err != nil {
+			log.Println("status service failed: " + err.Error())
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+// Package systemd implements readiness notification, watchdog and socket activation protocols of systemd.
+// All functions do nothing if the application is not started by systemd
+package systemd
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// listenFDsStart is the first file descriptor passed by socket activation
+	listenFDsStart = 3
+)
+
+// Notify sends state, e.g. "READY=1", to systemd. false is returned if notifications are not supported
+func Notify(state string) (bool, error) {
+	socketName := os.Getenv("NOTIFY_SOCKET")
+	if socketName == "" {
+		return false, nil
+	}
+
+	// abstract sockets are passed with @ prefix
+	if socketName[0] == '@' {
+		socketName = "\x00" + socketName[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketName, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("cannot connect to notify socket: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("cannot send %s: %v", state, err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns interval systemd expects watchdog pings with. Zero is returned if watchdog is disabled
+func WatchdogInterval() time.Duration {
+	if os.Getenv("WATCHDOG_PID") != "" && !forThisProcess("WATCHDOG_PID") {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdogInterval and lastPing are Unix nanoseconds. Watchdog is not pinged until EnableWatchdog is called
+var watchdogInterval, lastPing int64
+
+// EnableWatchdog turns on PingWatchdog if systemd expects watchdog pings
+func EnableWatchdog() {
+	atomic.StoreInt64(&watchdogInterval, int64(WatchdogInterval()))
+}
+
+// PingWatchdog tells systemd that the service makes progress. It is called from processing loops rather than
+// a timer, so that a stuck service is restarted. Pings are sent at most twice per interval systemd expects
+// them with, so it is cheap enough to be called for every processed record
+func PingWatchdog() {
+	interval := atomic.LoadInt64(&watchdogInterval)
+	if interval == 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&lastPing)
+	if now-last < interval/2 || !atomic.CompareAndSwapInt64(&lastPing, last, now) {
+		return
+	}
+	if _, err := Notify("WATCHDOG=1"); err != nil {
+		log.Printf("systemd watchdog ping failed: %v\n", err)
+	}
+}
+
+// Listener returns the first socket passed by systemd socket activation. nil is returned if process is not socket-activated
+func Listener() (net.Listener, error) {
+	if !forThisProcess("LISTEN_PID") {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+
+	file := os.NewFile(uintptr(listenFDsStart), "LISTEN_FD_3")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use activated socket: %v", err)
+	}
+	return listener, nil
+}
+
+// forThisProcess checks that variables of systemd protocol are meant for this process and not its parent
+func forThisProcess(pidVariable string) bool {
+	pid, err := strconv.Atoi(os.Getenv(pidVariable))
+	return err == nil && pid == os.Getpid()
+}
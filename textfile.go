@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/alexanderromanov/nginx-logparser/metrics"
+)
+
+const (
+	runStartedMetric        = "nginx_logparser_run_started_timestamp_seconds"
+	runDurationMetric       = "nginx_logparser_run_duration_seconds"
+	runServerSuccessMetric  = "nginx_logparser_run_server_success"
+	runRecordsMetric        = "nginx_logparser_run_records"
+	runBytesReadMetric      = "nginx_logparser_run_read_bytes"
+	runSavedEntitiesMetric  = "nginx_logparser_run_saved_entities"
+	runFailedBatchesMetric  = "nginx_logparser_run_failed_batches"
+	runServerDurationMetric = "nginx_logparser_run_server_read_seconds"
+)
+
+// writeTextfile writes counters of the run to fileName in node_exporter textfile collector format,
+// so that runs started by cron get into Prometheus without long-running process. The file describes
+// only the latest run, servers skipped by the run are missing in it
+func writeTextfile(fileName string, report runReport) error {
+	registry := metrics.NewRegistry()
+	registry.Register(runStartedMetric, "Start time of the latest run", metrics.Gauge, "", 0)
+	registry.Register(runDurationMetric, "Duration of the latest run", metrics.Gauge, "", 0)
+	registry.Register(runServerSuccessMetric, "Whether logs of the server were processed without errors by the latest run", metrics.Gauge, "", 0)
+	registry.Register(runRecordsMetric, "Log records of the server read by the latest run by result", metrics.Gauge, "", 0)
+	registry.Register(runBytesReadMetric, "Log bytes of the server read by the latest run", metrics.Gauge, "", 0)
+	registry.Register(runServerDurationMetric, "Time the latest run spent reading logs of the server", metrics.Gauge, "", 0)
+	registry.Register(runSavedEntitiesMetric, "Consumption entities of the server saved to storage by the latest run", metrics.Gauge, "", 0)
+	registry.Register(runFailedBatchesMetric, "Batches of the server storage failed to save in the latest run", metrics.Gauge, "", 0)
+
+	registry.Set(runStartedMetric, nil, float64(report.StartedAt.Unix()))
+	registry.Set(runDurationMetric, nil, report.FinishedAt.Sub(report.StartedAt).Seconds())
+	for _, server := range report.Servers {
+		labels := metrics.Labels{"server": server.Server}
+		success := 1.0
+		if server.Err != nil {
+			success = 0
+		}
+		registry.Set(runServerSuccessMetric, labels, success)
+
+		records := server.Records
+		for result, value := range map[string]int64{
+			"total":          records.Total,
+			"counted":        records.Counted,
+			"out_of_window":  records.OutOfWindow,
+			"excluded":       records.Excluded,
+			"ignored":        records.Ignored,
+			"marked":         records.Marked,
+			"duplicate":      records.Duplicate,
+			"unknown":        records.Unknown,
+			"skewed":         records.Skewed,
+			"unattributable": records.Unattributable,
+			"malformed":      records.Malformed,
+			"late":           records.Late,
+		} {
+			registry.Set(runRecordsMetric, metrics.Labels{"server": server.Server, "result": result}, float64(value))
+		}
+
+		if server.Throughput != nil {
+			registry.Set(runBytesReadMetric, labels, float64(server.Throughput.Bytes))
+			registry.Set(runServerDurationMetric, labels, server.Throughput.Duration.Seconds())
+		}
+		registry.Set(runSavedEntitiesMetric, labels, float64(server.Saved.Entities))
+		registry.Set(runFailedBatchesMetric, labels, float64(server.Saved.FailedBatches))
+	}
+	return registry.WriteFile(fileName)
+}
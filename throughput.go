@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/metrics"
+)
+
+// throughputReport shows how fast logs of the server are read and how far behind the newest record is
+type throughputReport struct {
+	Lines    int64
+	Bytes    int64
+	Duration time.Duration
+
+	// NewestRecord is the time of the newest parsed record. Zero if no records were read
+	NewestRecord time.Time
+
+	// Lag is the time between the newest parsed record and the end of reading
+	Lag time.Duration
+}
+
+// measureThroughput builds throughput report of logs read since started and exposes it as metrics of the server
+func measureThroughput(serverName string, started time.Time, lines, bytes int64, newestRecord time.Time) *throughputReport {
+	now := time.Now()
+	report := &throughputReport{
+		Lines:        lines,
+		Bytes:        bytes,
+		Duration:     now.Sub(started),
+		NewestRecord: newestRecord,
+	}
+
+	labels := metrics.Labels{"server": serverName}
+	metricsRegistry.Set(serverLinesRateMetric, labels, report.LinesPerSecond())
+	metricsRegistry.Set(serverBytesRateMetric, labels, report.BytesPerSecond())
+	// lag of servers without new records is unknown, the previous value is kept
+	if !newestRecord.IsZero() {
+		report.Lag = now.Sub(newestRecord)
+		metricsRegistry.Set(serverLagMetric, labels, report.Lag.Seconds())
+	}
+	return report
+}
+
+// LinesPerSecond returns average number of lines read per second
+func (r throughputReport) LinesPerSecond() float64 {
+	return perSecond(r.Lines, r.Duration)
+}
+
+// BytesPerSecond returns average number of bytes read per second
+func (r throughputReport) BytesPerSecond() float64 {
+	return perSecond(r.Bytes, r.Duration)
+}
+
+func perSecond(value int64, duration time.Duration) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	return float64(value) / duration.Seconds()
+}
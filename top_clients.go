@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/alexanderromanov/nginx-logparser/consumptions"
+	"github.com/alexanderromanov/nginx-logparser/rdns"
+)
+
+// resolveClients starts reverse DNS lookups of top clients, so that names are resolved while consumptions
+// are saved. The returned channel receives names by address
+func resolveClients(ctx context.Context, settings rdns.Settings, clients []consumptions.ClientCounter) <-chan map[string]string {
+	result := make(chan map[string]string, 1)
+	if !settings.Enabled || len(clients) == 0 {
+		result <- nil
+		return result
+	}
+	addresses := make([]string, len(clients))
+	for i, client := range clients {
+		addresses[i] = client.IP
+	}
+	go func() {
+		result <- rdns.Lookup(ctx, settings, addresses)
+	}()
+	return result
+}
+
+// reportTopClients sets resolved names of top clients of the server and logs them for abuse investigation
+func reportTopClients(serverName string, clients []consumptions.ClientCounter, names map[string]string) {
+	for i := range clients {
+		clients[i].Host = names[clients[i].IP]
+		host := clients[i].Host
+		if host == "" {
+			host = "-"
+		}
+		log.Printf("%s - Top client %s (%s): %d requests, %d bytes\n", serverName, clients[i].IP, host, clients[i].Requests, clients[i].Bytes)
+	}
+}
@@ -0,0 +1,65 @@
+// Package tracing configures OpenTelemetry tracing of the application
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	defaultServiceName = "nginx-logparser"
+)
+
+// Settings contains settings of OTLP exporter spans are sent to
+type Settings struct {
+	// Endpoint is host:port of OTLP HTTP collector. Tracing is disabled if it is empty
+	Endpoint string
+
+	// Insecure disables TLS when connecting to collector
+	Insecure bool
+
+	// ServiceName is reported as service.name resource attribute
+	ServiceName string
+}
+
+// Setup registers global tracer provider exporting spans to OTLP collector.
+// Returned function flushes pending spans and must be called before application exits
+func Setup(settings Settings) (func(), error) {
+	if settings.Endpoint == "" {
+		return func() {}, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(settings.Endpoint)}
+	if settings.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create OTLP exporter: %v", err)
+	}
+
+	serviceName := settings.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func() {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			log.Printf("cannot flush traces: %v\n", err)
+		}
+	}, nil
+}
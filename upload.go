@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/consumptions"
+	"github.com/alexanderromanov/nginx-logparser/metrics"
+	"github.com/alexanderromanov/nginx-logparser/queue"
+)
+
+const (
+	minUploadRetryDelay = 5 * time.Second
+	maxUploadRetryDelay = 5 * time.Minute
+	queueIdleWait       = time.Minute
+
+	// maxUploadAttempts is the number of failed saves after which queued snapshot is moved to dead-letter directory
+	maxUploadAttempts = 10
+
+	queueLengthMetric = "nginx_logparser_upload_queue_length"
+)
+
+// uploadQueue decouples reading logs from saving consumptions to storage in daemon mode.
+// Consumptions are saved directly if it is nil
+var uploadQueue *queue.Queue
+
+// queuedConsumptions is the entry of upload queue
+type queuedConsumptions struct {
+	Server   string                           `json:"server"`
+	SaveID   string                           `json:"saveId"`
+	Attempts int                              `json:"attempts,omitempty"`
+	Websites consumptions.WebsiteConsumptions `json:"websites"`
+	Accounts consumptions.AccountConsumptions `json:"accounts,omitempty"`
+}
+
+// startUploader opens upload queue in directory and starts draining it to storage in background
+func startUploader(ctx context.Context, settings applicationSettings, directory string) error {
+	q, err := queue.Open(directory)
+	if err != nil {
+		return err
+	}
+	uploadQueue = q
+	metricsRegistry.Register(queueLengthMetric, "Consumption snapshots waiting to be saved to storage", metrics.Gauge, "", 0)
+	log.Printf("upload queue %s contains %d entries\n", directory, q.Len())
+
+	store := func(entry queuedConsumptions, stats *consumptions.SaveStats) error {
+		return storeConsumptions(ctx, settings, entry.Server, entry.SaveID, entry.Websites, entry.Accounts, stats)
+	}
+	go func() {
+		delay := minUploadRetryDelay
+		for ctx.Err() == nil {
+			metricsRegistry.Set(queueLengthMetric, nil, float64(q.Len()))
+			err := uploadOldest(q, store)
+			if err == errQueueEmpty {
+				q.Wait(queueIdleWait)
+				continue
+			}
+			if err != nil {
+				if !errors.Is(err, consumptions.ErrSinkUnavailable) {
+					// failures other than unavailable storage are not expected to go away soon
+					delay = maxUploadRetryDelay
+				}
+				log.Printf("failed to upload queued consumptions, retrying in %v: %v\n", delay, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				if delay *= 2; delay > maxUploadRetryDelay {
+					delay = maxUploadRetryDelay
+				}
+				continue
+			}
+			delay = minUploadRetryDelay
+		}
+	}()
+	return nil
+}
+
+var errQueueEmpty = errors.New("queue is empty")
+
+// uploadOldest saves the oldest queued snapshot with store and removes it from the queue. Failed attempts
+// are counted in the entry, it is moved to dead-letter directory after maxUploadAttempts
+func uploadOldest(q *queue.Queue, store func(queuedConsumptions, *consumptions.SaveStats) error) error {
+	name, data, err := q.Oldest()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errQueueEmpty
+	}
+
+	var entry queuedConsumptions
+	if err := json.Unmarshal(data, &entry); err != nil {
+		// broken entry would block the queue forever
+		log.Printf("dropping queue entry %s that cannot be parsed: %v\n", name, err)
+		return q.Remove(name)
+	}
+
+	var saved consumptions.SaveStats
+	err = store(entry, &saved)
+	if err != nil {
+		entry.Attempts++
+		if entry.Attempts >= maxUploadAttempts {
+			log.Printf("%s - moving queue entry %s to dead-letter directory after %d attempts: %v\n", entry.Server, name, entry.Attempts, err)
+			return q.DeadLetter(name)
+		}
+		if data, marshalErr := json.Marshal(entry); marshalErr == nil {
+			if updateErr := q.Update(name, data); updateErr != nil {
+				log.Printf("failed to count upload attempt of %s: %v\n", name, updateErr)
+			}
+		}
+		return err
+	}
+	log.Printf("%s - Queued consumptions are saved: %d entities in %d batches\n", entry.Server, saved.Entities, saved.Batches)
+	return q.Remove(name)
+}
+
+// enqueueConsumptions durably stores consumptions, so that reader state can be saved before they are uploaded
+func enqueueConsumptions(serverName, saveID string, websites consumptions.WebsiteConsumptions, accounts consumptions.AccountConsumptions) error {
+	data, err := json.Marshal(queuedConsumptions{Server: serverName, SaveID: saveID, Websites: websites, Accounts: accounts})
+	if err != nil {
+		return fmt.Errorf("cannot serialize consumptions of %s: %v", serverName, err)
+	}
+	err = uploadQueue.Append(data)
+	if err != nil {
+		return fmt.Errorf("cannot queue consumptions of %s: %v", serverName, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alexanderromanov/nginx-logparser/consumptions"
+	"github.com/alexanderromanov/nginx-logparser/queue"
+)
+
+func TestUploadOldest(t *testing.T) {
+	errStorage := errors.New("storage is unavailable")
+
+	tests := []struct {
+		name         string
+		data         string
+		storeErr     error
+		wantErr      error
+		wantSaveID   string
+		wantLen      int
+		wantAttempts int
+		wantDead     bool
+	}{
+		{
+			name:       "saved",
+			data:       `{"server":"s1","saveId":"42"}`,
+			wantSaveID: "42",
+			wantLen:    0,
+		},
+		{
+			name:         "first failure is counted",
+			data:         `{"server":"s1","saveId":"42"}`,
+			storeErr:     errStorage,
+			wantErr:      errStorage,
+			wantSaveID:   "42",
+			wantLen:      1,
+			wantAttempts: 1,
+		},
+		{
+			name:         "failure is added to previous attempts",
+			data:         `{"server":"s1","saveId":"42","attempts":3}`,
+			storeErr:     errStorage,
+			wantErr:      errStorage,
+			wantSaveID:   "42",
+			wantLen:      1,
+			wantAttempts: 4,
+		},
+		{
+			name:       "last attempt moves entry to dead-letter directory",
+			data:       `{"server":"s1","saveId":"42","attempts":9}`,
+			storeErr:   errStorage,
+			wantSaveID: "42",
+			wantLen:    0,
+			wantDead:   true,
+		},
+		{
+			name:    "broken entry is dropped",
+			data:    `{"server":`,
+			wantLen: 0,
+		},
+		{
+			name:    "empty queue",
+			wantErr: errQueueEmpty,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "queue")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			q, err := queue.Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.data != "" {
+				if err := q.Append([]byte(test.data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var stored queuedConsumptions
+			store := func(entry queuedConsumptions, stats *consumptions.SaveStats) error {
+				stored = entry
+				return test.storeErr
+			}
+			if err := uploadOldest(q, store); err != test.wantErr {
+				t.Fatalf("uploadOldest() = %v, want %v", err, test.wantErr)
+			}
+			if stored.SaveID != test.wantSaveID {
+				t.Errorf("stored save id %q, want %q", stored.SaveID, test.wantSaveID)
+			}
+			if q.Len() != test.wantLen {
+				t.Errorf("queue length %d, want %d", q.Len(), test.wantLen)
+			}
+
+			if test.wantLen > 0 {
+				_, data, err := q.Oldest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var entry queuedConsumptions
+				if err := json.Unmarshal(data, &entry); err != nil {
+					t.Fatal(err)
+				}
+				if entry.Attempts != test.wantAttempts {
+					t.Errorf("attempts %d, want %d", entry.Attempts, test.wantAttempts)
+				}
+			}
+
+			dead, _ := ioutil.ReadDir(filepath.Join(dir, "dead-letter"))
+			if test.wantDead != (len(dead) == 1) {
+				t.Errorf("dead-letter entries %d, want dead %v", len(dead), test.wantDead)
+			}
+		})
+	}
+}
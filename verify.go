@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/alexanderromanov/nginx-logparser/consumptions"
+)
+
+const defaultVerifyTolerance = 0.001
+
+// verifySettings control comparison of consumptions recomputed from archived logs with stored ones
+type verifySettings struct {
+	// Tolerance is the relative difference of counters that is not reported as drift.
+	// defaultVerifyTolerance is used if it is zero
+	Tolerance float64
+
+	// ReportFile the drift report is written to as JSON. Drifts are only logged if it is empty
+	ReportFile string
+}
+
+// driftReport lists website-hours with counters that differ between logs and storage
+type driftReport struct {
+	Since    time.Time   `json:"since"`
+	Until    time.Time   `json:"until"`
+	Websites int         `json:"websites"`
+	Hours    int         `json:"hours"`
+	Drifts   []hourDrift `json:"drifts"`
+}
+
+type hourDrift struct {
+	WebsiteID int       `json:"websiteId"`
+	Hour      time.Time `json:"hour"`
+	Field     string    `json:"field"`
+	Computed  int64     `json:"computed"`
+	Stored    int64     `json:"stored"`
+}
+
+// runVerify recomputes consumptions of the period from archived logs with names starting with prefix and
+// compares them with consumptions stored in Azure tables. Nothing is written to storage, state or the provider.
+// Stored hours are the sum of all servers, so archives have to contain logs of every server of the period.
+// Logs are counted with the same dedup and clock skew settings as runs, logs of every server are expected
+// in their own folder which is the dedup source of their records. All websites stored for the period are
+// compared, so that hours without any logs are reported as well
+func runVerify(ctx context.Context, settings applicationSettings, domains *domainsCache, prefix string) error {
+	ctx, span := tracer.Start(ctx, "verify")
+	defer span.End()
+
+	since, until := settings.Usages.Since, settings.Usages.Until
+	if since.IsZero() || until.IsZero() {
+		return fmt.Errorf("verified period has to be specified with -since and -until")
+	}
+	container := settings.Import.Container
+	if container == "" {
+		return fmt.Errorf("container of archived logs is not configured")
+	}
+	if settings.AzureStorage.AccountName == "" {
+		return fmt.Errorf("azure storage is not configured")
+	}
+
+	client, err := settings.AzureStorage.Client()
+	if err != nil {
+		return err
+	}
+	blobs, err := client.GetBlobService().ListBlobs(ctx, container, prefix)
+	if err != nil {
+		return fmt.Errorf("cannot list blobs of %s: %v", container, err)
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Name < blobs[j].Name })
+
+	err = domains.wait()
+	if err != nil {
+		return err
+	}
+	var dedup *consumptions.Deduplicator
+	if settings.Dedup.Key != "" {
+		dedup = consumptions.NewDeduplicator(settings.Dedup)
+	}
+	// like in runs, every source has its own collection, so that copies of its requests in other sources are skipped
+	sources := map[string]*consumptions.UsagesCollection{}
+	for _, blob := range blobs {
+		// blob modified before the verified period can only contain older records
+		if blob.LastModified.Before(since) {
+			continue
+		}
+		source := path.Dir(blob.Name)
+		usages, ok := sources[source]
+		if !ok {
+			usages = domains.newUsagesCollection(settings.Usages)
+			defer domains.release(usages)
+			if dedup != nil {
+				usages.Deduplicate(dedup, source)
+			}
+			sources[source] = usages
+		}
+
+		log.Printf("reading %s (%d bytes)\n", blob.Name, blob.Size)
+		err = readBlob(ctx, settings, blob.Name, usages.AddRecord)
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %v", blob.Name, err)
+		}
+	}
+
+	// stored consumptions are transformed and billed before they are saved
+	computed := consumptions.WebsiteConsumptions{}
+	for _, usages := range sources {
+		records := usages.GetTrafficConsumption()
+		consumptions.ApplyTransforms(records, settings.Transforms)
+		consumptions.ApplyBilling(records, settings.Billing)
+		for websiteID, websiteRecords := range records {
+			computed[websiteID] = append(computed[websiteID], websiteRecords...)
+		}
+	}
+
+	storedWebsites, err := consumptions.StoredWebsites(ctx, settings.AzureStorage, since, until)
+	if err != nil {
+		return fmt.Errorf("cannot list stored websites: %v", err)
+	}
+	websites := map[int]bool{}
+	for websiteID := range computed {
+		websites[websiteID] = true
+	}
+	for _, websiteID := range storedWebsites {
+		websites[websiteID] = true
+	}
+
+	tolerance := settings.Verify.Tolerance
+	if tolerance <= 0 {
+		tolerance = defaultVerifyTolerance
+	}
+	report := driftReport{Since: since, Until: until, Websites: len(websites)}
+	for websiteID := range websites {
+		stored, err := consumptions.LoadHistory(ctx, settings.AzureStorage, websiteID, since, until)
+		if err != nil {
+			return fmt.Errorf("cannot load stored consumptions of website %d: %v", websiteID, err)
+		}
+		drifts, hours := compareHours(websiteID, sumHours(computed[websiteID]), sumHours(stored), tolerance)
+		report.Drifts = append(report.Drifts, drifts...)
+		report.Hours += hours
+	}
+	sort.Slice(report.Drifts, func(i, j int) bool {
+		a, b := report.Drifts[i], report.Drifts[j]
+		if a.WebsiteID != b.WebsiteID {
+			return a.WebsiteID < b.WebsiteID
+		}
+		return a.Hour.Before(b.Hour)
+	})
+
+	for _, drift := range report.Drifts {
+		log.Printf("website %d, %s: %s is %d in logs and %d in storage\n", drift.WebsiteID,
+			drift.Hour.UTC().Format(time.RFC3339), drift.Field, drift.Computed, drift.Stored)
+	}
+	log.Printf("%d hours of %d websites are verified, %d counters drift\n", report.Hours, report.Websites, len(report.Drifts))
+
+	if settings.Verify.ReportFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot serialize drift report: %v", err)
+	}
+	err = ioutil.WriteFile(settings.Verify.ReportFile, data, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write drift report to %s: %v", settings.Verify.ReportFile, err)
+	}
+	return nil
+}
+
+// sumHours sums records of different domains and ports of the same hour
+func sumHours(records []*consumptions.ConsumptionRecord) map[int64]*consumptions.ConsumptionRecord {
+	result := map[int64]*consumptions.ConsumptionRecord{}
+	for _, record := range records {
+		hour, ok := result[record.Time.Unix()]
+		if !ok {
+			hour = &consumptions.ConsumptionRecord{Time: record.Time}
+			result[record.Time.Unix()] = hour
+		}
+		hour.Files += record.Files
+		hour.FilesCount += record.FilesCount
+		hour.Dynamic += record.Dynamic
+		hour.DynamicCount += record.DynamicCount
+		hour.Other += record.Other
+		hour.OtherCount += record.OtherCount
+		hour.Probe += record.Probe
+		hour.ProbeCount += record.ProbeCount
+		hour.UploadBytes += record.UploadBytes
+		hour.BillableBytes += record.BillableBytes
+		hour.ExpensiveCount += record.ExpensiveCount
+		hour.ClientClosedCount += record.ClientClosedCount
+	}
+	return result
+}
+
+// compareHours returns counters of hours that differ by more than tolerance and the number of compared hours
+func compareHours(websiteID int, computed, stored map[int64]*consumptions.ConsumptionRecord, tolerance float64) ([]hourDrift, int) {
+	hours := map[int64]bool{}
+	for hour := range computed {
+		hours[hour] = true
+	}
+	for hour := range stored {
+		hours[hour] = true
+	}
+
+	var result []hourDrift
+	for hour := range hours {
+		c, s := computed[hour], stored[hour]
+		if c == nil {
+			c = &consumptions.ConsumptionRecord{}
+		}
+		if s == nil {
+			s = &consumptions.ConsumptionRecord{}
+		}
+		counters := []struct {
+			field            string
+			computed, stored int64
+		}{
+			{"Files", c.Files, s.Files},
+			{"FilesCount", int64(c.FilesCount), int64(s.FilesCount)},
+			{"Dynamic", c.Dynamic, s.Dynamic},
+			{"DynamicCount", int64(c.DynamicCount), int64(s.DynamicCount)},
+			{"Other", c.Other, s.Other},
+			{"OtherCount", int64(c.OtherCount), int64(s.OtherCount)},
+			{"Probe", c.Probe, s.Probe},
+			{"ProbeCount", int64(c.ProbeCount), int64(s.ProbeCount)},
+			{"UploadBytes", c.UploadBytes, s.UploadBytes},
+			{"BillableBytes", c.BillableBytes, s.BillableBytes},
+			{"ExpensiveCount", int64(c.ExpensiveCount), int64(s.ExpensiveCount)},
+			{"ClientClosedCount", int64(c.ClientClosedCount), int64(s.ClientClosedCount)},
+		}
+		for _, counter := range counters {
+			if drifts(counter.computed, counter.stored, tolerance) {
+				result = append(result, hourDrift{WebsiteID: websiteID, Hour: time.Unix(hour, 0).UTC(),
+					Field: counter.field, Computed: counter.computed, Stored: counter.stored})
+			}
+		}
+	}
+	return result, len(hours)
+}
+
+func drifts(computed, stored int64, tolerance float64) bool {
+	if computed == stored {
+		return false
+	}
+	if computed == 0 {
+		return true
+	}
+	return math.Abs(float64(stored-computed))/float64(computed) > tolerance
+}
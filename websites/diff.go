@@ -0,0 +1,48 @@
+package websites
+
+import "sort"
+
+// DomainChange describes how website of the domain changed between two domains lists
+type DomainChange struct {
+	Domain string
+
+	// OldWebsiteID is zero for added domains, NewWebsiteID is zero for removed ones
+	OldWebsiteID int
+	NewWebsiteID int
+}
+
+// DomainsDiff lists domains that were added, removed or moved to another website. Changes are sorted by domain
+type DomainsDiff struct {
+	Added   []DomainChange
+	Removed []DomainChange
+	Moved   []DomainChange
+}
+
+// Diff compares domains list with the previous one, e.g. on refresh
+func Diff(previous, current Domains) DomainsDiff {
+	var result DomainsDiff
+	for domain, website := range current {
+		old, ok := previous[domain]
+		switch {
+		case !ok:
+			result.Added = append(result.Added, DomainChange{Domain: domain, NewWebsiteID: website.ID})
+		case old.ID != website.ID:
+			result.Moved = append(result.Moved, DomainChange{Domain: domain, OldWebsiteID: old.ID, NewWebsiteID: website.ID})
+		}
+	}
+	for domain, website := range previous {
+		if _, ok := current[domain]; !ok {
+			result.Removed = append(result.Removed, DomainChange{Domain: domain, OldWebsiteID: website.ID})
+		}
+	}
+
+	for _, changes := range [][]DomainChange{result.Added, result.Removed, result.Moved} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Domain < changes[j].Domain })
+	}
+	return result
+}
+
+// Empty returns true if domains lists are the same
+func (diff DomainsDiff) Empty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Moved) == 0
+}
@@ -0,0 +1,97 @@
+package websites
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// suppressionRetention is the time domain stays in suppression list after it was reported the last time
+const suppressionRetention = 90 * 24 * time.Hour
+
+// SuppressUnknownDomains filters out unknown domains that were already reported in previous runs unless they were
+// requested at least settings.SuppressedDomainsThreshold times. Nothing is filtered if settings.SuppressionFile
+// is not configured
+func SuppressUnknownDomains(settings DomainsInfoProviderSettings, requests map[string]int) (map[string]int, error) {
+	if settings.SuppressionFile == "" {
+		return requests, nil
+	}
+
+	seen, err := loadSuppressionList(settings.SuppressionFile)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]int{}
+	for domain, requested := range requests {
+		_, ok := seen[domain]
+		if !ok || settings.SuppressedDomainsThreshold > 0 && requested >= settings.SuppressedDomainsThreshold {
+			result[domain] = requested
+		}
+	}
+	return result, nil
+}
+
+// SuppressReportedDomains persists domains reported to the provider with first-seen and last-seen timestamps
+// in settings.SuppressionFile. It is called only after the report succeeds, so that domains of failed report
+// are surfaced again in the next run
+func SuppressReportedDomains(settings DomainsInfoProviderSettings, reported map[string]int, now time.Time) error {
+	if settings.SuppressionFile == "" || len(reported) == 0 {
+		return nil
+	}
+
+	seen, err := loadSuppressionList(settings.SuppressionFile)
+	if err != nil {
+		return err
+	}
+
+	for domain := range reported {
+		entry, ok := seen[domain]
+		if !ok {
+			entry = suppressedDomainJSON{FirstSeen: now.Unix()}
+		}
+		entry.LastSeen = now.Unix()
+		seen[domain] = entry
+	}
+
+	expired := now.Add(-suppressionRetention).Unix()
+	for domain, entry := range seen {
+		if entry.LastSeen < expired {
+			delete(seen, domain)
+		}
+	}
+
+	data, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(settings.SuppressionFile, data, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot save suppression list to %s: %v", settings.SuppressionFile, err)
+	}
+	return nil
+}
+
+func loadSuppressionList(fileName string) (map[string]suppressedDomainJSON, error) {
+	result := map[string]suppressedDomainJSON{}
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read suppression list from %s: %v", fileName, err)
+	}
+
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse suppression list from %s: %v", fileName, err)
+	}
+	return result, nil
+}
+
+type suppressedDomainJSON struct {
+	FirstSeen int64 `json:"first"`
+	LastSeen  int64 `json:"last"`
+}
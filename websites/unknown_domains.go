@@ -0,0 +1,67 @@
+package websites
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ReportUnknownDomains posts domains that were requested at least settings.UnknownDomainsThreshold times
+// to settings.UnknownDomainsURL, so that provider can create placeholder records or alert admins.
+// It returns the reported domains. Nothing is sent if the URL is not configured
+func ReportUnknownDomains(settings DomainsInfoProviderSettings, requests map[string]int) (map[string]int, error) {
+	if settings.UnknownDomainsURL == "" {
+		return nil, nil
+	}
+
+	threshold := settings.UnknownDomainsThreshold
+	if threshold == 0 {
+		threshold = DefaultUnknownDomainsThreshold
+	}
+
+	var domains []unknownDomainJSON
+	reported := map[string]int{}
+	for domain, requested := range requests {
+		if requested >= threshold {
+			domains = append(domains, unknownDomainJSON{Domain: domain, Requested: requested})
+			reported[domain] = requested
+		}
+	}
+	if len(domains) == 0 {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(domains)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Add("username", settings.UserName)
+	form.Add("password", settings.Password)
+	form.Add("domains", string(data))
+	req, err := http.NewRequest("POST", settings.UnknownDomainsURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("HTTP Response Error %d", resp.StatusCode)
+	}
+	return reported, nil
+}
+
+type unknownDomainJSON struct {
+	Domain    string `json:"d"`
+	Requested int    `json:"r"`
+}
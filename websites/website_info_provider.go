@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 // DomainsInfoProviderSettings contains settings required to connect to DomainInfo provider
@@ -15,15 +17,85 @@ type DomainsInfoProviderSettings struct {
 	UserName            string
 	Password            string
 	ServiceDomainSuffix string
+
+	// ServiceDomains lists service domains of all white-label platforms. ServiceDomainSuffix
+	// is treated as one more service domain without www. alias and subdomains mapping
+	ServiceDomains []ServiceDomain
+
+	// Anonymous bypasses the provider. No domains are requested and every observed
+	// domain is expected to be assigned AnonymousWebsite
+	Anonymous bool
+
+	// UnknownDomainsURL is the provider endpoint unknown domains are reported to. Not reported if it is empty
+	UnknownDomainsURL string
+
+	// UnknownDomainsThreshold is the minimal number of requests to unknown domain for it to be reported.
+	// DefaultUnknownDomainsThreshold is used if it is 0
+	UnknownDomainsThreshold int
+
+	// DeletedRetentionDays is the number of days deleted websites keep receiving their traffic
+	DeletedRetentionDays int
+
+	// SuppressionFile persists unknown domains reported in previous runs, so that they are not surfaced again
+	SuppressionFile string
+
+	// SuppressedDomainsThreshold is the minimal number of requests for already reported unknown domain to be surfaced again.
+	// Reported domains are never surfaced again if it is zero
+	SuppressedDomainsThreshold int
 }
 
+// DefaultUnknownDomainsThreshold keeps domains with typos that were requested a few times from being reported
+const DefaultUnknownDomainsThreshold = 100
+
+// ServiceDomain describes suffix of domains provided by the platform and how such domains are mapped to websites
+type ServiceDomain struct {
+	Suffix string
+
+	// AddWWW specifies whether www. alias is added for domains with this suffix
+	AddWWW bool
+
+	// MapSubdomains specifies whether all subdomains of domains with this suffix are attributed to the same website
+	MapSubdomains bool
+}
+
+// Domains maps domain names to websites
+type Domains map[string]*WebsiteInfo
+
+// wildcardPrefix marks keys of Domains whose subdomains belong to the same website
+const wildcardPrefix = "*."
+
 // WebsiteInfo provides basic information about website
 type WebsiteInfo struct {
 	ID int
+
+	// AccountID is the ID of account (reseller) the website belongs to. 0 if provider didn't supply it
+	AccountID int
+
+	// Shard is the storage shard hint supplied by provider
+	Shard string
+
+	// DeletedAt is the time website was deleted at. Zero for active websites
+	DeletedAt time.Time
+
+	// Plan is the pricing plan of the website. Empty if provider didn't supply it
+	Plan string
+
+	// CanonicalDomain is the domain the looked up domain is an alias of, e.g. new domain of the website
+	// during domain migration. Empty if the domain is canonical itself
+	CanonicalDomain string
+}
+
+// IsDeletedAt returns true if website was already deleted at the given time
+func (website *WebsiteInfo) IsDeletedAt(t time.Time) bool {
+	return !website.DeletedAt.IsZero() && !t.Before(website.DeletedAt)
 }
 
 // GetDomains returns map of type DomainName -> WebsiteInfo
-func GetDomains(settings DomainsInfoProviderSettings) (map[string]*WebsiteInfo, error) {
+func GetDomains(settings DomainsInfoProviderSettings) (Domains, error) {
+	if settings.Anonymous {
+		return Domains{}, nil
+	}
+
 	if err := settings.validate(); err != nil {
 		return nil, err
 	}
@@ -55,32 +127,131 @@ func GetDomains(settings DomainsInfoProviderSettings) (map[string]*WebsiteInfo,
 		return nil, err
 	}
 
-	result := map[string]*WebsiteInfo{}
+	serviceDomains := settings.allServiceDomains()
+	retainDeletedSince := time.Now().AddDate(0, 0, -settings.DeletedRetentionDays)
+	result := Domains{}
+	aliases := map[string]string{}
 	for _, line := range domains {
 		key, value := processWebsiteInfoJSON(&line)
+		if !value.DeletedAt.IsZero() && value.DeletedAt.Before(retainDeletedSince) {
+			continue
+		}
 
-		result[key] = value
+		result.add(key, value, serviceDomains)
+		if canonical := strings.ToLower(line.Canonical); canonical != "" && canonical != key {
+			aliases[key] = canonical
+		}
+	}
 
-		if !strings.HasSuffix(key, settings.ServiceDomainSuffix) {
-			result["www."+key] = value
+	// aliases are attributed to the website of their canonical domain, so that traffic of both
+	// domains is counted once during migration. Alias keeps its own website if canonical domain is unknown
+	for key, canonical := range aliases {
+		website, ok := result[canonical]
+		if !ok {
+			continue
 		}
+		alias := *website
+		alias.CanonicalDomain = canonical
+		result.add(key, &alias, serviceDomains)
 	}
 
 	return result, nil
 }
 
+// add maps domain with its www. alias and subdomains to the website according to service domain settings
+func (domains Domains) add(key string, value *WebsiteInfo, serviceDomains []ServiceDomain) {
+	domains[key] = value
+
+	serviceDomain, found := findServiceDomain(serviceDomains, key)
+	if !found || serviceDomain.AddWWW {
+		domains["www."+key] = value
+	}
+	if found && serviceDomain.MapSubdomains {
+		domains[wildcardPrefix+key] = value
+	}
+}
+
+// Canonical returns canonical domain of the domain. The domain itself is returned if it is not an alias
+func (domains Domains) Canonical(domain string) string {
+	if website, ok := domains.Lookup(domain); ok && website.CanonicalDomain != "" {
+		return website.CanonicalDomain
+	}
+	return domain
+}
+
+// Lookup returns website the domain belongs to. Subdomains of domains that
+// have subdomains mapping enabled are attributed to the parent website
+func (domains Domains) Lookup(domain string) (*WebsiteInfo, bool) {
+	if website, ok := domains[domain]; ok {
+		return website, true
+	}
+
+	for i := strings.Index(domain, "."); i >= 0; i = strings.Index(domain, ".") {
+		domain = domain[i+1:]
+		if website, ok := domains[wildcardPrefix+domain]; ok {
+			return website, true
+		}
+	}
+
+	return nil, false
+}
+
+// AnonymousWebsite returns synthetic website for the domain. ID is the stable hash of the domain name,
+// so the same domain gets the same ID across runs
+func AnonymousWebsite(domain string) *WebsiteInfo {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(domain)))
+
+	id := int(h.Sum32() & 0x7fffffff)
+	if id == 0 {
+		id = 1
+	}
+	return &WebsiteInfo{ID: id}
+}
+
+func (settings *DomainsInfoProviderSettings) allServiceDomains() []ServiceDomain {
+	result := make([]ServiceDomain, 0, len(settings.ServiceDomains)+1)
+	if settings.ServiceDomainSuffix != "" {
+		result = append(result, ServiceDomain{Suffix: settings.ServiceDomainSuffix})
+	}
+	return append(result, settings.ServiceDomains...)
+}
+
+// findServiceDomain returns service domain with the longest suffix matching the domain
+func findServiceDomain(serviceDomains []ServiceDomain, domain string) (ServiceDomain, bool) {
+	var result ServiceDomain
+	found := false
+	for _, serviceDomain := range serviceDomains {
+		if strings.HasSuffix(domain, serviceDomain.Suffix) && len(serviceDomain.Suffix) > len(result.Suffix) {
+			result = serviceDomain
+			found = true
+		}
+	}
+	return result, found
+}
+
 type domainsList struct {
 	Domains []websiteInfoJSON `json:"domains"`
 }
 
 type websiteInfoJSON struct {
-	Domain string `json:"d"`
-	ID     int    `json:"w"`
+	Domain    string `json:"d"`
+	ID        int    `json:"w"`
+	AccountID int    `json:"a"`
+	Shard     string `json:"s"`
+	DeletedAt int64  `json:"del"`
+	Plan      string `json:"p"`
+
+	// Canonical is the domain Domain is an alias of
+	Canonical string `json:"c"`
 }
 
 func processWebsiteInfoJSON(websiteInfo *websiteInfoJSON) (string, *WebsiteInfo) {
 	key := strings.ToLower(websiteInfo.Domain)
-	value := WebsiteInfo{ID: websiteInfo.ID}
+	value := WebsiteInfo{ID: websiteInfo.ID, AccountID: websiteInfo.AccountID, Shard: websiteInfo.Shard, Plan: websiteInfo.Plan}
+	if websiteInfo.DeletedAt != 0 {
+		value.DeletedAt = time.Unix(websiteInfo.DeletedAt, 0).UTC()
+	}
 
 	return key, &value
 }
@@ -98,9 +269,15 @@ func (settings *DomainsInfoProviderSettings) validate() error {
 		return errors.New("Password was not provided")
 	}
 
-	if settings.ServiceDomainSuffix == "" {
+	if settings.ServiceDomainSuffix == "" && len(settings.ServiceDomains) == 0 {
 		return errors.New("Service Domain Suffix was not provided")
 	}
 
+	for _, serviceDomain := range settings.ServiceDomains {
+		if serviceDomain.Suffix == "" {
+			return errors.New("Service Domain Suffix cannot be empty")
+		}
+	}
+
 	return nil
 }